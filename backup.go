@@ -0,0 +1,292 @@
+package kadiyadb
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/epoch"
+)
+
+const (
+	// manifest is the last file in a backup and it has the CRC32 checksum
+	// of each file in the backup. Each line has a checksum and a file path.
+	manifest = "MANIFEST"
+)
+
+var (
+	// ErrChecksum is returned when a restored file does not match the checksum
+	ErrChecksum = errors.New("backup checksum mismatch")
+
+	// ErrManifest is returned when the backup manifest is missing or invalid
+	ErrManifest = errors.New("backup manifest is missing or invalid")
+)
+
+// Backup writes all database files to the writer as a tar archive. Epochs in
+// storage tiers are also included. Pending writes are synced before copying
+// files and the database can be used while the backup is running. Points
+// written while the backup is running may or may not be included in it.
+// The archive ends with a manifest with checksums used to verify restores.
+func (d *DB) Backup(w io.Writer) (err error) {
+	return d.BackupSince(w, 0)
+}
+
+// BackupSince is the same as Backup but only epochs updated at or after the
+// given time (unix nanoseconds) are included in the archive. Other database
+// files are always included. The manifest has the time the backup started
+// which can be used as `since` for the next incremental backup. To restore,
+// restore the full backup and then each incremental backup in order.
+func (d *DB) BackupSince(w io.Writer, since int64) (err error) {
+	started := time.Now().UnixNano()
+
+	if err := d.Sync(); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	sums := map[string]uint32{}
+
+	if err := backupDir(tw, d.dir, "", since, sums); err != nil {
+		return err
+	}
+
+	for _, tier := range d.params.Tiers {
+		files, err := ioutil.ReadDir(tier)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			if !isEpochDir(name) || !file.IsDir() {
+				continue
+			}
+
+			if err := backupDir(tw, path.Join(tier, name), name, since, sums); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeManifest(tw, started, sums); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// RestoreBackup extracts a backup created with the Backup method into dir.
+// Checksums of all restored files are verified using the backup manifest.
+// The restored database can be opened with the Open function or LoadAll.
+func RestoreBackup(r io.Reader, dir string) (err error) {
+	tr := tar.NewReader(r)
+	sums := map[string]uint32{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ErrManifest
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Name == manifest {
+			return verifyManifest(tr, sums)
+		}
+
+		name := path.Clean(hdr.Name)
+		if strings.HasPrefix(name, "..") || path.IsAbs(name) {
+			return ErrManifest
+		}
+
+		file := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+
+		sum, err := restoreFile(tr, file)
+		if err != nil {
+			return err
+		}
+
+		sums[name] = sum
+	}
+}
+
+// isEpochDir checks whether the directory name is an epoch start time
+func isEpochDir(name string) bool {
+	_, err := strconv.ParseInt(name, 10, 64)
+	return err == nil
+}
+
+// backupDir adds all files inside dir to the archive with given name prefix.
+// Temporary directories created while compacting epochs and local copies
+// of offloaded epochs are not included. Epoch directories are only included
+// if they are updated after `since`.
+func backupDir(tw *tar.Writer, dir, prefix string, since int64, sums map[string]uint32) (err error) {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if epoch.IsTempDir(info.Name()) || info.Name() == colddir {
+				return filepath.SkipDir
+			}
+
+			if since > 0 && isEpochDir(info.Name()) {
+				ts, err := epoch.Updated(file)
+				if err != nil {
+					return err
+				}
+
+				if ts < since {
+					return filepath.SkipDir
+				}
+			}
+
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		sum, err := backupFile(tw, file, name, info)
+		if err != nil {
+			return err
+		}
+
+		sums[name] = sum
+		return nil
+	})
+}
+
+// backupFile adds a single file to the archive and returns its checksum
+func backupFile(tw *tar.Writer, file, name string, info os.FileInfo) (sum uint32, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return 0, err
+	}
+
+	hdr.Name = name
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+
+	h := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), f, info.Size()); err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
+
+// restoreFile writes the current archive file to disk and returns its checksum
+func restoreFile(r io.Reader, file string) (sum uint32, err error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	// restored files should not evict frequently used data from the page
+	// cache. Page cache hints are optional therefore errors are ignored.
+	epoch.DropFileCache(f)
+
+	return h.Sum32(), f.Close()
+}
+
+// writeManifest adds the manifest file with checksums to the archive.
+// The first line has the time the backup started as a comment.
+func writeManifest(tw *tar.Writer, started int64, sums map[string]uint32) (err error) {
+	data := []byte(fmt.Sprintf("# %d\n", started))
+	for name, sum := range sums {
+		line := fmt.Sprintf("%08x %s\n", sum, name)
+		data = append(data, line...)
+	}
+
+	hdr := &tar.Header{
+		Name: manifest,
+		Mode: 0644,
+		Size: int64(len(data)),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+// verifyManifest reads the manifest and compares checksums of restored files
+func verifyManifest(r io.Reader, sums map[string]uint32) (err error) {
+	expected := map[string]uint32{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return ErrManifest
+		}
+
+		sum, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return ErrManifest
+		}
+
+		expected[parts[1]] = uint32(sum)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(expected) != len(sums) {
+		return ErrChecksum
+	}
+
+	for name, sum := range sums {
+		if s, ok := expected[name]; !ok || s != sum {
+			return ErrChecksum
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package kadiyadb
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestBackupSince(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().UnixNano()
+
+	if err := db.Track(uint64(p.Duration), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.BackupSince(buf, since); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(buf)
+	epochs := map[string]bool{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := path.Dir(hdr.Name); d != "." {
+			epochs[d] = true
+		}
+	}
+
+	expected := map[string]bool{"3600000000000": true}
+	if !reflect.DeepEqual(epochs, expected) {
+		t.Fatal("wrong epochs", epochs)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	srcdir := path.Join(dir, "src")
+	dstdir := path.Join(dir, "dst")
+
+	if err := os.MkdirAll(srcdir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(srcdir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if err := RestoreBackup(bytes.NewReader(data), dstdir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Open(dstdir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	restored.Fetch(0, uint64(p.Resolution), fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		points := []protocol.Point{{5, 1}}
+		if !reflect.DeepEqual(res[0].Series[0].Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	wg.Wait()
+
+	// backups without a manifest should fail
+	if err := RestoreBackup(bytes.NewReader(nil), dstdir); err == nil {
+		t.Fatal("should return error")
+	}
+
+	// modify the content of a file in the archive
+	corrupt := &bytes.Buffer{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(corrupt)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Name != manifest && len(body) > 0 {
+			body[0]++
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreBackup(corrupt, path.Join(dir, "bad")); err != ErrChecksum {
+		t.Fatal("should return error", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,7 +2,9 @@ package block
 
 import (
 	"io"
+	"os"
 	"reflect"
+	"strconv"
 	"unsafe"
 
 	"github.com/kadirahq/go-tools/fs"
@@ -14,9 +16,10 @@ const (
 	// block files will be named "block_0, block_1, ..."
 	prefix = "block_"
 
-	// Size of the segment file
+	// Default size of the segment file
 	// !IMPORTANT if this value changes, the database will not be able to use
 	// older data. To avoid accidental changes, this value is hardcoded here.
+	// Blocks must always be loaded with the segment size used to create them.
 	segsz = 1024 * 1024 * 200
 
 	// A struct size depends on it's fields, field order and alignment (hardware).
@@ -66,6 +69,33 @@ type Block interface {
 	io.Closer
 }
 
+// segmentSize returns the size of block segment files for given segment size
+// and record size in bytes. Segment files have a whole number of records
+// (at least one record). The default size is used if `ssz` is zero.
+func segmentSize(ssz, rbs int64) (sfs int64) {
+	if ssz <= 0 {
+		ssz = segsz
+	}
+
+	sfs = ssz - (ssz % rbs)
+	if sfs < rbs {
+		sfs = rbs
+	}
+
+	return sfs
+}
+
+// segmentFiles returns the number of block segment files with given prefix
+func segmentFiles(sfp string) (n int64) {
+	for {
+		if _, err := os.Stat(sfp + strconv.FormatInt(n, 10)); err != nil {
+			return n
+		}
+
+		n++
+	}
+}
+
 // decode maps given byte slice to a record made of points
 // both the record and given data will share same memory
 func decode(b []byte) []protocol.Point {
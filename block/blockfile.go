@@ -0,0 +1,272 @@
+package block
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/go-tools/segments"
+	"github.com/kadirahq/go-tools/segments/segfile"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// FileBlock is a read-write block which uses file reads and writes instead of
+// memory maps. Block files are the same as RWBlock files therefore a block
+// can be loaded with either type. This uses less memory in environments where
+// memory mapped pages are accounted as used memory but writes are slower.
+type FileBlock struct {
+	segments  segments.Store
+	recLength int64
+	recBytes  int64
+	segRecs   int64
+	numRecs   int64
+	ptype     PointType
+	mutex     *sync.RWMutex
+	buffers   *sync.Pool
+	grow      func(start time.Time)
+}
+
+// NewFile function reads or creates a block on given directory. Points are
+// read from segment files when required. New segment files are created with
+// given size (default size if zero).
+func NewFile(dir string, rsz, segsize int64) (b *FileBlock, err error) {
+	rbs := rsz * pointsz
+	sfp := path.Join(dir, prefix)
+	sfs := segmentSize(segsize, rbs)
+	ssz := sfs / rbs
+
+	files := segmentFiles(sfp)
+
+	m, err := segfile.New(sfp, sfs)
+	if err != nil {
+		return nil, err
+	}
+
+	b = &FileBlock{
+		segments:  m,
+		recLength: rsz,
+		recBytes:  rbs,
+		segRecs:   ssz,
+		numRecs:   files * ssz,
+		mutex:     &sync.RWMutex{},
+		buffers: &sync.Pool{
+			New: func() interface{} { return make([]byte, rbs) },
+		},
+	}
+
+	if err := loadSparse(b, dir, rsz); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// SetPointType sets how tracked values are combined with existing values.
+// Blocks use the Counter point type by default. It must be called before
+// the block is used for tracking values.
+func (b *FileBlock) SetPointType(t PointType) {
+	b.ptype = t
+}
+
+// SetGrowHook sets a function which is called with the start time after
+// allocating new segment files. It must be called before the block is used
+// for tracking values.
+func (b *FileBlock) SetGrowHook(fn func(start time.Time)) {
+	b.grow = fn
+}
+
+// Track adds a new set of point values to the Block
+// This increments the Total and Count by given values
+// unless the block has a different point type.
+func (b *FileBlock) Track(rid, pid int64, total, count float64) (err error) {
+	return b.update(rid, pid, func(point *protocol.Point) {
+		*point = b.ptype.Merge(*point, protocol.Point{Total: total, Count: count})
+	})
+}
+
+// setPoint replaces the point with given values regardless of the point type
+func (b *FileBlock) setPoint(rid, pid int64, p protocol.Point) (err error) {
+	return b.update(rid, pid, func(point *protocol.Point) {
+		*point = p
+	})
+}
+
+// update reads the point, calls fn with it and writes it back to segment
+// files. Segment files are allocated if the record does not exist yet.
+func (b *FileBlock) update(rid, pid int64, fn func(point *protocol.Point)) (err error) {
+	if pid < 0 || pid >= b.recLength {
+		panic("point index is out of record bounds")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if rid >= b.numRecs {
+		start := time.Now()
+		off := rid * b.recBytes
+		if err := b.segments.Ensure(off); err != nil {
+			return err
+		}
+
+		b.numRecs = (rid/b.segRecs + 1) * b.segRecs
+
+		if b.grow != nil {
+			b.grow(start)
+		}
+	}
+
+	buff := b.buffers.Get().([]byte)
+	defer b.buffers.Put(buff)
+
+	p := buff[:pointsz]
+	off := rid*b.recBytes + pid*pointsz
+	if err := b.readAt(p, off); err != nil {
+		return err
+	}
+
+	fn(&decode(p)[0])
+
+	return b.writeAt(p, off)
+}
+
+// Fetch returns required range of points from a single record
+// Results are copies of points therefore they are always valid.
+func (b *FileBlock) Fetch(rid, from, to int64) (res []protocol.Point, err error) {
+	if from >= b.recLength || from < 0 ||
+		to > b.recLength || to < 0 || to < from {
+		panic("point index is out of record bounds")
+	}
+
+	num := (to - from)
+	res = make([]protocol.Point, num)
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if rid >= b.numRecs {
+		return res, nil
+	}
+
+	buff := b.buffers.Get().([]byte)
+	defer b.buffers.Put(buff)
+
+	p := buff[:num*pointsz]
+	if err := b.readAt(p, rid*b.recBytes+from*pointsz); err != nil {
+		return nil, err
+	}
+
+	copy(res, decode(p))
+
+	return res, nil
+}
+
+// Clear sets all points to zero in records with IDs larger than or equal to
+// given record ID. Block files are not shrunk. `cleared` will be true if any
+// of those records had measurements before clearing them.
+func (b *FileBlock) Clear(from int64) (cleared bool, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if from < 0 {
+		from = 0
+	}
+
+	buff := b.buffers.Get().([]byte)
+	defer b.buffers.Put(buff)
+
+	for rid := from; rid < b.numRecs; rid++ {
+		off := rid * b.recBytes
+		if err := b.readAt(buff, off); err != nil {
+			return false, err
+		}
+
+		if isEmpty(decode(buff)) {
+			continue
+		}
+
+		for i := range buff {
+			buff[i] = 0
+		}
+
+		if err := b.writeAt(buff, off); err != nil {
+			return false, err
+		}
+
+		cleared = true
+	}
+
+	return cleared, nil
+}
+
+// ClearPoints sets points in given position range to zero in all records.
+// Records are not added if they do not exist in the block yet.
+func (b *FileBlock) ClearPoints(from, to int64) (err error) {
+	if from >= b.recLength || from < 0 ||
+		to > b.recLength || to < 0 || to < from {
+		panic("point index is out of record bounds")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	zero := make([]byte, (to-from)*pointsz)
+
+	for rid := int64(0); rid < b.numRecs; rid++ {
+		if err := b.writeAt(zero, rid*b.recBytes+from*pointsz); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sync synchronises data written to segment files to disk storage
+func (b *FileBlock) Sync() (err error) {
+	return b.segments.Sync()
+}
+
+// Close releases resources
+func (b *FileBlock) Close() (err error) {
+	return b.segments.Close()
+}
+
+// readAt reads len(p) bytes from segment files starting from offset
+func (b *FileBlock) readAt(p []byte, off int64) (err error) {
+	for len(p) > 0 {
+		n, err := b.segments.ReadAt(p, off)
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+
+	return nil
+}
+
+// writeAt writes all bytes in p to segment files starting from offset
+func (b *FileBlock) writeAt(p []byte, off int64) (err error) {
+	for len(p) > 0 {
+		n, err := b.segments.WriteAt(p, off)
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+
+	return nil
+}
+
+// isEmpty checks whether the record has no measurements
+func isEmpty(record []protocol.Point) bool {
+	for _, p := range record {
+		if p.Total != 0 || p.Count != 0 {
+			return false
+		}
+	}
+
+	return true
+}
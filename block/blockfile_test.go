@@ -0,0 +1,158 @@
+package block
+
+import (
+	"os"
+	"testing"
+)
+
+var (
+	tmpdirfile = "/tmp/test-fileblock/"
+)
+
+func setupfile(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirfile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(tmpdirfile, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirfile); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrackerFile(t *testing.T) {
+	defer setupfile(t)()
+
+	// small segments to test records in multiple segments
+	b, err := NewFile(tmpdirfile, 5, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := b.Track(7, 2, 3, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if res, err := b.Fetch(7, 1, 4); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 3 || res[1].Total != 6 || res[1].Count != 2 {
+		t.Fatal("wrong result", res)
+	}
+
+	if res, err := b.Fetch(100, 0, 5); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 5 || !isEmpty(res) {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// file blocks and memory mapped blocks use the same files
+	r, err := NewRW(tmpdirfile, 5, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := r.Fetch(7, 0, 5); err != nil {
+		t.Fatal(err)
+	} else if res[2].Total != 6 || res[2].Count != 2 {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearFile(t *testing.T) {
+	defer setupfile(t)()
+
+	b, err := NewFile(tmpdirfile, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetPointType(Max)
+
+	for rid := int64(0); rid < 3; rid++ {
+		if err := b.Track(rid, 0, float64(rid), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cleared, err := b.Clear(1); err != nil {
+		t.Fatal(err)
+	} else if !cleared {
+		t.Fatal("records should be cleared")
+	}
+
+	if cleared, err := b.Clear(1); err != nil {
+		t.Fatal(err)
+	} else if cleared {
+		t.Fatal("records should be already cleared")
+	}
+
+	if res, err := b.Fetch(0, 0, 1); err != nil {
+		t.Fatal(err)
+	} else if res[0].Count != 1 {
+		t.Fatal("wrong result", res)
+	}
+
+	if res, err := b.Fetch(2, 0, 1); err != nil {
+		t.Fatal(err)
+	} else if res[0].Count != 0 {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearPointsFile(t *testing.T) {
+	defer setupfile(t)()
+
+	b, err := NewFile(tmpdirfile, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pid := int64(0); pid < 5; pid++ {
+		if err := b.Track(1, pid, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.ClearPoints(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := b.Fetch(1, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pid, count := range []float64{1, 0, 0, 1, 1} {
+		if res[pid].Count != count {
+			t.Fatal("wrong result", res)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImplFile(t *testing.T) {
+	// throws error if it doesn't
+	var _ Block = &FileBlock{}
+}
@@ -12,6 +12,7 @@ import (
 // This block type can only perform read operations and makes garbage.
 type ROBlock struct {
 	segments  segments.Store
+	sparse    map[int64][]sparsePoint
 	recLength int64
 	recBytes  int64
 	emptyRec  []protocol.Point
@@ -19,17 +20,25 @@ type ROBlock struct {
 
 // NewRO function reads a block on given directory.
 // It will read data from segment files when required.
-func NewRO(dir string, rsz int64) (b *ROBlock, err error) {
+// Segment size must be the size used when creating the block.
+func NewRO(dir string, rsz, segsize int64) (b *ROBlock, err error) {
 	rbs := rsz * pointsz
 	sfp := path.Join(dir, prefix)
-	sfs := segsz - (segsz % rbs)
+	sfs := segmentSize(segsize, rbs)
 	m, err := segfile.New(sfp, sfs)
 	if err != nil {
 		return nil, err
 	}
 
+	sparse, err := readSparse(dir, rsz)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
 	b = &ROBlock{
 		segments:  m,
+		sparse:    sparse,
 		recLength: rsz,
 		recBytes:  rbs,
 		emptyRec:  make([]protocol.Point, rsz),
@@ -53,6 +62,16 @@ func (b *ROBlock) Fetch(rid, from, to int64) (res []protocol.Point, err error) {
 	num := (to - from)
 	res = make([]protocol.Point, num)
 
+	if points, ok := b.sparse[rid]; ok {
+		for _, p := range points {
+			if p.pid >= from && p.pid < to {
+				res[p.pid-from] = p.point
+			}
+		}
+
+		return res, nil
+	}
+
 	off := rid*b.recBytes + from*pointsz
 	p, err := b.segments.SliceAt(num*pointsz, off)
 	if err != nil {
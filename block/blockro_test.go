@@ -33,7 +33,7 @@ func TestNewRO(t *testing.T) {
 	defer setupro(t)()
 
 	for i := 0; i < 3; i++ {
-		b, err := NewRO(tmpdirro, 5)
+		b, err := NewRO(tmpdirro, 5, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -47,7 +47,7 @@ func TestNewRO(t *testing.T) {
 func TestOpenRO(t *testing.T) {
 	defer setupro(t)()
 
-	b, err := NewRW(tmpdirro, 5)
+	b, err := NewRW(tmpdirro, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +60,7 @@ func TestOpenRO(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	b2, err := NewRO(tmpdirro, 5)
+	b2, err := NewRO(tmpdirro, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +73,7 @@ func TestOpenRO(t *testing.T) {
 func TestFetcherRO(t *testing.T) {
 	defer setupro(t)()
 
-	b, err := NewRW(tmpdirro, 5)
+	b, err := NewRW(tmpdirro, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,7 +99,7 @@ func TestFetcherRO(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	b2, err := NewRO(tmpdirro, 5)
+	b2, err := NewRO(tmpdirro, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,7 +124,7 @@ func TestImplRO(t *testing.T) {
 func BenchFetchRO(b *testing.B, ps int64) {
 	defer setupro(b)()
 
-	b1, err := NewRW(tmpdirro, ps)
+	b1, err := NewRW(tmpdirro, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -138,7 +138,7 @@ func BenchFetchRO(b *testing.B, ps int64) {
 		b.Fatal(err)
 	}
 
-	b2, err := NewRW(tmpdirro, ps)
+	b2, err := NewRW(tmpdirro, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -167,7 +167,7 @@ func BenchmarkFetchRO1M(b *testing.B) { BenchFetchRO(b, 1000000) }
 func BenchFetchROP(b *testing.B, ps int64) {
 	defer setupro(b)()
 
-	b1, err := NewRW(tmpdirro, ps)
+	b1, err := NewRW(tmpdirro, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -181,7 +181,7 @@ func BenchFetchROP(b *testing.B, ps int64) {
 		b.Fatal(err)
 	}
 
-	b2, err := NewRW(tmpdirro, ps)
+	b2, err := NewRW(tmpdirro, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/kadirahq/go-tools/fatomic"
 	"github.com/kadirahq/go-tools/segments"
@@ -21,14 +22,25 @@ type RWBlock struct {
 	recBytes  int64
 	segRecs   int64
 	emptyRec  []protocol.Point
+
+	// ptype defines how tracked values are combined with existing values.
+	// Only counters can be updated atomically therefore points of other
+	// point types (including gauges) are updated holding trackMtx.
+	ptype    PointType
+	trackMtx *sync.Mutex
+
+	// grow is called with the start time after allocating new records
+	grow func(start time.Time)
 }
 
 // NewRW function reads or creates a block on given directory.
 // It will automatically load all existing block files.
-func NewRW(dir string, rsz int64) (b *RWBlock, err error) {
+// Sparse records are converted to regular records as they can be modified.
+// New segment files are created with given size (default size if zero).
+func NewRW(dir string, rsz, segsize int64) (b *RWBlock, err error) {
 	rbs := rsz * pointsz
 	sfp := path.Join(dir, prefix)
-	sfs := segsz - (segsz % rbs)
+	sfs := segmentSize(segsize, rbs)
 	ssz := sfs / rbs
 	m, err := segmmap.New(sfp, sfs, false)
 	if err != nil {
@@ -43,6 +55,7 @@ func NewRW(dir string, rsz int64) (b *RWBlock, err error) {
 		recBytes:  rbs,
 		segRecs:   ssz,
 		emptyRec:  make([]protocol.Point, rsz),
+		trackMtx:  new(sync.Mutex),
 	}
 
 	// This will use the segment.Read method until it reaches the EOF
@@ -52,11 +65,30 @@ func NewRW(dir string, rsz int64) (b *RWBlock, err error) {
 		return nil, err
 	}
 
+	if err := loadSparse(b, dir, rsz); err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
 
+// SetPointType sets how tracked values are combined with existing values.
+// Blocks use the Counter point type by default. It must be called before
+// the block is used for tracking values.
+func (b *RWBlock) SetPointType(t PointType) {
+	b.ptype = t
+}
+
+// SetGrowHook sets a function which is called with the start time after
+// allocating and mapping new segment files. It must be called before the
+// block is used for tracking values.
+func (b *RWBlock) SetGrowHook(fn func(start time.Time)) {
+	b.grow = fn
+}
+
 // Track adds a new set of point values to the Block
 // This increments the Total and Count by given values
+// unless the block has a different point type.
 func (b *RWBlock) Track(rid, pid int64, total, count float64) (err error) {
 	if pid < 0 || pid >= b.recLength {
 		panic("point index is out of record bounds")
@@ -67,6 +99,18 @@ func (b *RWBlock) Track(rid, pid int64, total, count float64) (err error) {
 		return err
 	}
 
+	// Total and Count of other point types are written with separate stores
+	// therefore concurrent writes to the same point are serialized. For gauges,
+	// any one of them can win but Total and Count are always from the same one.
+	if b.ptype != Counter {
+		b.trackMtx.Lock()
+		res := b.ptype.Merge(*point, protocol.Point{Total: total, Count: count})
+		writeFloat64(&point.Total, res.Total)
+		writeFloat64(&point.Count, res.Count)
+		b.trackMtx.Unlock()
+		return nil
+	}
+
 	// Atomically increment total and count fields.
 	// As these memory locations are memory mapped,
 	// this will be automatically saved to the disk.
@@ -77,6 +121,25 @@ func (b *RWBlock) Track(rid, pid int64, total, count float64) (err error) {
 	return nil
 }
 
+// setPoint replaces the point with given values regardless of the point type
+func (b *RWBlock) setPoint(rid, pid int64, p protocol.Point) (err error) {
+	if pid < 0 || pid >= b.recLength {
+		panic("point index is out of record bounds")
+	}
+
+	point, err := b.GetPoint(rid, pid)
+	if err != nil {
+		return err
+	}
+
+	b.trackMtx.Lock()
+	writeFloat64(&point.Total, p.Total)
+	writeFloat64(&point.Count, p.Count)
+	b.trackMtx.Unlock()
+
+	return nil
+}
+
 // Fetch returns required range of points from a single record
 func (b *RWBlock) Fetch(rid, from, to int64) (res []protocol.Point, err error) {
 	if from >= b.recLength || from < 0 ||
@@ -104,6 +167,50 @@ func (b *RWBlock) Close() (err error) {
 	return b.segments.Close()
 }
 
+// Clear sets all points to zero in records with IDs larger than or equal to
+// given record ID. Block files are not shrunk. `cleared` will be true if any
+// of those records had measurements before clearing them.
+func (b *RWBlock) Clear(from int64) (cleared bool, err error) {
+	b.recsMtx.Lock()
+	defer b.recsMtx.Unlock()
+
+	if from < 0 {
+		from = 0
+	}
+
+	for rid := from; rid < int64(len(b.records)); rid++ {
+		record := b.records[rid]
+		for pid := range record {
+			if record[pid].Total != 0 || record[pid].Count != 0 {
+				record[pid] = protocol.Point{}
+				cleared = true
+			}
+		}
+	}
+
+	return cleared, nil
+}
+
+// ClearPoints sets points in given position range to zero in all records.
+// Records are not added if they do not exist in the block yet.
+func (b *RWBlock) ClearPoints(from, to int64) (err error) {
+	if from >= b.recLength || from < 0 ||
+		to > b.recLength || to < 0 || to < from {
+		panic("point index is out of record bounds")
+	}
+
+	b.recsMtx.Lock()
+	defer b.recsMtx.Unlock()
+
+	for _, record := range b.records {
+		for pid := from; pid < to; pid++ {
+			record[pid] = protocol.Point{}
+		}
+	}
+
+	return nil
+}
+
 // GetRecord checks if the record exists in the block and returns it
 // if it's available. Otherwise, it will return an empty point record.
 func (b *RWBlock) GetRecord(rid int64) (rec []protocol.Point, err error) {
@@ -143,6 +250,7 @@ func (b *RWBlock) GetPoint(rid, pid int64) (point *protocol.Point, err error) {
 		return point, nil
 	}
 
+	start := time.Now()
 	off := rid * b.recBytes
 	if err := b.segments.Ensure(off); err != nil {
 		return nil, err
@@ -154,6 +262,10 @@ func (b *RWBlock) GetPoint(rid, pid int64) (point *protocol.Point, err error) {
 		return nil, err
 	}
 
+	if b.grow != nil {
+		b.grow(start)
+	}
+
 	point = &b.records[rid][pid]
 
 	return point, nil
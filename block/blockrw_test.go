@@ -3,6 +3,7 @@ package block
 import (
 	"os"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"testing"
 
@@ -33,7 +34,7 @@ func TestNewRW(t *testing.T) {
 	defer setuprw(t)()
 
 	for i := 0; i < 3; i++ {
-		b, err := NewRW(tmpdirrw, 5)
+		b, err := NewRW(tmpdirrw, 5, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -47,7 +48,7 @@ func TestNewRW(t *testing.T) {
 func TestOpenRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +61,7 @@ func TestOpenRW(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	b, err = NewRW(tmpdirrw, 5)
+	b, err = NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,7 +78,7 @@ func TestOpenRW(t *testing.T) {
 func TestSyncRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -94,7 +95,7 @@ func TestSyncRW(t *testing.T) {
 func TestTrackerRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -126,10 +127,114 @@ func TestTrackerRW(t *testing.T) {
 	}
 }
 
+func TestTrackGaugeConcurrentRW(t *testing.T) {
+	defer setuprw(t)()
+
+	b, err := NewRW(tmpdirrw, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetPointType(Gauge)
+
+	// each writer tracks the same total and count (n)
+	// the stored point must have both values from one writer
+	var wg sync.WaitGroup
+	for n := 1; n <= 8; n++ {
+		wg.Add(1)
+		go func(n float64) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if err := b.Track(0, 0, n, n); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(float64(n))
+	}
+
+	wg.Wait()
+
+	p := b.records[0][0]
+	if p.Count == 0 || p.Total != p.Count {
+		t.Fatal("wrong value", p)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearRW(t *testing.T) {
+	defer setuprw(t)()
+
+	b, err := NewRW(tmpdirrw, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rid := int64(0); rid < 3; rid++ {
+		if err := b.Track(rid, 0, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cleared, err := b.Clear(1); err != nil {
+		t.Fatal(err)
+	} else if !cleared {
+		t.Fatal("records should be cleared")
+	}
+
+	if cleared, err := b.Clear(1); err != nil {
+		t.Fatal(err)
+	} else if cleared {
+		t.Fatal("records are already cleared")
+	}
+
+	if b.records[0][0].Count != 1 ||
+		b.records[1][0].Count != 0 ||
+		b.records[2][0].Count != 0 {
+		t.Fatal("wrong values")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearPointsRW(t *testing.T) {
+	defer setuprw(t)()
+
+	b, err := NewRW(tmpdirrw, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pid := int64(0); pid < 5; pid++ {
+		if err := b.Track(1, pid, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.ClearPoints(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for pid, count := range []float64{1, 0, 0, 1, 1} {
+		if b.records[1][pid].Count != count {
+			t.Fatal("wrong values", b.records[1])
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestTrackerMissingRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -147,7 +252,7 @@ func TestTrackerMissingRW(t *testing.T) {
 func TestFetcherRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -184,7 +289,7 @@ func TestFetcherRW(t *testing.T) {
 func TestFetcherMissingRW(t *testing.T) {
 	defer setuprw(t)()
 
-	b, err := NewRW(tmpdirrw, 5)
+	b, err := NewRW(tmpdirrw, 5, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -207,7 +312,7 @@ func TestImplRW(t *testing.T) {
 func BenchTrackRW(b *testing.B, rs int64) {
 	defer setuprw(b)()
 
-	b1, err := NewRW(tmpdirrw, 100)
+	b1, err := NewRW(tmpdirrw, 100, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -239,7 +344,7 @@ func BenchmarkTrackRW1M(b *testing.B) { BenchTrackRW(b, 1000000) }
 func BenchTrackRWP(b *testing.B, rs int64) {
 	defer setuprw(b)()
 
-	b1, err := NewRW(tmpdirrw, 100)
+	b1, err := NewRW(tmpdirrw, 100, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -273,7 +378,7 @@ func BenchmarkTrackRW1MP(b *testing.B) { BenchTrackRWP(b, 1000000) }
 func BenchFetchRW(b *testing.B, ps int64) {
 	defer setuprw(b)()
 
-	b1, err := NewRW(tmpdirrw, ps)
+	b1, err := NewRW(tmpdirrw, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -307,7 +412,7 @@ func BenchmarkFetchRW1M(b *testing.B) { BenchFetchRW(b, 1000000) }
 func BenchFetchRWP(b *testing.B, ps int64) {
 	defer setuprw(b)()
 
-	b1, err := NewRW(tmpdirrw, ps)
+	b1, err := NewRW(tmpdirrw, ps, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
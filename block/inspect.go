@@ -0,0 +1,88 @@
+package block
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Stats has information about records of a block on disk
+type Stats struct {
+	// Segments is the number of block segment files.
+	Segments int64
+
+	// Records is the number of records in segment files and sparse records.
+	Records int64
+
+	// Filled is the number of records with at least one measurement.
+	Filled int64
+
+	// Points is the number of points with measurements.
+	Points int64
+}
+
+// Inspect reads stats of the block in given directory. Segment files are read
+// sequentially one record at a time instead of loading them into memory.
+// Block segment size must be the size used to create the block.
+func Inspect(dir string, rsz, segsize int64) (s *Stats, err error) {
+	rbs := rsz * pointsz
+	sfp := path.Join(dir, prefix)
+	sfs := segmentSize(segsize, rbs)
+
+	s = &Stats{Segments: segmentFiles(sfp)}
+	s.Records = s.Segments * (sfs / rbs)
+
+	buff := make([]byte, rbs)
+	for i := int64(0); i < s.Segments; i++ {
+		if err := inspectSegment(sfp+strconv.FormatInt(i, 10), buff, s); err != nil {
+			return nil, err
+		}
+	}
+
+	sparse, err := readSparse(dir, rsz)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, points := range sparse {
+		s.Records++
+		s.Filled++
+		s.Points += int64(len(points))
+	}
+
+	return s, nil
+}
+
+// inspectSegment counts records and points with measurements in a segment
+// file. The buffer is used to read records and must have the record size.
+func inspectSegment(name string, buff []byte, s *Stats) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		if _, err := io.ReadFull(r, buff); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var n int64
+		for _, p := range decode(buff) {
+			if p.Total != 0 || p.Count != 0 {
+				n++
+			}
+		}
+
+		if n > 0 {
+			s.Filled++
+			s.Points += n
+		}
+	}
+}
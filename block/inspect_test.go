@@ -0,0 +1,60 @@
+package block
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdirinspect = "/tmp/test-inspect/"
+)
+
+func TestInspect(t *testing.T) {
+	if err := os.RemoveAll(tmpdirinspect); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdirinspect, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 records per segment file
+	b, err := NewRW(tmpdirinspect, 5, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := [][2]int64{{0, 0}, {0, 1}, {12, 3}}
+	for _, p := range points {
+		if err := b.Track(p[0], p[1], 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[int64][]protocol.Point{
+		20: {{}, {Total: 2, Count: 1}, {}, {}, {}},
+	}
+
+	if err := WriteSparse(tmpdirinspect, records); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Inspect(tmpdirinspect, 5, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Stats{Segments: 2, Records: 21, Filled: 3, Points: 4}
+	if *s != expected {
+		t.Fatal("wrong stats", s)
+	}
+
+	if err := os.RemoveAll(tmpdirinspect); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package block
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// PointType defines how values tracked to a point are combined with existing
+// values and how points are merged when aggregating (e.g. rollups).
+// The storage format is the same (Total and Count) for all point types.
+type PointType int
+
+const (
+	// Counter adds tracked totals and counts to the point (default).
+	Counter PointType = iota
+
+	// Gauge keeps the last tracked total and count of the point
+	// (last write wins). It can also be used with the name "set".
+	Gauge
+
+	// Max keeps the largest tracked total and adds counts.
+	Max
+
+	// Min keeps the smallest tracked total and adds counts.
+	Min
+)
+
+var (
+	// ErrPointType is returned when the point type name is invalid
+	ErrPointType = errors.New("invalid point type")
+
+	// names of point types used in database params
+	ptypes = map[string]PointType{
+		"":        Counter,
+		"counter": Counter,
+		"gauge":   Gauge,
+		"set":     Gauge,
+		"max":     Max,
+		"min":     Min,
+	}
+)
+
+// ParsePointType returns the point type with given name. An empty name is
+// the same as "counter" to work with params files without a point type.
+func ParsePointType(name string) (t PointType, err error) {
+	t, ok := ptypes[name]
+	if !ok {
+		return Counter, ErrPointType
+	}
+
+	return t, nil
+}
+
+// String returns the name of the point type used in database params.
+// ParsePointType returns the same point type for the name.
+func (t PointType) String() string {
+	for _, name := range []string{"counter", "gauge", "max", "min"} {
+		if ptypes[name] == t {
+			return name
+		}
+	}
+
+	return "invalid"
+}
+
+// Valid checks whether the point type is one of supported point types
+func (t PointType) Valid() bool {
+	return t >= Counter && t <= Min
+}
+
+// Merge combines two points of this type. Point `b` is considered to be the
+// more recent one. Points without measurements (zero count) are ignored.
+func (t PointType) Merge(a, b protocol.Point) (res protocol.Point) {
+	if t == Counter {
+		return protocol.Point{Total: a.Total + b.Total, Count: a.Count + b.Count}
+	}
+
+	if b.Count == 0 {
+		return a
+	} else if a.Count == 0 || t == Gauge {
+		return b
+	}
+
+	res = protocol.Point{Total: a.Total, Count: a.Count + b.Count}
+	if (t == Max && b.Total > a.Total) || (t == Min && b.Total < a.Total) {
+		res.Total = b.Total
+	}
+
+	return res
+}
+
+// writeFloat64 atomically writes the value so that concurrent readers
+// never see a partially written value in memory mapped block files.
+func writeFloat64(addr *float64, val float64) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(addr)), math.Float64bits(val))
+}
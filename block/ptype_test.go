@@ -0,0 +1,116 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestParsePointType(t *testing.T) {
+	names := map[string]PointType{
+		"":        Counter,
+		"counter": Counter,
+		"gauge":   Gauge,
+		"set":     Gauge,
+		"max":     Max,
+		"min":     Min,
+	}
+
+	for name, expected := range names {
+		if pt, err := ParsePointType(name); err != nil {
+			t.Fatal(err)
+		} else if pt != expected || !pt.Valid() {
+			t.Fatal("wrong point type", name, pt)
+		}
+	}
+
+	if _, err := ParsePointType("avg"); err != ErrPointType {
+		t.Fatal("should return error")
+	}
+
+	for _, pt := range []PointType{Counter, Gauge, Max, Min} {
+		if res, err := ParsePointType(pt.String()); err != nil || res != pt {
+			t.Fatal("wrong point type name", pt, res, err)
+		}
+	}
+}
+
+func TestMergePointType(t *testing.T) {
+	a := protocol.Point{Total: 1, Count: 1}
+	b := protocol.Point{Total: 3, Count: 2}
+	empty := protocol.Point{}
+
+	tests := []struct {
+		pt  PointType
+		a   protocol.Point
+		b   protocol.Point
+		res protocol.Point
+	}{
+		{Counter, a, b, protocol.Point{Total: 4, Count: 3}},
+		{Gauge, a, b, b},
+		{Gauge, b, empty, b},
+		{Max, a, b, protocol.Point{Total: 3, Count: 3}},
+		{Max, b, a, protocol.Point{Total: 3, Count: 3}},
+		{Min, a, b, protocol.Point{Total: 1, Count: 3}},
+		{Min, empty, b, b},
+	}
+
+	for _, test := range tests {
+		if res := test.pt.Merge(test.a, test.b); res != test.res {
+			t.Fatal("wrong result", test.pt, res)
+		}
+	}
+}
+
+func TestTrackPointType(t *testing.T) {
+	defer setuprw(t)()
+
+	b, err := NewRW(tmpdirrw, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetPointType(Min)
+
+	for _, v := range []float64{5, -2, 3} {
+		if err := b.Track(0, 1, v, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := b.Fetch(0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res[0].Total != -2 || res[0].Count != 3 {
+		t.Fatal("wrong result", res)
+	}
+
+	// gauge points use atomic stores
+	b.SetPointType(Gauge)
+
+	for _, v := range []float64{5, -2, 3} {
+		if err := b.Track(0, 2, v, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// points without measurements are ignored
+	if err := b.Track(0, 2, 7, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = b.Fetch(0, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res[0].Total != 3 || res[0].Count != 1 {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
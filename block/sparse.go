@@ -0,0 +1,184 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	// sparsefile stores records with only a few points with measurements.
+	// These records are not stored in block segment files to save space.
+	//
+	// Sparse File Format:
+	//
+	//   [rid-0][count-0][pid-0 total-0 count-0][pid-1 total-1 count-1]...
+	//   [rid-1][count-1][pid-0 total-0 count-0]...
+	//
+	// All values are 8 bytes (little endian int64 or float64 bits).
+	sparsefile = "sparse"
+
+	// size of a sparse point (position, total and count)
+	sparseptsz = 24
+)
+
+var (
+	// ErrSparse is returned when the sparse record file is invalid
+	ErrSparse = errors.New("invalid sparse record file")
+)
+
+// sparsePoint is a point with measurements and its position in the record
+type sparsePoint struct {
+	pid   int64
+	point protocol.Point
+}
+
+// WriteSparse writes given records in sparse format to the directory of the
+// block. Only points with measurements are stored. Read-only blocks read
+// these records transparently. Read-write blocks convert sparse records to
+// regular records when they are loaded as they can be modified.
+// Record IDs of sparse records must not be used in block segment files.
+func WriteSparse(dir string, records map[int64][]protocol.Point) (err error) {
+	f, err := os.Create(path.Join(dir, sparsefile))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	buff := make([]byte, 8)
+
+	write := func(v uint64) {
+		binary.LittleEndian.PutUint64(buff, v)
+		if err == nil {
+			_, err = w.Write(buff)
+		}
+	}
+
+	for rid, record := range records {
+		var n int64
+		for _, p := range record {
+			if p.Total != 0 || p.Count != 0 {
+				n++
+			}
+		}
+
+		write(uint64(rid))
+		write(uint64(n))
+
+		for pid, p := range record {
+			if p.Total != 0 || p.Count != 0 {
+				write(uint64(pid))
+				write(math.Float64bits(p.Total))
+				write(math.Float64bits(p.Count))
+			}
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readSparse reads sparse records of the block in given directory
+// An empty map is returned if the block does not have sparse records.
+func readSparse(dir string, rsz int64) (records map[int64][]sparsePoint, err error) {
+	records = map[int64][]sparsePoint{}
+
+	data, err := ioutil.ReadFile(path.Join(dir, sparsefile))
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	read := func() int64 {
+		v := binary.LittleEndian.Uint64(data[:8])
+		data = data[8:]
+		return int64(v)
+	}
+
+	for len(data) > 0 {
+		if len(data) < 16 {
+			return nil, ErrSparse
+		}
+
+		rid := read()
+		n := read()
+		if n < 0 || n > rsz || int64(len(data)) < n*sparseptsz {
+			return nil, ErrSparse
+		}
+
+		points := make([]sparsePoint, n)
+		for i := range points {
+			points[i].pid = read()
+			points[i].point.Total = math.Float64frombits(uint64(read()))
+			points[i].point.Count = math.Float64frombits(uint64(read()))
+
+			if points[i].pid < 0 || points[i].pid >= rsz {
+				return nil, ErrSparse
+			}
+		}
+
+		records[rid] = points
+	}
+
+	return records, nil
+}
+
+// pointSetter is a read-write block which can replace points
+type pointSetter interface {
+	setPoint(rid, pid int64, p protocol.Point) (err error)
+	Sync() (err error)
+}
+
+// loadSparse writes points of sparse records to regular records of a
+// read-write block and removes the sparse record file. Sparse records are
+// always empty in segment files. Points are replaced instead of adding them
+// so loading again after a crash before removing the file is safe.
+func loadSparse(b pointSetter, dir string, rsz int64) (err error) {
+	sparse, err := readSparse(dir, rsz)
+	if err != nil || len(sparse) == 0 {
+		return err
+	}
+
+	for rid, points := range sparse {
+		for _, p := range points {
+			if err := b.setPoint(rid, p.pid, p.point); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.Sync(); err != nil {
+		return err
+	}
+
+	return removeSparse(dir)
+}
+
+// removeSparse removes the sparse record file of the block
+func removeSparse(dir string) (err error) {
+	err = os.Remove(path.Join(dir, sparsefile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
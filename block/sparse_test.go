@@ -0,0 +1,147 @@
+package block
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdirsparse = "/tmp/test-sparse/"
+)
+
+func setupsp(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirsparse); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(tmpdirsparse, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirsparse); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	defer setupsp(t)()
+
+	b, err := NewRW(tmpdirsparse, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Track(0, 0, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[int64][]protocol.Point{
+		1: {{}, {}, {}, {Total: 2, Count: 1}, {}},
+	}
+
+	if err := WriteSparse(tmpdirsparse, records); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRO(tmpdirsparse, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := r.Fetch(1, 2, 5); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 3 || res[1].Total != 2 || res[1].Count != 1 {
+		t.Fatal("wrong result", res)
+	}
+
+	if res, err := r.Fetch(0, 0, 5); err != nil {
+		t.Fatal(err)
+	} else if res[0].Total != 1 {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewRW(tmpdirsparse, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirsparse, sparsefile)); !os.IsNotExist(err) {
+		t.Fatal("sparse records should be converted")
+	}
+
+	if res, err := w.Fetch(1, 0, 5); err != nil {
+		t.Fatal(err)
+	} else if res[3].Total != 2 || res[3].Count != 1 {
+		t.Fatal("wrong result", res)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSparseReload(t *testing.T) {
+	defer setupsp(t)()
+
+	records := map[int64][]protocol.Point{
+		0: {{}, {Total: 2, Count: 1}, {}, {}, {}},
+	}
+
+	// the sparse file is kept if loading stops before removing it
+	// (ex: crash) therefore points must not be added again
+	for j := 0; j < 2; j++ {
+		if err := WriteSparse(tmpdirsparse, records); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewFile(tmpdirsparse, 5, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res, err := w.Fetch(0, 0, 5); err != nil {
+			t.Fatal(err)
+		} else if res[1].Total != 2 || res[1].Count != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSparseInvalid(t *testing.T) {
+	defer setupsp(t)()
+
+	fpath := path.Join(tmpdirsparse, sparsefile)
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readSparse(tmpdirsparse, 5); err != ErrSparse {
+		t.Fatal("should fail with invalid sparse file")
+	}
+}
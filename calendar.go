@@ -0,0 +1,79 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Calendar is a calendar unit used to bucket points by local time
+type Calendar int
+
+const (
+	// CalendarDay buckets start at midnight
+	CalendarDay Calendar = iota
+
+	// CalendarWeek buckets start at midnight on Monday
+	CalendarWeek
+
+	// CalendarMonth buckets start at midnight on the first day of the month
+	CalendarMonth
+)
+
+var (
+	// ErrInvCalendar is returned when the calendar unit is not supported
+	ErrInvCalendar = errors.New("invalid calendar unit")
+)
+
+// FetchCalendar is the same as FetchTimed but points are aggregated into days,
+// weeks or months in given time zone (UTC if nil). Buckets follow local time
+// therefore days can be 23 or 25 hours long when daylight saving changes.
+// Points are timestamped with the start of their bucket and merged with the
+// point type of the database. The time range is not aligned to buckets so
+// the first and the last buckets only have points within the range.
+func (d *DB) FetchCalendar(ctx context.Context, from, to uint64, unit Calendar, loc *time.Location, fields []string, fn TimedHandler) {
+	if unit != CalendarDay && unit != CalendarWeek && unit != CalendarMonth {
+		fn(nil, ErrInvCalendar)
+		return
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	bucket := func(ts uint64) uint64 {
+		return uint64(CalendarStart(time.Unix(0, int64(ts)).In(loc), unit).UnixNano())
+	}
+
+	l := d.level(from)
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		result := l.timed(chunks)
+		for _, s := range result {
+			s.Points = l.buckets(s.Points, bucket)
+		}
+
+		fn(result, nil)
+	}, l.fetchQuery(fields))
+}
+
+// CalendarStart returns the start of the calendar bucket which has given time
+// in the time zone of the time. It can be used to align fetch time ranges.
+func CalendarStart(t time.Time, unit Calendar) time.Time {
+	y, m, d := t.Date()
+
+	switch unit {
+	case CalendarWeek:
+		d -= (int(t.Weekday()) + 6) % 7
+	case CalendarMonth:
+		d = 1
+	}
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
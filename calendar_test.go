@@ -0,0 +1,111 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCalendarStart(t *testing.T) {
+	loc := time.FixedZone("test", -5*3600)
+	tm := time.Date(2023, 3, 19, 10, 30, 0, 0, loc)
+
+	tests := map[Calendar]time.Time{
+		CalendarDay:   time.Date(2023, 3, 19, 0, 0, 0, 0, loc),
+		CalendarWeek:  time.Date(2023, 3, 13, 0, 0, 0, 0, loc),
+		CalendarMonth: time.Date(2023, 3, 1, 0, 0, 0, 0, loc),
+	}
+
+	for unit, exp := range tests {
+		if res := CalendarStart(tm, unit); !res.Equal(exp) {
+			t.Fatal("wrong start", unit, res)
+		}
+	}
+
+	// days are shorter when daylight saving starts
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+
+	day := CalendarStart(time.Date(2023, 3, 12, 12, 0, 0, 0, ny), CalendarDay)
+	next := CalendarStart(time.Date(2023, 3, 13, 12, 0, 0, 0, ny), CalendarDay)
+	if d := next.Sub(day); d != 23*time.Hour {
+		t.Fatal("wrong day length", d)
+	}
+}
+
+func TestFetchCalendar(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	loc := time.FixedZone("test", -5*3600)
+	hour := uint64(time.Hour)
+
+	// Mon Jan 5 1970 10:00 and 23:00, Tue Jan 6 01:00, Tue Jan 13 12:00
+	points := []TimedPoint{
+		{111 * hour, 1, 1},
+		{124 * hour, 2, 1},
+		{126 * hour, 3, 1},
+		{305 * hour, 4, 1},
+	}
+
+	for _, p := range points {
+		if err := db.Track(p.Timestamp, fields, p.Total, p.Count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[Calendar][]TimedPoint{
+		CalendarDay:   {{101 * hour, 3, 2}, {125 * hour, 3, 1}, {293 * hour, 4, 1}},
+		CalendarWeek:  {{101 * hour, 6, 3}, {269 * hour, 4, 1}},
+		CalendarMonth: {{5 * hour, 10, 4}},
+	}
+
+	for unit, exp := range tests {
+		expected := []*TimedSeries{{Fields: fields, Points: exp}}
+		db.FetchCalendar(context.Background(), 100*hour, 310*hour, unit, loc, fields, func(res []*TimedSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(res, expected) {
+				t.Fatal("wrong result", unit, res[0].Points)
+			}
+		})
+	}
+
+	db.FetchCalendar(context.Background(), 0, hour, Calendar(-1), nil, fields, func(res []*TimedSeries, err error) {
+		if err != ErrInvCalendar {
+			t.Fatal("expected ErrInvCalendar", err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
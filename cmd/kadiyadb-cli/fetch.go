@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	// timeFormat is used to print timestamps in table and json output
+	timeFormat = "2006-01-02 15:04:05"
+
+	// wideFormat is used to print timestamps in wide output column headers
+	wideFormat = "01-02 15:04"
+)
+
+var (
+	// ErrOutput is returned when the fetch output mode is not supported
+	ErrOutput = errors.New("invalid output mode")
+
+	// sparks are used to draw sparklines from the lowest to the highest value
+	sparks = []rune("▁▂▃▄▅▆▇█")
+)
+
+// series is a fetched series with its points by timestamp
+type series struct {
+	fields []string
+	points map[uint64]*protocol.Point
+}
+
+// timestamps implements sort.Interface to sort timestamps
+type timestamps []uint64
+
+func (t timestamps) Len() int           { return len(t) }
+func (t timestamps) Less(i, j int) bool { return t[i] < t[j] }
+func (t timestamps) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// namedRecord is a point printed with field names in json output
+type namedRecord struct {
+	Timestamp uint64            `json:"timestamp"`
+	Time      string            `json:"time"`
+	Fields    map[string]string `json:"fields"`
+	Total     float64           `json:"total"`
+	Count     float64           `json:"count"`
+	Unit      string            `json:"unit,omitempty"`
+}
+
+// fetch prints all points of matching series in the time range
+func fetch(db *kadiyadb.DB, args []string) (err error) {
+	if len(args) < 3 {
+		return ErrUsage
+	}
+
+	from, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	to, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	mode := *output
+	if *asJSON {
+		mode = "json"
+	}
+
+	fields := args[2:]
+
+	switch mode {
+	case "csv":
+		_, err = db.Export(from, to, fields, kadiyadb.FormatCSV, out)
+		return err
+	case "json":
+		if *names == "" {
+			_, err = db.Export(from, to, fields, kadiyadb.FormatJSON, out)
+			return err
+		}
+	case "table", "wide":
+	default:
+		return ErrOutput
+	}
+
+	all, times, err := collect(db, from, to, fields)
+	if err != nil {
+		return err
+	}
+
+	header := fieldNames(len(fields))
+
+	switch mode {
+	case "json":
+		return printJSON(all, times, header)
+	case "table":
+		return printTable(all, times, header)
+	default:
+		return printWide(all, times, header)
+	}
+}
+
+// collect fetches all series in the time range. Series are returned in the
+// order they are first fetched with their non-empty points and timestamps of
+// all non-empty points are returned in ascending order.
+func collect(db *kadiyadb.DB, from, to uint64, fields []string) (all []*series, times []uint64, err error) {
+	byKey := map[string]*series{}
+	seen := map[uint64]bool{}
+
+	err = db.FetchStream(context.Background(), from, to, fields, func(c *protocol.Chunk) error {
+		for _, s := range c.Series {
+			if len(s.Points) == 0 {
+				continue
+			}
+
+			key := strings.Join(s.Fields, "\x00")
+			ser, ok := byKey[key]
+			if !ok {
+				ser = &series{fields: s.Fields, points: map[uint64]*protocol.Point{}}
+				byKey[key] = ser
+				all = append(all, ser)
+			}
+
+			res := (c.To - c.From) / uint64(len(s.Points))
+			for i := range s.Points {
+				p := &s.Points[i]
+				if p.Total == 0 && p.Count == 0 {
+					continue
+				}
+
+				ts := c.From + uint64(i)*res
+				ser.points[ts] = &protocol.Point{Total: p.Total, Count: p.Count}
+
+				if !seen[ts] {
+					seen[ts] = true
+					times = append(times, ts)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Sort(timestamps(times))
+	return all, times, nil
+}
+
+// fieldNames returns names given with -names for n fields. Fields without
+// a name are named by their position starting from 1.
+func fieldNames(n int) (res []string) {
+	var given []string
+	if *names != "" {
+		given = strings.Split(*names, ",")
+	}
+
+	res = make([]string, n)
+	for i := range res {
+		if i < len(given) && given[i] != "" {
+			res[i] = given[i]
+		} else {
+			res[i] = "field" + strconv.Itoa(i+1)
+		}
+	}
+
+	return res
+}
+
+// printJSON prints a named record for each point ordered by timestamp
+func printJSON(all []*series, times []uint64, header []string) (err error) {
+	enc := json.NewEncoder(out)
+
+	for _, ts := range times {
+		for _, s := range all {
+			p, ok := s.points[ts]
+			if !ok {
+				continue
+			}
+
+			rec := &namedRecord{
+				Timestamp: ts,
+				Time:      formatTime(ts, timeFormat),
+				Fields:    map[string]string{},
+				Total:     p.Total,
+				Count:     p.Count,
+				Unit:      *unit,
+			}
+
+			for i, f := range s.fields {
+				if i < len(header) {
+					rec.Fields[header[i]] = f
+				}
+			}
+
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// printTable prints a row for each point of each series. Rows of a series
+// are followed by its sparkline when -spark is set.
+func printTable(all []*series, times []uint64, header []string) (err error) {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	cols := append([]string{"time"}, header...)
+	cols = append(cols, withUnit("total"), "count")
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+
+	for _, s := range all {
+		for _, ts := range times {
+			p, ok := s.points[ts]
+			if !ok {
+				continue
+			}
+
+			row := append([]string{formatTime(ts, timeFormat)}, s.fields...)
+			row = append(row, formatFloat(p.Total), formatFloat(p.Count))
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+
+		if *spark {
+			row := append([]string{"spark"}, s.fields...)
+			row = append(row, sparkline(s, times))
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+	}
+
+	return tw.Flush()
+}
+
+// printWide prints a row for each series with a column for each timestamp.
+// Series sparklines are added as the last column when -spark is set.
+func printWide(all []*series, times []uint64, header []string) (err error) {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	cols := append([]string{}, header...)
+	for _, ts := range times {
+		cols = append(cols, formatTime(ts, wideFormat))
+	}
+
+	if *spark {
+		cols = append(cols, "spark")
+	}
+
+	if *unit != "" {
+		fmt.Fprintf(out, "unit: %s\n", *unit)
+	}
+
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+
+	for _, s := range all {
+		row := append([]string{}, s.fields...)
+		for _, ts := range times {
+			if p, ok := s.points[ts]; ok {
+				row = append(row, formatFloat(p.Total))
+			} else {
+				row = append(row, "-")
+			}
+		}
+
+		if *spark {
+			row = append(row, sparkline(s, times))
+		}
+
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// sparkline draws totals of the series at given timestamps scaled between
+// its lowest and highest totals. Missing points are drawn as spaces.
+func sparkline(s *series, times []uint64) string {
+	var min, max float64
+	first := true
+
+	for _, p := range s.points {
+		if first || p.Total < min {
+			min = p.Total
+		}
+		if first || p.Total > max {
+			max = p.Total
+		}
+		first = false
+	}
+
+	res := make([]rune, len(times))
+	for i, ts := range times {
+		p, ok := s.points[ts]
+		switch {
+		case !ok:
+			res[i] = ' '
+		case max == min:
+			res[i] = sparks[len(sparks)/2]
+		default:
+			idx := int((p.Total - min) / (max - min) * float64(len(sparks)-1))
+			res[i] = sparks[idx]
+		}
+	}
+
+	return string(res)
+}
+
+// withUnit adds the unit given with -unit to a column name
+func withUnit(name string) string {
+	if *unit == "" {
+		return name
+	}
+
+	return name + " (" + *unit + ")"
+}
+
+// formatTime formats a timestamp in nanoseconds in local time
+func formatTime(ts uint64, layout string) string {
+	return time.Unix(0, int64(ts)).Local().Format(layout)
+}
+
+// formatFloat formats a value with the minimum number of digits needed
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,436 @@
+// Command kadiyadb-cli runs administration tasks on databases stored in a
+// data directory. Databases must not be used by a running server at the
+// same time as they are opened directly by this command.
+//
+//	kadiyadb-cli -dir /data dbs list
+//	kadiyadb-cli -dir /data dbs create mydb params.json
+//	kadiyadb-cli -dir /data dbs drop mydb
+//	kadiyadb-cli -dir /data track mydb <ts> <total> <count> <fields...>
+//	kadiyadb-cli -dir /data fetch mydb <from> <to> <fields...>
+//	kadiyadb-cli -dir /data info mydb
+//	kadiyadb-cli -dir /data backup mydb <file>
+//	kadiyadb-cli -dir /data verify mydb <ts>
+//	kadiyadb-cli -dir /data compact mydb <ts>
+//	kadiyadb-cli -dir /data expire mydb <ts>
+//	kadiyadb-cli -dir /data inspect mydb <ts>
+//	kadiyadb-cli -dir /data rename mydb <from...> <to...>
+//	kadiyadb-cli -dir /data repair mydb
+//	kadiyadb-cli -dir /data archive mydb <ts>
+//	kadiyadb-cli -dir /data unarchive mydb <ts>
+//	kadiyadb-cli -dir /data restore mydb <file>
+//
+// Timestamps are in nanoseconds. Fetch results are written to the standard
+// output in the mode set with -output:
+//
+//	csv    kadiyadb.FormatCSV records (default)
+//	json   kadiyadb.FormatJSON records, or named records when -names is set
+//	table  a row for each point with local time, fields, total and count
+//	wide   a row for each series with a column for each local time
+//
+// Fields are shown with the names given with -names (e.g. -names host,metric)
+// and values with the unit given with -unit. Table and wide output include a
+// sparkline of each series with -spark.
+// The rename command takes the same number of fields for the field pattern
+// and new fields (use "*" to keep a field) (see kadiyadb.DB.Rename).
+// The restore command creates a new database from a backup file.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	// paramfile is the params file of a database (see kadiyadb.OpenDir)
+	paramfile = "params.json"
+)
+
+var (
+	// ErrUsage is returned when a command is used with wrong arguments
+	ErrUsage = errors.New("invalid command arguments")
+
+	// ErrNoDB is returned when the database directory has no params file
+	ErrNoDB = errors.New("database does not exist")
+)
+
+var (
+	dir    = flag.String("dir", "/data", "data directory with databases")
+	asJSON = flag.Bool("json", false, "print fetch results as json (same as -output json)")
+	output = flag.String("output", "csv", "fetch output mode: csv, json, table or wide")
+	names  = flag.String("names", "", "comma separated names of fetched fields")
+	unit   = flag.String("unit", "", "unit of fetched values")
+	spark  = flag.Bool("spark", false, "add sparklines to table and wide output")
+
+	// out is where commands write their output
+	out io.Writer = os.Stdout
+)
+
+// commands which use an opened database with their arguments
+var commands = map[string]func(db *kadiyadb.DB, args []string) error{
+	"track":     track,
+	"fetch":     fetch,
+	"backup":    backup,
+	"verify":    verify,
+	"compact":   compact,
+	"expire":    expire,
+	"inspect":   inspect,
+	"rename":    rename,
+	"repair":    repair,
+	"archive":   archive,
+	"unarchive": unarchive,
+}
+
+func main() {
+	flag.Parse()
+
+	err := run(flag.Args())
+	if err == ErrUsage {
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command in given arguments (flags should be parsed already).
+// Returns ErrUsage if the command does not exist or arguments are wrong.
+func run(args []string) (err error) {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch cmd := args[0]; cmd {
+	case "dbs":
+		return dbs(args[1:])
+	case "info":
+		return info(args[1:])
+	case "restore":
+		return restore(args[1:])
+	}
+
+	fn, ok := commands[args[0]]
+	if !ok || len(args) < 2 {
+		return ErrUsage
+	}
+
+	return withDB(args[1], func(db *kadiyadb.DB) error {
+		return fn(db, args[2:])
+	})
+}
+
+// withDB opens the database with given name and calls fn with it.
+// The database is closed after fn returns.
+func withDB(name string, fn func(db *kadiyadb.DB) error) (err error) {
+	dbdir := path.Join(*dir, name)
+	if _, err := os.Stat(path.Join(dbdir, paramfile)); os.IsNotExist(err) {
+		return ErrNoDB
+	}
+
+	db, err := kadiyadb.OpenDir(dbdir)
+	if err != nil {
+		return err
+	}
+
+	err = fn(db)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// dbs lists, creates or drops databases
+func dbs(args []string) (err error) {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		files, err := ioutil.ReadDir(*dir)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			p := path.Join(*dir, file.Name(), paramfile)
+			if _, err := os.Stat(p); err == nil && file.IsDir() {
+				fmt.Fprintln(out, file.Name())
+			}
+		}
+
+		return nil
+
+	case args[0] == "create" && len(args) == 3:
+		dbdir := path.Join(*dir, args[1])
+		if _, err := os.Stat(dbdir); err == nil {
+			return kadiyadb.ErrExists
+		}
+
+		data, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return err
+		}
+
+		p, err := kadiyadb.ParseParams(data)
+		if err != nil {
+			return err
+		}
+
+		// files created by Create are removed if it fails
+		db, err := kadiyadb.Create(dbdir, p)
+		if err != nil {
+			return err
+		}
+
+		return db.Close()
+
+	case args[0] == "drop" && len(args) == 2:
+		dbdir := path.Join(*dir, args[1])
+		if _, err := os.Stat(path.Join(dbdir, paramfile)); os.IsNotExist(err) {
+			return ErrNoDB
+		}
+
+		return os.RemoveAll(dbdir)
+	}
+
+	return ErrUsage
+}
+
+// info prints params and disk usage of a database
+func info(args []string) (err error) {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	dbdir := path.Join(*dir, args[0])
+	data, err := ioutil.ReadFile(path.Join(dbdir, paramfile))
+	if os.IsNotExist(err) {
+		return ErrNoDB
+	} else if err != nil {
+		return err
+	}
+
+	var size, files int64
+	err = filepath.Walk(dbdir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			size += fi.Size()
+			files++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "params: %s\n", bytes.TrimSpace(data))
+	fmt.Fprintln(out, "files:", files)
+	fmt.Fprintln(out, "bytes:", size)
+
+	return nil
+}
+
+// track tracks a single measurement
+func track(db *kadiyadb.DB, args []string) (err error) {
+	if len(args) < 4 {
+		return ErrUsage
+	}
+
+	ts, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	total, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return err
+	}
+
+	count, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Track(ts, args[3:], total, count); err != nil {
+		return err
+	}
+
+	return db.Sync()
+}
+
+// backup writes a backup of the database to a file
+func backup(db *kadiyadb.DB, args []string) (err error) {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := db.Backup(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// verify checks checksums of the epoch which contains the timestamp
+func verify(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	return db.Verify(ts)
+}
+
+// compact compacts the epoch which contains the timestamp
+func compact(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	return db.Compact(ts)
+}
+
+// expire removes epochs which are expired at the timestamp
+func expire(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	return db.Expire(ts)
+}
+
+// parseTimestamp parses the only argument as a timestamp
+func parseTimestamp(args []string) (ts uint64, err error) {
+	if len(args) != 1 {
+		return 0, ErrUsage
+	}
+
+	return strconv.ParseUint(args[0], 10, 64)
+}
+
+// inspect prints information about the epoch which contains the timestamp
+func inspect(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	info, err := db.Inspect(ts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "records:", info.Records)
+	fmt.Fprintln(out, "segments:", info.Segments)
+	fmt.Fprintln(out, "nodes:", info.Nodes)
+	fmt.Fprintf(out, "fill: %.4f\n", info.Fill)
+	fmt.Fprintln(out, "bytes:", info.Bytes)
+	fmt.Fprintln(out, "updated:", time.Unix(0, info.Updated).UTC().Format(time.RFC3339))
+
+	return nil
+}
+
+// rename renames all series matching the field pattern. The first half of
+// arguments is the field pattern and the second half has new field values.
+func rename(db *kadiyadb.DB, args []string) (err error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return ErrUsage
+	}
+
+	half := len(args) / 2
+	n, err := db.Rename(args[:half], args[half:])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "renamed:", n)
+	return nil
+}
+
+// repair repairs epochs damaged by an unclean shutdown
+func repair(db *kadiyadb.DB, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+
+	n, err := db.Repair()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "repaired:", n)
+	return nil
+}
+
+// archive moves the epoch which contains the timestamp to the archive path
+func archive(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	return db.Archive(ts)
+}
+
+// unarchive moves the archived epoch which contains the timestamp back
+func unarchive(db *kadiyadb.DB, args []string) (err error) {
+	ts, err := parseTimestamp(args)
+	if err != nil {
+		return err
+	}
+
+	return db.Unarchive(ts)
+}
+
+// restore creates a new database from a backup file. The database directory
+// is removed if the backup cannot be restored.
+func restore(args []string) (err error) {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+
+	dbdir := path.Join(*dir, args[0])
+	if _, err := os.Stat(dbdir); err == nil {
+		return kadiyadb.ErrExists
+	}
+
+	f, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if err := kadiyadb.RestoreBackup(f, dbdir); err != nil {
+		os.RemoveAll(dbdir)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+var (
+	tmpdir = "/tmp/test-cli"
+)
+
+func setup(t *testing.T) func() {
+	if err := os.RemoveAll(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(tmpdir, "data"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	*dir = path.Join(tmpdir, "data")
+
+	return func() {
+		out = os.Stdout
+		*asJSON, *output, *names, *unit, *spark = false, "csv", "", "", false
+		if err := os.RemoveAll(tmpdir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runOut runs the command and returns its output
+func runOut(t *testing.T, args ...string) string {
+	buf := &bytes.Buffer{}
+	out = buf
+
+	if err := run(args); err != nil {
+		t.Fatal(args, err)
+	}
+
+	return buf.String()
+}
+
+func TestRunUsage(t *testing.T) {
+	defer setup(t)()
+
+	cases := [][]string{
+		{},
+		{"unknown", "test"},
+		{"track"},
+		{"dbs"},
+		{"dbs", "list", "test"},
+		{"dbs", "create", "test"},
+		{"dbs", "drop"},
+		{"info"},
+		{"restore", "test"},
+	}
+
+	for _, args := range cases {
+		if err := run(args); err != ErrUsage {
+			t.Fatal("expected ErrUsage", args, err)
+		}
+	}
+
+	if err := run([]string{"verify", "test", "0"}); err != ErrNoDB {
+		t.Fatal("expected ErrNoDB", err)
+	}
+
+	if err := run([]string{"info", "test"}); err != ErrNoDB {
+		t.Fatal("expected ErrNoDB", err)
+	}
+
+	if _, err := parseTimestamp([]string{"1", "2"}); err != ErrUsage {
+		t.Fatal("expected ErrUsage", err)
+	}
+
+	if _, err := parseTimestamp([]string{"x"}); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if ts, err := parseTimestamp([]string{"60"}); err != nil || ts != 60 {
+		t.Fatal("wrong timestamp", ts, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	defer setup(t)()
+
+	params := path.Join(tmpdir, "params.json")
+	archived := path.Join(tmpdir, "archive")
+	data := []byte(`{
+		"duration": "1h",
+		"resolution": "1m",
+		"retention": "10h",
+		"maxROEpochs": 2,
+		"maxRWEpochs": 2,
+		"archivePath": "` + archived + `"
+	}`)
+
+	if err := ioutil.WriteFile(params, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runOut(t, "dbs", "create", "test", params)
+
+	if err := run([]string{"dbs", "create", "test", params}); err != kadiyadb.ErrExists {
+		t.Fatal("expected ErrExists", err)
+	}
+
+	if res := runOut(t, "dbs", "list"); res != "test\n" {
+		t.Fatal("wrong result", res)
+	}
+
+	runOut(t, "track", "test", "0", "5", "1", "a", "b")
+
+	if res := runOut(t, "fetch", "test", "0", "60000000000", "a", "b"); !strings.Contains(res, "5") {
+		t.Fatal("wrong result", res)
+	}
+
+	if res := runOut(t, "info", "test"); !strings.HasPrefix(res, "params: ") {
+		t.Fatal("wrong result", res)
+	}
+
+	if res := runOut(t, "inspect", "test", "0"); !strings.Contains(res, "nodes: ") {
+		t.Fatal("wrong result", res)
+	}
+
+	runOut(t, "compact", "test", "0")
+	runOut(t, "verify", "test", "0")
+
+	if res := runOut(t, "rename", "test", "a", "b", "*", "c"); res != "renamed: 1\n" {
+		t.Fatal("wrong result", res)
+	}
+
+	if res := runOut(t, "repair", "test"); res != "repaired: 0\n" {
+		t.Fatal("wrong result", res)
+	}
+
+	backup := path.Join(tmpdir, "backup.tar")
+	runOut(t, "backup", "test", backup)
+	runOut(t, "restore", "copy", backup)
+
+	if err := run([]string{"restore", "copy", backup}); err != kadiyadb.ErrExists {
+		t.Fatal("expected ErrExists", err)
+	}
+
+	if res := runOut(t, "fetch", "copy", "0", "60000000000", "a", "c"); !strings.Contains(res, "5") {
+		t.Fatal("wrong result", res)
+	}
+
+	runOut(t, "dbs", "drop", "copy")
+
+	if res := runOut(t, "dbs", "list"); res != "test\n" {
+		t.Fatal("wrong result", res)
+	}
+
+	// expire at 20h to archive the first epoch
+	runOut(t, "expire", "test", "72000000000000")
+
+	if _, err := os.Stat(path.Join(archived, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+
+	runOut(t, "unarchive", "test", "0")
+
+	if _, err := os.Stat(path.Join(*dir, "test", "0")); err != nil {
+		t.Fatal("epoch should be restored")
+	}
+
+	runOut(t, "archive", "test", "0")
+
+	if _, err := os.Stat(path.Join(archived, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+}
+
+func TestFetchOutput(t *testing.T) {
+	defer setup(t)()
+
+	params := path.Join(tmpdir, "params.json")
+	data := []byte(`{
+		"duration": "1h",
+		"resolution": "1m",
+		"retention": "10h",
+		"maxROEpochs": 2,
+		"maxRWEpochs": 2
+	}`)
+
+	if err := ioutil.WriteFile(params, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runOut(t, "dbs", "create", "test", params)
+	runOut(t, "track", "test", "0", "5", "1", "a", "b")
+	runOut(t, "track", "test", "60000000000", "7", "1", "a", "b")
+
+	args := []string{"fetch", "test", "0", "120000000000", "a", "b"}
+	first := time.Unix(0, 0).Local()
+	second := time.Unix(60, 0).Local()
+
+	*output = "xml"
+	if err := run(args); err != ErrOutput {
+		t.Fatal("expected ErrOutput", err)
+	}
+
+	*output, *names, *unit, *spark = "table", "app,metric", "ms", true
+	res := runOut(t, args...)
+	for _, str := range []string{
+		"time", "app", "metric", "total (ms)", "count",
+		first.Format(timeFormat), second.Format(timeFormat), "▁█",
+	} {
+		if !strings.Contains(res, str) {
+			t.Fatal("wrong result", str, res)
+		}
+	}
+
+	*output = "wide"
+	res = runOut(t, args...)
+	for _, str := range []string{
+		"unit: ms", "app", first.Format(wideFormat), second.Format(wideFormat), "5", "7", "▁█",
+	} {
+		if !strings.Contains(res, str) {
+			t.Fatal("wrong result", str, res)
+		}
+	}
+
+	*output = "json"
+	res = runOut(t, args...)
+	exp := `{"timestamp":0,"time":"` + first.Format(timeFormat) + `","fields":{"app":"a","metric":"b"},"total":5,"count":1,"unit":"ms"}`
+	if !strings.HasPrefix(res, exp+"\n") {
+		t.Fatal("wrong result", res)
+	}
+
+	*names = ""
+	if res = runOut(t, args...); !strings.Contains(res, `"fields":["a","b"]`) {
+		t.Fatal("wrong result", res)
+	}
+}
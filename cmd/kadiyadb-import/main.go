@@ -0,0 +1,73 @@
+// Command kadiyadb-import imports historical data files to a database.
+// The database must not be used by a running server while importing.
+//
+//	kadiyadb-import -db /data/mydb -format csv points-1.csv points-2.csv
+//
+// Data is read from the standard input if no files are given.
+// See kadiyadb.FormatCSV and kadiyadb.FormatJSON for data formats.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+func main() {
+	dir := flag.String("db", "", "database directory (with params.json)")
+	format := flag.String("format", kadiyadb.FormatCSV, "data format (csv or json)")
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := kadiyadb.OpenDir(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	var total int64
+	files := flag.Args()
+	if len(files) == 0 {
+		total, err = db.Import(os.Stdin, *format)
+	}
+
+	for _, name := range files {
+		var n int64
+		if n, err = importFile(db, name, *format); err != nil {
+			err = fmt.Errorf("%s: %s", name, err)
+			break
+		}
+
+		total += n
+	}
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("imported", total, "points")
+}
+
+// importFile imports all points in the file to the database
+func importFile(db *kadiyadb.DB, name, format string) (n int64, err error) {
+	var r io.ReadCloser
+	if r, err = os.Open(name); err != nil {
+		return 0, err
+	}
+
+	defer r.Close()
+
+	return db.Import(r, format)
+}
@@ -0,0 +1,110 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+var (
+	// ErrConvert is returned when a database cannot be converted with given
+	// params. Old and new resolutions must be multiples of each other.
+	ErrConvert = errors.New("incompatible resolution for conversion")
+)
+
+// Convert copies all data from the src database to the dst database which
+// can have a different resolution and epoch duration. When the resolution
+// of dst is lower, points are aggregated. When it's higher, each point goes
+// to the first dst point in its time range (values are not interpolated).
+// Data in dst is added to existing values so dst should be a new database.
+func Convert(src, dst *DB) (err error) {
+	sr := src.params.Resolution
+	dr := dst.params.Resolution
+	if sr%dr != 0 && dr%sr != 0 {
+		return ErrConvert
+	}
+
+	epochs, err := src.epochs()
+	if err != nil {
+		return err
+	}
+
+	for _, ets := range epochs {
+		if err := src.convert(ets, dst); err != nil {
+			return err
+		}
+	}
+
+	return dst.Sync()
+}
+
+// convert copies all records of the epoch starting at ets to dst database
+func (d *DB) convert(ets int64, dst *DB) (err error) {
+	e, err := d.cache.LoadRO(ets)
+	if err != nil {
+		return err
+	}
+
+	defer e.Release()
+
+	points, nodes, err := e.FetchAll(context.Background(), 0, d.rsize)
+	if err != nil {
+		return err
+	}
+
+	for i, node := range nodes {
+		for j, p := range points[i] {
+			if p.Total == 0 && p.Count == 0 {
+				continue
+			}
+
+			ts := uint64(ets + int64(j)*d.params.Resolution)
+			if err := dst.trackExact(ts, node.Fields, p.Total, p.Count); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// epochs returns start times of all epochs stored in the database directory
+// and storage tiers (if any) in ascending order.
+func (d *DB) epochs() (epochs []int64, err error) {
+	dirs := append([]string{d.dir}, d.params.Tiers...)
+	seen := map[int64]bool{}
+
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if !file.IsDir() {
+				continue
+			}
+
+			ets, err := strconv.ParseInt(file.Name(), 10, 64)
+			if err != nil || seen[ets] {
+				continue
+			}
+
+			seen[ets] = true
+			epochs = append(epochs, ets)
+		}
+	}
+
+	sort.Sort(int64s(epochs))
+
+	return epochs, nil
+}
+
+// int64s sorts int64 values in ascending order
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
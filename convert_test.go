@@ -0,0 +1,109 @@
+package kadiyadb
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestConvert(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	srcdir := path.Join(dir, "src")
+	dstdir := path.Join(dir, "dst")
+
+	for _, d := range []string{srcdir, dstdir} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sp := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	dp := &Params{
+		Duration:    7200000000000,
+		Retention:   36000000000000,
+		Resolution:  120000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	src, err := Open(srcdir, sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(dstdir, dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+
+	// points in two source epochs which go to the same dst epoch
+	tss := []uint64{0, uint64(sp.Resolution), uint64(sp.Duration)}
+	for _, ts := range tss {
+		if err := src.Track(ts, fields, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := src.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Convert(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	to := uint64(sp.Duration + dp.Resolution)
+	offset := int((sp.Duration) / dp.Resolution)
+	expected := make([]protocol.Point, offset+1)
+	expected[0] = protocol.Point{Total: 2, Count: 2}
+	expected[offset] = protocol.Point{Total: 1, Count: 1}
+
+	// parent series should not be counted twice
+	for _, f := range [][]string{fields, fields[:1]} {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		dst.Fetch(0, to, f, func(res []*protocol.Chunk, err error) {
+			defer wg.Done()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || len(res[0].Series) != 1 {
+				t.Fatal("wrong result")
+			}
+
+			if !reflect.DeepEqual(res[0].Series[0].Points, expected) {
+				t.Fatal("wrong points", f, res[0].Series[0].Points)
+			}
+		})
+
+		wg.Wait()
+	}
+
+	dp.Resolution = 90000000000
+	if err := Convert(src, dst); err != ErrConvert {
+		t.Fatal("should return error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
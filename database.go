@@ -1,15 +1,25 @@
 package kadiyadb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/block"
 	"github.com/kadirahq/kadiyadb/epoch"
+	"github.com/kadirahq/kadiyadb/index"
 )
 
 const (
@@ -24,25 +34,135 @@ const (
 	//     "resolution": "1m",
 	//     "retention": "24h",
 	//     "maxROEpochs": 12,
-	//     "maxRWEpochs": 2
+	//     "maxRWEpochs": 2,
+	//     "maxMemory": 4294967296,
+	//     "tiers": ["/mnt/hdd/db"],
+	//     "fetchTimeout": "30s",
+	//     "maxSeries": 100000,
+	//     "rollups": [
+	//       {"duration": "24h", "resolution": "1h", "retention": "720h"}
+	//     ],
+	//     "queries": [
+	//       {"fields": ["cpu", "*"], "target": ["cpu_all"], "func": "sum"}
+	//     ],
+	//     "compact": true,
+	//     "coldAfter": "720h",
+	//     "archivePath": "/mnt/archive/db",
+	//     "verifyEpochs": true,
+	//     "durable": true,
+	//     "warmEpochs": 2,
+	//     "copyResults": false,
+	//     "pointType": "counter",
+	//     "buckets": [10, 50, 100, 500, 1000],
+	//     "lateWindow": "6h",
+	//     "blockSegmentSize": 209715200,
+	//     "indexSegmentSize": 20971520,
+	//     "storage": "mmap",
+	//     "dedupWindow": 1024,
+	//     "maxPointsPerSec": 100000,
+	//     "maxDiskBytes": 107374182400,
+	//     "minFreeDiskBytes": 1073741824,
+	//     "retentionBytes": 53687091200,
+	//     "minMax": true,
+	//     "leafOnly": false,
+	//     "aggregateLevels": "all",
+	//     "checkpointInterval": "10m",
+	//     "snapshotDepth": 1,
+	//     "maxIndexMemory": 104857600,
+	//     "maintainInterval": "1m"
 	//   }
 	//
+	// Max memory is optional and limits the total size of loaded epochs.
+	// Tiers are optional slower data directories used to store older epochs.
+	// The fetch timeout is optional and fetch requests never time out if not set.
+	// Max series is optional and limits the number of unique series per epoch.
+	// Rollups are optional and epochs are rolled up when they are no longer
+	// writable. Rollup resolution and duration must be multiples of db values
+	// and the rollup resolution must also divide the database duration.
+	// Queries are optional and their func can be "sum" (default), "min" or "max".
+	// Query targets must not match their fields (results would be included).
+	// Compaction is optional and runs on epochs after they are rolled up.
+	// Epochs older than coldAfter are offloaded if an object store is set.
+	// Expired epochs are moved to the archive path instead of removing if set.
+	// Epoch checksums are verified when loading epochs if verifyEpochs is set.
+	// Durable mode discards writes which were not synced after a crash.
+	// The most recent warmEpochs epochs are loaded when opening the database.
+	// Fetch results are copied and can be used later if copyResults is set.
+	// Point type can be "counter" (default), "gauge" ("set"), "max" or "min".
+	// Buckets are optional increasing upper bounds of histogram buckets.
+	// Closed epochs are processed after the late window if it's set.
+	// Segment sizes are optional and only used when creating new epochs.
+	// Storage can be "mmap" (default) or "file" (see StorageFile).
+	// Dedup window is the number of sequence numbers remembered per source.
+	// Writes fail when point rate or disk usage quotas are exceeded if set.
+	// Writes also fail when free disk space is below minFreeDiskBytes if set.
+	// Oldest epochs are removed early when files are over retentionBytes.
+	// Min and max values of points are also stored if minMax is set.
+	// Parent series are calculated when fetching data if leafOnly is set.
+	// Aggregate levels can be "all" (default), "none" or field counts ([1, 3]).
+	// Index checkpoints of read-write epochs are written periodically if set.
+	// Snapshot depth is the number of index levels used to split snapshots.
+	// Index branches of read-only epochs are unloaded over maxIndexMemory.
+	// Background jobs (ex: retention) run every maintainInterval (1m default).
+	// Durations can also be integers in nanoseconds (ex: 3600000000000).
 	paramfile = "params.json"
+
+	// colddir is the directory inside the database directory where epochs
+	// downloaded from the object store are kept. It can be safely removed.
+	colddir = ".cold"
+)
+
+const (
+	// StorageMmap memory maps block files of read-write epochs (default).
+	StorageMmap = "mmap"
+
+	// StorageFile uses file reads and writes for blocks of read-write epochs.
+	// Memory mapped pages are accounted as used memory in some environments
+	// (ex: containers with memory cgroups) and this storage avoids that.
+	StorageFile = "file"
 )
 
 var (
-	// ErrInvParams is returned when the db params are invalid
+	// ErrInvParams is returned when the db params are invalid. Validation
+	// errors are ParamError values which match this error with errors.Is.
 	ErrInvParams = errors.New("invalid database parameters")
 
 	// ErrInvTime is returned when the timestamp is invalid
 	ErrInvTime = errors.New("invalid timestamp")
+
+	// ErrExists is returned when creating a database which already exists
+	ErrExists = errors.New("database already exists")
 )
 
 // Handler is a function which is called with Fetch result
 // The data returned here is only valid inside this function
-// For extended use of results, a copy of the data must be made.
+// For extended use of results, a copy of the data must be made
+// with CloneChunk or by setting the CopyResults param.
 type Handler func(result []*protocol.Chunk, err error)
 
+// CloneChunk returns a deep copy of the chunk which does not use any memory
+// of database epochs. The copy can be used after the handler returns.
+func CloneChunk(c *protocol.Chunk) (clone *protocol.Chunk) {
+	if c == nil {
+		return nil
+	}
+
+	clone = &protocol.Chunk{
+		From:   c.From,
+		To:     c.To,
+		Series: make([]*protocol.Series, len(c.Series)),
+	}
+
+	for i, s := range c.Series {
+		clone.Series[i] = &protocol.Series{
+			Fields: append([]string(nil), s.Fields...),
+			Points: append([]protocol.Point(nil), s.Points...),
+		}
+	}
+
+	return clone
+}
+
 // Params is used when creating a new database
 type Params struct {
 	DurationStr   string `json:"duration"`
@@ -51,216 +171,1732 @@ type Params struct {
 	Resolution    int64  `json:"-"`
 	RetentionStr  string `json:"retention"`
 	Retention     int64  `json:"-"`
-	MaxROEpochs   int64  `json:"maxROEpochs"`
-	MaxRWEpochs   int64  `json:"maxRWEpochs"`
+	MaxROEpochs   int64  `json:"maxROEpochs,omitempty"`
+	MaxRWEpochs   int64  `json:"maxRWEpochs,omitempty"`
+
+	// MaxMemory is the maximum total size of loaded epoch files in bytes.
+	// Epoch count limits are optional (zero means no limit) when it's set.
+	MaxMemory int64 `json:"maxMemory,omitempty"`
+
+	// Tiers can be used to move older epochs to slower (cheaper) storage
+	// devices. New epochs are always created in the database directory and
+	// closed epochs are moved to the last tier automatically (see Migrate).
+	Tiers []string `json:"tiers,omitempty"`
+
+	// FetchTimeout is the maximum time a fetch request can run before it
+	// fails with a context.DeadlineExceeded error. Zero means no timeout.
+	FetchTimeoutStr string `json:"fetchTimeout,omitempty"`
+	FetchTimeout    int64  `json:"-"`
+
+	// MaxSeries is the maximum number of unique series (field combinations)
+	// allowed in an epoch. Track fails when the limit is exceeded.
+	MaxSeries int64 `json:"maxSeries,omitempty"`
+
+	// Rollups are lower resolution companion databases which keep aggregated
+	// data for longer. Fetch uses them when raw data is no longer available.
+	Rollups []*Params `json:"rollups,omitempty"`
+
+	// Queries are continuous queries which are evaluated as points complete.
+	// Results are written to derived series in the same database.
+	Queries []*Query `json:"queries,omitempty"`
+
+	// Compact enables compacting epochs once they are closed. Compaction
+	// removes empty records and rebuilds the index snapshot for the epoch.
+	Compact bool `json:"compact,omitempty"`
+
+	// Store is an object store (ex: S3) used to keep epochs older than
+	// ColdAfter. It must be set in code as it cannot be set with JSON.
+	// Epochs are downloaded from the store when they are requested.
+	Store        epoch.ObjectStore `json:"-"`
+	ColdAfterStr string            `json:"coldAfter,omitempty"`
+	ColdAfter    int64             `json:"-"`
+
+	// ArchivePath is a directory where expired epochs are moved instead
+	// of removing them permanently. Use Unarchive to bring them back.
+	ArchivePath string `json:"archivePath,omitempty"`
+
+	// VerifyEpochs enables verifying checksums of epoch files when they are
+	// loaded for reading. Corrupted epochs fail with epoch.ErrCorrupt.
+	VerifyEpochs bool `json:"verifyEpochs,omitempty"`
+
+	// Durable makes Sync write a sync marker after syncing block and index
+	// files. After a crash, index nodes written after the last marker are
+	// discarded so they never point at block records which were not synced.
+	Durable bool `json:"durable,omitempty"`
+
+	// WarmEpochs is the number of most recent epochs loaded when opening
+	// the database to avoid slow first requests. Use Pin to keep epochs
+	// loaded regardless of cache limits.
+	WarmEpochs int64 `json:"warmEpochs,omitempty"`
+
+	// CopyResults makes fetch functions copy points to new memory instead of
+	// using memory mapped epoch files. Results can be used after handlers
+	// return and epochs are released sooner but fetching uses more memory.
+	CopyResults bool `json:"copyResults,omitempty"`
+
+	// PointType defines how tracked values are combined with existing values
+	// of a point and how points are aggregated when rolling up. Counters add
+	// values, gauges keep the last value and max/min keep the largest or the
+	// smallest total. Rollup levels always use the point type of the parent.
+	PointTypeStr string          `json:"pointType,omitempty"`
+	PointType    block.PointType `json:"-"`
+
+	// Buckets are upper bounds of histogram buckets in increasing order.
+	// They're required to use TrackHistogram and FetchPercentiles and the
+	// point type must be counter as bucket series count values.
+	Buckets []float64 `json:"buckets,omitempty"`
+
+	// LateWindow is the time epochs stay open for late points after they
+	// leave the read-write window. Epochs are rolled up and compacted after
+	// that. Late points written to epochs which are already rolled up are
+	// also added to rollup levels directly so they're never lost.
+	LateWindowStr string `json:"lateWindow,omitempty"`
+	LateWindow    int64  `json:"-"`
+
+	// BlockSegmentSize and IndexSegmentSize are sizes of segment files in
+	// bytes. Small databases can use smaller segments to save disk space.
+	// Changes only affect new epochs. Zero means default sizes.
+	BlockSegmentSize int64 `json:"blockSegmentSize,omitempty"`
+	IndexSegmentSize int64 `json:"indexSegmentSize,omitempty"`
+
+	// Storage selects how blocks of read-write epochs access their files.
+	// Files are the same for all storage types and it can be changed.
+	Storage string `json:"storage,omitempty"`
+
+	// DedupWindow is the number of recent sequence numbers remembered for
+	// each source to detect retried writes (see TrackSeq). Default is 1024.
+	DedupWindow int64 `json:"dedupWindow,omitempty"`
+
+	// MaxPointsPerSec limits the number of points tracked each second and
+	// MaxDiskBytes limits the size of database files. Track fails with
+	// ErrRateLimit or ErrDiskQuota when these are exceeded (see Usage).
+	// Disk usage is updated when background jobs run (every minute).
+	MaxPointsPerSec int64 `json:"maxPointsPerSec,omitempty"`
+	MaxDiskBytes    int64 `json:"maxDiskBytes,omitempty"`
+
+	// MinFreeDiskBytes makes Track fail with ErrLowDisk when the file system
+	// of the database has less free space than this (low disk watermark) so
+	// writes are rejected before segment files fail to grow. Free space is
+	// checked when background jobs run. It's only checked on linux.
+	MinFreeDiskBytes int64 `json:"minFreeDiskBytes,omitempty"`
+
+	// RetentionBytes removes the oldest epochs before the end of the retention
+	// period when database files are larger than this. Epochs which can be
+	// written (see MaxRWEpochs) are never removed early therefore files can
+	// still be larger. Disk usage is checked when background jobs run.
+	// Files of rollup levels are not counted as they are not removed early
+	// unless RetentionBytes is also set for the rollup level.
+	RetentionBytes int64 `json:"retentionBytes,omitempty"`
+
+	// MinMax enables storing the smallest and the largest value tracked to
+	// each point in separate databases inside the database directory.
+	// These values can be fetched with FetchMinMax. Rollups do not have them.
+	MinMax bool `json:"minMax,omitempty"`
+
+	// LeafOnly makes Track write only to the series with given fields instead
+	// of writing to all parent series one at a time. A crash while tracking
+	// can not leave parent series inconsistent with child series as parent
+	// series are calculated by merging child series when they're fetched.
+	// This makes fetching parent series slower. It must be set when creating
+	// the database. FetchPage, FetchLabels, Count and Exists use stored series.
+	LeafOnly bool `json:"leafOnly,omitempty"`
+
+	// AggregateLevels selects parent series written by Track in addition to
+	// the series with given fields (ex: [1, 3] writes fields[:1] and
+	// fields[:3]). All parent series are written if it's nil. In params
+	// files it can also be "all" or "none" (same as setting LeafOnly).
+	// Parent series which are not written are calculated when fetching
+	// them like with LeafOnly. It must be set when creating the database.
+	AggregateLevelsRaw json.RawMessage `json:"aggregateLevels,omitempty"`
+	AggregateLevels    []int           `json:"-"`
+
+	// CheckpointInterval is the time between index checkpoints of read-write
+	// epochs. Only index nodes added after the last checkpoint are read from
+	// index logs when a closed epoch is loaded for the first time. Large
+	// epochs load faster but checkpoints use extra disk space while epochs
+	// are writable. Checkpoints are written by background jobs if it's set.
+	CheckpointIntervalStr string `json:"checkpointInterval,omitempty"`
+	CheckpointInterval    int64  `json:"-"`
+
+	// SnapshotDepth is the number of index tree levels used to split index
+	// snapshots into branches which are loaded when they're queried. When
+	// a single first level value has most series, a higher depth can be
+	// used to load only the part of that branch used by queries. Changes
+	// only affect epochs written after the change. Default is 1.
+	SnapshotDepth int `json:"snapshotDepth,omitempty"`
+
+	// MaxIndexMemory limits the size of index snapshot branches loaded by
+	// each read-only epoch. Least recently used branches are unloaded when
+	// it's exceeded. Sizes are measured using snapshot files therefore the
+	// memory used by loaded branches is higher. Zero means no limit.
+	// SetMaxIndexMemory can be used to set a limit for all databases.
+	MaxIndexMemory int64 `json:"maxIndexMemory,omitempty"`
+
+	// MaintainInterval is the time between background job runs which remove
+	// expired epochs, process closed epochs and check disk usage. Retention
+	// can also be applied immediately with Expire. Default is 1 minute.
+	MaintainIntervalStr string `json:"maintainInterval,omitempty"`
+	MaintainInterval    int64  `json:"-"`
 }
 
 // DB is a database
 type DB struct {
-	params *Params
-	cache  *epoch.Cache
-	rsize  int64
+	params  *Params
+	cache   *epoch.Cache
+	rsize   int64
+	dir     string
+	rollups []*DB
+	closed  chan struct{}
+
+	// closer makes sure the database is closed only once
+	closer *sync.Once
+
+	// jobs tracks background jobs (maintenance and queries). Close waits
+	// for running jobs to finish before closing epochs used by them.
+	jobs *sync.WaitGroup
+
+	// dedup has recent sequence numbers of writes made with TrackSeq
+	dedup *dedup
+
+	// quota has usage counters used to enforce quotas (see Usage)
+	quota *quota
+
+	// minDB and maxDB store min/max values of points if MinMax is set
+	minDB *DB
+	maxDB *DB
+
+	// lastCheckpoint is the time index checkpoints were last written
+	lastCheckpoint int64
+
+	// lastClosed is the start time of the last closed epoch processed by
+	// background jobs (see processClosed). It's -1 if none were processed.
+	lastClosed int64
+
+	// lastQueried is the end of points evaluated by continuous queries
+	// (see queryPending). Points are evaluated from the end in order.
+	lastQueried int64
+}
+
+// SetMaxIndexMemory limits the size of index snapshot branches loaded by all
+// read-only epochs of all databases (see Params.MaxIndexMemory).
+// Zero means no limit (default).
+func SetMaxIndexMemory(max int64) {
+	index.SetMaxTotalMemory(max)
 }
 
-// LoadAll loads all databases inside the path
+// LoadAll loads all databases inside the path. Databases which fail to load
+// are logged and skipped (see LoadAllErrors and LoadAllStrict).
 func LoadAll(dir string) (dbs map[string]*DB) {
-	dbs = map[string]*DB{}
+	dbs, errs, err := LoadAllErrors(dir)
+	if err != nil {
+		return nil
+	}
+
+	for name, err := range errs {
+		logError("open", path.Join(dir, name), err)
+	}
+
+	return dbs
+}
 
+// LoadAllErrors loads all databases inside the path and returns errors of
+// databases which failed to load by directory name. Directories without a
+// params file are not databases and they are skipped without an error.
+func LoadAllErrors(dir string) (dbs map[string]*DB, errs map[string]error, err error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return nil
+		return nil, nil, err
 	}
 
+	dbs = map[string]*DB{}
+	errs = map[string]error{}
+
 	for _, file := range files {
 		if !file.IsDir() {
 			continue
 		}
 
 		name := file.Name()
-		base := path.Join(dir, name)
-		file := path.Join(base, paramfile)
-		data, err := ioutil.ReadFile(file)
-		if err != nil {
+		db, err := OpenDir(path.Join(dir, name))
+		if os.IsNotExist(err) {
 			continue
-		}
-
-		params := &Params{}
-		if err := json.Unmarshal(data, params); err != nil {
-			fmt.Println("DB Error: params:", name, err)
+		} else if err != nil {
+			errs[name] = err
 			continue
 		}
 
-		if dur, err := time.ParseDuration(params.DurationStr); err != nil {
-			fmt.Println("DB Error: duration", name, params.DurationStr, err)
-			continue
-		} else {
-			params.Duration = int64(dur)
-		}
+		dbs[name] = db
+	}
 
-		if dur, err := time.ParseDuration(params.ResolutionStr); err != nil {
-			fmt.Println("DB Error: resolution", name, params.ResolutionStr, err)
-			continue
-		} else {
-			params.Resolution = int64(dur)
+	return dbs, errs, nil
+}
+
+// LoadAllStrict loads all databases inside the path and fails if any of them
+// cannot be loaded. Databases which were loaded are closed in that case.
+// The error names the first database (by directory name) which failed.
+func LoadAllStrict(dir string) (dbs map[string]*DB, err error) {
+	dbs, errs, err := LoadAllErrors(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(errs) == 0 {
+		return dbs, nil
+	}
+
+	for _, db := range dbs {
+		if err := db.Close(); err != nil {
+			logError("close", db.dir, err)
 		}
+	}
+
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return nil, fmt.Errorf("load %s: %w", names[0], errs[names[0]])
+}
+
+// OpenDir opens the database in given directory using its params file
+func OpenDir(dir string) (db *DB, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, paramfile))
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := ParseParams(data)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+
+	db, err = Open(dir, params)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+
+	return db, nil
+}
+
+// ParseParams parses the content of a params file (see paramfile)
+func ParseParams(data []byte) (p *Params, err error) {
+	p = &Params{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// durationParams are params file keys of duration params. Their values can
+// be duration strings ("1h") or integers in nanoseconds (older params files).
+var durationParams = []string{
+	"duration",
+	"resolution",
+	"retention",
+	"fetchTimeout",
+	"coldAfter",
+	"lateWindow",
+	"checkpointInterval",
+	"maintainInterval",
+}
+
+// UnmarshalJSON reads params from params files. Integer duration params are
+// converted to duration strings before parsing them (see durationParams).
+func (p *Params) UnmarshalJSON(data []byte) (err error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
 
-		if dur, err := time.ParseDuration(params.RetentionStr); err != nil {
-			fmt.Println("DB Error: retention", name, params.RetentionStr, err)
+	for _, key := range durationParams {
+		val, ok := raw[key]
+		if !ok {
 			continue
-		} else {
-			params.Retention = int64(dur)
 		}
 
-		db, err := Open(base, params)
-		if err != nil {
-			fmt.Println("DB Error: open:", name, err)
-			continue
+		if ns, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			raw[key], _ = json.Marshal(time.Duration(ns).String())
 		}
+	}
 
-		dbs[name] = db
+	if data, err = json.Marshal(raw); err != nil {
+		return err
 	}
 
-	return dbs
+	// params is used to avoid calling this method recursively
+	type params Params
+	return json.Unmarshal(data, (*params)(p))
 }
 
-// Open opens an existing database with given parameters
-func Open(dir string, p *Params) (db *DB, err error) {
-	if p == nil ||
-		p.Duration == 0 ||
-		p.Resolution == 0 ||
-		p.Retention == 0 ||
-		p.MaxROEpochs == 0 ||
-		p.MaxRWEpochs == 0 ||
-		p.Duration%p.Resolution != 0 ||
-		p.Retention%p.Duration != 0 {
+// Create creates a new database in given directory and opens it. Params are
+// written to the params file first so the database can be loaded later with
+// OpenDir or LoadAll. The params file is created exclusively therefore only
+// one of concurrent calls succeeds and others return ErrExists. Files created
+// by the call are removed if the database cannot be opened. Params which
+// cannot be stored in params files (ex: Store) are only used by the returned
+// database. Given params are not modified.
+func Create(dir string, p *Params) (db *DB, err error) {
+	if p == nil {
 		return nil, ErrInvParams
 	}
 
-	rsize := p.Duration / p.Resolution
-	cache := epoch.NewCache(p.MaxRWEpochs, p.MaxROEpochs, dir, rsize)
+	file := path.Join(dir, paramfile)
+	if _, err := os.Stat(file); err == nil {
+		return nil, ErrExists
+	}
 
-	db = &DB{
-		params: p,
-		cache:  cache,
-		rsize:  rsize,
+	p = p.copy()
+	p.format()
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	// names of files which existed before creating the database
+	// it's nil if the directory is created by this call
+	var existing map[string]bool
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		existing = map[string]bool{}
+		for _, f := range files {
+			existing[f.Name()] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := createParams(file, data); err != nil {
+		return nil, err
+	}
+
+	db, err = Open(dir, p)
+	if err != nil {
+		removeCreated(dir, existing)
+		return nil, err
 	}
 
 	return db, nil
 }
 
-// Track records a measurement with given total value and measurement count.
-// It uses the field combination and the timestamp to locate the data point.
-func (d *DB) Track(ts uint64, fields []string, total, count float64) (err error) {
-	ets, pos := d.split(ts)
+// copy returns a copy of params with copies of rollup level params
+func (p *Params) copy() (pc *Params) {
+	pc = new(Params)
+	*pc = *p
 
-	if ets < 0 {
-		return ErrInvTime
+	if p.Rollups != nil {
+		pc.Rollups = make([]*Params, len(p.Rollups))
+		for i, r := range p.Rollups {
+			if r != nil {
+				pc.Rollups[i] = r.copy()
+			}
+		}
 	}
 
-	e, err := d.cache.LoadRW(ets)
+	return pc
+}
+
+// createParams writes a params file to a temporary file first and links it
+// so the params file is never partially written. It fails with ErrExists if
+// the params file already exists.
+func createParams(file string, data []byte) (err error) {
+	f, err := ioutil.TempFile(path.Dir(file), path.Base(file)+".tmp")
 	if err != nil {
 		return err
 	}
 
-	err = e.Track(pos, fields, total, count)
-	if err != nil {
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// unlike renaming, linking fails if the file exists
+	if err := os.Link(tmp, file); os.IsExist(err) {
+		return ErrExists
+	} else if err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Fetch fetches data from database by given field pattern and timestamp range.
-// The handler function is called with the result and errors (if any).
-func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
-	if to < from {
-		fn(nil, ErrInvTime)
+// removeCreated removes files of the directory which are not in `existing`.
+// The directory is removed with all files if `existing` is nil.
+func removeCreated(dir string, existing map[string]bool) {
+	if existing == nil {
+		os.RemoveAll(dir)
 		return
 	}
 
-	ets0, pos0 := d.split(from)
-	ets1, pos1 := d.split(to)
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if !existing[f.Name()] {
+			os.RemoveAll(path.Join(dir, f.Name()))
+		}
+	}
+}
 
-	if pos1 == 0 {
-		ets1 -= d.params.Duration
-		pos1 = d.rsize
+// format sets string params (used in params files) from parsed values if they
+// are not set. It's the reverse of parse for params created in code.
+func (p *Params) format() {
+	durations := []struct {
+		str *string
+		val int64
+	}{
+		{&p.DurationStr, p.Duration},
+		{&p.ResolutionStr, p.Resolution},
+		{&p.RetentionStr, p.Retention},
+		{&p.FetchTimeoutStr, p.FetchTimeout},
+		{&p.ColdAfterStr, p.ColdAfter},
+		{&p.LateWindowStr, p.LateWindow},
+		{&p.CheckpointIntervalStr, p.CheckpointInterval},
+		{&p.MaintainIntervalStr, p.MaintainInterval},
 	}
 
-	// check timestamp bounds
-	if ets0 < 0 || ets1 < 0 {
-		fn(nil, ErrInvTime)
-		return
+	for _, d := range durations {
+		if *d.str == "" && d.val != 0 {
+			*d.str = time.Duration(d.val).String()
+		}
 	}
 
-	// no points in given time range
-	if ets0 == ets1 && pos0 == pos1 {
-		fn([]*protocol.Chunk{}, nil)
-		return
+	if p.PointTypeStr == "" && p.PointType != block.Counter {
+		p.PointTypeStr = p.PointType.String()
 	}
 
-	nchunks := (ets1-ets0)/d.params.Duration + 1
-	chunks := make([]*protocol.Chunk, 0, nchunks)
+	if p.AggregateLevelsRaw == nil && p.AggregateLevels != nil {
+		if data, err := json.Marshal(p.AggregateLevels); err == nil {
+			p.AggregateLevelsRaw = data
+		}
+	}
 
-	for ets := ets0; ets <= ets1; ets += d.params.Duration {
-		var start int64
-		end := d.rsize
+	for _, r := range p.Rollups {
+		if r != nil {
+			r.format()
+		}
+	}
+}
 
-		if ets == ets0 {
-			start = pos0
+// parse parses duration strings in params and params of rollup levels
+func (p *Params) parse() (err error) {
+	if dur, err := time.ParseDuration(p.DurationStr); err != nil {
+		return fmt.Errorf("duration %s %s", p.DurationStr, err)
+	} else {
+		p.Duration = int64(dur)
+	}
+
+	if dur, err := time.ParseDuration(p.ResolutionStr); err != nil {
+		return fmt.Errorf("resolution %s %s", p.ResolutionStr, err)
+	} else {
+		p.Resolution = int64(dur)
+	}
+
+	if dur, err := time.ParseDuration(p.RetentionStr); err != nil {
+		return fmt.Errorf("retention %s %s", p.RetentionStr, err)
+	} else {
+		p.Retention = int64(dur)
+	}
+
+	if p.FetchTimeoutStr != "" {
+		if dur, err := time.ParseDuration(p.FetchTimeoutStr); err != nil {
+			return fmt.Errorf("fetch timeout %s %s", p.FetchTimeoutStr, err)
+		} else {
+			p.FetchTimeout = int64(dur)
 		}
+	}
 
-		if ets == ets1 {
-			end = pos1
+	if p.ColdAfterStr != "" {
+		if dur, err := time.ParseDuration(p.ColdAfterStr); err != nil {
+			return fmt.Errorf("cold after %s %s", p.ColdAfterStr, err)
+		} else {
+			p.ColdAfter = int64(dur)
 		}
+	}
 
-		e, err := d.cache.LoadRO(ets)
-		if err != nil {
-			fn(nil, err)
-			return
+	if t, err := block.ParsePointType(p.PointTypeStr); err != nil {
+		return fmt.Errorf("point type %s %s", p.PointTypeStr, err)
+	} else {
+		p.PointType = t
+	}
+
+	if p.LateWindowStr != "" {
+		if dur, err := time.ParseDuration(p.LateWindowStr); err != nil {
+			return fmt.Errorf("late window %s %s", p.LateWindowStr, err)
+		} else {
+			p.LateWindow = int64(dur)
 		}
+	}
 
-		// epochs are RLocked to make sure they are not closed while in use
-		// memory locations of Points are valid only when epochs are available
-		// epoch read locks are unlocked after running the handler function
-		e.RLock()
-		defer e.RUnlock()
+	if p.CheckpointIntervalStr != "" {
+		if dur, err := time.ParseDuration(p.CheckpointIntervalStr); err != nil {
+			return fmt.Errorf("checkpoint interval %s %s", p.CheckpointIntervalStr, err)
+		} else {
+			p.CheckpointInterval = int64(dur)
+		}
+	}
 
-		points, nodes, err := e.Fetch(start, end, fields)
-		if err != nil {
-			fn(nil, err)
-			return
+	if p.MaintainIntervalStr != "" {
+		if dur, err := time.ParseDuration(p.MaintainIntervalStr); err != nil {
+			return fmt.Errorf("maintain interval %s %s", p.MaintainIntervalStr, err)
+		} else {
+			p.MaintainInterval = int64(dur)
 		}
+	}
 
-		count := len(points)
-		series := make([]*protocol.Series, count)
+	if len(p.AggregateLevelsRaw) != 0 {
+		if levels, none, err := parseLevels(p.AggregateLevelsRaw); err != nil {
+			return fmt.Errorf("aggregate levels %s %s", p.AggregateLevelsRaw, err)
+		} else {
+			p.AggregateLevels = levels
+			p.LeafOnly = p.LeafOnly || none
+		}
+	}
 
-		for i := 0; i < count; i++ {
-			series[i] = &protocol.Series{
-				Fields: nodes[i].Fields,
-				Points: points[i],
-			}
+	for _, r := range p.Rollups {
+		if r == nil {
+			return ErrInvRollup
 		}
 
-		chunk := &protocol.Chunk{
-			From:   uint64(ets + start*d.params.Resolution),
-			To:     uint64(ets + end*d.params.Resolution),
-			Series: series,
+		if err := r.parse(); err != nil {
+			return fmt.Errorf("rollup %s", err)
 		}
+	}
 
-		chunks = append(chunks, chunk)
+	return nil
+}
+
+// validBuckets checks whether histogram buckets are valid for the database
+func validBuckets(p *Params) bool {
+	if len(p.Buckets) == 0 {
+		return true
 	}
 
-	fn(chunks, nil)
-	return
+	if p.PointType != block.Counter {
+		return false
+	}
+
+	for i, b := range p.Buckets {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= p.Buckets[i-1]) {
+			return false
+		}
+	}
+
+	return true
 }
 
-// Sync flushes pending writes to the filesystem
-func (d *DB) Sync() (err error) {
-	if err := d.cache.Sync(); err != nil {
-		return err
+// parseLevels parses aggregate levels from params files. Levels can be "all",
+// "none" or a list of field counts. An empty list is the same as "none".
+func parseLevels(data json.RawMessage) (levels []int, none bool, err error) {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		switch name {
+		case "all":
+			return nil, false, nil
+		case "none":
+			return nil, true, nil
+		default:
+			return nil, false, ErrInvParams
+		}
 	}
 
-	return nil
+	if err := json.Unmarshal(data, &levels); err != nil {
+		return nil, false, err
+	}
+
+	if len(levels) == 0 {
+		return nil, true, nil
+	}
+
+	return levels, false, nil
+}
+
+// validLevels checks whether aggregate levels are increasing field counts
+func validLevels(levels []int) bool {
+	for i, l := range levels {
+		if l <= 0 || (i > 0 && l <= levels[i-1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParamError describes a param which does not satisfy a constraint. Err is
+// ErrInvParams or ErrInvRollup and errors.Is(err, Err) returns true.
+type ParamError struct {
+	Err        error
+	Param      string
+	Constraint string
+}
+
+func (e *ParamError) Error() string {
+	return e.Err.Error() + ": " + e.Param + " " + e.Constraint
+}
+
+// Is returns true if target is the error the ParamError belongs to
+func (e *ParamError) Is(target error) bool {
+	return target == e.Err
+}
+
+// invParams returns a ParamError with ErrInvParams for given param. The
+// constraint is formatted with given format and arguments.
+func invParams(param, format string, a ...interface{}) (err error) {
+	return &ParamError{Err: ErrInvParams, Param: param, Constraint: fmt.Sprintf(format, a...)}
+}
+
+// validate checks whether params can be used to open a database. The error
+// names the first invalid param and the constraint it does not satisfy.
+func (p *Params) validate() (err error) {
+	dur := time.Duration(p.Duration)
+	res := time.Duration(p.Resolution)
+	ret := time.Duration(p.Retention)
+
+	switch {
+	case p.Duration <= 0:
+		return invParams("duration", "%s must be positive", dur)
+	case p.Resolution <= 0:
+		return invParams("resolution", "%s must be positive", res)
+	case p.Retention <= 0:
+		return invParams("retention", "%s must be positive", ret)
+	case p.Duration%p.Resolution != 0:
+		return invParams("duration", "%s not a multiple of resolution %s", dur, res)
+	case p.Retention%p.Duration != 0:
+		return invParams("retention", "%s not a multiple of duration %s", ret, dur)
+	}
+
+	nonneg := []struct {
+		name string
+		val  int64
+	}{
+		{"maxROEpochs", p.MaxROEpochs},
+		{"maxRWEpochs", p.MaxRWEpochs},
+		{"maxMemory", p.MaxMemory},
+		{"maxSeries", p.MaxSeries},
+		{"warmEpochs", p.WarmEpochs},
+		{"snapshotDepth", int64(p.SnapshotDepth)},
+		{"maxIndexMemory", p.MaxIndexMemory},
+		{"dedupWindow", p.DedupWindow},
+		{"maxPointsPerSec", p.MaxPointsPerSec},
+		{"maxDiskBytes", p.MaxDiskBytes},
+		{"minFreeDiskBytes", p.MinFreeDiskBytes},
+		{"retentionBytes", p.RetentionBytes},
+		{"blockSegmentSize", p.BlockSegmentSize},
+		{"indexSegmentSize", p.IndexSegmentSize},
+	}
+
+	for _, f := range nonneg {
+		if f.val < 0 {
+			return invParams(f.name, "%d must not be negative", f.val)
+		}
+	}
+
+	durations := []struct {
+		name string
+		val  int64
+	}{
+		{"fetchTimeout", p.FetchTimeout},
+		{"coldAfter", p.ColdAfter},
+		{"lateWindow", p.LateWindow},
+		{"checkpointInterval", p.CheckpointInterval},
+		{"maintainInterval", p.MaintainInterval},
+	}
+
+	for _, f := range durations {
+		if f.val < 0 {
+			return invParams(f.name, "%s must not be negative", time.Duration(f.val))
+		}
+	}
+
+	if p.MaxMemory == 0 && (p.MaxROEpochs == 0 || p.MaxRWEpochs == 0) {
+		return invParams("maxROEpochs and maxRWEpochs", "are required without maxMemory")
+	}
+
+	if p.Storage != "" && p.Storage != StorageMmap && p.Storage != StorageFile {
+		return invParams("storage", "%q must be %q or %q", p.Storage, StorageMmap, StorageFile)
+	}
+
+	if !p.PointType.Valid() {
+		return invParams("pointType", "%d is not supported", p.PointType)
+	}
+
+	if !validBuckets(p) {
+		return invParams("buckets", "%v must be increasing and need the counter point type", p.Buckets)
+	}
+
+	if !validLevels(p.AggregateLevels) {
+		return invParams("aggregateLevels", "%v must be positive and increasing", p.AggregateLevels)
+	}
+
+	return nil
+}
+
+// Open opens an existing database with given parameters
+func Open(dir string, p *Params) (db *DB, err error) {
+	if p == nil {
+		return nil, ErrInvParams
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := migrate(dir); err != nil {
+		return nil, err
+	}
+
+	// epochs may have been replaced by compacted epochs when stopped
+	for _, root := range append([]string{dir}, p.Tiers...) {
+		if err := epoch.Recover(root); err != nil {
+			return nil, err
+		}
+	}
+
+	rsize := p.Duration / p.Resolution
+	cache := epoch.NewCache(&epoch.Options{
+		Path:        dir,
+		Tiers:       p.Tiers,
+		RecordSize:  rsize,
+		Resolution:  p.Resolution,
+		MaxROEpochs: p.MaxROEpochs,
+		MaxRWEpochs: p.MaxRWEpochs,
+		MaxMemory:   p.MaxMemory,
+		MaxSeries:   p.MaxSeries,
+		Store:       p.Store,
+		ColdPath:    path.Join(dir, colddir),
+		ArchivePath: p.ArchivePath,
+		Verify:      p.VerifyEpochs,
+		Durable:     p.Durable,
+		PointType:   p.PointType,
+
+		BlockSegmentSize: p.BlockSegmentSize,
+		IndexSegmentSize: p.IndexSegmentSize,
+		FileIO:           p.Storage == StorageFile,
+		SnapshotDepth:    p.SnapshotDepth,
+		MaxIndexMemory:   p.MaxIndexMemory,
+		Stored:           storedLevels(p),
+	})
+
+	var rollups []*DB
+	var minDB, maxDB *DB
+
+	// databases opened before an error are closed
+	defer func() {
+		if err != nil {
+			closeDBs(cache, append(rollups, minDB, maxDB)...)
+		}
+	}()
+
+	for _, q := range p.Queries {
+		if err := q.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rollups, err = openRollups(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	lastClosed, err := readClosed(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// continuous queries start with points which complete after opening
+	lastQueried, err := readEpochFile(path.Join(dir, queriedfile))
+	if err != nil {
+		return nil, err
+	} else if lastQueried < 0 {
+		lastQueried = p.Resolution * (time.Now().UnixNano() / p.Resolution)
+	}
+
+	if p.MinMax {
+		if minDB, maxDB, err = openExtrema(dir, p); err != nil {
+			return nil, err
+		}
+	}
+
+	db = &DB{
+		params:      p,
+		cache:       cache,
+		rsize:       rsize,
+		dir:         dir,
+		rollups:     rollups,
+		closed:      make(chan struct{}),
+		closer:      &sync.Once{},
+		jobs:        new(sync.WaitGroup),
+		dedup:       newDedup(p.DedupWindow),
+		quota:       &quota{freeDiskBytes: -1, mutex: &sync.Mutex{}},
+		minDB:       minDB,
+		maxDB:       maxDB,
+		lastClosed:  lastClosed,
+		lastQueried: lastQueried,
+	}
+
+	if _, err := db.updateDiskUsage(); err != nil {
+		return nil, err
+	}
+
+	if p.MinFreeDiskBytes > 0 {
+		if _, err := db.updateFreeDisk(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.WarmEpochs > 0 {
+		if err := db.warmUp(p.WarmEpochs); err != nil {
+			logError("warm up", dir, err)
+		}
+	}
+
+	setOpened(db, true)
+
+	db.jobs.Add(1)
+	go db.maintainLoop()
+
+	if len(p.Queries) > 0 {
+		db.jobs.Add(1)
+		go db.queryLoop()
+	}
+
+	return db, nil
+}
+
+// Track records a measurement with given total value and measurement count.
+// It uses the field combination and the timestamp to locate the data point.
+func (d *DB) Track(ts uint64, fields []string, total, count float64) (err error) {
+	return d.TrackContext(context.Background(), ts, fields, total, count)
+}
+
+// TrackContext is the same as Track but it will not write to the database if
+// the context gets cancelled before the write starts (e.g. while loading).
+// Once started, the write is not cancelled to keep all index levels valid.
+func (d *DB) TrackContext(ctx context.Context, ts uint64, fields []string, total, count float64) (err error) {
+	_, err = d.trackContext(ctx, ts, fields, total, count, nil)
+	return err
+}
+
+// trackContext is the same as TrackContext but `begin` is called (if it's not
+// nil) right before writing. The point is not written if it returns false and
+// `skipped` will be true. Errors returned before calling it mean that nothing
+// was written.
+func (d *DB) trackContext(ctx context.Context, ts uint64, fields []string, total, count float64, begin func() bool) (skipped bool, err error) {
+	start := time.Now()
+	defer func() { logRequest(ctx, "track", d.dir, start, err) }()
+
+	ets, _ := d.split(ts)
+
+	ctx, span := d.startSpan(ctx, "kadiyadb.track", ets)
+	defer func() { span.End(err) }()
+
+	if ets < 0 {
+		return false, ErrInvTime
+	}
+
+	done, err := d.checkQuota()
+	if err != nil {
+		return false, err
+	}
+
+	// failed and duplicate writes are not counted
+	defer func() { done(err == nil && !skipped) }()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	e, err := d.cache.LoadRW(ets)
+	if err != nil {
+		return false, err
+	}
+
+	defer e.Release()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if begin != nil && !begin() {
+		return true, nil
+	}
+
+	return false, d.trackEpoch(ctx, e.Epoch, ts, fields, total, count)
+}
+
+// trackEpoch adds a measurement to the loaded epoch which contains given time.
+// Series are written depending on LeafOnly and AggregateLevels. Min/max values
+// are tracked as well and rollup levels are updated if the epoch is closed.
+func (d *DB) trackEpoch(ctx context.Context, e *epoch.Epoch, ts uint64, fields []string, total, count float64) (err error) {
+	ets, pos := d.split(ts)
+
+	if d.params.LeafOnly {
+		err = e.TrackExact(pos, fields, total, count)
+	} else if d.params.AggregateLevels != nil {
+		err = e.TrackLevels(pos, fields, d.params.AggregateLevels, total, count)
+	} else {
+		err = e.Track(pos, fields, total, count)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.trackMinMax(ctx, ts, fields, total, count); err != nil {
+		return err
+	}
+
+	// closed epochs are already rolled up therefore
+	// late points are added to rollup levels directly
+	if ets <= atomic.LoadInt64(&d.lastClosed) {
+		for _, r := range d.rollups {
+			if err := r.Track(ts, fields, total, count); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// trackExact is the same as Track but the measurement is only added to the
+// series with exact given fields and not to series with parent fields.
+func (d *DB) trackExact(ts uint64, fields []string, total, count float64) (err error) {
+	ets, pos := d.split(ts)
+
+	if ets < 0 {
+		return ErrInvTime
+	}
+
+	e, err := d.cache.LoadRW(ets)
+	if err != nil {
+		return err
+	}
+
+	defer e.Release()
+
+	return e.TrackExact(pos, fields, total, count)
+}
+
+// Fetch fetches data from database by given field pattern and timestamp range.
+// The handler function is called with the result and errors (if any).
+// Series in each chunk are sorted by their fields in lexicographic order
+// therefore results are the same for each call with the same data.
+func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
+	d.FetchContext(context.Background(), from, to, fields, fn)
+}
+
+// FetchContext is the same as Fetch but it stops fetching data when the
+// context gets cancelled. The context is checked before loading each epoch
+// and before reading each record. The handler is called with the ctx error.
+// If the database has a fetch timeout, it's applied to the given context.
+// If the data for the start time has been removed after the retention period
+// it's fetched from the rollup level with the highest available resolution.
+func (d *DB) FetchContext(ctx context.Context, from, to uint64, fields []string, fn Handler) {
+	l := d.level(from)
+	l.fetch(ctx, from, to, fn, l.fetchQuery(fields))
+}
+
+// FetchPage is the same as FetchContext but only a page of matching series
+// is included in the result. Series are ordered by the first epoch they
+// appear in and then by their record ID in that epoch. Offset and limit are
+// applied to series merged from all epochs and points are only read for
+// series in the page. Pages are stable while new series are added to the
+// last epoch in the range. Series added to earlier epochs move later series
+// to the next pages. A limit of zero or less includes all series after the
+// offset.
+func (d *DB) FetchPage(ctx context.Context, from, to uint64, fields []string, offset, limit int, fn Handler) {
+	page, err := d.page(ctx, from, to, fields, offset, limit)
+	if err != nil {
+		fn(nil, err)
+		return
+	}
+
+	d.fetch(ctx, from, to, fn, func(ctx context.Context, e *epoch.Epoch, start, end int64) ([][]protocol.Point, []*index.Node, error) {
+		nodes, err := e.Find(fields)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		selected := []*index.Node{}
+		for _, n := range nodes {
+			if page[strings.Join(n.Fields, "\x00")] {
+				selected = append(selected, n)
+			}
+		}
+
+		points, err := e.FetchNodes(ctx, start, end, selected)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return points, selected, nil
+	})
+}
+
+// page returns keys (joined fields) of matching series within the page.
+// Series are numbered in the order they first appear in epochs within the
+// range and by their record ID in each epoch. Points are not read.
+func (d *DB) page(ctx context.Context, from, to uint64, fields []string, offset, limit int) (page map[string]bool, err error) {
+	spans, err := d.spans(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	page = map[string]bool{}
+	seen := map[string]bool{}
+
+	for _, s := range spans {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		e, err := d.cache.LoadRO(s.ets)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes, err := e.Find(fields)
+		e.Release()
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Sort(byRecordID(nodes))
+
+		for _, n := range nodes {
+			key := strings.Join(n.Fields, "\x00")
+			if seen[key] {
+				continue
+			}
+
+			if i := len(seen); i >= offset && (limit <= 0 || i < offset+limit) {
+				page[key] = true
+			}
+
+			seen[key] = true
+		}
+	}
+
+	return page, nil
+}
+
+// byRecordID sorts index nodes by their RecordID
+type byRecordID []*index.Node
+
+func (a byRecordID) Len() int           { return len(a) }
+func (a byRecordID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRecordID) Less(i, j int) bool { return a[i].RecordID < a[j].RecordID }
+
+// FetchLabels fetches data from database by given labels and timestamp range.
+// Labels are fields formatted as "key=value" which can be in any position.
+// Series which have all given labels are included in the result.
+func (d *DB) FetchLabels(ctx context.Context, from, to uint64, labels []string, fn Handler) {
+	d.fetch(ctx, from, to, fn, func(ctx context.Context, e *epoch.Epoch, start, end int64) ([][]protocol.Point, []*index.Node, error) {
+		return e.FetchLabels(ctx, start, end, labels)
+	})
+}
+
+// query reads points and index nodes from an epoch within the given range.
+type query func(ctx context.Context, e *epoch.Epoch, start, end int64) ([][]protocol.Point, []*index.Node, error)
+
+// span is the range of point positions to read from an epoch
+type span struct {
+	ets   int64
+	start int64
+	end   int64
+}
+
+// fetch runs the query on all epochs within the timestamp range and calls
+// the handler function with results collected from all epochs as chunks.
+func (d *DB) fetch(ctx context.Context, from, to uint64, fn Handler, q query) {
+	if RequestID(ctx) != "" {
+		start, handler := time.Now(), fn
+		fn = func(res []*protocol.Chunk, err error) {
+			logRequest(ctx, "fetch", d.dir, start, err)
+			handler(res, err)
+		}
+	}
+
+	if tracer != nil {
+		var span Span
+		handler := fn
+		ctx, span = d.startSpan(ctx, "kadiyadb.fetch", -1)
+		fn = func(res []*protocol.Chunk, err error) {
+			span.End(err)
+			handler(res, err)
+		}
+	}
+
+	if d.params.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		timeout := time.Duration(d.params.FetchTimeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	spans, err := d.spans(from, to)
+	if err != nil {
+		fn(nil, err)
+		return
+	}
+
+	chunks := make([]*protocol.Chunk, 0, len(spans))
+
+	for _, s := range spans {
+		if err := ctx.Err(); err != nil {
+			fn(nil, err)
+			return
+		}
+
+		e, err := d.cache.LoadRO(s.ets)
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		// epoch handles make sure that epochs are not closed while in use
+		// memory locations of Points are valid only when epochs are available
+		// epoch handles are released after running the handler function
+		// unless results are copied which do not use epoch memory at all.
+		chunk, err := d.chunk(ctx, e.Epoch, s, q)
+		if err == nil && d.params.CopyResults {
+			chunk = CloneChunk(chunk)
+			e.Release()
+		} else {
+			defer e.Release()
+		}
+
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	fn(chunks, nil)
+	return
+}
+
+// StreamHandler is a function which is called with each chunk of a streamed
+// fetch result in order. The chunk is only valid inside this function
+// unless the CopyResults param is set. Returning an error stops the stream
+// and FetchStream returns the error.
+type StreamHandler func(chunk *protocol.Chunk) (err error)
+
+// FetchStream is the same as FetchContext but the handler is called with each
+// chunk as soon as it's read instead of collecting all chunks first.
+// Only one epoch is kept locked at a time which bounds memory usage
+// and reduces the time to get first results on big queries.
+func (d *DB) FetchStream(ctx context.Context, from, to uint64, fields []string, fn StreamHandler) (err error) {
+	start := time.Now()
+	defer func() { logRequest(ctx, "fetch stream", d.dir, start, err) }()
+
+	ctx, span := d.startSpan(ctx, "kadiyadb.fetch", -1)
+	defer func() { span.End(err) }()
+
+	if d.params.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		timeout := time.Duration(d.params.FetchTimeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	spans, err := d.spans(from, to)
+	if err != nil {
+		return err
+	}
+
+	q := d.fetchQuery(fields)
+
+	for _, s := range spans {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e, err := d.cache.LoadRO(s.ets)
+		if err != nil {
+			return err
+		}
+
+		chunk, err := d.chunk(ctx, e.Epoch, s, q)
+		if err == nil && d.params.CopyResults {
+			chunk = CloneChunk(chunk)
+		}
+		if err == nil {
+			err = fn(chunk)
+		}
+		e.Release()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spans returns point position ranges to read from each epoch in order.
+// An empty slice is returned if there are no points in the time range.
+func (d *DB) spans(from, to uint64) (spans []span, err error) {
+	if to < from {
+		return nil, ErrInvTime
+	}
+
+	ets0, pos0 := d.split(from)
+	ets1, pos1 := d.split(to)
+
+	if pos1 == 0 {
+		ets1 -= d.params.Duration
+		pos1 = d.rsize
+	}
+
+	// check timestamp bounds
+	if ets0 < 0 || ets1 < 0 {
+		return nil, ErrInvTime
+	}
+
+	// no points in given time range
+	if ets0 == ets1 && pos0 == pos1 {
+		return []span{}, nil
+	}
+
+	nspans := (ets1-ets0)/d.params.Duration + 1
+	spans = make([]span, 0, nspans)
+
+	for ets := ets0; ets <= ets1; ets += d.params.Duration {
+		s := span{ets: ets, end: d.rsize}
+
+		if ets == ets0 {
+			s.start = pos0
+		}
+
+		if ets == ets1 {
+			s.end = pos1
+		}
+
+		spans = append(spans, s)
+	}
+
+	return spans, nil
+}
+
+// chunk runs the query on the epoch and creates a chunk with the result.
+// The epoch must be locked until the chunk is no longer used.
+func (d *DB) chunk(ctx context.Context, e *epoch.Epoch, s span, q query) (c *protocol.Chunk, err error) {
+	ctx, sp := d.startSpan(ctx, "kadiyadb.fetch_epoch", s.ets)
+	defer func() { sp.End(err) }()
+
+	points, nodes, err := q(ctx, e, s.start, s.end)
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(points)
+	series := make([]*protocol.Series, count)
+
+	for i := 0; i < count; i++ {
+		series[i] = &protocol.Series{
+			Fields: nodes[i].Fields,
+			Points: points[i],
+		}
+	}
+
+	c = &protocol.Chunk{
+		From:   uint64(s.ets + s.start*d.params.Resolution),
+		To:     uint64(s.ets + s.end*d.params.Resolution),
+		Series: series,
+	}
+
+	return c, nil
+}
+
+// Count returns the number of unique series which match given fields in
+// epochs within the timestamp range. Only the index is used to count series
+// therefore series without any measurements in the range are also counted.
+func (d *DB) Count(from, to uint64, fields []string) (n int64, err error) {
+	spans, err := d.spans(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := map[string]bool{}
+
+	for _, s := range spans {
+		e, err := d.cache.LoadRO(s.ets)
+		if err != nil {
+			return 0, err
+		}
+
+		nodes, err := e.Find(fields)
+		e.Release()
+
+		if err != nil {
+			return 0, err
+		}
+
+		for _, node := range nodes {
+			seen[strings.Join(node.Fields, "\x00")] = true
+		}
+	}
+
+	return int64(len(seen)), nil
+}
+
+// Exists checks whether any series which match given fields has at least one
+// measurement within the timestamp range. Stops reading at the first match.
+func (d *DB) Exists(ctx context.Context, from, to uint64, fields []string) (ok bool, err error) {
+	spans, err := d.spans(from, to)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range spans {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		e, err := d.cache.LoadRO(s.ets)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := e.Exists(ctx, s.start, s.end, fields)
+		e.Release()
+
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+// List returns distinct field value combinations under given prefix up to
+// given depth in the epoch which contains given timestamp. This can be used
+// to get available field values (ex: all hosts of an app) without points.
+func (d *DB) List(ts uint64, prefix []string, depth int) (values [][]string, err error) {
+	ets, _ := d.split(ts)
+
+	e, err := d.cache.LoadRO(ets)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.Release()
+
+	return e.List(prefix, depth)
+}
+
+// Cardinality returns the number of series under each value of the first field
+// in the epoch which contains given timestamp. This can be used to find which
+// value is creating too many series when the series limit is exceeded.
+func (d *DB) Cardinality(ts uint64) (c map[string]int64, err error) {
+	ets, _ := d.split(ts)
+
+	e, err := d.cache.LoadRO(ets)
+	if err != nil {
+		return nil, err
+	}
+
+	defer e.Release()
+
+	return e.Cardinality()
+}
+
+// Expire removes epochs which end before the retention period starts at
+// given time and oldest epochs if database files are over RetentionBytes.
+// Background jobs do the same periodically (see MaintainInterval) and this
+// can be used to apply retention immediately. Rollup levels and min/max
+// databases also remove their expired epochs.
+func (d *DB) Expire(ts uint64) (err error) {
+	now := int64(ts)
+	if err := d.expire(now); err != nil {
+		return err
+	}
+
+	if max := d.params.RetentionBytes; max > 0 {
+		if size, err := d.retainedSize(); err != nil {
+			return err
+		} else if size > max {
+			if err := d.expireSize(now); err != nil {
+				return err
+			}
+		}
+	}
+
+	dbs := d.rollups
+	if d.minDB != nil {
+		dbs = append(dbs[:len(dbs):len(dbs)], d.minDB, d.maxDB)
+	}
+
+	for _, r := range dbs {
+		if err := r.Expire(ts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Migrate moves epochs older than the epoch which contains given timestamp
+// to the slowest storage tier. Does nothing if tiers are not configured.
+func (d *DB) Migrate(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Migrate(ets)
+}
+
+// Compact compacts the epoch which contains given timestamp by removing empty
+// records and rebuilding its index. Epochs loaded in read-write mode are not
+// compacted. Closed epochs are compacted automatically if enabled in params.
+func (d *DB) Compact(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Compact(ets)
+}
+
+// Offload uploads epochs older than the epoch which contains given timestamp
+// to the object store and removes them locally. Does nothing without a store.
+// Epochs are offloaded automatically if the ColdAfter param is set.
+func (d *DB) Offload(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Offload(ets)
+}
+
+// Verify checks whether files of the epoch which contains given timestamp
+// match checksums written when the epoch was closed after writing.
+// Returns an epoch.ErrCorrupt error with the name of the corrupted file.
+func (d *DB) Verify(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Verify(ets)
+}
+
+// Inspect returns information about the epoch which contains given timestamp
+// such as record and index node counts read from epoch files on disk.
+func (d *DB) Inspect(ts uint64) (info *epoch.Info, err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Inspect(ets)
+}
+
+// Unarchive moves the archived epoch which contains given timestamp back to
+// the database directory. Returns epoch.ErrNoArchive if it's not archived.
+// Unarchived epochs are not expired until Archive is called for them.
+func (d *DB) Unarchive(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Restore(ets)
+}
+
+// Archive moves the epoch which contains given timestamp to the archive path.
+// Use this to archive epochs again after they are no longer needed.
+func (d *DB) Archive(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Archive(ets)
+}
+
+// Repair checks all epochs of the database and rollup databases for damage
+// caused by an unclean shutdown and repairs them. Epochs which are loaded in
+// read-write mode are skipped therefore this should be called before writing
+// to the database. Returns the number of epochs which had to be repaired.
+func (d *DB) Repair() (n int, err error) {
+	epochs, err := d.epochs()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, ets := range epochs {
+		repaired, err := d.cache.Repair(ets)
+		if err != nil {
+			return n, err
+		}
+
+		if repaired {
+			n++
+		}
+	}
+
+	for _, r := range d.rollups {
+		rn, err := r.Repair()
+		n += rn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Rename rewrites fields of all series which have the `from` pattern as a
+// prefix in all epochs of the database and rollup databases (see
+// index.Rename). Series keep their record IDs so their data is not lost.
+// Epochs loaded in read-write mode are skipped therefore this should be
+// called before writing to the database. Returns the number of renamed
+// series summed over all epochs.
+func (d *DB) Rename(from, to []string) (n int, err error) {
+	epochs, err := d.epochs()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, ets := range epochs {
+		en, err := d.cache.Rename(ets, from, to)
+		n += en
+		if err != nil {
+			return n, err
+		}
+	}
+
+	for _, r := range d.rollups {
+		rn, err := r.Rename(from, to)
+		n += rn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Pin loads the epoch which contains given timestamp and keeps it loaded
+// regardless of cache limits until Unpin is called with the same epoch.
+func (d *DB) Pin(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Pin(ets)
+}
+
+// Unpin allows the epoch which contains given timestamp to be closed
+// by the cache again. Does nothing if the epoch is not pinned.
+func (d *DB) Unpin(ts uint64) (err error) {
+	ets, _ := d.split(ts)
+	return d.cache.Unpin(ets)
+}
+
+// warmUp loads the most recent `n` epochs available on disk
+func (d *DB) warmUp(n int64) (err error) {
+	epochs, err := d.epochs()
+	if err != nil {
+		return err
+	}
+
+	if int64(len(epochs)) > n {
+		epochs = epochs[int64(len(epochs))-n:]
+	}
+
+	for _, ets := range epochs {
+		e, err := d.cache.LoadRO(ets)
+		if err != nil {
+			return err
+		}
+
+		if err := e.Release(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// offloads checks whether epochs should be offloaded automatically
+func (d *DB) offloads() bool {
+	return d.params.Store != nil && d.params.ColdAfter > 0
+}
+
+// CacheMetrics returns epoch cache counters for read-only and read-write
+// epochs. These can be used to choose MaxROEpochs and MaxRWEpochs values.
+func (d *DB) CacheMetrics() (ro, rw epoch.Metrics) {
+	return d.cache.Metrics()
+}
+
+// Stalls returns the number of write stalls grouped by the cause.
+// A write is considered stalled when it takes much longer than usual.
+func (d *DB) Stalls() (s epoch.Stalls) {
+	return d.cache.Stalls()
+}
+
+// Sync flushes pending writes to the filesystem. Rollup databases (which
+// get late points) and min/max databases are also synced.
+func (d *DB) Sync() (err error) {
+	if err := d.cache.Sync(); err != nil {
+		return err
+	}
+
+	dbs := d.rollups
+	if d.minDB != nil {
+		dbs = append(dbs[:len(dbs):len(dbs)], d.minDB, d.maxDB)
+	}
+
+	for _, r := range dbs {
+		if err := r.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops background jobs, waits for running jobs to finish and releases
+// resources. Rollup databases are also closed. The database should not be
+// used after closing. Everything is closed even if some of it fails and the
+// first error is returned. Closing the database again does nothing.
+func (d *DB) Close() (err error) {
+	d.closer.Do(func() {
+		close(d.closed)
+		d.jobs.Wait()
+
+		setOpened(d, false)
+
+		dbs := append(d.rollups[:len(d.rollups):len(d.rollups)], d.minDB, d.maxDB)
+		err = closeDBs(d.cache, dbs...)
+	})
+
+	return err
+}
+
+// closeDBs closes given databases (nil values are skipped) and the cache.
+// All of them are closed even if some fail and the first error is returned.
+func closeDBs(cache *epoch.Cache, dbs ...*DB) (err error) {
+	for _, db := range dbs {
+		if db == nil {
+			continue
+		}
+
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if cache != nil {
+		if e := cache.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 // split the time into epoch start time and point position
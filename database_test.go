@@ -1,13 +1,22 @@
 package kadiyadb
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/block"
 )
 
 const (
@@ -98,6 +107,291 @@ func TestLoadAll(t *testing.T) {
 	}
 }
 
+func TestLoadAllErrors(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"test1": `{"duration": "1h", "resolution": "1m", "retention": "24h", "maxROEpochs": 10, "maxRWEpochs": 3}`,
+		"test2": `{"duration": "1h", "resolution": "31m", "retention": "24h", "maxROEpochs": 10, "maxRWEpochs": 3}`,
+	}
+
+	for name, data := range files {
+		if err := os.MkdirAll(dir+"/"+name, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+name+"/params.json", []byte(data), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// directories without params are not databases
+	if err := os.MkdirAll(dir+"/test3", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs, errs, err := LoadAllErrors(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dbs) != 1 || dbs["test1"] == nil {
+		t.Fatal("wrong databases", dbs)
+	}
+
+	if len(errs) != 1 || !strings.Contains(fmt.Sprint(errs["test2"]), ErrInvParams.Error()) {
+		t.Fatal("wrong errors", errs)
+	}
+
+	if err := dbs["test1"].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var perr *ParamError
+	if _, err := OpenDir(dir + "/test2"); !errors.Is(err, ErrInvParams) {
+		t.Fatal("expected ErrInvParams", err)
+	} else if !strings.HasPrefix(err.Error(), "open "+dir+"/test2: ") {
+		t.Fatal("wrong error", err)
+	} else if !errors.As(err, &perr) || perr.Param != "duration" {
+		t.Fatal("expected a ParamError", err)
+	}
+
+	// errors of broken params files also name the directory
+	if err := os.MkdirAll(dir+"/test4", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/test4/params.json", []byte(`{"duration": `), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDir(dir + "/test4"); err == nil {
+		t.Fatal("should return error")
+	} else if !strings.HasPrefix(err.Error(), "open "+dir+"/test4: params: ") {
+		t.Fatal("wrong error", err)
+	}
+
+	if err := os.RemoveAll(dir + "/test4"); err != nil {
+		t.Fatal(err)
+	}
+
+	if dbs, err := LoadAllStrict(dir); err == nil || dbs != nil {
+		t.Fatal("strict load should fail", err)
+	} else if !strings.HasPrefix(err.Error(), "load test2: ") {
+		t.Fatal("wrong error", err)
+	} else if !errors.Is(err, ErrInvParams) || !errors.As(err, &perr) {
+		t.Fatal("expected a ParamError", err)
+	}
+
+	if err := os.RemoveAll(dir + "/test2"); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs, err = LoadAllStrict(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(dbs) != 1 {
+		t.Fatal("wrong databases", dbs)
+	}
+
+	if err := dbs["test1"].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:         3600000000000,
+		Retention:        36000000000000,
+		Resolution:       60000000000,
+		MaxROEpochs:      2,
+		MaxRWEpochs:      1,
+		PointType:        block.Max,
+		MaintainInterval: 30000000000,
+		AggregateLevels:  []int{1},
+		Rollups: []*Params{
+			{Duration: 3600000000000, Retention: 36000000000000, Resolution: 600000000000},
+		},
+	}
+
+	db, err := Create(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create(dir, p); err != ErrExists {
+		t.Fatal("expected ErrExists", err)
+	}
+
+	// params are formatted without modifying given params
+	if p.DurationStr != "" || p.PointTypeStr != "" || p.Rollups[0].ResolutionStr != "" {
+		t.Fatal("params should not be modified", p)
+	}
+
+	data, err := ioutil.ReadFile(dir + "/params.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ParseParams(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Duration != p.Duration ||
+		res.Resolution != p.Resolution ||
+		res.Retention != p.Retention ||
+		res.MaintainInterval != p.MaintainInterval ||
+		res.PointType != block.Max ||
+		!reflect.DeepEqual(res.AggregateLevels, []int{1}) ||
+		len(res.Rollups) != 1 ||
+		res.Rollups[0].Resolution != 600000000000 {
+		t.Fatal("wrong params", string(data))
+	}
+
+	db, err = OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// params files are not written for invalid params
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p = &Params{Duration: 3600000000000, Retention: 36000000000000, Resolution: 7000000000000}
+	if _, err := Create(dir, p); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if _, err := os.Stat(dir + "/params.json"); !os.IsNotExist(err) {
+		t.Fatal("params file should not exist", err)
+	}
+
+	// files are removed if the database cannot be opened
+	p = &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Rollups: []*Params{
+			{Duration: 3600000000000, Retention: 36000000000000, Resolution: 600000000000},
+			{Duration: 3600000000000, Retention: 36000000000000, Resolution: 420000000000},
+		},
+	}
+
+	if _, err := Create(dir, p); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("database directory should not exist", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateConcurrent(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	n := 8
+	dbs := make(chan *DB, n)
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			if db, err := Create(dir, p); err != nil {
+				errs <- err
+			} else {
+				dbs <- db
+			}
+		}()
+	}
+
+	for i := 0; i < n-1; i++ {
+		if err := <-errs; err != ErrExists {
+			t.Fatal("expected ErrExists", err)
+		}
+	}
+
+	if err := (<-dbs).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	data := []byte(`{
+		"duration": 3600000000000,
+		"resolution": "1m",
+		"retention": 86400000000000,
+		"maxROEpochs": 10,
+		"maxRWEpochs": 3,
+		"maintainInterval": "30s",
+		"rollups": [{"duration": 3600000000000, "resolution": "10m", "retention": "24h"}]
+	}`)
+
+	p, err := ParseParams(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Duration != 3600000000000 ||
+		p.Resolution != 60000000000 ||
+		p.Retention != 86400000000000 ||
+		p.MaintainInterval != 30000000000 ||
+		p.MaxROEpochs != 10 ||
+		len(p.Rollups) != 1 ||
+		p.Rollups[0].Duration != 3600000000000 ||
+		p.Rollups[0].Resolution != 600000000000 {
+		t.Fatal("wrong params", p)
+	}
+
+	if _, err := ParseParams([]byte(`{"duration": 1.5}`)); err == nil {
+		t.Fatal("should return error")
+	}
+
+	var serr *json.SyntaxError
+	if _, err := ParseParams([]byte(`{`)); !errors.As(err, &serr) {
+		t.Fatal("expected a json.SyntaxError", err)
+	}
+}
+
 func TestTrack(t *testing.T) {
 	if err := os.RemoveAll(dir); err != nil {
 		t.Fatal(err)
@@ -366,3 +660,1528 @@ func TestFetchMultiChunk(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFetchPage(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// "b" is in both epochs but with a different record id in each
+	tracks := []struct {
+		ts     uint64
+		fields []string
+	}{
+		{0, []string{"a"}},
+		{0, []string{"b"}},
+		{uint64(p.Duration), []string{"c"}},
+		{uint64(p.Duration), []string{"b"}},
+		{uint64(p.Duration), []string{"d"}},
+	}
+
+	for _, tr := range tracks {
+		if err := db.Track(tr.ts, tr.fields, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to := uint64(0), uint64(p.Duration+p.Resolution)
+	pages := [][]string{{"a", "b"}, {"c", "d"}, {}}
+
+	for i, exp := range pages {
+		got := []string{}
+		seen := map[string]bool{}
+
+		db.FetchPage(context.Background(), from, to, []string{"*"}, i*2, 2, func(res []*protocol.Chunk, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 2 {
+				t.Fatal("wrong chunks")
+			}
+
+			for _, c := range res {
+				for _, s := range c.Series {
+					if !seen[s.Fields[0]] {
+						seen[s.Fields[0]] = true
+						got = append(got, s.Fields[0])
+					}
+				}
+			}
+		})
+
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatal("wrong page", i, got)
+		}
+	}
+}
+
+func TestFetchStream(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b", "d"}
+
+	if err := db.Track(uint64(p.Duration-p.Resolution), fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(p.Duration), fields, 5, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	from := uint64(p.Duration - p.Resolution)
+	to := uint64(p.Duration + p.Resolution)
+	expected := [][]protocol.Point{{{5, 1}}, {{5, 2}}}
+	chunks := 0
+
+	err = db.FetchStream(context.Background(), from, to, fields, func(c *protocol.Chunk) error {
+		if len(c.Series) != 1 {
+			t.Fatal("wrong series count")
+		}
+
+		if !reflect.DeepEqual(c.Series[0].Points, expected[chunks]) {
+			t.Fatal("wrong points")
+		}
+
+		chunks++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks != 2 {
+		t.Fatal("wrong chunk count")
+	}
+
+	// errors returned by the handler should stop the stream
+	errStop := errors.New("stop")
+	chunks = 0
+
+	err = db.FetchStream(context.Background(), from, to, fields, func(c *protocol.Chunk) error {
+		chunks++
+		return errStop
+	})
+
+	if err != errStop || chunks != 1 {
+		t.Fatal("should stop the stream")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountExists(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same series in two epochs and another series in the second one
+	if err := db.Track(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(p.Duration), []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(p.Duration), []string{"a", "c"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, uint64(2*p.Duration), []string{"a", "*"}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal("wrong count", n)
+	}
+
+	ctx := context.Background()
+
+	if ok, err := db.Exists(ctx, 0, uint64(p.Resolution), []string{"a", "c"}); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("should not exist")
+	}
+
+	if ok, err := db.Exists(ctx, 0, uint64(2*p.Duration), []string{"a", "c"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("should exist")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		MinMax:      true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second rollup level is invalid
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 300000000000,
+			},
+		},
+	}
+
+	n := runtime.NumGoroutine()
+
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvRollup) {
+		t.Fatal("should return error", err)
+	}
+
+	// background jobs of opened rollup levels should stop
+	for i := 0; runtime.NumGoroutine() > n; i++ {
+		if i == 100 {
+			t.Fatal("databases should be closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+
+	if err := db.Track(0, fields, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(p.Resolution), fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(10*p.Resolution), fields, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.rollups[0]
+	to := uint64(2 * r.params.Resolution)
+	expected := []protocol.Point{{3, 2}, {3, 1}}
+
+	// parent series should not be counted twice
+	for _, f := range [][]string{fields, fields[:1]} {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		r.Fetch(0, to, f, func(res []*protocol.Chunk, err error) {
+			defer wg.Done()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || len(res[0].Series) != 1 {
+				t.Fatal("wrong result")
+			}
+
+			if !reflect.DeepEqual(res[0].Series[0].Points, expected) {
+				t.Fatal("wrong points", f, res[0].Series[0].Points)
+			}
+		})
+
+		wg.Wait()
+	}
+
+	// data at this time is older than the retention period of both
+	if db.level(0) != r {
+		t.Fatal("should use the rollup level")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Rollups[0].Resolution = 90000000000
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvRollup) {
+		t.Fatal("should return error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollupRecover(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ets := range []int64{0, p.Duration} {
+		if err := db.Track(uint64(ets), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second epoch stops after adding points to the rollup level
+	if err := db.Rollup(uint64(p.Duration)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.rollups[0]
+	if err := ioutil.WriteFile(path.Join(r.dir, rolledfile), []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(r.dir, rollingfile), []byte(fmt.Sprint(p.Duration)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Rollup(uint64(p.Duration)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(r.dir, rollingfile)); !os.IsNotExist(err) {
+		t.Fatal("rollup marker should be removed")
+	}
+
+	// points of the partially rolled up epoch should not be added twice
+	pos := p.Duration / r.params.Resolution
+	r.Fetch(0, uint64(r.params.Duration), []string{"a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		ps := res[0].Series[0].Points
+		if ps[0].Count != 1 || ps[pos].Count != 1 {
+			t.Fatal("wrong rollup points", ps[0], ps[pos])
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollupPointType(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		PointType:   block.Max,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+
+	if err := db.Track(0, fields, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(0, fields, 4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(p.Resolution), fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.rollups[0]
+	if r.params.PointType != block.Max {
+		t.Fatal("rollups should use the parent point type")
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	r.Fetch(0, uint64(r.params.Resolution), fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []protocol.Point{{4, 3}}
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			!reflect.DeepEqual(res[0].Series[0].Points, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	wg.Wait()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.PointType = block.PointType(-1)
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvParams) {
+		t.Fatal("should return error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageFile(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Storage:     StorageFile,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	if err := db.Track(0, fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(0, uint64(p.Resolution), fields, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []protocol.Point{{2, 1}}
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			!reflect.DeepEqual(res[0].Series[0].Points, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Storage = "disk"
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvParams) {
+		t.Fatal("should return error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunQueries(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Queries: []*Query{
+			{Fields: []string{"a", "*"}, Target: []string{"sum"}},
+			{Fields: []string{"a", "*"}, Target: []string{"max"}, Func: FuncMax},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b"}, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(0, []string{"a", "c"}, 6, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	to := uint64(2 * p.Resolution)
+	if err := db.RunQueries(0, to); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]protocol.Point{
+		"sum": {{10, 3}, {0, 0}},
+		"max": {{6, 1}, {0, 0}},
+	}
+
+	for name, points := range expected {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		db.Fetch(0, to, []string{name}, func(res []*protocol.Chunk, err error) {
+			defer wg.Done()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || len(res[0].Series) != 1 {
+				t.Fatal("wrong result")
+			}
+
+			if !reflect.DeepEqual(res[0].Series[0].Points, points) {
+				t.Fatal("wrong points", name, res[0].Series[0].Points)
+			}
+		})
+
+		wg.Wait()
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Queries[0].Func = "median"
+	if _, err := Open(dir, p); err != ErrInvQuery {
+		t.Fatal("should return error")
+	}
+
+	// results would be included when evaluating the query again
+	p.Queries[0].Func = FuncSum
+	p.Queries[0].Target = []string{"a", "sum"}
+	if _, err := Open(dir, p); err != ErrInvQuery {
+		t.Fatal("should return error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryPending(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Queries: []*Query{
+			{Fields: []string{"a", "*"}, Target: []string{"sum"}},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := p.Resolution
+	if err := db.Track(0, []string{"a", "b"}, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(res), []string{"a", "b"}, 6, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// evaluate the first point as if the database was opened before it
+	db.lastQueried = 0
+	if err := db.queryPending(2 * res); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dir, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the second point is evaluated after opening again
+	if err := db.queryPending(3 * res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []protocol.Point{{4, 2}, {6, 1}, {0, 0}}
+	db.Fetch(0, uint64(3*res), []string{"sum"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			!reflect.DeepEqual(res[0].Series[0].Points, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b", "d"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := db.TrackContext(ctx, 0, fields, 5, 1); err != context.Canceled {
+		t.Fatal("should return error")
+	}
+
+	db.FetchContext(ctx, 0, uint64(p.Resolution*2), fields, func(res []*protocol.Chunk, err error) {
+		if err != context.Canceled {
+			t.Fatal("should return error")
+		}
+	})
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:     3600000000000,
+		Retention:    36000000000000,
+		Resolution:   60000000000,
+		MaxROEpochs:  2,
+		MaxRWEpochs:  2,
+		FetchTimeout: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b", "d"}
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(0, uint64(p.Resolution*2), fields, func(res []*protocol.Chunk, err error) {
+		if err != context.DeadlineExceeded {
+			t.Fatal("should return error")
+		}
+	})
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchLabels(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"app=a", "host=web1"}
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.FetchLabels(context.Background(), 0, uint64(p.Resolution), []string{"host=web1"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		s := res[0].Series[0]
+		points := []protocol.Point{{5, 1}}
+
+		if !reflect.DeepEqual(s.Fields, fields) {
+			t.Fatal("wrong fields")
+		}
+
+		if !reflect.DeepEqual(s.Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	// series under the parent series should not be counted again
+	if err := db.Track(0, []string{"app=a", "host=web2"}, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.FetchLabels(context.Background(), 0, uint64(p.Resolution), []string{"app=a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		var total protocol.Point
+		for _, s := range res[0].Series {
+			total.Total += s.Points[0].Total
+			total.Count += s.Points[0].Count
+		}
+
+		if total != (protocol.Point{Total: 8, Count: 2}) {
+			t.Fatal("wrong total", total)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Repair(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("undamaged epochs should not be repaired")
+	}
+
+	if err := db.Verify(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(0, []string{"c", "d"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Rename([]string{"a", "*"}, []string{"x", "*"}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal("wrong number of renamed series", n)
+	}
+
+	if err := db.Verify(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// renamed series can be written after renaming them
+	if err := db.Track(0, []string{"x", "b"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for q, exp := range map[string][]protocol.Point{"a": nil, "x": {{10, 2}}} {
+		db.Fetch(0, uint64(p.Resolution), []string{q, "b"}, func(res []*protocol.Chunk, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var points []protocol.Point
+			if len(res) == 1 && len(res[0].Series) == 1 {
+				points = res[0].Series[0].Points
+			}
+
+			if !reflect.DeepEqual(points, exp) {
+				t.Fatal("wrong points", q, points)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyResults(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		CopyResults: true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var result []*protocol.Chunk
+	db.Fetch(0, uint64(p.Resolution), fields, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result = res
+	})
+
+	// copied results should not change with new writes
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || len(result[0].Series) != 1 {
+		t.Fatal("wrong result")
+	}
+
+	points := []protocol.Point{{5, 1}}
+	if !reflect.DeepEqual(result[0].Series[0].Points, points) {
+		t.Fatal("wrong points")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloneChunk(t *testing.T) {
+	c := &protocol.Chunk{
+		From:   1,
+		To:     2,
+		Series: []*protocol.Series{{Fields: []string{"a"}, Points: []protocol.Point{{1, 1}}}},
+	}
+
+	clone := CloneChunk(c)
+	if !reflect.DeepEqual(c, clone) {
+		t.Fatal("clone should be equal")
+	}
+
+	c.Series[0].Fields[0] = "b"
+	c.Series[0].Points[0].Total = 2
+
+	if clone.Series[0].Fields[0] != "a" || clone.Series[0].Points[0].Total != 1 {
+		t.Fatal("clone should not share memory")
+	}
+}
+
+func TestCloseWaitsForJobs(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	interval := maintainInterval
+	maintainInterval = time.Millisecond
+	defer func() { maintainInterval = interval }()
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Compact:     true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		db.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("background jobs should be running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background jobs should be stopped after closing")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeafOnly(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		MaxSeries:   5,
+		LeafOnly:    true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := map[string][]string{
+		"ab":  {"a", "b"},
+		"acd": {"a", "c", "d"},
+		"ace": {"a", "c", "e"},
+	}
+
+	for _, fields := range tracks {
+		if err := db.Track(0, fields, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only leaf series are stored
+	if n, err := db.Count(0, 60000000000, []string{"a"}); err != nil || n != 0 {
+		t.Fatal("parent series should not be stored", n, err)
+	}
+
+	expected := map[string]protocol.Point{
+		"a":   {Total: 6, Count: 3},
+		"a b": {Total: 2, Count: 1},
+		"a c": {Total: 4, Count: 2},
+	}
+
+	fetch := func() {
+		for _, query := range [][]string{{"a"}, {"a", "*"}} {
+			db.Fetch(0, 60000000000, query, func(res []*protocol.Chunk, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(res) != 1 || len(res[0].Series) != len(query) {
+					t.Fatal("wrong result", query)
+				}
+
+				for _, s := range res[0].Series {
+					key := strings.Join(s.Fields, " ")
+					if s.Points[0] != expected[key] {
+						t.Fatal("wrong points", key, s.Points)
+					}
+				}
+			})
+		}
+	}
+
+	fetch()
+
+	// parent series must not be created when loading the epoch again
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, 60000000000, []string{"a"}); err != nil || n != 0 {
+		t.Fatal("parent series should not be stored", n, err)
+	}
+
+	fetch()
+
+	// a new series can be added without exceeding the series limit
+	if err := db.Track(0, []string{"a", "f"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, 60000000000, []string{"a"}); err != nil || n != 0 {
+		t.Fatal("parent series should not be stored", n, err)
+	}
+
+	// series can also be tracked with fields of a parent series
+	if err := db.Track(0, []string{"a"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, 60000000000, []string{"a"}); err != nil || n != 1 {
+		t.Fatal("series should be stored", n, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateLevels(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string][]int{
+		`"all"`:  nil,
+		`"none"`: nil,
+		`[]`:     nil,
+		`[1, 3]`: {1, 3},
+	}
+
+	for raw, levels := range parsed {
+		p := &Params{
+			DurationStr:        "1h",
+			ResolutionStr:      "1m",
+			RetentionStr:       "10h",
+			AggregateLevelsRaw: json.RawMessage(raw),
+		}
+
+		if err := p.parse(); err != nil {
+			t.Fatal(raw, err)
+		}
+
+		if !reflect.DeepEqual(p.AggregateLevels, levels) {
+			t.Fatal("wrong levels", raw, p.AggregateLevels)
+		}
+
+		if p.LeafOnly != (raw == `"none"` || raw == `[]`) {
+			t.Fatal("wrong leaf only", raw)
+		}
+	}
+
+	p := &Params{
+		DurationStr:        "1h",
+		ResolutionStr:      "1m",
+		RetentionStr:       "10h",
+		AggregateLevelsRaw: json.RawMessage(`"some"`),
+	}
+
+	if err := p.parse(); err == nil {
+		t.Fatal("invalid levels should fail")
+	}
+
+	p = &Params{
+		Duration:        3600000000000,
+		Retention:       36000000000000,
+		Resolution:      60000000000,
+		MaxROEpochs:     2,
+		MaxRWEpochs:     1,
+		AggregateLevels: []int{3, 1},
+	}
+
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvParams) {
+		t.Fatal("levels should be increasing", err)
+	}
+
+	p.AggregateLevels = []int{1, 3}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b", "c", "d"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]int64{
+		"a":       1,
+		"a b":     0,
+		"a b c":   1,
+		"a b c d": 1,
+	}
+
+	for q, expected := range tests {
+		if n, err := db.Count(0, 60000000000, strings.Split(q, " ")); err != nil || n != expected {
+			t.Fatal("wrong series count", q, n, err)
+		}
+	}
+
+	// series which are not stored must not be created when loading again
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.MaxSeries = 5
+	if db, err = Open(dir, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b", "x"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for q, expected := range tests {
+		if n, err := db.Count(0, 60000000000, strings.Split(q, " ")); err != nil || n != expected {
+			t.Fatal("wrong series count after reopen", q, n, err)
+		}
+	}
+
+	// series can also be tracked with fields of a level which is not stored
+	if err := db.Track(0, []string{"a", "b"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, 60000000000, []string{"a", "b"}); err != nil || n != 1 {
+		t.Fatal("series should be stored", n, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateLevelsFetch(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:        3600000000000,
+		Retention:       36000000000000,
+		Resolution:      60000000000,
+		MaxROEpochs:     2,
+		MaxRWEpochs:     1,
+		AggregateLevels: []int{1, 3},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := map[string][]string{
+		"abcd": {"a", "b", "c", "d"},
+		"abce": {"a", "b", "c", "e"},
+		"abx":  {"a", "b", "x"},
+	}
+
+	for _, fields := range tracks {
+		if err := db.Track(0, fields, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]protocol.Point{
+		"a":       {Total: 6, Count: 3},
+		"a b":     {Total: 6, Count: 3},
+		"a b c":   {Total: 4, Count: 2},
+		"a b c d": {Total: 2, Count: 1},
+	}
+
+	for q, point := range expected {
+		db.Fetch(0, 60000000000, strings.Split(q, " "), func(res []*protocol.Chunk, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || len(res[0].Series) != 1 {
+				t.Fatal("wrong result", q)
+			}
+
+			if s := res[0].Series[0]; s.Points[0] != point {
+				t.Fatal("wrong points", q, s.Points)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParamsValidate(t *testing.T) {
+	p := &Params{
+		Duration:    5000000000,
+		Resolution:  2000000000,
+		Retention:   10000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	exp := &ParamError{Err: ErrInvParams, Param: "duration", Constraint: "5s not a multiple of resolution 2s"}
+	if err := p.validate(); !reflect.DeepEqual(err, exp) {
+		t.Fatal("wrong error", err)
+	} else if !errors.Is(err, ErrInvParams) || errors.Is(err, ErrInvRollup) {
+		t.Fatal("should only match ErrInvParams")
+	} else if msg := ErrInvParams.Error() + ": duration 5s not a multiple of resolution 2s"; err.Error() != msg {
+		t.Fatal("wrong message", err)
+	}
+
+	p.Resolution = 1000000000
+	p.MaxSeries = -1
+
+	exp = &ParamError{Err: ErrInvParams, Param: "maxSeries", Constraint: "-1 must not be negative"}
+	if err := p.validate(); !reflect.DeepEqual(err, exp) {
+		t.Fatal("wrong error", err)
+	}
+
+	p.MaxSeries = 0
+	p.Storage = "disk"
+
+	exp = &ParamError{Err: ErrInvParams, Param: "storage", Constraint: `"disk" must be "mmap" or "file"`}
+	if err := p.validate(); !reflect.DeepEqual(err, exp) {
+		t.Fatal("wrong error", err)
+	}
+
+	p.Storage = ""
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
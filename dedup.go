@@ -0,0 +1,115 @@
+package kadiyadb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDedupWindow is the number of sequence numbers remembered for
+	// each source when the DedupWindow param is not set.
+	defaultDedupWindow = 1024
+
+	// dedupSourceTTL is how long sequence numbers of a source are kept after
+	// its last write. Sources are removed periodically (see maintain).
+	dedupSourceTTL = time.Hour
+)
+
+// dedup remembers recent sequence numbers of each write source. Sequence
+// numbers within the window below the largest sequence number of the source
+// are remembered. Older sequence numbers are considered already written.
+// Sequence numbers are kept in memory therefore they are lost on restart.
+type dedup struct {
+	window  uint64
+	sources map[string]*seqWindow
+	mutex   *sync.Mutex
+}
+
+// seqWindow has recent sequence numbers of a source and the time of its
+// last write (unix nanoseconds).
+type seqWindow struct {
+	max  uint64
+	seen map[uint64]struct{}
+	used int64
+}
+
+// newDedup creates a dedup with given window size (or the default size)
+func newDedup(window int64) (d *dedup) {
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+
+	return &dedup{
+		window:  uint64(window),
+		sources: map[string]*seqWindow{},
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// add adds the sequence number of the source. It returns false if the
+// sequence number was already added or if it's older than the window.
+func (d *dedup) add(source string, seq uint64) (ok bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w, ok := d.sources[source]
+	if !ok {
+		w = &seqWindow{seen: map[uint64]struct{}{}}
+		d.sources[source] = w
+	}
+
+	w.used = time.Now().UnixNano()
+
+	if w.max >= d.window && seq <= w.max-d.window {
+		return false
+	}
+
+	if _, ok := w.seen[seq]; ok {
+		return false
+	}
+
+	w.seen[seq] = struct{}{}
+
+	if seq > w.max {
+		w.max = seq
+
+		// remove old sequence numbers when the map has twice the window size
+		if uint64(len(w.seen)) > 2*d.window {
+			for s := range w.seen {
+				if w.max >= d.window && s <= w.max-d.window {
+					delete(w.seen, s)
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// expire removes sources which did not write since given time
+func (d *dedup) expire(ts int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for source, w := range d.sources {
+		if w.used < ts {
+			delete(d.sources, source)
+		}
+	}
+}
+
+// TrackSeq is the same as TrackContext but the write is identified by the
+// source (ex: client ID) and a sequence number which must be unique for the
+// source. Retried writes with a recent sequence number are not written again
+// and `dup` will be true. Sequence numbers are remembered in memory within
+// the dedup window (see Params.DedupWindow) and older ones are considered
+// duplicates. Sequence numbers should increase for each write of the source.
+// The sequence number is remembered right before writing, so writes which
+// fail while writing are not written again when retried. Sources are
+// forgotten when they do not write for an hour.
+func (d *DB) TrackSeq(ctx context.Context, source string, seq, ts uint64, fields []string, total, count float64) (dup bool, err error) {
+	return d.trackContext(ctx, ts, fields, total, count, func() bool {
+		return d.dedup.add(source, seq)
+	})
+}
@@ -0,0 +1,119 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestDedup(t *testing.T) {
+	d := newDedup(4)
+
+	for seq := uint64(10); seq < 20; seq++ {
+		if !d.add("a", seq) {
+			t.Fatal("new sequence numbers should be added", seq)
+		}
+	}
+
+	if d.add("a", 19) || d.add("a", 16) {
+		t.Fatal("sequence numbers in window should be duplicates")
+	}
+
+	if d.add("a", 15) {
+		t.Fatal("sequence numbers older than the window should be duplicates")
+	}
+
+	if !d.add("b", 19) {
+		t.Fatal("sources should have separate windows")
+	}
+
+	if n := len(d.sources["a"].seen); n > 8 {
+		t.Fatal("old sequence numbers should be removed", n)
+	}
+
+	d.sources["b"].used = 0
+	d.expire(1)
+
+	if len(d.sources) != 1 || d.sources["a"] == nil {
+		t.Fatal("idle sources should be removed")
+	}
+
+	if !d.add("b", 19) {
+		t.Fatal("removed sources should be added again")
+	}
+}
+
+func TestTrackSeq(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		MaxSeries:   2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i, dup := range []bool{false, true, true} {
+		res, err := db.TrackSeq(ctx, "client", 1, 0, []string{"a"}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if res != dup {
+			t.Fatal("wrong result", i, res)
+		}
+	}
+
+	// writes which fail before writing can be retried
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := db.TrackSeq(cctx, "client", 2, 0, []string{"a"}, 1, 1); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+
+	if dup, err := db.TrackSeq(ctx, "client", 2, 0, []string{"a"}, 1, 1); err != nil || dup {
+		t.Fatal("should be written", dup, err)
+	}
+
+	// writes which fail after they start are not written again
+	if _, err := db.TrackSeq(ctx, "client", 3, 0, []string{"a", "b", "c"}, 1, 1); err != ErrMaxSeries {
+		t.Fatal("expected ErrMaxSeries", err)
+	}
+
+	if dup, err := db.TrackSeq(ctx, "client", 3, 0, []string{"a", "b", "c"}, 1, 1); err != nil || !dup {
+		t.Fatal("should be a duplicate", dup, err)
+	}
+
+	db.Fetch(0, 60000000000, []string{"a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			res[0].Series[0].Points[0].Total != 2 {
+			t.Fatal("retried writes should not be counted")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
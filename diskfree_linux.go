@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package kadiyadb
+
+import (
+	"syscall"
+)
+
+// freeDiskBytes returns the number of bytes available to unprivileged users
+// on the file system which has given directory.
+func freeDiskBytes(dir string) (free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
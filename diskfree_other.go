@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package kadiyadb
+
+// freeDiskBytes returns -1 as free disk space is not checked on this platform
+func freeDiskBytes(dir string) (free int64, err error) {
+	return -1, nil
+}
@@ -0,0 +1,202 @@
+package epoch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// restoredext is the extension of files which mark restored epochs. These
+	// files are kept next to epoch directories in the main data directory.
+	restoredext = ".restored"
+)
+
+var (
+	// ErrNoArchive is returned when restoring an epoch which is not archived
+	ErrNoArchive = errors.New("epoch is not available in the archive")
+)
+
+// remove archives the epoch if the cache has an archive path or removes it.
+// Local copies of offloaded epochs are removed but the object store copy is
+// not (see Expire). The epoch must be closed and removed from cache maps
+// before calling this.
+func (c *Cache) remove(key int64) (err error) {
+	keystr := strconv.Itoa(int(key))
+
+	if c.coldpath != "" {
+		if err := os.RemoveAll(path.Join(c.coldpath, keystr)); err != nil {
+			return err
+		}
+	}
+
+	for _, root := range append([]string{c.dbpath}, c.tiers...) {
+		dir := path.Join(root, keystr)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		if c.archive == "" {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := os.MkdirAll(c.archive, 0755); err != nil {
+			return err
+		}
+
+		if err := moveDir(dir, path.Join(c.archive, keystr)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stored returns keys of all epochs older than given timestamp which are
+// stored locally (main data directory, tiers, downloaded copies) or in the
+// object store and names of their objects in the object store. Keys may be
+// repeated if there are multiple copies. Only local epochs are listed if the
+// cache has an archive path because epochs in the object store are kept when
+// archiving. This does not use the cache lock and should be called without
+// holding it as listing the object store can be slow.
+func (c *Cache) stored(ts int64) (keys []int64, objs map[int64][]string) {
+	roots := append([]string{c.dbpath}, c.tiers...)
+	if c.coldpath != "" {
+		roots = append(roots, c.coldpath)
+	}
+
+	for _, root := range roots {
+		files, err := ioutil.ReadDir(root)
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			key, err := strconv.ParseInt(file.Name(), 10, 64)
+			if err == nil && file.IsDir() && key < ts {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	objs = map[int64][]string{}
+
+	if c.store != nil && c.archive == "" {
+		names, _ := c.store.List("")
+		for _, obj := range names {
+			name := strings.SplitN(obj, "/", 2)[0]
+			key, err := strconv.ParseInt(name, 10, 64)
+			if err == nil && key < ts {
+				keys = append(keys, key)
+				objs[key] = append(objs[key], obj)
+			}
+		}
+	}
+
+	return keys, objs
+}
+
+// Restore moves an archived epoch back to the main data directory.
+// Restored epochs are not expired until they are archived again.
+// The cache is not locked while moving the epoch. Instead, the epoch is
+// marked as busy and loads wait until it's restored.
+func (c *Cache) Restore(key int64) (err error) {
+	if c.archive == "" {
+		return ErrNoArchive
+	}
+
+	keystr := strconv.Itoa(int(key))
+	src := path.Join(c.archive, keystr)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return ErrNoArchive
+	}
+
+	done, ok, err := c.hold(key)
+	if err != nil {
+		return err
+	} else if !ok {
+		return os.ErrExist
+	}
+
+	defer done()
+
+	dst := path.Join(c.dbpath, keystr)
+	if _, err := os.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+
+	if err := moveDir(src, dst); err != nil {
+		return err
+	}
+
+	// the epoch is still busy so it cannot be expired before it's marked
+	return ioutil.WriteFile(c.restoredPath(key), nil, 0644)
+}
+
+// Archive closes the epoch identified by given key if it's loaded and moves
+// it to the archive path. This is used to archive restored epochs again.
+// The epoch is moved without the cache lock after all handles to it are
+// released. Meanwhile, the epoch is marked as busy and loads wait.
+func (c *Cache) Archive(key int64) (err error) {
+	if c.archive == "" {
+		return ErrNoArchive
+	}
+
+	c.mapmtx.Lock()
+	c.wait(key)
+
+	var released []chan struct{}
+	for _, data := range []*lru{c.rodata, c.rwdata} {
+		if epoch, ok := data.remove(key); ok {
+			released = append(released, epoch.released)
+			if err := epoch.Release(); err != nil {
+				c.mapmtx.Unlock()
+				return err
+			}
+		}
+	}
+
+	busy := make(chan struct{})
+	c.busy[key] = busy
+	c.mapmtx.Unlock()
+
+	defer func() {
+		c.mapmtx.Lock()
+		delete(c.busy, key)
+		c.mapmtx.Unlock()
+		close(busy)
+	}()
+
+	for _, r := range released {
+		<-r
+	}
+
+	if err := c.remove(key); err != nil {
+		return err
+	}
+
+	err = os.Remove(c.restoredPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// restored returns true if the epoch was restored from the archive
+func (c *Cache) restored(key int64) bool {
+	_, err := os.Stat(c.restoredPath(key))
+	return err == nil
+}
+
+// restoredPath returns the path of the file which marks a restored epoch
+func (c *Cache) restoredPath(key int64) string {
+	return path.Join(c.dbpath, strconv.Itoa(int(key))+restoredext)
+}
@@ -0,0 +1,214 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	defer setupc(t)()
+
+	archive := path.Join(tmpdirc, "archive")
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		ArchivePath: archive,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	if h, err := c.LoadRO(0); err != nil {
+		t.Fatal(err)
+	} else if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Expire(1)
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if _, err := os.Stat(path.Join(archive, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+
+	if err := c.Restore(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Restore(0); err != ErrNoArchive {
+		t.Fatal("should return error")
+	}
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != 1 || ps[0][0].Total != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restored epochs are kept until they are archived again
+	if err := c.Expire(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); err != nil {
+		t.Fatal("restored epoch should not be removed")
+	}
+
+	if err := c.Archive(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if _, err := os.Stat(path.Join(archive, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+
+	if err := c.Restore(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveWaitsForHandles(t *testing.T) {
+	defer setupc(t)()
+
+	archive := path.Join(tmpdirc, "archive")
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		ArchivePath: archive,
+	}
+
+	c := NewCache(o)
+
+	h, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archived := make(chan error, 1)
+	go func() {
+		archived <- c.Archive(0)
+	}()
+
+	select {
+	case <-archived:
+		t.Fatal("should wait for handles")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := h.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-archived; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(archive, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+
+	if err := c.Restore(0); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != 1 || ps[0][0].Total != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreExisting(t *testing.T) {
+	defer setupc(t)()
+
+	archive := path.Join(tmpdirc, "archive")
+	c := NewCache(&Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		ArchivePath: archive,
+	})
+
+	if err := os.MkdirAll(path.Join(archive, "0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(path.Join(tmpdirc, "0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Restore(0); err != os.ErrExist {
+		t.Fatal("should return error")
+	}
+
+	if c.restored(0) {
+		t.Fatal("failed restores should not be marked")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
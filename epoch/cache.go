@@ -7,6 +7,10 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/block"
+	"github.com/kadirahq/kadiyadb/index"
 )
 
 const (
@@ -15,144 +19,473 @@ const (
 	ExpireAll = math.MaxInt64
 )
 
-// item structs are used as items in caches to store epochs and their weights.
-// Items with a higher number for weights are considered important so they less
-// likely to be removed when the cache runs out of space.
-type item struct {
-	weight int64
-	epoch  *Epoch
+// Options is used to configure the cache and epochs loaded by the cache.
+type Options struct {
+	// Path is the directory where new epochs are created.
+	Path string
+
+	// Tiers are slower storage directories used to store older epochs.
+	// Epochs which are not available in Path are looked for in tiers.
+	Tiers []string
+
+	// RecordSize is the number of points in a record.
+	RecordSize int64
+
+	// Resolution is the time between points in nanoseconds. It's stored in
+	// new epochs with their start timestamps (cache keys) and validated when
+	// loading them. Epochs are not validated if this is set to zero.
+	Resolution int64
+
+	// Maximum number of read-only and read-write epochs in the cache.
+	// There is no limit for the number of epochs if this is set to zero.
+	MaxROEpochs int64
+	MaxRWEpochs int64
+
+	// MaxMemory is the maximum total size of epoch files (in bytes) loaded
+	// by the cache. Least recently used epochs are closed to stay under it.
+	// There is no limit if this is set to zero.
+	MaxMemory int64
+
+	// MaxSeries is the maximum number of series (index nodes) allowed in
+	// a read-write epoch. There is no limit if this is set to zero.
+	MaxSeries int64
+
+	// Store is an optional object store used to keep old epochs remotely.
+	// Epochs are downloaded to ColdPath when they are loaded read-only.
+	Store    ObjectStore
+	ColdPath string
+
+	// ArchivePath is an optional directory where expired epochs are moved.
+	// Expired epochs are removed permanently if this is not set.
+	ArchivePath string
+
+	// Verify enables verifying epoch file checksums when loading epochs in
+	// read-only mode. Loading fails with ErrCorrupt if they do not match.
+	Verify bool
+
+	// Durable enables writing sync markers for read-write epochs. Index nodes
+	// written after the last marker are discarded when loading the epoch.
+	Durable bool
+
+	// PointType defines how values tracked to read-write epochs are combined
+	// with existing values. The default is block.Counter (add values).
+	PointType block.PointType
+
+	// BlockSegmentSize and IndexSegmentSize are sizes of segment files used
+	// when creating new epochs (zero means default sizes). Existing epochs
+	// always use the segment sizes they were created with.
+	BlockSegmentSize int64
+	IndexSegmentSize int64
+
+	// FileIO makes read-write epochs use file reads and writes for blocks
+	// instead of memory maps. This uses less memory but writes are slower.
+	FileIO bool
+
+	// SnapshotDepth is the number of index tree levels used to split index
+	// snapshots of epochs written after loading them for writing (see
+	// index.SetSnapDepth). Existing depths are not changed if it's zero.
+	SnapshotDepth int
+
+	// MaxIndexMemory limits the size of index snapshot branches loaded by
+	// each read-only epoch (see index.SetMaxMemory). Zero means no limit.
+	MaxIndexMemory int64
+
+	// Stored tells whether parent index nodes with given number of fields
+	// are written. Missing parent nodes which are not stored are not
+	// repaired when loading epochs (see index.NewRWStored). All parent
+	// nodes are stored if it's nil.
+	Stored func(depth int) bool
 }
 
 // Cache is an LRU cache for epochs. The cache contains both read-only epochs
 // and read-write epochs. An epoch can only be in one of these categories.
-// The cache has separate limits for the number of read-only/read-write epochs.
+// The cache has separate limits for the number of read-only/read-write epochs
+// and a shared limit for the total size of epochs (weighted by file size).
 type Cache struct {
-	rosize int64
-	rodata map[int64]*item
-	rwsize int64
-	rwdata map[int64]*item
-	dbpath string
-	nextID int64
-	mapmtx *sync.RWMutex
-	rsize  int64
-}
-
-// NewCache crates an LRU cache with given RO/RW size limits
-func NewCache(rwsz, rosz int64, dir string, rsz int64) (c *Cache) {
+	rosize   int64
+	rodata   *lru
+	rwsize   int64
+	rwdata   *lru
+	maxmem   int64
+	dbpath   string
+	tiers    []string
+	nextID   int64
+	mapmtx   *sync.RWMutex
+	rsize    int64
+	res      int64
+	stalls   *Stalls
+	maxsrs   int64
+	store    ObjectStore
+	coldpath string
+	archive  string
+	verify   bool
+	durable  bool
+	ptype    block.PointType
+	bsegsz   int64
+	isegsz   int64
+	fileio   bool
+	levels   func(depth int) bool
+	snapdpt  int
+	maxidx   int64
+	pinned   map[int64]bool
+	busy     map[int64]chan struct{}
+}
+
+// NewCache crates an LRU cache with given options. New epochs are
+// always created inside `o.Path`. Optionally, slower storage tiers can
+// be used to look for older epochs and to store migrated epochs.
+func NewCache(o *Options) (c *Cache) {
 	return &Cache{
-		rosize: rosz,
-		rodata: make(map[int64]*item, rosz),
-		rwsize: rwsz,
-		rwdata: make(map[int64]*item, rwsz),
-		dbpath: dir,
-		mapmtx: &sync.RWMutex{},
-		rsize:  rsz,
+		rosize:   o.MaxROEpochs,
+		rodata:   newLRU(),
+		rwsize:   o.MaxRWEpochs,
+		rwdata:   newLRU(),
+		maxmem:   o.MaxMemory,
+		dbpath:   o.Path,
+		tiers:    o.Tiers,
+		mapmtx:   &sync.RWMutex{},
+		rsize:    o.RecordSize,
+		res:      o.Resolution,
+		stalls:   &Stalls{},
+		maxsrs:   o.MaxSeries,
+		store:    o.Store,
+		coldpath: o.ColdPath,
+		archive:  o.ArchivePath,
+		verify:   o.Verify,
+		durable:  o.Durable,
+		ptype:    o.PointType,
+		bsegsz:   o.BlockSegmentSize,
+		isegsz:   o.IndexSegmentSize,
+		fileio:   o.FileIO,
+		levels:   o.Stored,
+		snapdpt:  o.SnapshotDepth,
+		maxidx:   o.MaxIndexMemory,
+		pinned:   map[int64]bool{},
+		busy:     map[int64]chan struct{}{},
 	}
 }
 
 // LoadRO fetches an epoch for reading. It will check for
 // epochs loaded in write-mode because they are faster.
-func (c *Cache) LoadRO(key int64) (epoch *Epoch, err error) {
+// The cache is not locked while downloading, verifying and opening epoch
+// files. Instead, the epoch is marked as busy and other loads wait for it.
+// The handle must be released after using the epoch.
+func (c *Cache) LoadRO(key int64) (h *Handle, err error) {
 	c.mapmtx.Lock()
-	defer c.mapmtx.Unlock()
+	c.wait(key)
 
-	if item, ok := c.rwdata[key]; ok {
-		nextID := atomic.AddInt64(&c.nextID, 1)
-		atomic.StoreInt64(&item.weight, nextID)
-		return item.epoch, nil
+	used := atomic.AddInt64(&c.nextID, 1)
+
+	if el, ok := c.rwdata.get(key, used); ok {
+		atomic.AddInt64(&c.rodata.metrics.Hits, 1)
+		h = newHandle(el.epoch)
+		c.mapmtx.Unlock()
+		return h, nil
 	}
 
-	if item, ok := c.rodata[key]; ok {
-		nextID := atomic.AddInt64(&c.nextID, 1)
-		atomic.StoreInt64(&item.weight, nextID)
-		return item.epoch, nil
+	if el, ok := c.rodata.get(key, used); ok {
+		atomic.AddInt64(&c.rodata.metrics.Hits, 1)
+		h = newHandle(el.epoch)
+		c.mapmtx.Unlock()
+		return h, nil
 	}
 
-	keystr := strconv.Itoa(int(key))
-	dir := path.Join(c.dbpath, keystr)
+	started := time.Now()
+	dir, ok := c.findPath(key)
+
+	done := make(chan struct{})
+	c.busy[key] = done
+	c.mapmtx.Unlock()
+
+	epoch, weight, err := c.openRO(key, dir, ok)
+
+	c.mapmtx.Lock()
+	defer c.mapmtx.Unlock()
+	delete(c.busy, key)
+	close(done)
 
-	epoch, err = NewRO(dir, c.rsize)
 	if err != nil {
 		return nil, err
 	}
 
+	c.rodata.metrics.recordLoad(started)
+
 	// add new item to the collection
-	nextID := atomic.AddInt64(&c.nextID, 1)
-	c.rodata[key] = &item{
-		weight: nextID,
+	c.rodata.add(&item{
+		key:    key,
 		epoch:  epoch,
-	}
+		weight: weight,
+		used:   used,
+	})
 
 	// enforce read-only cache size
-	c.enforceSize(c.rodata, c.rosize)
+	h = newHandle(epoch)
+	if err := c.enforceSize(c.rodata, c.rosize); err != nil {
+		h.Release()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// openRO opens the epoch in given directory in read-only mode. If the epoch
+// is not found locally (ok is false), it's downloaded from the object store
+// to the cold path (if any). Epoch files are verified first if the cache
+// verifies checksums. The size of epoch files is returned as the weight.
+func (c *Cache) openRO(key int64, dir string, ok bool) (epoch *Epoch, weight int64, err error) {
+	if !ok && c.store != nil && c.coldpath != "" {
+		cdir := path.Join(c.coldpath, strconv.Itoa(int(key)))
+		if ok, err := c.download(key, cdir); err != nil {
+			return nil, 0, err
+		} else if ok {
+			dir = cdir
+		}
+	}
+
+	if c.verify {
+		if err := Verify(dir); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := checkMeta(dir, key, c.res); err != nil {
+		return nil, 0, err
+	}
+
+	epoch, err = NewRO(dir, c.rsize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	epoch.index.SetMaxMemory(c.maxidx)
 
-	return epoch, nil
+	return epoch, dirSize(dir), nil
 }
 
 // LoadRW fetches an epoch for writing. It will make sure that
-// the epoch is not already loaded in read-only mode.
-func (c *Cache) LoadRW(key int64) (epoch *Epoch, err error) {
+// the epoch is not already loaded in read-only mode. If it is, the
+// read-only epoch is closed and this waits until its readers release
+// their handles. The handle must be released after using the epoch.
+func (c *Cache) LoadRW(key int64) (h *Handle, err error) {
+	locked := time.Now()
 	c.mapmtx.Lock()
 	defer c.mapmtx.Unlock()
+	recordStall(&c.stalls.Lock, locked)
+	c.wait(key)
+
+	// Index snapshot files are removed when the epoch is opened for writing.
+	// Readers of the read-only epoch may still load snapshot branches so it
+	// waits (without the cache lock) until they release their handles.
+	if epoch, ok := c.rodata.remove(key); ok {
+		released := epoch.released
+		if err := epoch.Release(); err != nil {
+			return nil, err
+		}
 
-	if item, ok := c.rodata[key]; ok {
-		delete(c.rodata, key)
-		item.epoch.Close()
+		done := make(chan struct{})
+		c.busy[key] = done
+		c.mapmtx.Unlock()
+		<-released
+		c.mapmtx.Lock()
+		delete(c.busy, key)
+		close(done)
 	}
 
-	if item, ok := c.rwdata[key]; ok {
-		nextID := atomic.AddInt64(&c.nextID, 1)
-		atomic.StoreInt64(&item.weight, nextID)
-		return item.epoch, nil
+	used := atomic.AddInt64(&c.nextID, 1)
+
+	if el, ok := c.rwdata.get(key, used); ok {
+		atomic.AddInt64(&c.rwdata.metrics.Hits, 1)
+		h = newHandle(el.epoch)
+
+		// epochs which were in use when they were evicted
+		if c.rwsize > 0 && c.rwdata.len() > int(c.rwsize) {
+			if err := c.enforceSize(c.rwdata, c.rwsize); err != nil {
+				h.Release()
+				return nil, err
+			}
+		}
+
+		return h, nil
 	}
 
-	keystr := strconv.Itoa(int(key))
-	dir := path.Join(c.dbpath, keystr)
+	started := time.Now()
+
+	// offloaded epochs are moved to the main data directory as they
+	// will be modified and they should be uploaded again when offloading.
+	dir, ok := c.findPath(key)
+	if !ok {
+		if _, err := c.download(key, dir); err != nil {
+			return nil, err
+		}
+	} else if c.coldpath != "" && path.Dir(dir) == path.Clean(c.coldpath) {
+		hot := path.Join(c.dbpath, strconv.Itoa(int(key)))
+		if err := moveDir(dir, hot); err != nil {
+			return nil, err
+		}
+
+		dir = hot
+	}
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	epoch, err = NewRW(dir, c.rsize)
+	if err := initSegments(dir, c.bsegsz, c.isegsz); err != nil {
+		return nil, err
+	}
+
+	if err := initMeta(dir, key, c.res); err != nil {
+		return nil, err
+	}
+
+	if c.snapdpt > 0 {
+		if err := index.SetSnapDepth(dir, c.snapdpt); err != nil {
+			return nil, err
+		}
+	}
+
+	loaded := time.Now()
+	epoch, err := newRW(dir, c.rsize, c.fileio, c.levels)
 	if err != nil {
 		return nil, err
 	}
 
+	recordStall(&c.stalls.Load, loaded)
+	c.rwdata.metrics.recordLoad(started)
+	epoch.setStalls(c.stalls)
+	epoch.index.SetMaxSeries(c.maxsrs)
+	epoch.SetDurable(c.durable)
+	epoch.setPointType(c.ptype)
+
 	// add new item to the collection
-	nextID := atomic.AddInt64(&c.nextID, 1)
-	c.rwdata[key] = &item{
-		weight: nextID,
+	c.rwdata.add(&item{
+		key:    key,
 		epoch:  epoch,
-	}
+		weight: dirSize(dir),
+		used:   used,
+	})
 
 	// enforce read-write cache size
-	c.enforceSize(c.rwdata, c.rwsize)
+	h = newHandle(epoch)
+	if err := c.enforceSize(c.rwdata, c.rwsize); err != nil {
+		h.Release()
+		return nil, err
+	}
 
-	return epoch, nil
+	return h, nil
 }
 
-// Expire removes all epochs from cache which are older than given timestamp
-// To remove all epochs, use ExpireAll (maximum int64 value) as the timestamp.
-func (c *Cache) Expire(ts int64) {
-	todo := make(map[int64]*item, c.rosize)
+// Expire removes all epochs which are older than given timestamp. Epochs are
+// closed if they are loaded and removed from the main data directory, tiers
+// and the object store (if any). To remove all epochs, use ExpireAll (maximum
+// int64 value) as the timestamp. If the cache has an archive path, epochs
+// are moved there instead. Offloaded epochs are kept in the object store.
+// Epochs restored from the archive are kept until they are archived again.
+// Files are removed without the cache lock after all handles to the epoch
+// are released. Meanwhile, the epoch is marked as busy and loads wait.
+// All epochs are tried even if some of them fail and the first error is
+// returned.
+func (c *Cache) Expire(ts int64) (err error) {
+	// listing the object store can be slow
+	// therefore it's done without the lock
+	keys, objs := c.stored(ts)
 
 	c.mapmtx.Lock()
-	defer c.mapmtx.Unlock()
 
-	for k, el := range c.rodata {
-		if k < ts {
-			todo[k] = el
-			delete(c.rodata, k)
+	// keys of epochs which should not be removed
+	failed := map[int64]bool{}
+
+	// closed when loaded epochs are closed
+	released := map[int64]chan struct{}{}
+
+	for _, data := range []*lru{c.rodata, c.rwdata} {
+		data.each(func(el *item) {
+			if el.key < ts && !c.restored(el.key) && c.busy[el.key] == nil {
+				data.remove(el.key)
+				released[el.key] = el.epoch.released
+				if e := el.epoch.Release(); e != nil {
+					failed[el.key] = true
+					if err == nil {
+						err = e
+					}
+				}
+			}
+		})
+	}
+
+	// epochs are marked as busy while removing their files and objects
+	// so that they are not loaded or downloaded meanwhile
+	busy := map[int64]chan struct{}{}
+
+	for _, k := range keys {
+		if failed[k] || busy[k] != nil || c.restored(k) || c.busy[k] != nil {
+			continue
 		}
+
+		busy[k] = make(chan struct{})
+		c.busy[k] = busy[k]
 	}
 
-	for k, el := range todo {
-		if err := el.epoch.Close(); err == nil {
-			keystr := strconv.Itoa(int(k))
-			dir := path.Join(c.dbpath, keystr)
-			os.RemoveAll(dir)
+	c.mapmtx.Unlock()
+
+	for k, done := range busy {
+		if r := released[k]; r != nil {
+			<-r
+		}
+
+		if e := c.remove(k); e != nil {
+			if err == nil {
+				err = e
+			}
+		} else {
+			for _, obj := range objs[k] {
+				if e := c.store.Delete(obj); e != nil && err == nil {
+					err = e
+				}
+			}
 		}
+
+		c.mapmtx.Lock()
+		delete(c.busy, k)
+		c.mapmtx.Unlock()
+		close(done)
+	}
+
+	return err
+}
+
+// Verify checks whether files of the epoch identified by given key match their
+// checksums. Epochs loaded in read-write mode do not have checksums.
+// The cache is not locked while calculating checksums.
+func (c *Cache) Verify(key int64) (err error) {
+	dir, h := c.acquire(key)
+	if h != nil {
+		defer h.Release()
 	}
+
+	return Verify(dir)
+}
+
+// Metrics returns counters of cache operations for read-only epochs and
+// read-write epochs. Read-only loads served by read-write epochs are hits.
+// Metrics also have the number of loaded epochs and their mapped bytes.
+// Sizes of epoch files measured when they were loaded (or when the cache
+// was last resized) are used as files are not checked while locked.
+func (c *Cache) Metrics() (ro, rw Metrics) {
+	c.mapmtx.RLock()
+	defer c.mapmtx.RUnlock()
+
+	ro, rw = c.rodata.metrics.Copy(), c.rwdata.metrics.Copy()
+	ro.Loaded, ro.Mapped = int64(c.rodata.len()), c.rodata.mapped()
+	rw.Loaded, rw.Mapped = int64(c.rwdata.len()), c.rwdata.mapped()
+
+	return ro, rw
+}
+
+// Stalls returns the number of write stalls detected for epochs in this
+// cache. Only writes which take longer than usual are counted as stalls.
+func (c *Cache) Stalls() (s Stalls) {
+	return c.stalls.Copy()
 }
 
 // Sync flushes all data to disk
@@ -160,13 +493,27 @@ func (c *Cache) Sync() (err error) {
 	c.mapmtx.RLock()
 	defer c.mapmtx.RUnlock()
 
-	for _, el := range c.rwdata {
-		if err := el.epoch.Sync(); err != nil {
-			return err
+	c.rwdata.each(func(el *item) {
+		if serr := el.epoch.Sync(); serr != nil && err == nil {
+			err = serr
 		}
-	}
+	})
 
-	return nil
+	return err
+}
+
+// Checkpoint writes index checkpoints of all read-write epochs
+func (c *Cache) Checkpoint() (err error) {
+	c.mapmtx.RLock()
+	defer c.mapmtx.RUnlock()
+
+	c.rwdata.each(func(el *item) {
+		if cerr := el.epoch.Checkpoint(); cerr != nil && err == nil {
+			err = cerr
+		}
+	})
+
+	return err
 }
 
 // Close releases resources
@@ -174,35 +521,112 @@ func (c *Cache) Close() (err error) {
 	c.mapmtx.Lock()
 	defer c.mapmtx.Unlock()
 
-	for _, el := range c.rwdata {
-		if err := el.epoch.Close(); err != nil {
-			return err
-		}
+	for _, data := range []*lru{c.rwdata, c.rodata} {
+		data.each(func(el *item) {
+			if cerr := el.epoch.Release(); cerr != nil && err == nil {
+				err = cerr
+			}
+		})
 	}
 
-	for _, el := range c.rodata {
-		if err := el.epoch.Close(); err != nil {
-			return err
-		}
+	return err
+}
+
+// Pin loads the epoch identified by given key (read-only unless it's already
+// loaded for writing) and keeps it loaded regardless of cache size limits.
+// Pinned epochs are still closed when they expire or when they're moved.
+func (c *Cache) Pin(key int64) (err error) {
+	h, err := c.LoadRO(key)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Release(); err != nil {
+		return err
 	}
 
+	c.mapmtx.Lock()
+	c.pinned[key] = true
+	c.mapmtx.Unlock()
+
 	return nil
 }
 
-// enforceSize checks size limits for given data map and size
-func (c *Cache) enforceSize(data map[int64]*item, size int64) {
-	for len(data) > int(size) {
-		var minKey int64
-		var minEl *item
+// Unpin allows the epoch identified by given key to be closed again when
+// the cache is over its limits. Extra epochs are closed immediately and
+// the first error returned when closing them is returned.
+func (c *Cache) Unpin(key int64) (err error) {
+	c.mapmtx.Lock()
+	defer c.mapmtx.Unlock()
+
+	delete(c.pinned, key)
+
+	if err := c.enforceSize(c.rodata, c.rosize); err != nil {
+		return err
+	}
+
+	return c.enforceSize(c.rwdata, c.rwsize)
+}
+
+// enforceSize checks size limits for given collection and the memory limit.
+// Least recently used epochs are closed until the cache is within limits.
+// The most recently used epoch in given collection (usually the epoch which
+// was just added to the collection) and pinned epochs are never closed.
+// Read-write epochs are not closed while they have handles because loading
+// them again would open another writer for the same files. The cache can
+// go over its limits until they are released. All evicted epochs are closed
+// even if some of them fail and the first error is returned.
+func (c *Cache) enforceSize(data *lru, size int64) (err error) {
+	recent := data.first()
+	evictable := func(el *item) bool {
+		if el.epoch.rw && atomic.LoadInt64(&el.epoch.refs) > 1 {
+			return false
+		}
+
+		return el != recent && !c.pinned[el.key]
+	}
+
+	evict := func(l *lru, el *item) {
+		l.remove(el.key)
+		if e := el.epoch.Release(); e != nil && err == nil {
+			err = e
+		}
+
+		atomic.AddInt64(&l.metrics.Evictions, 1)
+	}
+
+	for size > 0 && data.len() > int(size) {
+		el := data.last(evictable)
+		if el == nil {
+			break
+		}
+
+		evict(data, el)
+	}
+
+	if c.maxmem <= 0 {
+		return err
+	}
+
+	// read-write epochs grow as new records are added
+	c.rwdata.reweigh()
+
+	for c.rodata.weight+c.rwdata.weight > c.maxmem {
+		var oldest *lru
+		var el *item
 
-		for k, el := range data {
-			if minEl == nil || minEl.weight > el.weight {
-				minEl = el
-				minKey = k
+		for _, l := range []*lru{c.rodata, c.rwdata} {
+			if o := l.last(evictable); o != nil && (el == nil || o.used < el.used) {
+				oldest, el = l, o
 			}
 		}
 
-		delete(data, minKey)
-		minEl.epoch.Close()
+		if el == nil {
+			return err
+		}
+
+		evict(oldest, el)
 	}
+
+	return err
 }
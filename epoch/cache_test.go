@@ -2,7 +2,12 @@ package epoch
 
 import (
 	"os"
+	"path"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/index"
 )
 
 var (
@@ -29,7 +34,7 @@ func TestNewCache(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 		if err := c.Close(); err != nil {
 			t.Fatal(err)
@@ -40,7 +45,7 @@ func TestNewCache(t *testing.T) {
 func TestOpenCache(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 	e, err := c.LoadRW(0)
 	if err != nil {
@@ -55,7 +60,7 @@ func TestOpenCache(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c = NewCache(2, 2, tmpdirc, 5)
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 	e, err = c.LoadRO(0)
 	if err != nil {
@@ -81,14 +86,14 @@ func TestCacheLoadRO(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 		for j := 0; j < 3; j++ {
 			if _, err := c.LoadRO(0); err != nil {
 				t.Fatal(err)
 			}
 
-			if len(c.rodata) != 1 {
+			if c.rodata.len() != 1 {
 				t.Fatal("wrong count")
 			}
 		}
@@ -102,7 +107,7 @@ func TestCacheLoadRO(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			if len(c.rodata) != 2 {
+			if c.rodata.len() != 2 {
 				t.Fatal("wrong count")
 			}
 		}
@@ -117,28 +122,34 @@ func TestCacheLoadRW(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 		for j := 0; j < 3; j++ {
-			if _, err := c.LoadRW(0); err != nil {
+			if h, err := c.LoadRW(0); err != nil {
+				t.Fatal(err)
+			} else if err := h.Release(); err != nil {
 				t.Fatal(err)
 			}
 
-			if len(c.rwdata) != 1 {
+			if c.rwdata.len() != 1 {
 				t.Fatal("wrong count")
 			}
 		}
 
-		if _, err := c.LoadRW(1); err != nil {
+		if h, err := c.LoadRW(1); err != nil {
+			t.Fatal(err)
+		} else if err := h.Release(); err != nil {
 			t.Fatal(err)
 		}
 
 		for j := 2; j < 5; j++ {
-			if _, err := c.LoadRW(int64(i)); err != nil {
+			if h, err := c.LoadRW(int64(i)); err != nil {
+				t.Fatal(err)
+			} else if err := h.Release(); err != nil {
 				t.Fatal(err)
 			}
 
-			if len(c.rwdata) != 2 {
+			if c.rwdata.len() != 2 {
 				t.Fatal("wrong count")
 			}
 		}
@@ -152,16 +163,18 @@ func TestCacheLoadRW(t *testing.T) {
 func TestCacheLoadRORW(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
-	if _, err := c.LoadRO(0); err != nil {
+	if h, err := c.LoadRO(0); err != nil {
+		t.Fatal(err)
+	} else if err := h.Release(); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(c.rodata) != 1 {
+	if c.rodata.len() != 1 {
 		t.Fatal("wrong count")
 	}
-	if len(c.rwdata) != 0 {
+	if c.rwdata.len() != 0 {
 		t.Fatal("wrong count")
 	}
 
@@ -169,10 +182,10 @@ func TestCacheLoadRORW(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(c.rodata) != 0 {
+	if c.rodata.len() != 0 {
 		t.Fatal("wrong count")
 	}
-	if len(c.rwdata) != 1 {
+	if c.rwdata.len() != 1 {
 		t.Fatal("wrong count")
 	}
 
@@ -184,16 +197,16 @@ func TestCacheLoadRORW(t *testing.T) {
 func TestCacheLoadRWRO(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 	if _, err := c.LoadRW(0); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(c.rodata) != 0 {
+	if c.rodata.len() != 0 {
 		t.Fatal("wrong count")
 	}
-	if len(c.rwdata) != 1 {
+	if c.rwdata.len() != 1 {
 		t.Fatal("wrong count")
 	}
 
@@ -201,10 +214,10 @@ func TestCacheLoadRWRO(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(c.rodata) != 0 {
+	if c.rodata.len() != 0 {
 		t.Fatal("wrong count")
 	}
-	if len(c.rwdata) != 1 {
+	if c.rwdata.len() != 1 {
 		t.Fatal("wrong count")
 	}
 
@@ -213,10 +226,269 @@ func TestCacheLoadRWRO(t *testing.T) {
 	}
 }
 
+func TestCacheLRU(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	for _, key := range []int64{0, 1, 0, 2} {
+		if _, err := c.LoadRO(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.rodata.has(0) || c.rodata.has(1) || !c.rodata.has(2) {
+		t.Fatal("least recently used epoch should be closed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 1, MaxRWEpochs: 1})
+
+	if err := c.Pin(0); err != nil {
+		t.Fatal(err)
+	}
+
+	for key := int64(1); key < 3; key++ {
+		if _, err := c.LoadRO(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.rodata.has(0) || c.rodata.has(1) || c.rodata.len() != 2 {
+		t.Fatal("pinned epoch should stay loaded")
+	}
+
+	if err := c.Unpin(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.rodata.has(0) || !c.rodata.has(2) {
+		t.Fatal("unpinned epoch should be closed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheMaxMemory(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxMemory: 1})
+
+	for key := int64(0); key < 3; key++ {
+		e, err := c.LoadRW(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.LoadRO(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.rwdata.len() != 0 || c.rodata.len() != 1 {
+		t.Fatal("epochs over the memory limit should be closed")
+	}
+
+	if c.rodata.weight == 0 {
+		t.Fatal("epochs should be weighted by size")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheEvictInUse(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 1, MaxRWEpochs: 1})
+
+	h1, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2, err := c.LoadRW(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.rwdata.has(0) || !c.rwdata.has(1) {
+		t.Fatal("read-write epoch should not be closed while in use")
+	}
+
+	if err := h2.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	h3, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h3.Epoch != h1.Epoch {
+		t.Fatal("read-write epoch should not be opened again while in use")
+	}
+
+	if err := h1.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h3.Track(0, []string{"b"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*Handle{h1, h3} {
+		if err := h.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// released epochs are closed when the cache is over its limits again
+	h2, err = c.LoadRW(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.rwdata.has(0) || c.rwdata.len() != 1 {
+		t.Fatal("released read-write epoch should be closed")
+	}
+
+	if err := h2.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 1, MaxRWEpochs: 1})
+
+	ro, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := ro.Fetch(0, 5, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(points) != 2 || len(nodes) != 2 {
+		t.Fatal("wrong result", len(points))
+	}
+
+	for i, n := range nodes {
+		exp := map[string]float64{"a": 1, "b": 2}[n.Fields[0]]
+		if points[i][0].Total != exp {
+			t.Fatal("wrong total", n.Fields, points[i][0].Total)
+		}
+	}
+
+	if err := ro.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachePromote(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Expire(1)
+
+	ro, err := c.LoadRO(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := make(chan *Handle)
+	go func() {
+		rw, err := c.LoadRW(1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		loaded <- rw
+	}()
+
+	// the epoch is promoted after the read-only epoch is released
+	select {
+	case <-loaded:
+		t.Fatal("epoch should not be promoted while in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if refs := atomic.LoadInt64(&ro.refs); refs != 1 {
+		t.Fatal("read-only epoch should not be closed while in use")
+	}
+
+	if _, _, err := ro.Fetch(0, 5, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ro.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := <-loaded
+	if rw == nil {
+		t.FailNow()
+	}
+
+	if refs := atomic.LoadInt64(&ro.refs); refs != 0 {
+		t.Fatal("read-only epoch should be closed")
+	}
+
+	if err := rw.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if refs := atomic.LoadInt64(&rw.refs); refs != 0 {
+		t.Fatal("read-write epoch should be closed")
+	}
+}
+
 func TestSyncCache(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
 
 	if err := c.Sync(); err != nil {
 		t.Fatal(err)
@@ -226,3 +498,223 @@ func TestSyncCache(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCacheMaxSeries(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2, MaxSeries: 2})
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a", "c"}, 1, 1); err != index.ErrMaxSeries {
+		t.Fatal("should return error")
+	}
+
+	// the first level should not be updated
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ps[0][0].Total != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	for _, key := range []int64{0, 10} {
+		e, err := c.LoadRW(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs which are not loaded should also be removed
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+	c.Expire(5)
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "10")); err != nil {
+		t.Fatal("epoch should not be removed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheExpireInUse(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	h, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := make(chan error)
+	go func() {
+		expired <- c.Expire(5)
+	}()
+
+	select {
+	case <-expired:
+		t.Fatal("epoch should not be removed while in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := h.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-expired; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	defer setupc(t)()
+
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	if err := writeChecksums(path.Join(tmpdirc, "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Verify(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := corrupt(path.Join(tmpdirc, "0", "block_0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Verify(0); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadROVerify(t *testing.T) {
+	defer setupc(t)()
+
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeChecksums(path.Join(tmpdirc, "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := corrupt(path.Join(tmpdirc, "0", "block_0")); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Verify = true
+	c = NewCache(o)
+
+	// the epoch is verified without the lock and loading it again
+	// should not wait for the failed load
+	for i := 0; i < 2; i++ {
+		if _, err := c.LoadRO(0); err == nil {
+			t.Fatal("should return error")
+		}
+
+		if c.busy[0] != nil {
+			t.Fatal("epoch should not be busy")
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package epoch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// checksumfile has CRC32 checksums of all epoch files. It's written when
+	// a read-write epoch is closed and removed when it's opened for writing.
+	checksumfile = "checksums"
+)
+
+var (
+	// ErrCorrupt is returned when epoch files do not match their checksums
+	ErrCorrupt = errors.New("epoch files do not match checksums")
+)
+
+// Verify checks whether the epoch files match the checksums written when the
+// epoch was last closed. Epochs without checksums (ex: epochs loaded in
+// read-write mode, epochs created by older versions) are considered valid.
+func (e *Epoch) Verify() (err error) {
+	return Verify(e.dir)
+}
+
+// Verify checks whether the epoch files in given directory match the checksums
+// written when the epoch was last closed. It returns an error with ErrCorrupt
+// message and the file name if a file is missing or does not match.
+func Verify(dir string) (err error) {
+	return verifyFiles(dir, nil)
+}
+
+// verifyFiles is the same as Verify but files are not verified if `skip`
+// returns true for their names (all files are verified if it's nil).
+func verifyFiles(dir string, skip func(name string) bool) (err error) {
+	f, err := os.Open(path.Join(dir, checksumfile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s: %s", ErrCorrupt, checksumfile)
+		}
+
+		expected, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %s", ErrCorrupt, checksumfile)
+		}
+
+		if skip != nil && skip(parts[1]) {
+			continue
+		}
+
+		sum, err := checksum(path.Join(dir, parts[1]))
+		if err != nil || sum != uint32(expected) {
+			return fmt.Errorf("%s: %s", ErrCorrupt, parts[1])
+		}
+	}
+
+	return scanner.Err()
+}
+
+// writeChecksums writes checksums of all files in the epoch directory
+func writeChecksums(dir string) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || name == checksumfile || name == updatedfile {
+			continue
+		}
+
+		sum, err := checksum(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		data = append(data, fmt.Sprintf("%08x %s\n", sum, name)...)
+	}
+
+	return ioutil.WriteFile(path.Join(dir, checksumfile), data, 0644)
+}
+
+// removeChecksums removes the checksum file as epoch files will change
+func removeChecksums(dir string) (err error) {
+	err = os.Remove(path.Join(dir, checksumfile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// checksum calculates the CRC32 checksum of a file
+func checksum(file string) (sum uint32, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
@@ -0,0 +1,84 @@
+package epoch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// read-write epochs do not have checksums
+	if err := e.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt one of the files listed in the checksum file
+	data, err := ioutil.ReadFile(path.Join(dir, checksumfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := strings.SplitN(strings.SplitN(string(data), "\n", 2)[0], " ", 2)[1]
+	file := path.Join(dir, name)
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(dir); err == nil || !strings.HasPrefix(err.Error(), ErrCorrupt.Error()) {
+		t.Fatal("should return error")
+	}
+
+	// opening for writing should remove checksums
+	e, err = NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, checksumfile)); !os.IsNotExist(err) {
+		t.Fatal("checksums should be removed")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,335 @@
+package epoch
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ObjectStore is a remote storage (ex: S3, GCS) used to store old epochs.
+// Epoch files are stored using "<epoch>/<file>" keys. Implementations for
+// different storage services can be used by setting the cache Store option.
+type ObjectStore interface {
+	// Put stores data read from r with given key
+	Put(key string, r io.Reader) (err error)
+
+	// Get writes data stored with given key to w
+	Get(key string, w io.Writer) (err error)
+
+	// List returns all keys which start with given prefix
+	List(prefix string) (keys []string, err error)
+
+	// Delete removes data stored with given key
+	Delete(key string) (err error)
+}
+
+// DirStore is an ObjectStore which stores objects as files in a directory.
+// It can be used with network filesystems or as a reference implementation.
+type DirStore struct {
+	Dir string
+}
+
+// Put stores data read from r with given key
+func (s *DirStore) Put(key string, r io.Reader) (err error) {
+	file := path.Join(s.Dir, key)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Get writes data stored with given key to w
+func (s *DirStore) Get(key string, w io.Writer) (err error) {
+	f, err := os.Open(path.Join(s.Dir, key))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// List returns all keys which start with given prefix. Files in sub
+// directories of epochs are listed with their paths ("<epoch>/<dir>/<file>").
+func (s *DirStore) List(prefix string) (keys []string, err error) {
+	dirs, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		root := path.Join(s.Dir, d.Name())
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(s.Dir, file)
+			if err != nil {
+				return err
+			}
+
+			if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Delete removes data stored with given key
+func (s *DirStore) Delete(key string) (err error) {
+	file := path.Join(s.Dir, key)
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+
+	// remove the epoch directory if it's empty
+	os.Remove(path.Dir(file))
+
+	return nil
+}
+
+// Offload uploads epochs older than given timestamp to the object store and
+// removes them from local storage (including tiers). Epochs loaded in
+// read-write mode are not offloaded. Offloaded epochs are downloaded again
+// when they are loaded. Downloaded copies of offloaded epochs are removed
+// when they are no longer loaded in read-only mode. Does nothing if an
+// object store is not configured.
+func (c *Cache) Offload(ts int64) (err error) {
+	if c.store == nil {
+		return nil
+	}
+
+	dirs := append([]string{c.dbpath}, c.tiers...)
+	if c.coldpath != "" {
+		dirs = append(dirs, c.coldpath)
+	}
+
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// downloaded epochs are already in the object store
+		cold := dir == c.coldpath
+
+		for _, file := range files {
+			if !file.IsDir() {
+				continue
+			}
+
+			key, err := strconv.ParseInt(file.Name(), 10, 64)
+			if err != nil || key >= ts {
+				continue
+			}
+
+			if err := c.offload(key, path.Join(dir, file.Name()), cold); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// offload uploads a single epoch and removes its local directory. If `cold`
+// is set, the epoch is not uploaded and it's only removed if it's not loaded.
+// The cache is not locked while uploading files. Instead, the epoch is marked
+// as busy and loading it waits until the local directory is removed.
+func (c *Cache) offload(key int64, dir string, cold bool) (err error) {
+	c.mapmtx.Lock()
+	if c.rwdata.has(key) || c.busy[key] != nil || (cold && c.rodata.has(key)) {
+		c.mapmtx.Unlock()
+		return nil
+	}
+
+	if epoch, ok := c.rodata.remove(key); ok {
+		if err := epoch.Release(); err != nil {
+			c.mapmtx.Unlock()
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	c.busy[key] = done
+	c.mapmtx.Unlock()
+
+	defer func() {
+		c.mapmtx.Lock()
+		delete(c.busy, key)
+		c.mapmtx.Unlock()
+		close(done)
+	}()
+
+	if !cold {
+		if err := c.upload(key, dir); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// upload uploads all files of the epoch including files in sub directories
+func (c *Cache) upload(key int64, dir string) (err error) {
+	prefix := strconv.FormatInt(key, 10) + "/"
+
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		return c.store.Put(prefix+filepath.ToSlash(rel), f)
+	})
+}
+
+// hold marks the epoch as busy so its files can be rewritten without the
+// cache lock. The epoch is removed from the read-only cache and this waits
+// until all handles to it are released. `ok` is false if the epoch is
+// loaded in read-write mode. Otherwise, done must be called when finished.
+func (c *Cache) hold(key int64) (done func(), ok bool, err error) {
+	c.mapmtx.Lock()
+	c.wait(key)
+
+	if c.rwdata.has(key) {
+		c.mapmtx.Unlock()
+		return nil, false, nil
+	}
+
+	var released chan struct{}
+	if epoch, ok := c.rodata.remove(key); ok {
+		released = epoch.released
+		if err := epoch.Release(); err != nil {
+			c.mapmtx.Unlock()
+			return nil, false, err
+		}
+	}
+
+	busy := make(chan struct{})
+	c.busy[key] = busy
+	c.mapmtx.Unlock()
+
+	if released != nil {
+		<-released
+	}
+
+	done = func() {
+		c.mapmtx.Lock()
+		delete(c.busy, key)
+		c.mapmtx.Unlock()
+		close(busy)
+	}
+
+	return done, true, nil
+}
+
+// wait waits until the epoch is not busy (ex: while it's being offloaded).
+// The cache must be locked and it's unlocked while waiting.
+func (c *Cache) wait(key int64) {
+	for done := c.busy[key]; done != nil; done = c.busy[key] {
+		c.mapmtx.Unlock()
+		<-done
+		c.mapmtx.Lock()
+	}
+}
+
+// download downloads the epoch from the object store to given directory.
+// `ok` will be false if the object store does not have the epoch.
+func (c *Cache) download(key int64, dir string) (ok bool, err error) {
+	if c.store == nil {
+		return false, nil
+	}
+
+	prefix := strconv.FormatInt(key, 10) + "/"
+	keys, err := c.store.List(prefix)
+	if err != nil || len(keys) == 0 {
+		return false, err
+	}
+
+	// download to a temporary directory first to avoid partial epochs
+	tmp := dir + compactsfx
+	if err := os.RemoveAll(tmp); err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return false, err
+	}
+
+	for _, k := range keys {
+		file := path.Join(tmp, strings.TrimPrefix(k, prefix))
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+
+		f, err := os.Create(file)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+
+		err = c.store.Get(k, f)
+		f.Close()
+
+		if err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp, dir)
+}
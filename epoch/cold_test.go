@@ -0,0 +1,399 @@
+package epoch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+var (
+	tmpdirs = "/tmp/test-store/"
+)
+
+func TestDirStore(t *testing.T) {
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirs)
+
+	s := &DirStore{Dir: tmpdirs}
+	data := []byte("test data")
+
+	if keys, err := s.List("0/"); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Fatal("should be empty")
+	}
+
+	if err := s.Put("0/a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("10/b", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := s.List("0/"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"0/a"}) {
+		t.Fatal("wrong keys", keys)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := s.Get("0/a", buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("wrong data")
+	}
+
+	if err := s.Delete("0/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirs, "0")); !os.IsNotExist(err) {
+		t.Fatal("empty directory should be removed")
+	}
+}
+
+func TestOffload(t *testing.T) {
+	defer setupc(t)()
+
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirs)
+
+	cold := path.Join(tmpdirc, ".cold")
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Store:       &DirStore{Dir: tmpdirs},
+		ColdPath:    cold,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != 1 || ps[0][0].Total != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(cold, "0")); err != nil {
+		t.Fatal("epoch should be downloaded")
+	}
+
+	// loading for writes should move it back to the data directory
+	if _, err := c.LoadRW(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); err != nil {
+		t.Fatal("epoch should be moved")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOffloadCold(t *testing.T) {
+	defer setupc(t)()
+
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirs)
+
+	cold := path.Join(tmpdirc, ".cold")
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Store:       &DirStore{Dir: tmpdirs},
+		ColdPath:    cold,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// files in sub directories of epochs are offloaded as well
+	sub := path.Join(tmpdirc, "0", "sub")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(sub, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(cold, "0", "sub", "file")); err != nil {
+		t.Fatal("sub directories should be downloaded", err)
+	}
+
+	// downloaded epochs are kept while they are loaded
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(cold, "0")); err != nil {
+		t.Fatal("loaded epoch should not be removed")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(cold, "0")); !os.IsNotExist(err) {
+		t.Fatal("downloaded epoch should be removed")
+	}
+
+	if keys, err := o.Store.List("0/"); err != nil || len(keys) == 0 {
+		t.Fatal("epoch should be kept in the store", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lockedStore records whether the cache was locked when the store was used
+type lockedStore struct {
+	ObjectStore
+	c      *Cache
+	locked bool
+}
+
+func (s *lockedStore) check() {
+	if s.c.mapmtx.TryLock() {
+		s.c.mapmtx.Unlock()
+	} else {
+		s.locked = true
+	}
+}
+
+func (s *lockedStore) List(prefix string) (keys []string, err error) {
+	s.check()
+	return s.ObjectStore.List(prefix)
+}
+
+func (s *lockedStore) Delete(key string) (err error) {
+	s.check()
+	return s.ObjectStore.Delete(key)
+}
+
+func (s *lockedStore) Get(key string, w io.Writer) (err error) {
+	s.check()
+	return s.ObjectStore.Get(key, w)
+}
+
+func TestExpireOffloaded(t *testing.T) {
+	defer setupc(t)()
+
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirs)
+
+	s := &lockedStore{ObjectStore: &DirStore{Dir: tmpdirs}}
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Store:       s,
+	}
+
+	c := NewCache(o)
+	s.c = c
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	s.c = c
+
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// loading epochs can check the object store
+	s.locked = false
+
+	if err := c.Expire(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.locked {
+		t.Fatal("object store should be used without the lock")
+	}
+
+	if keys, err := s.List(""); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Fatal("objects should be removed", keys)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadROOffloaded(t *testing.T) {
+	defer setupc(t)()
+
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirs)
+
+	s := &lockedStore{ObjectStore: &DirStore{Dir: tmpdirs}}
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Store:       s,
+		ColdPath:    path.Join(tmpdirc, ".cold"),
+		Verify:      true,
+	}
+
+	c := NewCache(o)
+	s.c = c
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	s.c = c
+
+	if err := c.Offload(1); err != nil {
+		t.Fatal(err)
+	}
+
+	s.locked = false
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.locked {
+		t.Fatal("epoch should be downloaded without the lock")
+	}
+
+	if c.busy[0] != nil {
+		t.Fatal("epoch should not be busy after loading")
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ps) != 1 || ps[0][0].Total != 1 {
+		t.Fatal("wrong points")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
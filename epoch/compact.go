@@ -0,0 +1,320 @@
+package epoch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/block"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	// compactsfx is added to the epoch directory while compacting the epoch.
+	// Directories with this suffix are incomplete and can be removed safely.
+	compactsfx = ".compact"
+
+	// oldsfx is added to the epoch directory while replacing it after compacting.
+	// If the epoch directory is missing, this is the only copy of the epoch.
+	oldsfx = ".old"
+
+	// sparsefill is the fill ratio (points with measurements / record size)
+	// below which records are stored in the sparse format when compacting.
+	sparsefill = 0.25
+)
+
+// Compact rewrites the epoch in given directory to only include records which
+// have at least one measurement. Records are given new dense record IDs in the
+// same order and an index snapshot is created for the new index tree.
+// Records with only a few measurements are stored in the sparse block format
+// and get record IDs after all other records.
+// The epoch must not be loaded while compacting it. Epoch files are
+// dropped from the page cache to avoid evicting frequently used data.
+func Compact(dir string, rsz int64) (err error) {
+	// an earlier compaction may have stopped while replacing the epoch
+	if err := recoverOld(dir); err != nil {
+		return err
+	}
+
+	tmp := dir + compactsfx
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	// the compacted epoch uses the same segment sizes
+	bsz, isz, err := readSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSegments(tmp, bsz, isz); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// the compacted epoch keeps its start timestamp and resolution
+	if start, res, ok, err := readMeta(dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	} else if ok {
+		if err := writeMeta(tmp, start, res); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if depth := index.SnapDepth(dir); depth > 1 {
+		if err := index.SetSnapDepth(tmp, depth); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if err := compact(dir, tmp, rsz); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// create the index snapshot before replacing the epoch
+	i, err := index.NewRO(tmp, isz)
+	if err != nil {
+		return err
+	}
+
+	if err := i.Close(); err != nil {
+		return err
+	}
+
+	old := dir + oldsfx
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+
+	// compacted epochs are not expected to be used soon
+	// page cache hints are optional therefore errors are ignored
+	DropCache(dir)
+
+	return nil
+}
+
+// compact copies records with measurements from src epoch to dst epoch.
+func compact(src, dst string, rsz int64) (err error) {
+	se, err := NewRO(src, rsz)
+	if err != nil {
+		return err
+	}
+
+	defer se.Close()
+
+	de, err := NewRW(dst, rsz)
+	if err != nil {
+		return err
+	}
+
+	sparse := map[int64][]protocol.Point{}
+	if err := copyRecords(de, se, rsz, 0, sparse); err != nil {
+		de.Close()
+		return err
+	}
+
+	if err := de.Sync(); err != nil {
+		de.Close()
+		return err
+	}
+
+	// closing the epoch writes checksums of all files
+	// therefore the sparse file is written before that
+	if len(sparse) != 0 {
+		if err := block.WriteSparse(dst, sparse); err != nil {
+			de.Close()
+			return err
+		}
+	}
+
+	return de.Close()
+}
+
+// Compact compacts the epoch identified by given key unless it's loaded in
+// read-write mode. The epoch is closed if it's loaded in read-only mode and
+// compacted after all handles to it are released. Loads of the epoch wait
+// until it's compacted.
+func (c *Cache) Compact(key int64) (err error) {
+	done, ok, err := c.hold(key)
+	if err != nil || !ok {
+		return err
+	}
+
+	defer done()
+
+	dir := c.epochPath(key)
+	if err := recoverOld(dir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return Compact(dir, c.rsize)
+}
+
+// copyRecords adds points of all records with measurements in src epoch to
+// dst epoch. Records are added in RecordID order so new IDs keep the order.
+// Points are added to dst records starting from given point position offset.
+// If a sparse map is given, records below the sparse fill ratio are not added
+// to the dst block. Instead, they're added to the map with their new IDs.
+func copyRecords(dst, src *Epoch, rsz, offset int64, sparse map[int64][]protocol.Point) (err error) {
+	points, nodes, err := src.FetchAll(context.Background(), 0, rsz)
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(byRecord{points, nodes})
+
+	deferred := []int{}
+	for i, node := range nodes {
+		if isEmpty(points[i]) {
+			continue
+		}
+
+		if sparse != nil && fillRatio(points[i]) < sparsefill {
+			deferred = append(deferred, i)
+			continue
+		}
+
+		n, err := dst.index.Ensure(node.Fields)
+		if err != nil {
+			return err
+		}
+
+		for j, p := range points[i] {
+			if p.Total == 0 && p.Count == 0 {
+				continue
+			}
+
+			pid := offset + int64(j)
+			if err := dst.block.Track(n.RecordID, pid, p.Total, p.Count); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, i := range deferred {
+		n, err := dst.index.Ensure(nodes[i].Fields)
+		if err != nil {
+			return err
+		}
+
+		sparse[n.RecordID] = points[i]
+	}
+
+	return nil
+}
+
+// Recover restores epochs in given directory which were being replaced when
+// a compaction stopped (ex: crash). The old epoch directory is renamed back
+// if the compacted epoch is not in place yet, otherwise it's removed.
+// This must be done before loading epochs from the directory.
+func Recover(root string) (err error) {
+	files, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() || !strings.HasSuffix(name, oldsfx) {
+			continue
+		}
+
+		if err := recoverOld(path.Join(root, strings.TrimSuffix(name, oldsfx))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverOld restores the old copy of the epoch in given directory (if any).
+// The old copy is only removed after the compacted epoch has replaced it.
+func recoverOld(dir string) (err error) {
+	old := dir + oldsfx
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return os.Rename(old, dir)
+	} else if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// IsTempDir checks whether the directory is a temporary directory created
+// while compacting or merging epochs. These can be ignored but directories
+// with old epochs must not be removed before calling Recover.
+func IsTempDir(name string) bool {
+	return strings.HasSuffix(name, compactsfx) || strings.HasSuffix(name, oldsfx)
+}
+
+// isEmpty checks whether the record has no measurements
+func isEmpty(record []protocol.Point) bool {
+	for _, p := range record {
+		if p.Total != 0 || p.Count != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fillRatio returns the ratio of points with measurements in the record
+func fillRatio(record []protocol.Point) float64 {
+	if len(record) == 0 {
+		return 0
+	}
+
+	var n int
+	for _, p := range record {
+		if p.Total != 0 || p.Count != 0 {
+			n++
+		}
+	}
+
+	return float64(n) / float64(len(record))
+}
+
+// byRecord sorts records and their index nodes by RecordID
+type byRecord struct {
+	points [][]protocol.Point
+	nodes  []*index.Node
+}
+
+func (a byRecord) Len() int { return len(a.nodes) }
+func (a byRecord) Swap(i, j int) {
+	a.points[i], a.points[j] = a.points[j], a.points[i]
+	a.nodes[i], a.nodes[j] = a.nodes[j], a.nodes[i]
+}
+func (a byRecord) Less(i, j int) bool { return a.nodes[i].RecordID < a.nodes[j].RecordID }
@@ -0,0 +1,255 @@
+package epoch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// an index node without any measurements
+	if _, err := e.index.Ensure([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(2, []string{"c"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record above the sparse fill ratio
+	for i := int64(0); i < 3; i++ {
+		if err := e.Track(i, []string{"d"}, 3, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Compact(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir + compactsfx); !os.IsNotExist(err) {
+		t.Fatal("temporary directory should be removed")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "sparse")); err != nil {
+		t.Fatal("sparse records should be written", err)
+	}
+
+	if data, err := ioutil.ReadFile(path.Join(dir, checksumfile)); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(data), " sparse\n") {
+		t.Fatal("sparse records should have a checksum", string(data))
+	}
+
+	e, err = NewRO(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := e.FetchAll(context.Background(), 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 3 {
+		t.Fatal("wrong number of records")
+	}
+
+	for i, node := range nodes {
+		switch node.Fields[0] {
+		case "d":
+			if node.RecordID != 0 || points[i][2].Total != 3 {
+				t.Fatal("wrong record", node)
+			}
+		case "a":
+			if node.RecordID != 1 || points[i][1].Total != 1 {
+				t.Fatal("wrong record", node)
+			}
+		case "c":
+			if node.RecordID != 2 || points[i][2].Total != 2 {
+				t.Fatal("wrong record", node)
+			}
+		default:
+			t.Fatal("unexpected record", node)
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheCompactWait(t *testing.T) {
+	defer setupc(t)()
+
+	o := &Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2}
+	c := NewCache(o)
+
+	h, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+
+	h, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error)
+	go func() { errs <- c.Compact(0) }()
+
+	select {
+	case <-errs:
+		t.Fatal("should wait until the handle is released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.mapmtx.Lock()
+	_, busy := c.busy[0]
+	c.mapmtx.Unlock()
+	if !busy {
+		t.Fatal("epoch should be busy")
+	}
+
+	// the handle is still valid while compaction waits
+	if _, _, err := h.FetchAll(context.Background(), 0, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, busy := c.busy[0]; busy {
+		t.Fatal("epoch should not be busy")
+	}
+
+	h, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := h.FetchAll(context.Background(), 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || points[0][1].Total != 1 {
+		t.Fatal("wrong result", nodes, points)
+	}
+
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	edir := path.Join(dir, "0")
+	if err := os.MkdirAll(edir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(edir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped after moving the epoch but before replacing it
+	if err := os.Rename(edir, edir+oldsfx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Recover(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(edir + oldsfx); !os.IsNotExist(err) {
+		t.Fatal("old directory should be moved back")
+	}
+
+	e, err = NewRO(edir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, nodes, err := e.Fetch(0, 5, []string{"a"}); err != nil || len(nodes) != 1 {
+		t.Fatal("epoch should be recovered", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped after replacing the epoch but before removing the old copy
+	if err := os.MkdirAll(edir+oldsfx, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Compact(edir, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(edir + oldsfx); !os.IsNotExist(err) {
+		t.Fatal("old directory should be removed")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
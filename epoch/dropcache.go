@@ -0,0 +1,46 @@
+package epoch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// DropCache advises the kernel to drop cached pages of all files in the epoch
+// directory. This is used after writing or reading epochs in bulk (compacting,
+// merging or restoring epochs) and after closing epochs so they don't evict
+// frequently used data from the page cache. Files must be synced before this
+// as dirty pages are kept.
+// It does nothing on platforms which do not support it.
+func DropCache(dir string) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		f, err := os.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = DropFileCache(f)
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropCache advises the kernel to drop cached pages of epoch files. Pending
+// writes must be synced before this (see the DropCache function).
+func (e *Epoch) DropCache() (err error) {
+	return DropCache(e.dir)
+}
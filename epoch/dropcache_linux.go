@@ -0,0 +1,24 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package epoch
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// fadvDontNeed is POSIX_FADV_DONTNEED on linux
+	fadvDontNeed = 4
+)
+
+// DropFileCache advises the kernel to drop cached pages of the file
+func DropFileCache(f *os.File) (err error) {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
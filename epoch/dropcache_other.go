@@ -0,0 +1,13 @@
+//go:build !linux || (linux && !amd64 && !arm64)
+// +build !linux linux,!amd64,!arm64
+
+package epoch
+
+import (
+	"os"
+)
+
+// DropFileCache does nothing on this platform
+func DropFileCache(f *os.File) (err error) {
+	return nil
+}
@@ -0,0 +1,39 @@
+package epoch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDropCache(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DropCache(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := ioutil.ReadFile(path.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Fatal("file data should not change")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DropCache(dir); err == nil {
+		t.Fatal("should return error")
+	}
+}
@@ -1,13 +1,22 @@
 package epoch
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kadirahq/kadiyadb-protocol"
 	"github.com/kadirahq/kadiyadb/block"
 	"github.com/kadirahq/kadiyadb/index"
 )
 
+var (
+	// logcompactsize is the minimum size of index logs which are compacted
+	// when loading epochs for writing (see index.CompactLogs).
+	logcompactsize int64 = 1024 * 1024 * 20
+)
+
 // Epoch is a partition of database data created by measurement timestamps.
 // Each epoch has it's own index tree and block data store. Changes made to
 // one epoch will not affect any values of other epochs.
@@ -16,24 +25,122 @@ type Epoch struct {
 
 	index *index.Index
 	block block.Block
+	dir   string
+	rw    bool
+
+	// dirty is set to 1 when the epoch has writes which happened after the
+	// last sync. The updated time file is written on sync when it's dirty.
+	dirty int32
+
+	// durable epochs write a sync marker after syncing all epoch files.
+	// seq is the sequence number of the last sync marker (zero if none).
+	durable bool
+	seq     int64
+	syncmtx *sync.Mutex
+
+	// refs is the number of references to the epoch. Epochs are created with
+	// one reference and they are closed when all references are released.
+	// released is closed after closing the epoch when refs reaches zero.
+	refs     int64
+	released chan struct{}
+}
+
+// rwBlock is a block which can be used with read-write epochs.
+// Both memory mapped blocks and file blocks can be used.
+type rwBlock interface {
+	block.Block
+	Clear(from int64) (cleared bool, err error)
+	ClearPoints(from, to int64) (err error)
+	SetPointType(t block.PointType)
+	SetGrowHook(fn func(start time.Time))
+}
+
+// mapped returns true if the epoch block is memory mapped
+func (e *Epoch) mapped() bool {
+	_, ok := e.block.(*block.RWBlock)
+	return ok
 }
 
-// NewRW function will load an epoch in read-write mode
+// NewRW function will load an epoch in read-write mode. If the epoch has a
+// sync marker, index nodes written after the last sync are discarded as they
+// may point at block records which were not synced before a crash.
 func NewRW(dir string, rsz int64) (e *Epoch, err error) {
-	b, err := block.NewRW(dir, rsz)
+	return newRW(dir, rsz, false, nil)
+}
+
+// newRW is the same as NewRW but the epoch block uses file reads and writes
+// instead of memory maps if `fileio` is set (see block.FileBlock). Parent
+// index nodes are repaired using `stored` (see index.NewRWStored).
+func newRW(dir string, rsz int64, fileio bool, stored func(depth int) bool) (e *Epoch, err error) {
+	if err := removeChecksums(dir); err != nil {
+		return nil, err
+	}
+
+	seq, size, synced, err := readSynced(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	i, err := index.NewRW(dir)
+	bsz, isz, err := readSegments(dir)
 	if err != nil {
 		return nil, err
 	}
 
+	var b rwBlock
+	if fileio {
+		b, err = block.NewFile(dir, rsz, bsz)
+	} else {
+		b, err = block.NewRW(dir, rsz, bsz)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := index.NewRWStored(dir, isz, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if synced && i.LogSize() > size {
+		if err := i.Close(); err != nil {
+			return nil, err
+		}
+
+		next, _, err := index.TrimLogs(dir, size, isz, stored)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := b.Clear(next); err != nil {
+			return nil, err
+		}
+
+		if i, err = index.NewRWStored(dir, isz, stored); err != nil {
+			return nil, err
+		}
+	}
+
+	// large index logs with redundant entries are rewritten when loading
+	// the sync marker must have the new log size as the log is replaced
+	if compacted, err := i.CompactLogs(logcompactsize); err != nil {
+		return nil, err
+	} else if compacted && synced {
+		if err := writeSynced(dir, seq, i.LogSize()); err != nil {
+			return nil, err
+		}
+	}
+
 	e = &Epoch{
-		block:   b,
-		index:   i,
-		RWMutex: &sync.RWMutex{},
+		block:    b,
+		index:    i,
+		dir:      dir,
+		rw:       true,
+		seq:      seq,
+		refs:     1,
+		released: make(chan struct{}),
+		syncmtx:  &sync.Mutex{},
+		RWMutex:  &sync.RWMutex{},
 	}
 
 	return e, nil
@@ -41,36 +148,95 @@ func NewRW(dir string, rsz int64) (e *Epoch, err error) {
 
 // NewRO function will load an epoch in read-only mode
 func NewRO(dir string, rsz int64) (e *Epoch, err error) {
-	b, err := block.NewRO(dir, rsz)
+	bsz, isz, err := readSegments(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	i, err := index.NewRO(dir)
+	b, err := block.NewRO(dir, rsz, bsz)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := index.NewRO(dir, isz)
 	if err != nil {
 		return nil, err
 	}
 
 	e = &Epoch{
-		block:   b,
-		index:   i,
-		RWMutex: &sync.RWMutex{},
+		block:    b,
+		index:    i,
+		dir:      dir,
+		refs:     1,
+		released: make(chan struct{}),
+		syncmtx:  &sync.Mutex{},
+		RWMutex:  &sync.RWMutex{},
 	}
 
 	return e, nil
 }
 
+// Retain adds a reference to the epoch so it will not be closed until the
+// reference is released. Each Retain call must have a matching Release call.
+func (e *Epoch) Retain() {
+	atomic.AddInt64(&e.refs, 1)
+}
+
+// Release removes a reference to the epoch. The epoch is closed when there
+// are no references left. The reference held by the creator (usually the
+// cache) is released instead of closing the epoch while it may be in use.
+func (e *Epoch) Release() (err error) {
+	if atomic.AddInt64(&e.refs, -1) == 0 {
+		defer close(e.released)
+		return e.Close()
+	}
+
+	return nil
+}
+
 // Track records a measurement with given total value and measurement count
 // The record is identified by an array of string fields which will be used
 // in the index. The position of the point in the record is given as `pid`.
 func (e *Epoch) Track(pid int64, fields []string, total, count float64) (err error) {
-	for i, l := 1, len(fields); i <= l; i++ {
-		fieldset := fields[:i]
+	sets := make([][]string, len(fields))
+	for i := range fields {
+		sets[i] = fields[:i+1]
+	}
+
+	return e.track(pid, sets, total, count)
+}
+
+// TrackLevels is the same as Track but only parent records with given number
+// of fields are updated. The record with exact given fields is always updated.
+func (e *Epoch) TrackLevels(pid int64, fields []string, levels []int, total, count float64) (err error) {
+	sets := make([][]string, 0, len(levels)+1)
+	for _, l := range levels {
+		if l > 0 && l < len(fields) {
+			sets = append(sets, fields[:l])
+		}
+	}
+
+	sets = append(sets, fields)
+	return e.track(pid, sets, total, count)
+}
+
+// track records a measurement to records of all given field sets
+func (e *Epoch) track(pid int64, sets [][]string, total, count float64) (err error) {
+	// Ensure index nodes for all levels before writing any points so that
+	// a failure (ex: series limit) will not leave partially written data.
+	nodes := make([]*index.Node, len(sets))
+	for i, fieldset := range sets {
 		node, err := e.index.Ensure(fieldset)
 		if err != nil {
 			return err
 		}
 
+		nodes[i] = node
+	}
+
+	atomic.StoreInt32(&e.dirty, 1)
+
+	for _, node := range nodes {
 		if err := e.block.Track(node.RecordID, pid, total, count); err != nil {
 			return err
 		}
@@ -79,29 +245,225 @@ func (e *Epoch) Track(pid int64, fields []string, total, count float64) (err err
 	return nil
 }
 
+// TrackExact is the same as Track but the measurement is only added to the
+// record with exact given fields. Records of parent fields are not updated.
+// This is useful when copying records which already include child values.
+func (e *Epoch) TrackExact(pid int64, fields []string, total, count float64) (err error) {
+	node, err := e.index.Ensure(fields)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&e.dirty, 1)
+
+	return e.block.Track(node.RecordID, pid, total, count)
+}
+
+// ClearPoints sets points in given position range to zero in all records.
+// Index nodes are kept. Read-only epochs are not changed.
+func (e *Epoch) ClearPoints(from, to int64) (err error) {
+	b, ok := e.block.(rwBlock)
+	if !ok {
+		return nil
+	}
+
+	atomic.StoreInt32(&e.dirty, 1)
+
+	return b.ClearPoints(from, to)
+}
+
+// List returns distinct field value combinations under given prefix
+// up to given depth. This does not read any points from the block.
+func (e *Epoch) List(prefix []string, depth int) (values [][]string, err error) {
+	return e.index.List(prefix, depth)
+}
+
+// Cardinality returns the number of series under each value of the first
+// field. This can be used to find which value is creating too many series.
+func (e *Epoch) Cardinality() (c map[string]int64, err error) {
+	return e.index.Cardinality()
+}
+
 // Fetch fetches data from database from zero or more matching records
 // Matching records are identified from the index by given array of fields.
 // For each matching recods, points within the given range are extracted.
 // Finally the function returns both index nodes and points separately.
 func (e *Epoch) Fetch(from, to int64, fields []string) (points [][]protocol.Point, nodes []*index.Node, err error) {
+	return e.FetchContext(context.Background(), from, to, fields)
+}
+
+// FetchContext is the same as Fetch but it checks whether the context is
+// cancelled before reading each record and returns the error if it is.
+func (e *Epoch) FetchContext(ctx context.Context, from, to int64, fields []string) (points [][]protocol.Point, nodes []*index.Node, err error) {
 	nodes, err = e.index.Find(fields)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	points, err = e.fetch(ctx, from, to, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return points, nodes, nil
+}
+
+// FetchTree is the same as FetchContext but it also reads records of all
+// series which have given fields as a prefix (see index.FindTree).
+func (e *Epoch) FetchTree(ctx context.Context, from, to int64, fields []string) (points [][]protocol.Point, nodes []*index.Node, err error) {
+	nodes, err = e.index.FindTree(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	points, err = e.fetch(ctx, from, to, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return points, nodes, nil
+}
+
+// Find returns matching index nodes without reading any points from the
+// block. This can be used to cheaply check which series match the fields.
+func (e *Epoch) Find(fields []string) (nodes []*index.Node, err error) {
+	return e.index.Find(fields)
+}
+
+// Exists checks whether any matching record has at least one measurement
+// within the given range. It stops reading records when one is found.
+func (e *Epoch) Exists(ctx context.Context, from, to int64, fields []string) (ok bool, err error) {
+	nodes, err := e.index.Find(fields)
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		points, err := e.block.Fetch(node.RecordID, from, to)
+		if err != nil {
+			return false, err
+		}
+
+		for _, p := range points {
+			if p.Count != 0 {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// FetchNodes reads points of given index nodes within the range. Nodes must
+// be found in this epoch (ex: with Find). Points are in the same order.
+func (e *Epoch) FetchNodes(ctx context.Context, from, to int64, nodes []*index.Node) (points [][]protocol.Point, err error) {
+	return e.fetch(ctx, from, to, nodes)
+}
+
+// FetchAll is the same as FetchContext but it reads all records in the epoch
+// regardless of the number of fields used for each record.
+func (e *Epoch) FetchAll(ctx context.Context, from, to int64) (points [][]protocol.Point, nodes []*index.Node, err error) {
+	nodes, err = e.index.All()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	points, err = e.fetch(ctx, from, to, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return points, nodes, nil
+}
+
+// FetchLabels is the same as FetchContext but records are identified by
+// label fields (ex: "host=web1") which can be in any position of the node.
+func (e *Epoch) FetchLabels(ctx context.Context, from, to int64, labels []string) (points [][]protocol.Point, nodes []*index.Node, err error) {
+	nodes, err = e.index.FindLabels(labels)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	points, err = e.fetch(ctx, from, to, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return points, nodes, nil
+}
+
+// fetch reads points within the given range for each given index node.
+func (e *Epoch) fetch(ctx context.Context, from, to int64, nodes []*index.Node) (points [][]protocol.Point, err error) {
 	points = make([][]protocol.Point, len(nodes))
 	for i, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		points[i], err = e.block.Fetch(node.RecordID, from, to)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 
-	return points, nodes, nil
+	return points, nil
+}
+
+// setPointType sets the point type of the read-write block of the epoch.
+// It must be called before tracking any values.
+func (e *Epoch) setPointType(t block.PointType) {
+	if b, ok := e.block.(rwBlock); ok {
+		b.SetPointType(t)
+	}
+}
+
+// setStalls counts writes which allocate new block or index log segment
+// files and take longer than usual as grow stalls. It must be called
+// before tracking any values.
+func (e *Epoch) setStalls(s *Stalls) {
+	grow := func(start time.Time) { recordStall(&s.Grow, start) }
+
+	if b, ok := e.block.(rwBlock); ok {
+		b.SetGrowHook(grow)
+	}
+
+	e.index.SetGrowHook(grow)
 }
 
-// Sync flushes pending writes to the filesystem
+// SetDurable enables or disables writing a sync marker after each sync.
+// Block records are synced before index logs and the marker has the index
+// log size when the sync started. When the epoch is loaded again, index
+// nodes written after the last sync marker are discarded (see NewRW).
+func (e *Epoch) SetDurable(durable bool) {
+	e.syncmtx.Lock()
+	e.durable = durable
+	e.syncmtx.Unlock()
+}
+
+// Checkpoint writes a snapshot of index nodes stored so far so that only new
+// index nodes have to be read from the index log when the epoch is loaded in
+// read-only mode for the first time. It does nothing for read-only epochs.
+func (e *Epoch) Checkpoint() (err error) {
+	return e.index.Checkpoint()
+}
+
+// Sync flushes pending writes to the filesystem. If there were any writes
+// since the last sync, the updated time file is also written for the epoch.
+// Durable read-write epochs also write a sync marker after syncing.
 func (e *Epoch) Sync() (err error) {
+	e.syncmtx.Lock()
+	defer e.syncmtx.Unlock()
+
+	dirty := atomic.CompareAndSwapInt32(&e.dirty, 1, 0)
+
+	// Index nodes are stored before writing to block records therefore
+	// all nodes within this size may have records in the synced block.
+	size := e.index.LogSize()
+
 	if err := e.block.Sync(); err != nil {
 		return err
 	}
@@ -109,14 +471,49 @@ func (e *Epoch) Sync() (err error) {
 		return err
 	}
 
+	if dirty {
+		if err := writeUpdated(e.dir, time.Now().UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	if !e.rw {
+		return nil
+	}
+
+	if e.durable {
+		if err := writeSynced(e.dir, e.seq+1, size); err != nil {
+			return err
+		}
+
+		e.seq++
+	} else if e.seq > 0 {
+		// an old sync marker would discard writes made after it
+		if err := removeSynced(e.dir); err != nil {
+			return err
+		}
+
+		e.seq = 0
+	}
+
 	return nil
 }
 
-// Close releases resources
+// Close releases resources. Checksums of epoch files are written when
+// closing read-write epochs which can be verified later with Verify.
+// Durable epochs are synced before closing to update the sync marker.
+// Cached pages of epoch files are dropped as closed epochs (ex: evicted
+// from the cache) are not expected to be used soon.
 func (e *Epoch) Close() (err error) {
 	e.Lock()
 	defer e.Unlock()
 
+	if e.rw && (e.durable || e.seq > 0) {
+		if err := e.Sync(); err != nil {
+			return err
+		}
+	}
+
 	if err := e.block.Close(); err != nil {
 		return err
 	}
@@ -124,5 +521,14 @@ func (e *Epoch) Close() (err error) {
 		return err
 	}
 
+	if e.rw {
+		if err := writeChecksums(e.dir); err != nil {
+			return err
+		}
+	}
+
+	// page cache hints are optional therefore errors are ignored
+	DropCache(e.dir)
+
 	return nil
 }
@@ -1,10 +1,12 @@
 package epoch
 
 import (
+	"context"
 	"os"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 
@@ -192,6 +194,51 @@ func TestTrackValue(t *testing.T) {
 	}
 }
 
+func TestTrackLevels(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b", "c", "d"}
+	if err := e.TrackLevels(0, fields, []int{1, 3}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"a":       true,
+		"a b":     false,
+		"a b c":   true,
+		"a b c d": true,
+	}
+
+	for q, stored := range tests {
+		_, nodes, err := e.Fetch(0, 5, strings.Split(q, " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (len(nodes) == 1) != stored {
+			t.Fatal("wrong nodes", q, len(nodes))
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFetchFast(t *testing.T) {
 	// NOTE checked here
 	TestTrackValue(t)
@@ -253,6 +300,15 @@ func TestFetchSlow(t *testing.T) {
 				{{3, 3}, {3, 3}, {3, 3}, {3, 3}, {3, 3}},
 			},
 		},
+		test{
+			query: []string{"a", "!b", "*"},
+			nodes: Nodes{
+				{RecordID: 5, Fields: []string{"a", "e", "c"}},
+			},
+			points: Series{
+				{{3, 3}, {3, 3}, {3, 3}, {3, 3}, {3, 3}},
+			},
+		},
 		test{
 			query: []string{"a", "*", "*"},
 			nodes: Nodes{
@@ -294,6 +350,191 @@ func TestFetchSlow(t *testing.T) {
 	}
 }
 
+func TestFetchTree(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.TrackExact(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.TrackExact(0, []string{"a", "c", "d"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := e.FetchTree(context.Background(), 0, 5, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 2 || len(points) != 2 {
+		t.Fatal("wrong result", nodes)
+	}
+
+	var total float64
+	for _, record := range points {
+		total += record[0].Total
+	}
+
+	if total != 3 {
+		t.Fatal("wrong total", total)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, _, err := e.FetchContext(ctx, 0, 5, []string{"a", "*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	if _, _, err := e.FetchContext(ctx, 0, 5, []string{"a", "*"}); err != context.Canceled {
+		t.Fatal("should return error")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchNodes(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		f := []string{"a", strconv.Itoa(i)}
+		if err := e.Track(0, f, float64(i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes, err := e.Find([]string{"a", "{2,0}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := e.FetchNodes(context.Background(), 0, 1, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != len(nodes) {
+		t.Fatal("wrong length", len(ps))
+	}
+
+	for i, n := range nodes {
+		if total, _ := strconv.ParseFloat(n.Fields[1], 64); ps[i][0].Total != total {
+			t.Fatal("wrong points", n.Fields, ps[i])
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountExists(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Track(2, []string{"a", "c"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if nodes, err := e.Find([]string{"a", "*"}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 2 {
+		t.Fatal("wrong count")
+	}
+
+	ctx := context.Background()
+
+	if ok, err := e.Exists(ctx, 0, 5, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("should exist")
+	}
+
+	if ok, err := e.Exists(ctx, 2, 5, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("should not exist")
+	}
+
+	if ok, err := e.Exists(ctx, 2, 5, []string{"a", "*"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("should exist")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkTrackValue(b *testing.B) {
 	if err := os.RemoveAll(dir); err != nil {
 		b.Fatal(err)
@@ -0,0 +1,29 @@
+package epoch
+
+import "sync/atomic"
+
+// Handle is a reference to an epoch loaded by the cache. The epoch will not
+// be closed (and its memory maps will not be removed) until the handle is
+// released therefore results read from the epoch are valid until then.
+type Handle struct {
+	*Epoch
+
+	// released is set to 1 when the handle is released
+	released int32
+}
+
+// newHandle adds a reference to the epoch and returns a handle for it
+func newHandle(e *Epoch) (h *Handle) {
+	e.Retain()
+	return &Handle{Epoch: e}
+}
+
+// Release releases the reference to the epoch. The epoch must not be used
+// with this handle after releasing it. Releasing it again does nothing.
+func (h *Handle) Release() (err error) {
+	if !atomic.CompareAndSwapInt32(&h.released, 0, 1) {
+		return nil
+	}
+
+	return h.Epoch.Release()
+}
@@ -0,0 +1,49 @@
+package epoch
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestHandle(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 1, MaxRWEpochs: 1})
+
+	h, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the epoch is evicted from the cache while the handle is in use
+	h2, err := c.LoadRO(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refs := atomic.LoadInt64(&h.refs); refs != 1 {
+		t.Fatal("epoch should not be closed while in use")
+	}
+
+	if _, _, err := h.Fetch(0, 5, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if refs := atomic.LoadInt64(&h.refs); refs != 0 {
+		t.Fatal("epoch should be closed after releasing")
+	}
+
+	if err := h2.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
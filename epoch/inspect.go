@@ -0,0 +1,111 @@
+package epoch
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kadirahq/kadiyadb/block"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+// Info has information about an epoch on disk
+type Info struct {
+	// Records is the number of records in block files (including empty
+	// records allocated in segment files) and Segments is the number of
+	// block segment files.
+	Records  int64
+	Segments int64
+
+	// Nodes is the number of index nodes with valid record IDs.
+	Nodes int64
+
+	// Fill is the ratio of points with measurements in records which have
+	// at least one measurement. Compacted epochs store records with a low
+	// fill ratio as sparse records.
+	Fill float64
+
+	// Bytes is the total size of epoch files on disk.
+	Bytes int64
+
+	// Updated is the last time the epoch was written to (see Updated).
+	Updated int64
+}
+
+// Inspect reads information about the epoch in given directory. The epoch
+// is not loaded therefore this can be used with epochs in use. Block files
+// are read sequentially and only one index branch is loaded at a time.
+func Inspect(dir string, rsz int64) (info *Info, err error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	bsz, isz, err := readSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := block.Inspect(dir, rsz, bsz)
+	if err != nil {
+		return nil, err
+	}
+
+	info = &Info{
+		Records:  stats.Records,
+		Segments: stats.Segments,
+	}
+
+	if stats.Filled > 0 {
+		info.Fill = float64(stats.Points) / float64(stats.Filled*rsz)
+	}
+
+	if info.Nodes, err = index.Count(dir, isz); err != nil {
+		return nil, err
+	}
+
+	if info.Updated, err = Updated(dir); err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			info.Bytes += fi.Size()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Inspect reads information about the epoch identified by given key.
+// Returns an error if the epoch does not exist (see epoch.Inspect).
+// The cache is not locked while reading epoch files.
+func (c *Cache) Inspect(key int64) (info *Info, err error) {
+	dir, h := c.acquire(key)
+	if h != nil {
+		defer h.Release()
+	}
+
+	return Inspect(dir, c.rsize)
+}
+
+// acquire returns the directory of the epoch identified by given key and a
+// handle if it's loaded so that it's not closed while its files are read.
+// The handle is nil if the epoch is not loaded and it must be released.
+func (c *Cache) acquire(key int64) (dir string, h *Handle) {
+	c.mapmtx.RLock()
+	defer c.mapmtx.RUnlock()
+
+	for _, data := range []*lru{c.rwdata, c.rodata} {
+		if e, ok := data.items[key]; ok {
+			el := e.Value.(*item)
+			return el.epoch.dir, newHandle(el.epoch)
+		}
+	}
+
+	return c.epochPath(key), nil
+}
@@ -0,0 +1,65 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{
+		Path:             tmpdirc,
+		RecordSize:       5,
+		MaxROEpochs:      2,
+		MaxRWEpochs:      2,
+		BlockSegmentSize: 800,
+	})
+
+	if _, err := c.Inspect(0); !os.IsNotExist(err) {
+		t.Fatal("expected a not exist error", err)
+	}
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 2; i++ {
+		if err := e.Track(i, []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.Release()
+
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.Inspect(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Records != 10 || info.Segments != 1 || info.Nodes != 1 ||
+		info.Fill != 0.4 || info.Bytes == 0 || info.Updated == 0 {
+		t.Fatal("wrong info", info)
+	}
+
+	// loaded epochs are not closed while they're inspected
+	if dir, h := c.acquire(0); h == nil || dir != path.Join(tmpdirc, "0") {
+		t.Fatal("should return a handle", dir)
+	} else if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dir, h := c.acquire(1); h != nil || dir != path.Join(tmpdirc, "1") {
+		t.Fatal("should not return a handle", dir)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package epoch
+
+import (
+	"container/list"
+	"io/ioutil"
+)
+
+// item structs are used as items in caches to store epochs and their weights.
+// The weight of an item is the size of epoch files in bytes and `used` is a
+// cache wide counter value set when the item was used most recently.
+type item struct {
+	key    int64
+	epoch  *Epoch
+	weight int64
+	used   int64
+}
+
+// lru is a collection of epochs ordered by the time they were last used.
+// Items are kept in a linked list with the most recently used item in front.
+// The map is used to find list elements by their keys in constant time.
+type lru struct {
+	items   map[int64]*list.Element
+	order   *list.List
+	weight  int64
+	metrics *Metrics
+}
+
+// newLRU creates an empty collection of epochs
+func newLRU() (l *lru) {
+	return &lru{
+		items:   map[int64]*list.Element{},
+		order:   list.New(),
+		metrics: &Metrics{},
+	}
+}
+
+// get returns the item with given key and moves it to the front
+func (l *lru) get(key int64, used int64) (el *item, ok bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.order.MoveToFront(e)
+	el = e.Value.(*item)
+	el.used = used
+
+	return el, true
+}
+
+// has checks whether the collection has an item with given key
+func (l *lru) has(key int64) (ok bool) {
+	_, ok = l.items[key]
+	return ok
+}
+
+// add adds a new item to the front. The key must not be in the collection.
+func (l *lru) add(el *item) {
+	l.items[el.key] = l.order.PushFront(el)
+	l.weight += el.weight
+}
+
+// remove removes the item with given key and returns its epoch
+func (l *lru) remove(key int64) (epoch *Epoch, ok bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	el := l.order.Remove(e).(*item)
+	delete(l.items, key)
+	l.weight -= el.weight
+
+	return el.epoch, true
+}
+
+// first returns the most recently used item or nil if it's empty
+func (l *lru) first() (el *item) {
+	if e := l.order.Front(); e != nil {
+		return e.Value.(*item)
+	}
+
+	return nil
+}
+
+// last returns the least recently used item which satisfies given function
+func (l *lru) last(fn func(el *item) bool) (el *item) {
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		if el := e.Value.(*item); fn(el) {
+			return el
+		}
+	}
+
+	return nil
+}
+
+// reweigh updates weights of all items using current sizes of epoch files
+func (l *lru) reweigh() {
+	l.weight = 0
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		el := e.Value.(*item)
+		el.weight = dirSize(el.epoch.dir)
+		l.weight += el.weight
+	}
+}
+
+// mapped returns the total weight of items which have memory mapped blocks.
+// Cached weights are used therefore this does not read epoch directories.
+func (l *lru) mapped() (size int64) {
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		if el := e.Value.(*item); el.epoch.mapped() {
+			size += el.weight
+		}
+	}
+
+	return size
+}
+
+// len returns the number of items in the collection
+func (l *lru) len() (n int) {
+	return len(l.items)
+}
+
+// each calls given function for all items from the most recently used one.
+// Items can be removed from the collection inside the function.
+func (l *lru) each(fn func(el *item)) {
+	for e := l.order.Front(); e != nil; {
+		next := e.Next()
+		fn(e.Value.(*item))
+		e = next
+	}
+}
+
+// dirSize returns the total size of files in given directory in bytes.
+// It's used as the weight of epochs as epoch files are memory mapped.
+func dirSize(dir string) (size int64) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,51 @@
+package epoch
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	l := newLRU()
+
+	for i := int64(0); i < 3; i++ {
+		l.add(&item{key: i, weight: 10, used: i})
+	}
+
+	if l.len() != 3 || l.weight != 30 {
+		t.Fatal("wrong size")
+	}
+
+	all := func(el *item) bool { return true }
+
+	if el := l.last(all); el.key != 0 {
+		t.Fatal("wrong oldest item")
+	}
+
+	if el := l.first(); el.key != 2 {
+		t.Fatal("wrong newest item")
+	}
+
+	if _, ok := l.get(0, 3); !ok {
+		t.Fatal("item should exist")
+	}
+
+	if el := l.last(all); el.key != 1 {
+		t.Fatal("wrong oldest item")
+	}
+
+	if _, ok := l.remove(1); !ok {
+		t.Fatal("item should exist")
+	}
+
+	if l.has(1) || l.len() != 2 || l.weight != 20 {
+		t.Fatal("item should be removed")
+	}
+
+	var keys []int64
+	l.each(func(el *item) {
+		keys = append(keys, el.key)
+		l.remove(el.key)
+	})
+
+	if len(keys) != 2 || keys[0] != 0 || keys[1] != 2 || l.len() != 0 {
+		t.Fatal("wrong items")
+	}
+}
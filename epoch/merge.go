@@ -0,0 +1,134 @@
+package epoch
+
+import (
+	"errors"
+	"os"
+
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+var (
+	// ErrMergeRange is returned when a source epoch does not fit in the
+	// destination epoch when merging epochs with given positions.
+	ErrMergeRange = errors.New("source epoch is out of destination range")
+
+	// ErrMergeDst is returned when the destination epoch already exists.
+	ErrMergeDst = errors.New("destination epoch already exists")
+)
+
+// Source is an epoch merged into a larger epoch by the Merge function.
+// Offset is the point position in the destination epoch where the first
+// point of the source epoch goes. All epochs must have the same resolution.
+type Source struct {
+	Dir        string
+	RecordSize int64
+	Offset     int64
+}
+
+// Merge creates a new epoch in dst directory with records of all source
+// epochs. This can be used to keep existing data when the epoch duration is
+// changed. Records with same fields in different source epochs are merged
+// into a single record and records get new IDs. An index snapshot is created
+// for the merged epoch. Source epochs are not removed and must not be loaded.
+// The merged epoch uses segment sizes of the first source epoch. Source and
+// merged epoch files are dropped from the page cache after merging.
+func Merge(dst string, rsz int64, srcs ...*Source) (err error) {
+	for _, src := range srcs {
+		if src.Offset < 0 || src.Offset+src.RecordSize > rsz {
+			return ErrMergeRange
+		}
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return ErrMergeDst
+	}
+
+	tmp := dst + compactsfx
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	var bsz, isz int64
+	depth := 1
+	if len(srcs) > 0 {
+		if bsz, isz, err = readSegments(srcs[0].Dir); err != nil {
+			return err
+		}
+
+		depth = index.SnapDepth(srcs[0].Dir)
+	}
+
+	if err := writeSegments(tmp, bsz, isz); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if depth > 1 {
+		if err := index.SetSnapDepth(tmp, depth); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if err := merge(tmp, rsz, srcs); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// create the index snapshot before moving the epoch
+	i, err := index.NewRO(tmp, isz)
+	if err != nil {
+		return err
+	}
+
+	if err := i.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	// page cache hints are optional therefore errors are ignored
+	DropCache(dst)
+	for _, src := range srcs {
+		DropCache(src.Dir)
+	}
+
+	return nil
+}
+
+// merge copies records of all source epochs to a new epoch in dst directory
+func merge(dst string, rsz int64, srcs []*Source) (err error) {
+	de, err := NewRW(dst, rsz)
+	if err != nil {
+		return err
+	}
+
+	for _, src := range srcs {
+		se, err := NewRO(src.Dir, src.RecordSize)
+		if err != nil {
+			de.Close()
+			return err
+		}
+
+		err = copyRecords(de, se, src.RecordSize, src.Offset, nil)
+		se.Close()
+
+		if err != nil {
+			de.Close()
+			return err
+		}
+	}
+
+	if err := de.Sync(); err != nil {
+		de.Close()
+		return err
+	}
+
+	return de.Close()
+}
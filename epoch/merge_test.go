@@ -0,0 +1,95 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestMerge(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	dir0 := path.Join(dir, "0")
+	dir1 := path.Join(dir, "1")
+	dst := path.Join(dir, "merged")
+
+	for i, d := range []string{dir0, dir1} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := NewRW(d, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// series "a" in both epochs and "b" only in the second one
+		if err := e.Track(1, []string{"a"}, float64(i+1), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 1 {
+			if err := e.Track(0, []string{"b"}, 5, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcs := []*Source{
+		{Dir: dir0, RecordSize: 2, Offset: 0},
+		{Dir: dir1, RecordSize: 2, Offset: 2},
+	}
+
+	if err := Merge(dst, 4, srcs...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Merge(dst, 4, srcs...); err != ErrMergeDst {
+		t.Fatal("should return error")
+	}
+
+	if err := Merge(dst+"x", 3, srcs...); err != ErrMergeRange {
+		t.Fatal("should return error")
+	}
+
+	e, err := NewRO(dst, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]protocol.Point{
+		"a": {{0, 0}, {1, 1}, {0, 0}, {2, 1}},
+		"b": {{0, 0}, {0, 0}, {5, 1}, {0, 0}},
+	}
+
+	for name, points := range expected {
+		ps, _, err := e.Fetch(0, 4, []string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ps) != 1 || !reflect.DeepEqual(ps[0], points) {
+			t.Fatal("wrong points", name, ps)
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
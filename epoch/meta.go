@@ -0,0 +1,83 @@
+package epoch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// metafile has the start timestamp and the resolution of the epoch.
+	// It's used to detect epochs copied to the wrong path or epochs loaded
+	// with a different resolution. Epochs without this file are not checked.
+	metafile = "meta"
+)
+
+var (
+	// ErrMismatch is returned when the start timestamp or the resolution
+	// stored in the epoch directory does not match the expected values.
+	ErrMismatch = errors.New("epoch does not match its path or resolution")
+)
+
+// readMeta reads the start timestamp and the resolution of the epoch in given
+// directory. The result is false if the epoch does not have them.
+func readMeta(dir string) (start, res int64, ok bool, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, metafile))
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+
+	if _, err := fmt.Sscan(string(data), &start, &res); err != nil {
+		return 0, 0, false, err
+	}
+
+	return start, res, true, nil
+}
+
+// writeMeta writes the start timestamp and the resolution of the epoch
+// in given directory.
+func writeMeta(dir string, start, res int64) (err error) {
+	data := []byte(fmt.Sprintf("%d %d\n", start, res))
+	return ioutil.WriteFile(path.Join(dir, metafile), data, 0644)
+}
+
+// checkMeta returns an error with ErrMismatch if the epoch in given directory
+// has a different start timestamp or resolution. Nothing is checked if the
+// resolution is zero (unknown) or the epoch does not have a meta file.
+func checkMeta(dir string, start, res int64) (err error) {
+	if res == 0 {
+		return nil
+	}
+
+	mstart, mres, ok, err := readMeta(dir)
+	if err != nil || !ok {
+		return err
+	}
+
+	if mstart != start || mres != res {
+		return fmt.Errorf("%s: %s has %d %d, expected %d %d",
+			ErrMismatch, dir, mstart, mres, start, res)
+	}
+
+	return nil
+}
+
+// initMeta validates the start timestamp and the resolution of the epoch in
+// given directory and writes them if the epoch does not have a meta file.
+func initMeta(dir string, start, res int64) (err error) {
+	if res == 0 {
+		return nil
+	}
+
+	if _, _, ok, err := readMeta(dir); err != nil {
+		return err
+	} else if !ok {
+		return writeMeta(dir, start, res)
+	}
+
+	return checkMeta(dir, start, res)
+}
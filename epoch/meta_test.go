@@ -0,0 +1,81 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	defer setupc(t)()
+
+	o := &Options{Path: tmpdirc, RecordSize: 5, Resolution: 10, MaxROEpochs: 2, MaxRWEpochs: 2}
+	c := NewCache(o)
+
+	e, err := c.LoadRW(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if start, res, ok, err := readMeta(path.Join(tmpdirc, "50")); err != nil {
+		t.Fatal(err)
+	} else if !ok || start != 50 || res != 10 {
+		t.Fatal("wrong meta", start, res, ok)
+	}
+
+	// copy the epoch to the wrong path
+	if err := os.Rename(path.Join(tmpdirc, "50"), path.Join(tmpdirc, "100")); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+	if _, err := c.LoadRO(100); err == nil || !strings.HasPrefix(err.Error(), ErrMismatch.Error()) {
+		t.Fatal("expected ErrMismatch", err)
+	}
+
+	if _, err := c.LoadRW(100); err == nil || !strings.HasPrefix(err.Error(), ErrMismatch.Error()) {
+		t.Fatal("expected ErrMismatch", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path.Join(tmpdirc, "100"), path.Join(tmpdirc, "50")); err != nil {
+		t.Fatal(err)
+	}
+
+	// load with a different resolution
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, Resolution: 20, MaxROEpochs: 2, MaxRWEpochs: 2})
+	if _, err := c.LoadRO(50); err == nil || !strings.HasPrefix(err.Error(), ErrMismatch.Error()) {
+		t.Fatal("expected ErrMismatch", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs are not validated without a resolution
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+	e, err = c.LoadRO(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+package epoch
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts epoch cache operations for read-only or read-write epochs.
+// These can be used to pick cache size limits. Counters are incremented
+// atomically therefore values must be read with the Copy method.
+type Metrics struct {
+	// Hits counts epoch loads which used an epoch already in the cache.
+	Hits int64
+
+	// Misses counts epoch loads which had to open the epoch from disk.
+	Misses int64
+
+	// Evictions counts epochs closed to keep the cache within its limits.
+	Evictions int64
+
+	// LoadTime is the total time spent opening epochs in nanoseconds.
+	LoadTime int64
+
+	// Loaded is the number of epochs currently loaded in the cache and
+	// Mapped is the size of files of those with memory mapped blocks in
+	// bytes. Read-only epochs and epochs using file IO are not mapped.
+	// These are only set in metrics returned by Cache.Metrics.
+	Loaded int64
+	Mapped int64
+}
+
+// Copy atomically reads all counters and returns them as a new struct.
+func (m *Metrics) Copy() (c Metrics) {
+	c.Hits = atomic.LoadInt64(&m.Hits)
+	c.Misses = atomic.LoadInt64(&m.Misses)
+	c.Evictions = atomic.LoadInt64(&m.Evictions)
+	c.LoadTime = atomic.LoadInt64(&m.LoadTime)
+	return c
+}
+
+// recordLoad counts a cache miss and the time spent loading the epoch
+func (m *Metrics) recordLoad(start time.Time) {
+	atomic.AddInt64(&m.Misses, 1)
+	atomic.AddInt64(&m.LoadTime, int64(time.Since(start)))
+}
@@ -0,0 +1,40 @@
+package epoch
+
+import "testing"
+
+func TestMetrics(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 1, MaxRWEpochs: 1})
+	defer c.Close()
+
+	for _, key := range []int64{0, 0, 1} {
+		if _, err := c.LoadRO(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e, err := c.LoadRW(2); err != nil {
+		t.Fatal(err)
+	} else if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.LoadRO(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, rw := c.Metrics()
+	if ro.Hits != 2 || ro.Misses != 2 || ro.Evictions != 1 || ro.LoadTime <= 0 {
+		t.Fatal("wrong read-only metrics", ro)
+	}
+
+	if rw.Hits != 0 || rw.Misses != 1 || rw.Evictions != 0 || rw.LoadTime <= 0 {
+		t.Fatal("wrong read-write metrics", rw)
+	}
+
+	// read-only epochs are not memory mapped
+	if ro.Loaded != 1 || rw.Loaded != 1 || ro.Mapped != 0 || rw.Mapped <= 0 {
+		t.Fatal("wrong loaded epochs", ro, rw)
+	}
+}
@@ -0,0 +1,67 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+// Rename rewrites fields of series in the epoch in given directory which have
+// the `from` pattern as a prefix (see index.Rename). Series keep their record
+// IDs therefore no data is lost. The sync marker and checksums are updated
+// for the new index files. The epoch must not be loaded while renaming it.
+// It returns the number of renamed series.
+func Rename(dir string, from, to []string) (n int, err error) {
+	_, isz, err := readSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n, size, err := index.Rename(dir, from, to, isz)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	// the index log is replaced therefore the synced size has changed
+	if seq, _, synced, err := readSynced(dir); err != nil {
+		return 0, err
+	} else if synced {
+		if err := writeSynced(dir, seq, size); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writeUpdated(dir, time.Now().UnixNano()); err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(path.Join(dir, checksumfile)); err == nil {
+		if err := writeChecksums(dir); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// Rename renames series of the epoch identified by given key unless it's
+// loaded in read-write mode. The epoch is closed if it's loaded in read-only
+// mode and renamed after all handles to it are released. Loads of the epoch
+// wait until it's renamed.
+func (c *Cache) Rename(key int64, from, to []string) (n int, err error) {
+	done, ok, err := c.hold(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	defer done()
+
+	dir, ok := c.findPath(key)
+	if !ok {
+		return 0, nil
+	}
+
+	return Rename(dir, from, to)
+}
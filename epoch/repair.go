@@ -0,0 +1,100 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/block"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+// Repair fixes the epoch in given directory after an unclean shutdown. Partial
+// index log entries are trimmed and the index snapshot is rebuilt from logs.
+// Block records without an index node are cleared so the record IDs can be
+// reused safely. Index nodes written after the last sync marker are also
+// discarded. `repaired` will be true if any damage was found and fixed.
+// Parent index nodes are repaired using `stored` (see index.NewRWStored).
+// Files which are not rebuilt must match their checksums (if any) otherwise
+// it fails with ErrCorrupt. The epoch must not be loaded while repairing it.
+func Repair(dir string, rsz int64, stored func(depth int) bool) (repaired bool, err error) {
+	// files which are not rebuilt must still match their checksums as new
+	// checksums are written after repairing (corruption would be hidden)
+	if err := verifyFiles(dir, index.IsSnapshotFile); err != nil {
+		return false, err
+	}
+
+	_, size, synced, err := readSynced(dir)
+	if err != nil {
+		return false, err
+	} else if !synced {
+		size = -1
+	}
+
+	bsz, isz, err := readSegments(dir)
+	if err != nil {
+		return false, err
+	}
+
+	next, trimmed, err := index.Repair(dir, size, isz, stored)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := block.NewRW(dir, rsz, bsz)
+	if err != nil {
+		return false, err
+	}
+
+	cleared, err := b.Clear(next)
+	if err != nil {
+		b.Close()
+		return false, err
+	}
+
+	if err := b.Sync(); err != nil {
+		b.Close()
+		return false, err
+	}
+
+	if err := b.Close(); err != nil {
+		return false, err
+	}
+
+	repaired = trimmed || cleared
+	if repaired {
+		if err := writeUpdated(dir, time.Now().UnixNano()); err != nil {
+			return false, err
+		}
+	}
+
+	// the index snapshot is rewritten therefore checksums are updated as well
+	// other files were verified above and only changed by the repair
+	if _, err := os.Stat(path.Join(dir, checksumfile)); err == nil {
+		if err := writeChecksums(dir); err != nil {
+			return false, err
+		}
+	}
+
+	return repaired, nil
+}
+
+// Repair repairs the epoch identified by given key unless it's loaded in
+// read-write mode. The epoch is closed if it's loaded in read-only mode and
+// repaired after all handles to it are released. Loads of the epoch wait
+// until it's repaired.
+func (c *Cache) Repair(key int64) (repaired bool, err error) {
+	done, ok, err := c.hold(key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	defer done()
+
+	dir, ok := c.findPath(key)
+	if !ok {
+		return false, nil
+	}
+
+	return Repair(dir, c.rsize, c.levels)
+}
@@ -0,0 +1,145 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record written without an index node (lost index log entry)
+	if err := e.block.Track(1, 2, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := Repair(dir, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !repaired {
+		t.Fatal("epoch should be repaired")
+	}
+
+	if err := Verify(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err = Repair(dir, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if repaired {
+		t.Fatal("epoch is already repaired")
+	}
+
+	e, err = NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(2, []string{"b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := e.Fetch(0, 5, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 {
+		t.Fatal("wrong number of records")
+	}
+
+	if points[0][2].Total != 1 || points[0][2].Count != 1 {
+		t.Fatal("record should not have old values")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairCorrupt(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index snapshot is written when repairing the epoch
+	if _, err := Repair(dir, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot files are rebuilt from index logs therefore these can be fixed
+	if err := corrupt(path.Join(dir, "snapr_0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Repair(dir, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := corrupt(path.Join(dir, "block_0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Repair(dir, 5, nil); err == nil || !strings.HasPrefix(err.Error(), ErrCorrupt.Error()) {
+		t.Fatal("should return error", err)
+	}
+
+	// checksums must not be updated to match corrupt files
+	if err := Verify(dir); err == nil || !strings.HasPrefix(err.Error(), ErrCorrupt.Error()) {
+		t.Fatal("should return error", err)
+	}
+}
+
+// corrupt overwrites the beginning of the file
+func corrupt(file string) (err error) {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt([]byte("garbage"), 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
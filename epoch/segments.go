@@ -0,0 +1,58 @@
+package epoch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// segmentsfile has segment sizes of block and index files of the epoch.
+	// Epoch files must always be loaded with the segment sizes used to create
+	// them. Epochs without this file use default segment sizes (zero).
+	segmentsfile = "segments"
+)
+
+// readSegments reads block and index segment sizes of the epoch in given
+// directory. Sizes will be zero (default) if the epoch does not have them.
+func readSegments(dir string) (bsz, isz int64, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, segmentsfile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := fmt.Sscan(string(data), &bsz, &isz); err != nil {
+		return 0, 0, err
+	}
+
+	return bsz, isz, nil
+}
+
+// writeSegments writes block and index segment sizes of the epoch in given
+// directory. Nothing is written if both sizes are zero (default).
+func writeSegments(dir string, bsz, isz int64) (err error) {
+	if bsz == 0 && isz == 0 {
+		return nil
+	}
+
+	data := []byte(fmt.Sprintf("%d %d\n", bsz, isz))
+	return ioutil.WriteFile(path.Join(dir, segmentsfile), data, 0644)
+}
+
+// initSegments writes segment sizes for a new epoch in given directory.
+// Existing epochs keep using the segment sizes used to create them.
+func initSegments(dir string, bsz, isz int64) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return nil
+	}
+
+	return writeSegments(dir, bsz, isz)
+}
@@ -0,0 +1,68 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{
+		Path:             tmpdirc,
+		RecordSize:       5,
+		MaxROEpochs:      2,
+		MaxRWEpochs:      2,
+		BlockSegmentSize: 800,
+		IndexSegmentSize: 4096,
+	})
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	edir := path.Join(tmpdirc, "0")
+	if bsz, isz, err := readSegments(edir); err != nil {
+		t.Fatal(err)
+	} else if bsz != 800 || isz != 4096 {
+		t.Fatal("wrong segment sizes", bsz, isz)
+	}
+
+	if info, err := os.Stat(path.Join(edir, "block_0")); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 800 {
+		t.Fatal("wrong block segment size", info.Size())
+	}
+
+	// existing epochs should use their own segment sizes
+	c = NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if points, _, err := e.Fetch(0, 5, []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if len(points) != 1 || points[0][1].Total != 1 {
+		t.Fatal("wrong result")
+	}
+
+	e.Release()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
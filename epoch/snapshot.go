@@ -0,0 +1,58 @@
+package epoch
+
+import (
+	"os"
+
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+// Snapshot creates the index snapshot of the epoch in given directory if it
+// doesn't have one. Read-only epochs load faster when the snapshot exists as
+// index logs do not have to be read when the epoch is loaded.
+func Snapshot(dir string) (err error) {
+	_, isz, err := readSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	// the index snapshot is created when it's loaded in read-only mode
+	i, err := index.NewRO(dir, isz)
+	if err != nil {
+		return err
+	}
+
+	return i.Close()
+}
+
+// Snapshot creates the index snapshot of the epoch identified by given key
+// unless the epoch is loaded (see Snapshot). This can be used when epochs are
+// no longer writable so that the first reader doesn't have to wait for it.
+// The cache is not locked while creating the snapshot. Instead, the epoch is
+// marked as busy and loads of the epoch wait until it's created.
+func (c *Cache) Snapshot(key int64) (err error) {
+	c.mapmtx.Lock()
+	c.wait(key)
+
+	if c.rwdata.has(key) || c.rodata.has(key) {
+		c.mapmtx.Unlock()
+		return nil
+	}
+
+	done := make(chan struct{})
+	c.busy[key] = done
+	c.mapmtx.Unlock()
+
+	defer func() {
+		c.mapmtx.Lock()
+		delete(c.busy, key)
+		c.mapmtx.Unlock()
+		close(done)
+	}()
+
+	dir := c.epochPath(key)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return Snapshot(dir)
+}
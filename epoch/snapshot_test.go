@@ -0,0 +1,126 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer setupc(t)()
+
+	o := &Options{
+		Path:        tmpdirc,
+		RecordSize:  5,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	snapfile := path.Join(tmpdirc, "0", "snapr_0")
+
+	// loaded epochs are not changed
+	if err := c.Snapshot(0); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(snapfile); !os.IsNotExist(err) {
+		t.Fatal("snapshot should not be created for loaded epochs")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+
+	if err := c.Snapshot(0); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(snapfile); err != nil {
+		t.Fatal("snapshot should be created", err)
+	}
+
+	h, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nodes, err := h.Find([]string{"a", "b"}); err != nil || len(nodes) != 1 {
+		t.Fatal("wrong nodes", nodes, err)
+	}
+
+	loaded := make(chan error)
+	go func() {
+		rw, err := c.LoadRW(0)
+		if err == nil {
+			err = rw.Release()
+		}
+
+		loaded <- err
+	}()
+
+	// snapshot files are removed after readers release the epoch
+	select {
+	case <-loaded:
+		t.Fatal("epoch should not be loaded for writing while in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := os.Stat(snapfile); err != nil {
+		t.Fatal("snapshot should not be removed while in use", err)
+	}
+
+	h.Release()
+
+	if err := <-loaded; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(snapfile); !os.IsNotExist(err) {
+		t.Fatal("snapshot should be removed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotDepth(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(&Options{
+		Path:          tmpdirc,
+		RecordSize:    5,
+		MaxROEpochs:   2,
+		MaxRWEpochs:   2,
+		SnapshotDepth: 2,
+	})
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Release()
+
+	if depth := index.SnapDepth(path.Join(tmpdirc, "0")); depth != 2 {
+		t.Fatal("wrong snapshot depth", depth)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
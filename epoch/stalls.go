@@ -0,0 +1,46 @@
+package epoch
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// stallThreshold is the minimum time a write operation should take
+	// in order to be considered as a write stall. It's a variable only
+	// to make it possible to change the value when running the tests.
+	stallThreshold = 100 * time.Millisecond
+)
+
+// Stalls counts write operations which took longer than expected grouped by
+// the reason for the delay. Counters are incremented atomically therefore
+// values must be read with the Copy method or with atomic.LoadInt64.
+type Stalls struct {
+	// Grow counts writes delayed while allocating space on block or index
+	// log segment files (creating, truncating and memory mapping them).
+	Grow int64
+
+	// Load counts writes delayed while an epoch is loaded or created
+	// in read-write mode (reading all records and index log entries).
+	Load int64
+
+	// Lock counts writes delayed while waiting for the epoch cache lock
+	// which is held when syncing, expiring and loading other epochs.
+	Lock int64
+}
+
+// Copy atomically reads all counters and returns them as a new struct.
+func (s *Stalls) Copy() (c Stalls) {
+	c.Grow = atomic.LoadInt64(&s.Grow)
+	c.Load = atomic.LoadInt64(&s.Load)
+	c.Lock = atomic.LoadInt64(&s.Lock)
+	return c
+}
+
+// recordStall increments given counter if the time passed since `start`
+// is longer than the stall threshold. Counters are updated atomically.
+func recordStall(counter *int64, start time.Time) {
+	if time.Since(start) >= stallThreshold {
+		atomic.AddInt64(counter, 1)
+	}
+}
@@ -0,0 +1,55 @@
+package epoch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStalls(t *testing.T) {
+	defer setupc(t)()
+
+	defer func(d time.Duration) { stallThreshold = d }(stallThreshold)
+	stallThreshold = time.Hour
+
+	c := NewCache(&Options{Path: tmpdirc, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+	defer c.Close()
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Stalls(); s.Grow != 0 || s.Load != 0 || s.Lock != 0 {
+		t.Fatal("unexpected stall")
+	}
+
+	// consider every write as a stall
+	stallThreshold = 0
+
+	e, err = c.LoadRW(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block and the index log both allocate their first segment
+	if s := c.Stalls(); s.Grow != 2 || s.Load != 1 || s.Lock != 1 {
+		t.Fatal("wrong stall count")
+	}
+
+	// writes to existing records do not allocate any space
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Stalls(); s.Grow != 2 {
+		t.Fatal("wrong grow stall count")
+	}
+}
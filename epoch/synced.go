@@ -0,0 +1,71 @@
+package epoch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// syncedfile is written after all epoch files are synced in durable mode.
+	// It has a sequence number which increases on each sync and the size of
+	// the index log when the sync started. Index log entries written after
+	// that may point at block records which were not synced to the disk.
+	syncedfile = "synced"
+)
+
+// readSynced reads the sync marker of the epoch in given directory.
+// `ok` will be false if the epoch does not have a sync marker.
+func readSynced(dir string) (seq, size int64, ok bool, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, syncedfile))
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+
+	if _, err := fmt.Sscan(string(data), &seq, &size); err != nil {
+		return 0, 0, false, err
+	}
+
+	return seq, size, true, nil
+}
+
+// writeSynced replaces the sync marker of the epoch in given directory.
+// The marker is written to a temporary file first to replace it atomically.
+func writeSynced(dir string, seq, size int64) (err error) {
+	file := path.Join(dir, syncedfile)
+	tmp := file + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%d %d\n", seq, size); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// removeSynced removes the sync marker as it will not be updated anymore
+func removeSynced(dir string) (err error) {
+	err = os.Remove(path.Join(dir, syncedfile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
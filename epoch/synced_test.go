@@ -0,0 +1,94 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSynced(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.SetDurable(true)
+
+	if err := e.Track(1, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if seq, _, ok, err := readSynced(dir); err != nil {
+		t.Fatal(err)
+	} else if !ok || seq != 2 {
+		t.Fatal("wrong sync marker")
+	}
+
+	// written after the last sync and the epoch is not closed (crash)
+	if err := e.Track(1, []string{"b"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, nodes, err := e.Fetch(0, 5, []string{"*"}); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 || nodes[0].Fields[0] != "a" {
+		t.Fatal("unsynced nodes should be discarded")
+	}
+
+	if err := e.Track(1, []string{"c"}, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// not durable anymore, the sync marker should be removed
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, syncedfile)); !os.IsNotExist(err) {
+		t.Fatal("sync marker should be removed")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := e.Fetch(0, 5, []string{"c"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 1 {
+		t.Fatal("wrong number of records")
+	}
+
+	if points[0][1].Total != 3 || points[0][1].Count != 1 {
+		t.Fatal("discarded record values should be cleared")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
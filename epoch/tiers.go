@@ -0,0 +1,183 @@
+package epoch
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Migrate moves epochs older than given timestamp from the main data directory
+// and faster storage tiers to the last (slowest) storage tier. Epochs loaded
+// in read-write mode are not moved. Read-only epochs are closed and will be
+// loaded again when requested. Epochs are moved without the cache lock but
+// loads of an epoch wait until it's moved.
+func (c *Cache) Migrate(ts int64) (err error) {
+	if len(c.tiers) == 0 {
+		return nil
+	}
+
+	target := c.tiers[len(c.tiers)-1]
+	roots := append([]string{c.dbpath}, c.tiers[:len(c.tiers)-1]...)
+	moved := map[int64]bool{}
+
+	for _, root := range roots {
+		files, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if !file.IsDir() {
+				continue
+			}
+
+			key, err := strconv.ParseInt(file.Name(), 10, 64)
+			if err != nil || key >= ts || moved[key] {
+				continue
+			}
+
+			moved[key] = true
+			if err := c.migrate(key, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrate moves a single epoch to given tier directory unless it's loaded in
+// read-write mode. The epoch is closed if it's loaded in read-only mode and
+// moved after all handles to it are released.
+func (c *Cache) migrate(key int64, target string) (err error) {
+	done, ok, err := c.hold(key)
+	if err != nil || !ok {
+		return err
+	}
+
+	defer done()
+
+	src, ok := c.findPath(key)
+	if !ok || path.Dir(src) == path.Clean(target) {
+		return nil
+	}
+
+	// downloaded copies of offloaded epochs are not moved
+	if c.coldpath != "" && path.Dir(src) == path.Clean(c.coldpath) {
+		return nil
+	}
+
+	return moveDir(src, path.Join(target, strconv.Itoa(int(key))))
+}
+
+// epochPath returns the directory of the epoch identified by given key.
+// The main data directory and tiers are checked in order and the first
+// existing directory is used. Otherwise, the main data directory is used.
+func (c *Cache) epochPath(key int64) (dir string) {
+	dir, _ = c.findPath(key)
+	return dir
+}
+
+// findPath is the same as epochPath but `ok` will be false if the epoch
+// directory does not exist in the main data directory, tiers or the local
+// directory used to store epochs downloaded from the object store.
+func (c *Cache) findPath(key int64) (dir string, ok bool) {
+	keystr := strconv.Itoa(int(key))
+	dir = path.Join(c.dbpath, keystr)
+
+	if _, err := os.Stat(dir); err == nil {
+		return dir, true
+	}
+
+	roots := c.tiers
+	if c.coldpath != "" {
+		roots = append(roots[:len(roots):len(roots)], c.coldpath)
+	}
+
+	for _, root := range roots {
+		tdir := path.Join(root, keystr)
+		if _, err := os.Stat(tdir); err == nil {
+			return tdir, true
+		}
+	}
+
+	return dir, false
+}
+
+// moveDir moves a directory with files to a new location. Tiers are usually
+// on different devices where os.Rename fails. If that happens, files are
+// copied to the new location and the source directory is removed afterwards.
+func moveDir(src, dst string) (err error) {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	// incomplete copies from earlier attempts
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if err := copyDir(src, dst); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// copyDir copies the directory on `src` path to `dst` path with all files
+// and subdirectories.
+func copyDir(src, dst string) (err error) {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		copyFn := copyFile
+		if file.IsDir() {
+			copyFn = copyDir
+		}
+
+		if err := copyFn(path.Join(src, name), path.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies the file on `src` path to `dst` path and syncs it.
+func copyFile(src, dst string) (err error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
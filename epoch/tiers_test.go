@@ -0,0 +1,230 @@
+package epoch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var (
+	tmpdirt = "/tmp/test-tiers/"
+)
+
+func TestMigrate(t *testing.T) {
+	defer setupc(t)()
+
+	if err := os.RemoveAll(tmpdirt); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdirt, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirt)
+
+	c := NewCache(&Options{Path: tmpdirc, Tiers: []string{tmpdirt}, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs loaded in read-write mode should not move
+	if err := c.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); err != nil {
+		t.Fatal("epoch should not move")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(&Options{Path: tmpdirc, Tiers: []string{tmpdirt}, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2})
+	if err := c.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(tmpdirc, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should move")
+	}
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != 1 || ps[0][0].Total != 1 || ps[0][0].Count != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateTiers(t *testing.T) {
+	defer setupc(t)()
+
+	tier1 := path.Join(tmpdirt, "1")
+	tier2 := path.Join(tmpdirt, "2")
+
+	if err := os.RemoveAll(tmpdirt); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tier1, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdirt)
+
+	o := &Options{Path: tmpdirc, Tiers: []string{tier1, tier2}, RecordSize: 5, MaxROEpochs: 2, MaxRWEpochs: 2}
+	c := NewCache(o)
+
+	e, err := c.LoadRW(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveDir(path.Join(tmpdirc, "0"), path.Join(tier1, "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(o)
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated := make(chan error)
+	go func() {
+		migrated <- c.Migrate(1)
+	}()
+
+	select {
+	case <-migrated:
+		t.Fatal("epoch should not move while in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, _, err := e.Fetch(0, 1, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-migrated; err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs on faster tiers should move to the last tier
+	if _, err := os.Stat(path.Join(tier1, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should move")
+	}
+
+	e, err = c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.dir != path.Join(tier2, "0") {
+		t.Fatal("epoch should be loaded from the last tier")
+	}
+
+	ps, _, err := e.Fetch(0, 1, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ps) != 1 || ps[0][0].Total != 1 || ps[0][0].Count != 1 {
+		t.Fatal("wrong value")
+	}
+
+	if err := e.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	defer setupc(t)()
+
+	src := path.Join(tmpdirc, "src")
+	dst := path.Join(tmpdirc, "dst")
+	data := []byte("test data")
+
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := ioutil.ReadFile(dst); err != nil {
+		t.Fatal(err)
+	} else if string(out) != string(data) {
+		t.Fatal("wrong data")
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	defer setupc(t)()
+
+	src := path.Join(tmpdirc, "src")
+	dst := path.Join(tmpdirc, "dst")
+	data := []byte("test data")
+
+	if err := os.MkdirAll(path.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"f", "a/f", "a/b/f"} {
+		if err := ioutil.WriteFile(path.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := copyDir(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"f", "a/f", "a/b/f"} {
+		if out, err := ioutil.ReadFile(path.Join(dst, name)); err != nil {
+			t.Fatal(err)
+		} else if string(out) != string(data) {
+			t.Fatal("wrong data")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package epoch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// updatedfile stores the time of the last synced write to the epoch.
+	// It can be used to find epochs which changed after a given time.
+	updatedfile = "updated"
+)
+
+// Updated returns the last time the epoch in given directory was written to
+// as a unix timestamp in nanoseconds. If the epoch does not have an updated
+// time file, the latest modification time of epoch files is used instead.
+func Updated(dir string) (ts int64, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, updatedfile))
+	if err == nil {
+		return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		if mt := file.ModTime().UnixNano(); mt > ts {
+			ts = mt
+		}
+	}
+
+	return ts, nil
+}
+
+// writeUpdated writes the updated time file for the epoch in given directory
+func writeUpdated(dir string, ts int64) (err error) {
+	data := []byte(strconv.FormatInt(ts, 10))
+	return ioutil.WriteFile(path.Join(dir, updatedfile), data, 0644)
+}
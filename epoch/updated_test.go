@@ -0,0 +1,69 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestUpdated(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	synced := time.Now().UnixNano()
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := Updated(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if ts < synced {
+		t.Fatal("wrong updated time")
+	}
+
+	// syncing without any writes should not change the time
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts2, err := Updated(dir); err != nil {
+		t.Fatal(err)
+	} else if ts2 != ts {
+		t.Fatal("updated time should not change")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// uses file modification times when there's no updated file
+	if err := os.Remove(path.Join(dir, updatedfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(-time.Minute).UnixNano()
+	if ts, err := Updated(dir); err != nil {
+		t.Fatal(err)
+	} else if ts < before {
+		t.Fatal("wrong updated time")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
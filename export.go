@@ -0,0 +1,79 @@
+package kadiyadb
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Export writes all points with measurements of series matching given fields
+// in the time range to w in given format. The output can be imported with
+// DB.Import. Results are written chunk by chunk as they are fetched so only
+// one epoch is kept in memory at a time. It returns the number of points.
+func (d *DB) Export(from, to uint64, fields []string, format string, w io.Writer) (n int64, err error) {
+	var write func(rec *Record) error
+	var flush func() error
+
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		write = func(rec *Record) error { return writeCSV(cw, rec) }
+		flush = func() error { cw.Flush(); return cw.Error() }
+	case FormatJSON:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(rec *Record) error { return enc.Encode(rec) }
+		flush = bw.Flush
+	default:
+		return 0, ErrFormat
+	}
+
+	res := uint64(d.params.Resolution)
+	rec := &Record{}
+
+	err = d.FetchStream(context.Background(), from, to, fields, func(chunk *protocol.Chunk) error {
+		for _, s := range chunk.Series {
+			rec.Fields = s.Fields
+
+			for i, p := range s.Points {
+				if p.Total == 0 && p.Count == 0 {
+					continue
+				}
+
+				rec.Timestamp = chunk.From + uint64(i)*res
+				rec.Total = p.Total
+				rec.Count = p.Count
+
+				if err := write(rec); err != nil {
+					return err
+				}
+
+				n++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, flush()
+}
+
+// writeCSV writes a record in CSV format
+func writeCSV(w *csv.Writer, rec *Record) (err error) {
+	values := make([]string, 3, 3+len(rec.Fields))
+	values[0] = strconv.FormatUint(rec.Timestamp, 10)
+	values[1] = strconv.FormatFloat(rec.Total, 'g', -1, 64)
+	values[2] = strconv.FormatFloat(rec.Count, 'g', -1, 64)
+	values = append(values, rec.Fields...)
+
+	return w.Write(values)
+}
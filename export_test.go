@@ -0,0 +1,66 @@
+package kadiyadb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(60000000000, []string{"a", "b"}, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(3600000000000, []string{"a", "b"}, 2.5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		FormatCSV: "60000000000,3,2,a,b\n3600000000000,2.5,1,a,b\n",
+		FormatJSON: `{"timestamp":60000000000,"fields":["a","b"],"total":3,"count":2}` + "\n" +
+			`{"timestamp":3600000000000,"fields":["a","b"],"total":2.5,"count":1}` + "\n",
+	}
+
+	for format, str := range expected {
+		buff := &bytes.Buffer{}
+		n, err := db.Export(0, 2*3600000000000, []string{"a", "b"}, format, buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 2 || buff.String() != str {
+			t.Fatal("wrong result", format, n, buff.String())
+		}
+	}
+
+	if _, err := db.Export(0, 1, []string{"a"}, "parquet", &bytes.Buffer{}); err != ErrFormat {
+		t.Fatal("expected ErrFormat")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
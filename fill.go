@@ -0,0 +1,169 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Fill defines how points without measurements are filled in results
+type Fill int
+
+const (
+	// FillNull sets totals and counts of empty points to NaN (default)
+	FillNull Fill = iota
+
+	// FillZero keeps empty points as zeros
+	FillZero
+
+	// FillPrevious copies the previous point which has measurements
+	FillPrevious
+
+	// FillLinear interpolates totals and counts between the previous and
+	// the next points which have measurements
+	FillLinear
+)
+
+var (
+	// ErrInvFill is returned when the fill policy is not supported
+	ErrInvFill = errors.New("invalid fill policy")
+)
+
+// FilledSeries has points of a series for the whole time range. Point i is
+// for the time range starting at From + i*Step. Points which could not be
+// filled (ex: no previous point) are set to NaN. The validity bitmap tells
+// which points have measurements and which points were filled.
+type FilledSeries struct {
+	Fields []string
+	From   uint64
+	Step   uint64
+	Points []protocol.Point
+	Valid  []uint64
+}
+
+// IsValid checks whether point i has measurements (it's not filled)
+func (s *FilledSeries) IsValid(i int) bool {
+	return s.Valid[i/64]&(1<<uint(i%64)) != 0
+}
+
+// FillHandler is a function which is called with FetchFill result.
+// Results are copies therefore they can be used after the function returns.
+type FillHandler func(result []*FilledSeries, err error)
+
+// FetchFill is the same as FetchContext but points of a series from all epochs
+// are merged into a single series and empty points are filled with given fill
+// policy. Points are empty when they do not have any measurements. Series are
+// ordered by the chunk they first appear in and their order in that chunk.
+func (d *DB) FetchFill(ctx context.Context, from, to uint64, fields []string, fill Fill, fn FillHandler) {
+	if fill < FillNull || fill > FillLinear {
+		fn(nil, ErrInvFill)
+		return
+	}
+
+	l := d.level(from)
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		result := l.filled(chunks)
+		for _, s := range result {
+			s.fill(fill)
+		}
+
+		fn(result, nil)
+	}, l.fetchQuery(fields))
+}
+
+// filled converts chunks to filled series without filling empty points
+func (d *DB) filled(chunks []*protocol.Chunk) (result []*FilledSeries) {
+	res := uint64(d.params.Resolution)
+	result = []*FilledSeries{}
+	if len(chunks) == 0 {
+		return result
+	}
+
+	var n uint64
+	for _, c := range chunks {
+		n += (c.To - c.From) / res
+	}
+
+	seen := map[string]*FilledSeries{}
+	from := chunks[0].From
+
+	for _, c := range chunks {
+		off := int((c.From - from) / res)
+
+		for _, s := range c.Series {
+			key := strings.Join(s.Fields, "\x00")
+			fs, ok := seen[key]
+			if !ok {
+				fs = &FilledSeries{
+					Fields: append([]string(nil), s.Fields...),
+					From:   from,
+					Step:   res,
+					Points: make([]protocol.Point, n),
+					Valid:  make([]uint64, (n+63)/64),
+				}
+
+				seen[key] = fs
+				result = append(result, fs)
+			}
+
+			for i, p := range s.Points {
+				if p.Total == 0 && p.Count == 0 {
+					continue
+				}
+
+				j := off + i
+				fs.Points[j] = p
+				fs.Valid[j/64] |= 1 << uint(j%64)
+			}
+		}
+	}
+
+	return result
+}
+
+// fill fills empty points of the series with given fill policy
+func (s *FilledSeries) fill(fill Fill) {
+	if fill == FillZero {
+		return
+	}
+
+	null := protocol.Point{Total: math.NaN(), Count: math.NaN()}
+	prev := -1
+
+	for i := range s.Points {
+		if s.IsValid(i) {
+			if fill == FillLinear && prev >= 0 {
+				s.interpolate(prev, i)
+			}
+
+			prev = i
+			continue
+		}
+
+		if fill == FillPrevious && prev >= 0 {
+			s.Points[i] = s.Points[prev]
+		} else {
+			s.Points[i] = null
+		}
+	}
+}
+
+// interpolate sets points between two valid points with linear interpolation
+func (s *FilledSeries) interpolate(a, b int) {
+	pa, pb := s.Points[a], s.Points[b]
+	for i := a + 1; i < b; i++ {
+		f := float64(i-a) / float64(b-a)
+		s.Points[i] = protocol.Point{
+			Total: pa.Total + (pb.Total-pa.Total)*f,
+			Count: pa.Count + (pb.Count-pa.Count)*f,
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package kadiyadb
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFetchFill(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	min := uint64(p.Resolution)
+
+	if err := db.Track(1*min, fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(4*min, fields, 8, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	nan := math.NaN()
+	tests := map[Fill][]protocol.Point{
+		FillNull:     {{nan, nan}, {2, 1}, {nan, nan}, {nan, nan}, {8, 4}, {nan, nan}},
+		FillZero:     {{0, 0}, {2, 1}, {0, 0}, {0, 0}, {8, 4}, {0, 0}},
+		FillPrevious: {{nan, nan}, {2, 1}, {2, 1}, {2, 1}, {8, 4}, {8, 4}},
+		FillLinear:   {{nan, nan}, {2, 1}, {4, 2}, {6, 3}, {8, 4}, {nan, nan}},
+	}
+
+	for fill, exp := range tests {
+		db.FetchFill(context.Background(), 0, 6*min, fields, fill, func(res []*FilledSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || res[0].From != 0 || res[0].Step != min || !samePoints(res[0].Points, exp) {
+				t.Fatal("wrong result", fill, res)
+			}
+
+			for i := range exp {
+				if res[0].IsValid(i) != (i == 1 || i == 4) {
+					t.Fatal("wrong validity", fill, i)
+				}
+			}
+		})
+	}
+
+	// series are filled in epochs which do not have them
+	db.FetchFill(context.Background(), 0, uint64(p.Duration)+2*min, fields, FillPrevious, func(res []*FilledSeries, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := []protocol.Point{{8, 4}, {8, 4}}
+		if len(res) != 1 || len(res[0].Points) != 62 || !samePoints(res[0].Points[60:], exp) {
+			t.Fatal("wrong result", res)
+		}
+	})
+
+	db.FetchFill(context.Background(), 0, min, fields, Fill(-1), func(res []*FilledSeries, err error) {
+		if err != ErrInvFill {
+			t.Fatal("expected ErrInvFill", err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// samePoints compares points treating NaN values as equal
+func samePoints(a, b []protocol.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	same := func(x, y float64) bool {
+		return x == y || (math.IsNaN(x) && math.IsNaN(y))
+	}
+
+	for i := range a {
+		if !same(a[i].Total, b[i].Total) || !same(a[i].Count, b[i].Count) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,226 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	// infbucket is the field value used for the bucket which has values
+	// larger than the upper bound of the last histogram bucket.
+	infbucket = "+Inf"
+)
+
+var (
+	// ErrNoHistogram is returned when the database has no histogram buckets
+	ErrNoHistogram = errors.New("database has no histogram buckets")
+
+	// ErrInvPercentile is returned when a percentile is not within 0 and 100
+	ErrInvPercentile = errors.New("invalid percentile")
+)
+
+// PercentilePoint has estimated percentile values of a histogram series at
+// the start of its time range. Values are in the same order as percentiles.
+type PercentilePoint struct {
+	Timestamp uint64
+	Values    []float64
+}
+
+// PercentileSeries has percentile values of a histogram series. Points
+// without any measurements are not included in the series.
+type PercentileSeries struct {
+	Fields []string
+	Points []PercentilePoint
+}
+
+// PercentileHandler is a function which is called with FetchPercentiles result
+type PercentileHandler func(result []*PercentileSeries, err error)
+
+// TrackHistogram adds a value to the histogram series with given fields.
+// Histograms are stored as a series for each bucket with the upper bound of
+// the bucket as the last field (see Params.Buckets). Bucket series have the
+// sum of values in the bucket as the total and the number of values as count
+// therefore the series with given fields has the total of all buckets.
+func (d *DB) TrackHistogram(ts uint64, fields []string, value float64) (err error) {
+	if len(d.params.Buckets) == 0 {
+		return ErrNoHistogram
+	}
+
+	bucket := append(fields[:len(fields):len(fields)], d.bucket(value))
+	return d.Track(ts, bucket, value, 1)
+}
+
+// FetchPercentiles fetches histogram series matching given fields and
+// estimates given percentiles (ex: 50, 95, 99) for each point. Percentiles
+// are estimated using linear interpolation inside the matching bucket.
+// Values larger than the last bucket are estimated with their average.
+func (d *DB) FetchPercentiles(ctx context.Context, from, to uint64, fields []string, percentiles []float64, fn PercentileHandler) {
+	if len(d.params.Buckets) == 0 {
+		fn(nil, ErrNoHistogram)
+		return
+	}
+
+	for _, p := range percentiles {
+		if p < 0 || p > 100 || math.IsNaN(p) {
+			fn(nil, ErrInvPercentile)
+			return
+		}
+	}
+
+	// data may be fetched from a rollup level with a lower resolution
+	l := d.level(from)
+	res := uint64(l.params.Resolution)
+
+	buckets := append(fields[:len(fields):len(fields)], "*")
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(d.percentiles(chunks, percentiles, res), nil)
+	}, l.fetchQuery(buckets))
+}
+
+// bucket returns the field value of the histogram bucket for given value
+func (d *DB) bucket(value float64) (name string) {
+	i := sort.SearchFloat64s(d.params.Buckets, value)
+	if i == len(d.params.Buckets) {
+		return infbucket
+	}
+
+	return strconv.FormatFloat(d.params.Buckets[i], 'g', -1, 64)
+}
+
+// percentiles groups bucket series in chunks by their histogram series and
+// estimates percentiles for each point with measurements. Series are ordered
+// by the chunk they first appear in and their order in that chunk. Points in
+// chunks are `res` nanoseconds apart (resolution of the fetched level).
+func (d *DB) percentiles(chunks []*protocol.Chunk, percentiles []float64, res uint64) (result []*PercentileSeries) {
+	nb := len(d.params.Buckets)
+
+	index := make(map[string]int, nb+1)
+	for i, b := range d.params.Buckets {
+		index[strconv.FormatFloat(b, 'g', -1, 64)] = i
+	}
+	index[infbucket] = nb
+
+	type histogram struct {
+		series *PercentileSeries
+		points map[uint64][]protocol.Point
+	}
+
+	seen := map[string]*histogram{}
+	order := []*histogram{}
+
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			if len(s.Fields) == 0 {
+				continue
+			}
+
+			n := len(s.Fields) - 1
+			bi, ok := index[s.Fields[n]]
+			if !ok {
+				continue
+			}
+
+			key := strings.Join(s.Fields[:n], "\x00")
+			h, ok := seen[key]
+			if !ok {
+				h = &histogram{
+					series: &PercentileSeries{Fields: append([]string(nil), s.Fields[:n]...)},
+					points: map[uint64][]protocol.Point{},
+				}
+
+				seen[key] = h
+				order = append(order, h)
+			}
+
+			for i, p := range s.Points {
+				if p.Count == 0 {
+					continue
+				}
+
+				ts := c.From + uint64(i)*res
+				counts, ok := h.points[ts]
+				if !ok {
+					counts = make([]protocol.Point, nb+1)
+					h.points[ts] = counts
+				}
+
+				counts[bi].Total += p.Total
+				counts[bi].Count += p.Count
+			}
+		}
+	}
+
+	result = make([]*PercentileSeries, len(order))
+	for i, h := range order {
+		times := make([]uint64, 0, len(h.points))
+		for ts := range h.points {
+			times = append(times, ts)
+		}
+
+		sort.Sort(byTimestamp(times))
+
+		for _, ts := range times {
+			values := make([]float64, len(percentiles))
+			for j, p := range percentiles {
+				values[j] = estimate(d.params.Buckets, h.points[ts], p)
+			}
+
+			h.series.Points = append(h.series.Points, PercentilePoint{ts, values})
+		}
+
+		result[i] = h.series
+	}
+
+	return result
+}
+
+// estimate estimates the percentile using bucket upper bounds and points of
+// each bucket. The last point is the bucket for values above all bounds.
+func estimate(bounds []float64, buckets []protocol.Point, percentile float64) float64 {
+	var total float64
+	for _, b := range buckets {
+		total += b.Count
+	}
+
+	rank := total * percentile / 100
+	var seen float64
+
+	for i, b := range buckets {
+		if b.Count == 0 || seen+b.Count < rank {
+			seen += b.Count
+			continue
+		}
+
+		if i == len(bounds) {
+			return b.Total / b.Count
+		}
+
+		upper := bounds[i]
+		lower := math.Min(0, upper)
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+
+		return lower + (upper-lower)*(rank-seen)/b.Count
+	}
+
+	return 0
+}
+
+// byTimestamp sorts timestamps in ascending order
+type byTimestamp []uint64
+
+func (a byTimestamp) Len() int           { return len(a) }
+func (a byTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTimestamp) Less(i, j int) bool { return a[i] < a[j] }
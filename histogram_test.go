@@ -0,0 +1,171 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFetchPercentiles(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Buckets:     []float64{10, 20, 40},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	ts0 := uint64(p.Resolution * 2)
+
+	for _, v := range []float64{5, 5, 15, 15, 15, 15, 35, 35, 35, 100} {
+		if err := db.TrackHistogram(ts0, fields, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []*PercentileSeries{{
+		Fields: fields,
+		Points: []PercentilePoint{{ts0, []float64{0, 17.5, 100}}},
+	}}
+
+	percentiles := []float64{0, 50, 100}
+	db.FetchPercentiles(context.Background(), 0, uint64(p.Duration), fields, percentiles, func(res []*PercentileSeries, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	// the histogram series has the total of all buckets
+	db.Fetch(ts0, ts0+uint64(p.Resolution), fields, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 || res[0].Series[0].Points[0].Count != 10 {
+			t.Fatal("wrong result")
+		}
+	})
+
+	db.FetchPercentiles(context.Background(), 0, uint64(p.Duration), fields, []float64{101}, func(res []*PercentileSeries, err error) {
+		if err != ErrInvPercentile {
+			t.Fatal("should return error")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Buckets = []float64{10, 5}
+	if _, err := Open(dir, p); !errors.Is(err, ErrInvParams) {
+		t.Fatal("should return error")
+	}
+
+	p.Buckets = nil
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.TrackHistogram(ts0, fields, 1); err != ErrNoHistogram {
+		t.Fatal("should return error")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchPercentilesRollup(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Buckets:     []float64{10, 20, 40},
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	res := uint64(p.Rollups[0].Resolution)
+
+	for _, v := range []float64{5, 5, 15, 15, 15, 15, 35, 35, 35, 100} {
+		if err := db.TrackHistogram(res, fields, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// data at this time is fetched from the rollup level
+	expected := []*PercentileSeries{{
+		Fields: fields,
+		Points: []PercentilePoint{{res, []float64{0, 17.5, 100}}},
+	}}
+
+	percentiles := []float64{0, 50, 100}
+	db.FetchPercentiles(context.Background(), 0, 2*res, fields, percentiles, func(res []*PercentileSeries, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatal("wrong result", res)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
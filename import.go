@@ -0,0 +1,199 @@
+package kadiyadb
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	// FormatCSV has a point on each line as comma separated values.
+	// The first 3 values are the timestamp (in nanoseconds), the total and
+	// the count. All other values are fields of the series.
+	//
+	//   1451606400000000000,10.5,2,cpu,host1
+	//
+	FormatCSV = "csv"
+
+	// FormatJSON has a JSON object for each point on each line.
+	//
+	//   {"timestamp":1451606400000000000,"fields":["cpu","host1"],"total":10.5,"count":2}
+	//
+	FormatJSON = "json"
+)
+
+var (
+	// ErrFormat is returned when the data format is not supported
+	ErrFormat = errors.New("unsupported data format")
+)
+
+// Record is a point of a series with its timestamp.
+// It's used when importing and exporting data.
+type Record struct {
+	Timestamp uint64   `json:"timestamp"`
+	Fields    []string `json:"fields"`
+	Total     float64  `json:"total"`
+	Count     float64  `json:"count"`
+}
+
+// Import reads points in given format and adds them to the database. Points
+// are grouped by epoch first so each epoch is loaded and written only once.
+// Index snapshots are created for imported epochs which are not writable
+// anymore. Cached pages of imported epochs are dropped after syncing them.
+// All points are kept in memory until they are written.
+// It returns the number of imported points.
+func (d *DB) Import(r io.Reader, format string) (n int64, err error) {
+	epochs := map[int64][]*Record{}
+
+	add := func(rec *Record) error {
+		ets, _ := d.split(rec.Timestamp)
+		if ets < 0 {
+			return ErrInvTime
+		}
+
+		epochs[ets] = append(epochs[ets], rec)
+		return nil
+	}
+
+	switch format {
+	case FormatCSV:
+		err = readCSV(r, add)
+	case FormatJSON:
+		err = readJSON(r, add)
+	default:
+		err = ErrFormat
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]int64, 0, len(epochs))
+	for ets := range epochs {
+		keys = append(keys, ets)
+	}
+
+	sort.Sort(int64s(keys))
+
+	for _, ets := range keys {
+		if err := d.importEpoch(ets, epochs[ets]); err != nil {
+			return n, err
+		}
+
+		n += int64(len(epochs[ets]))
+	}
+
+	if err := d.Sync(); err != nil {
+		return n, err
+	}
+
+	// read-only epochs create index snapshots when they're loaded
+	for _, ets := range keys {
+		e, err := d.cache.LoadRO(ets)
+		if err != nil {
+			return n, err
+		}
+
+		// imported epochs are synced and they should not evict frequently
+		// used data from the page cache (hints are optional)
+		e.DropCache()
+		e.Release()
+	}
+
+	return n, nil
+}
+
+// importEpoch adds all records to the epoch which starts at ets the same way
+// as TrackContext (including quotas, min/max values and closed epochs).
+func (d *DB) importEpoch(ets int64, records []*Record) (err error) {
+	e, err := d.cache.LoadRW(ets)
+	if err != nil {
+		return err
+	}
+
+	defer e.Release()
+
+	ctx := context.Background()
+	for _, rec := range records {
+		done, err := d.checkQuota()
+		if err != nil {
+			return err
+		}
+
+		err = d.trackEpoch(ctx, e.Epoch, rec.Timestamp, rec.Fields, rec.Total, rec.Count)
+		done(err == nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCSV reads records in CSV format and calls fn with each record
+func readCSV(r io.Reader, fn func(rec *Record) error) (err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	for line := 1; ; line++ {
+		values, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(values) < 4 {
+			return fmt.Errorf("line %d: %s", line, ErrFormat)
+		}
+
+		rec := &Record{Fields: values[3:]}
+		if rec.Timestamp, err = strconv.ParseUint(values[0], 10, 64); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.Total, err = strconv.ParseFloat(values[1], 64); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.Count, err = strconv.ParseFloat(values[2], 64); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+
+		if err := fn(rec); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+}
+
+// readJSON reads records in JSON format and calls fn with each record
+func readJSON(r io.Reader, fn func(rec *Record) error) (err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(s.Bytes(), rec); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+
+		if len(rec.Fields) == 0 {
+			return fmt.Errorf("line %d: %s", line, ErrFormat)
+		}
+
+		if err := fn(rec); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+
+	return s.Err()
+}
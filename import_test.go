@@ -0,0 +1,135 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestImport(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]string{
+		FormatCSV: "3600000000000,2,1,a,b\n0,1,1,a,b\n60000000000,3,2,a,b\n",
+		FormatJSON: `{"timestamp":0,"fields":["a","b"],"total":1,"count":1}` + "\n" +
+			`{"timestamp":3600000000000,"fields":["a","b"],"total":2,"count":1}` + "\n" +
+			`{"timestamp":60000000000,"fields":["a","b"],"total":3,"count":2}` + "\n",
+	}
+
+	for format, str := range data {
+		if n, err := db.Import(strings.NewReader(str), format); err != nil {
+			t.Fatal(err)
+		} else if n != 3 {
+			t.Fatal("wrong number of points", n)
+		}
+	}
+
+	db.Fetch(0, uint64(2*p.Resolution), []string{"a", "b"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []protocol.Point{{2, 2}, {6, 4}}
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			!reflect.DeepEqual(res[0].Series[0].Points, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	// the first epoch is not writable after importing the second one
+	if _, err := os.Stat(path.Join(dir, "0", "snapr_0")); err != nil {
+		t.Fatal("index snapshot should be created", err)
+	}
+
+	if _, err := db.Import(strings.NewReader("0,1,a,b\n"), FormatCSV); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if _, err := db.Import(strings.NewReader(""), "xml"); err != ErrFormat {
+		t.Fatal("should return error")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportLeafOnly(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		LeafOnly:    true,
+		MinMax:      true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	str := "0,1,1,a,b\n0,6,2,a,b\n"
+	if _, err := db.Import(strings.NewReader(str), FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+
+	// imported points are written the same way as tracked points
+	if n, err := db.Count(0, uint64(p.Resolution), []string{"a"}); err != nil || n != 0 {
+		t.Fatal("parent series should not be stored", n, err)
+	}
+
+	db.FetchMinMax(context.Background(), 0, uint64(p.Resolution), []string{"a", "b"}, func(res []*MinMaxChunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			res[0].Series[0].Points[0] != (MinMaxPoint{Min: 1, Max: 3}) {
+			t.Fatal("min/max values should be tracked")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// bloomfile has bloom filters of first level snapshot branches
+	bloomfile = "snapbloom"
+
+	// number of bits used for each key and the number of hash functions
+	// the false positive rate is around 1% with these values
+	bloomBits   = 10
+	bloomHashes = 7
+)
+
+// bloom is a bloom filter with fields of all index nodes in a snapshot branch.
+// It's used to check whether a branch may have an index node without loading
+// the branch. Branches never have nodes which are not in the filter.
+type bloom struct {
+	bits []uint64
+}
+
+// newBloom creates a bloom filter for given number of keys
+func newBloom(n int) (b *bloom) {
+	words := (n*bloomBits + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+
+	return &bloom{bits: make([]uint64, words)}
+}
+
+// add adds the key to the filter
+func (b *bloom) add(key string) {
+	h1, h2 := bloomHash(key)
+	m := uint64(len(b.bits) * 64)
+
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) % m
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// has checks whether the key may have been added to the filter
+func (b *bloom) has(key string) bool {
+	h1, h2 := bloomHash(key)
+	m := uint64(len(b.bits) * 64)
+
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) % m
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bloomHash returns two hashes of the key used to get bit positions
+func bloomHash(key string) (h1, h2 uint64) {
+	f1 := fnv.New64a()
+	f1.Write([]byte(key))
+
+	f2 := fnv.New64()
+	f2.Write([]byte(key))
+
+	// the second hash must not be zero to get different positions
+	return f1.Sum64(), f2.Sum64() | 1
+}
+
+// branchBlooms creates bloom filters for each first level branch of the tree
+func branchBlooms(tree *TNode) (blooms map[string]*bloom) {
+	blooms = make(map[string]*bloom, len(tree.Children))
+
+	for name, tn := range tree.Children {
+		nodes := tn.All()
+
+		b := newBloom(len(nodes))
+		for _, n := range nodes {
+			b.add(branchKey(n.Fields))
+		}
+
+		blooms[name] = b
+	}
+
+	return blooms
+}
+
+// writeBlooms writes bloom filters of snapshot branches to given directory.
+// Each filter is written as the name size, the name, the number of words
+// and words of the filter.
+func writeBlooms(dir string, blooms map[string]*bloom) (err error) {
+	buff := &bytes.Buffer{}
+
+	for name, b := range blooms {
+		binary.Write(buff, binary.LittleEndian, int64(len(name)))
+		buff.WriteString(name)
+		binary.Write(buff, binary.LittleEndian, int64(len(b.bits)))
+		binary.Write(buff, binary.LittleEndian, b.bits)
+	}
+
+	return ioutil.WriteFile(path.Join(dir, bloomfile), buff.Bytes(), 0644)
+}
+
+// readBlooms reads bloom filters of snapshot branches from given directory.
+// It returns a nil map if the snapshot does not have bloom filters.
+func readBlooms(dir string) (blooms map[string]*bloom, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, bloomfile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+	blooms = map[string]*bloom{}
+
+	for r.Len() > 0 {
+		var size int64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		} else if size < 0 || size > int64(r.Len()) {
+			return nil, ErrNoSnap
+		}
+
+		name := make([]byte, size)
+		if _, err := r.Read(name); err != nil {
+			return nil, err
+		}
+
+		var words int64
+		if err := binary.Read(r, binary.LittleEndian, &words); err != nil {
+			return nil, err
+		} else if words <= 0 || words*8 > int64(r.Len()) {
+			return nil, ErrNoSnap
+		}
+
+		b := &bloom{bits: make([]uint64, words)}
+		if err := binary.Read(r, binary.LittleEndian, b.bits); err != nil {
+			return nil, err
+		}
+
+		blooms[string(name)] = b
+	}
+
+	return blooms, nil
+}
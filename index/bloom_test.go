@@ -0,0 +1,112 @@
+package index
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	b := newBloom(1000)
+	for i := 0; i < 1000; i++ {
+		b.add("a" + strconv.Itoa(i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !b.has("a" + strconv.Itoa(i)) {
+			t.Fatal("added keys should be in the filter")
+		}
+	}
+
+	var fp int
+	for i := 0; i < 1000; i++ {
+		if b.has("b" + strconv.Itoa(i)) {
+			fp++
+		}
+	}
+
+	if fp > 50 {
+		t.Fatal("too many false positives", fp)
+	}
+}
+
+func TestBloomFiles(t *testing.T) {
+	defer setupsn(t)()
+
+	if blooms, err := readBlooms(tmpdirsnap); err != nil || blooms != nil {
+		t.Fatal("should not have bloom filters", err)
+	}
+
+	tree := WrapNode(nil)
+	tree.Ensure([]string{"a", "b"}).Node.RecordID = 0
+	tree.Ensure([]string{"c"}).Node.RecordID = 1
+
+	if err := writeBlooms(tmpdirsnap, branchBlooms(tree)); err != nil {
+		t.Fatal(err)
+	}
+
+	blooms, err := readBlooms(tmpdirsnap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blooms) != 2 || !blooms["a"].has(branchKey([]string{"a", "b"})) || !blooms["c"].has("c") {
+		t.Fatal("wrong bloom filters")
+	}
+}
+
+func TestFindMissing(t *testing.T) {
+	defer setupsn(t)()
+
+	i, err := NewRW(tmpdirsnap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fields := range [][]string{{"a"}, {"a", "b"}, {`\a`, "b*"}} {
+		if _, err := i.Ensure(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// creates the snapshot
+	if i, err = NewRO(tmpdirsnap, 0); err != nil {
+		t.Fatal(err)
+	} else if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = NewRO(tmpdirsnap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := i.FindOne([]string{"a", "x"}); err != nil || n != nil {
+		t.Fatal("should not find missing nodes", n, err)
+	}
+
+	if i.root.Children["a"] != nil {
+		t.Fatal("branch should not be loaded for missing nodes")
+	}
+
+	if n, err := i.FindOne([]string{"a", "b"}); err != nil || n == nil {
+		t.Fatal("should find existing nodes", err)
+	}
+
+	// fields are exact values even if they look like query fields
+	if n, err := i.FindOne([]string{`\a`, "b*"}); err != nil || n == nil {
+		t.Fatal("should find nodes with pattern like fields", err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tmpdirsnap + bloomfile); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,198 @@
+package index
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/kadirahq/go-tools/hybrid"
+)
+
+const (
+	// ckptdir is the directory inside the index directory which has a snapshot
+	// of nodes stored in the index log before an offset. It's written while
+	// the index is writable so that only the rest of the log has to be read
+	// when the index is loaded in read-only mode for the first time.
+	ckptdir = "checkpoint"
+
+	// ckptfile is the file in the checkpoint directory with the log offset
+	ckptfile = "offset"
+)
+
+// Checkpoint writes a snapshot of all nodes stored in the index log so far.
+// The previous checkpoint is loaded and only log entries stored after it are
+// read from the log. NewRO uses the checkpoint to build the index snapshot
+// by reading only log entries stored after the checkpoint.
+// It does nothing if the index is read-only.
+func (i *Index) Checkpoint() (err error) {
+	if i.logs == nil {
+		return nil
+	}
+
+	i.ckptmtx.Lock()
+	defer i.ckptmtx.Unlock()
+
+	i.logs.iomutex.Lock()
+	end := i.logs.nextOff
+	i.logs.iomutex.Unlock()
+
+	tree, off := loadCheckpoint(i.dir, i.ssz)
+	if off == end {
+		return nil
+	} else if off > end {
+		tree, off = newTree(), 0
+	}
+
+	if err := i.logs.replay(tree, off, end); err != nil {
+		return err
+	}
+
+	return writeCheckpoint(i.dir, tree, end, i.ssz)
+}
+
+// newTree creates an empty index tree with a root node
+func newTree() (tree *TNode) {
+	return WrapNode(&Node{Fields: []string{}})
+}
+
+// loadCheckpoint loads the index tree and the log offset from the checkpoint
+// in given index directory. All snapshot branches are loaded. An empty tree
+// is returned with a zero offset if there's no valid checkpoint.
+func loadCheckpoint(dir string, ssz int64) (tree *TNode, off int64) {
+	cdir := path.Join(dir, ckptdir)
+
+	data, err := ioutil.ReadFile(path.Join(cdir, ckptfile))
+	if err != nil || len(data) != hybrid.SzInt64 {
+		return newTree(), 0
+	}
+
+	hybrid.DecodeInt64(data, &off)
+
+	snap, err := LoadSnap(cdir, ssz)
+	if err != nil {
+		return newTree(), 0
+	}
+
+	defer snap.Close()
+
+	tree = newTree()
+	for name := range snap.branches {
+		br, err := snap.LoadBranch(name)
+		if err != nil {
+			return newTree(), 0
+		}
+
+		initChildren(br)
+		tree.Children[name] = br
+	}
+
+	return tree, off
+}
+
+// initChildren creates missing children maps of tree nodes loaded from a
+// snapshot so that new nodes can be added to the tree (see TNode.Ensure).
+func initChildren(tn *TNode) {
+	if tn.Children == nil {
+		tn.Children = map[string]*TNode{}
+	}
+
+	for _, c := range tn.Children {
+		initChildren(c)
+	}
+}
+
+// writeCheckpoint replaces the checkpoint in given index directory. The new
+// checkpoint is written to a temporary directory and moved when it's ready.
+func writeCheckpoint(dir string, tree *TNode, off, ssz int64) (err error) {
+	cdir := path.Join(dir, ckptdir)
+	tdir := cdir + ".tmp"
+
+	if err := os.RemoveAll(tdir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tdir, 0755); err != nil {
+		return err
+	}
+
+	snap, err := writeSnapshot(tdir, tree, ssz)
+	if err != nil {
+		return err
+	}
+
+	if err := snap.Close(); err != nil {
+		return err
+	}
+
+	data := make([]byte, hybrid.SzInt64)
+	hybrid.EncodeInt64(data, &off)
+	if err := ioutil.WriteFile(path.Join(tdir, ckptfile), data, 0644); err != nil {
+		return err
+	}
+
+	if err := removeCheckpoint(dir); err != nil {
+		return err
+	}
+
+	return os.Rename(tdir, cdir)
+}
+
+// removeCheckpoint removes the checkpoint in given index directory
+func removeCheckpoint(dir string) (err error) {
+	return os.RemoveAll(path.Join(dir, ckptdir))
+}
+
+// replay adds index nodes stored in the log between given offsets to the tree.
+// All log entries after `off` are read if `end` is negative.
+func (l *Logs) replay(tree *TNode, off, end int64) (err error) {
+	if end < 0 {
+		l.iomutex.Lock()
+		end, err = l.logFile.Seek(0, 2)
+		l.iomutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	sizeBuff := make([]byte, hybrid.SzInt64)
+
+	for off+hybrid.SzInt64 <= end {
+		if err := l.readAt(sizeBuff, off); err != nil {
+			return err
+		}
+
+		var size int64
+		hybrid.DecodeInt64(sizeBuff, &size)
+		if size <= 0 {
+			break
+		} else if off+hybrid.SzInt64+size > end {
+			return io.ErrUnexpectedEOF
+		}
+
+		data := make([]byte, size)
+		if err := l.readAt(data, off+hybrid.SzInt64); err != nil {
+			return err
+		}
+
+		node := &Node{}
+		if err := proto.Unmarshal(data, node); err != nil {
+			return err
+		}
+
+		if err := node.Validate(); err != nil {
+			return err
+		}
+
+		tn := tree.Ensure(node.Fields)
+		tn.Mutex.Lock()
+		tn.Node = node
+		tn.Mutex.Unlock()
+
+		off += hybrid.SzInt64 + size
+	}
+
+	return nil
+}
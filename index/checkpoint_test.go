@@ -0,0 +1,104 @@
+package index
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+var (
+	tmpdirckpt = "/tmp/test-checkpoint/"
+)
+
+func TestCheckpoint(t *testing.T) {
+	if err := os.RemoveAll(tmpdirckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdirckpt, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(tmpdirckpt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][][]string{
+		{{"a", "b"}, {"a", "c"}},
+		{{"a", "b", "x"}, {"d", "e"}},
+		{{"f"}},
+	}
+
+	for k, set := range sets {
+		for _, fields := range set {
+			if _, err := i.Ensure(fields); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the last set is only in the log
+		if k == len(sets)-1 {
+			break
+		}
+
+		if err := i.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, off := loadCheckpoint(tmpdirckpt, 0); off != i.LogSize() {
+			t.Fatal("wrong checkpoint offset", off, i.LogSize())
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := NewLogs(tmpdirckpt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the log tail should be replayed
+	tree, off := loadCheckpoint(tmpdirckpt, 0)
+	if n, err := tree.FindOne([]string{"f"}); err != nil || n != nil {
+		t.Fatal("checkpoint should not have the last node")
+	}
+
+	if err := logs.replay(tree, off, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := tree.FindOne([]string{"f"}); err != nil || n == nil {
+		t.Fatal("missing node after replay", err)
+	}
+
+	if err := logs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = NewRO(tmpdirckpt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, set := range sets {
+		for _, fields := range set {
+			if n, err := i.FindOne(fields); err != nil || n == nil {
+				t.Fatal("missing node", fields, err)
+			}
+		}
+	}
+
+	if exists(path.Join(tmpdirckpt, ckptdir)) {
+		t.Fatal("checkpoint should be removed after creating the snapshot")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(tmpdirckpt); err != nil {
+		t.Fatal(err)
+	}
+}
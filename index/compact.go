@@ -0,0 +1,166 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// compactdir is the directory inside the index directory where the
+	// compacted index log is written before replacing the index log.
+	compactdir = "logs.compact"
+
+	// compactdone is created in compactdir when the compacted log is ready.
+	// It has the number of segment files of the compacted log. Compacted
+	// logs without it are incomplete and they are removed.
+	compactdone = "done"
+)
+
+// CompactLogs rewrites the index log with a single entry for each index node
+// in record ID order if the log is larger than given size and has redundant
+// entries (ex: entries added when repairing the index). The log is replaced
+// only after the compacted log is written and synced. It must not be used
+// while adding nodes to the index. Index checkpoints are removed as well.
+func (i *Index) CompactLogs(size int64) (compacted bool, err error) {
+	if i.logs == nil || i.LogSize() <= size {
+		return false, nil
+	}
+
+	var nodes []*Node
+	for _, tn := range i.root.Children {
+		nodes = append(nodes, tn.All()...)
+	}
+
+	if int64(len(nodes)) >= i.logs.entries {
+		return false, nil
+	}
+
+	sort.Sort(byRecordID(nodes))
+
+	tmp := path.Join(i.dir, compactdir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return false, err
+	}
+
+	if err := writeLogs(tmp, i.ssz, nodes); err != nil {
+		os.RemoveAll(tmp)
+		return false, err
+	}
+
+	next := i.logs.nextID
+	if err := i.logs.Close(); err != nil {
+		return false, err
+	}
+
+	// NewLogs replaces the index log with the compacted log
+	logs, err := NewLogs(i.dir, i.ssz)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := logs.Load(); err != nil {
+		return false, err
+	}
+
+	logs.nextID = next
+	i.logs = logs
+
+	if err := removeCheckpoint(i.dir); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeLogs writes a new index log with given nodes to given directory and
+// marks it as a compacted log which can replace the index log.
+func writeLogs(dir string, ssz int64, nodes []*Node) (err error) {
+	logs, err := NewLogs(dir, ssz)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		if err := logs.Store(WrapNode(n)); err != nil {
+			logs.Close()
+			return err
+		}
+	}
+
+	if err := logs.Sync(); err != nil {
+		logs.Close()
+		return err
+	}
+
+	if err := logs.Close(); err != nil {
+		return err
+	}
+
+	// the number of segment files is used when replacing the log
+	files, err := filepath.Glob(path.Join(dir, prefixlogs+"*"))
+	if err != nil {
+		return err
+	}
+
+	data := []byte(strconv.Itoa(len(files)) + "\n")
+	return ioutil.WriteFile(path.Join(dir, compactdone), data, 0644)
+}
+
+// recoverLogs replaces the index log in given directory with the compacted
+// log if it's ready. This also finishes compactions interrupted by a crash
+// while replacing the log. Incomplete compacted logs are removed.
+func recoverLogs(dir string) (err error) {
+	tmp := path.Join(dir, compactdir)
+	if !exists(tmp) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tmp, compactdone))
+	if os.IsNotExist(err) {
+		return os.RemoveAll(tmp)
+	} else if err != nil {
+		return err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return os.RemoveAll(tmp)
+	}
+
+	// segment files are replaced one at a time therefore some of them
+	// may have been replaced already if it was interrupted before.
+	for n := 0; n < count; n++ {
+		name := prefixlogs + strconv.Itoa(n)
+		if !exists(path.Join(tmp, name)) {
+			continue
+		}
+
+		if err := os.Rename(path.Join(tmp, name), path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	for n := count; exists(path.Join(dir, prefixlogs+strconv.Itoa(n))); n++ {
+		if err := os.Remove(path.Join(dir, prefixlogs+strconv.Itoa(n))); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(tmp)
+}
+
+// byRecordID sorts index nodes by record ID
+type byRecordID []*Node
+
+func (a byRecordID) Len() int           { return len(a) }
+func (a byRecordID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRecordID) Less(i, j int) bool { return a[i].RecordID < a[j].RecordID }
@@ -0,0 +1,142 @@
+package index
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+var (
+	tmpdircompact = "/tmp/test-compact-logs/"
+)
+
+func TestCompactLogs(t *testing.T) {
+	if err := os.RemoveAll(tmpdircompact); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdircompact, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(tmpdircompact, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fields := range [][]string{{"a"}, {"a", "b"}, {"c"}} {
+		if _, err := i.Ensure(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// store a redundant log entry for an existing node
+	tn := i.root.Children["a"]
+	if err := i.logs.Store(tn); err != nil {
+		t.Fatal(err)
+	}
+
+	size := i.LogSize()
+
+	if compacted, err := i.CompactLogs(size); err != nil || compacted {
+		t.Fatal("logs within the size should not be compacted", err)
+	}
+
+	if compacted, err := i.CompactLogs(0); err != nil || !compacted {
+		t.Fatal("logs should be compacted", err)
+	}
+
+	if i.LogSize() >= size {
+		t.Fatal("compacted log should be smaller", i.LogSize(), size)
+	}
+
+	if compacted, err := i.CompactLogs(0); err != nil || compacted {
+		t.Fatal("compacted logs should not be compacted again", err)
+	}
+
+	// new nodes get the next record ID
+	if n, err := i.Ensure([]string{"d"}); err != nil || n.RecordID != 3 {
+		t.Fatal("wrong node", n, err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(path.Join(tmpdircompact, compactdir)) {
+		t.Fatal("compacted log directory should be removed")
+	}
+
+	i, err = NewRW(tmpdircompact, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, err := i.All(); err != nil || len(ns) != 4 {
+		t.Fatal("wrong nodes", len(ns), err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(tmpdircompact); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverLogs(t *testing.T) {
+	if err := os.RemoveAll(tmpdircompact); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdircompact, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := path.Join(tmpdircompact, compactdir)
+
+	// incomplete compacted logs are removed
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverLogs(tmpdircompact); err != nil {
+		t.Fatal(err)
+	} else if exists(tmp) {
+		t.Fatal("incomplete compacted log should be removed")
+	}
+
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeLogs(tmp, 0, []*Node{{RecordID: 0, Fields: []string{"a"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NewLogs finishes the compaction
+	logs, err := NewLogs(tmpdircompact, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := logs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := tree.FindOne([]string{"a"}); err != nil || n == nil {
+		t.Fatal("compacted log should be used", err)
+	}
+
+	if err := logs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(tmp) {
+		t.Fatal("compacted log directory should be removed")
+	}
+
+	if err := os.RemoveAll(tmpdircompact); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,66 @@
+package index
+
+import (
+	"os"
+	"path"
+)
+
+// Count returns the number of index nodes with valid record IDs in given
+// directory without keeping the index loaded. Snapshot branches are loaded
+// one at a time. Index logs are used if the index does not have a snapshot.
+// Index segment size must be the size used to create the index.
+func Count(dir string, ssz int64) (n int64, err error) {
+	if exists(path.Join(dir, prefixsnaproot+"0")) {
+		snap, err := LoadSnap(dir, ssz)
+		if err == nil {
+			defer snap.Close()
+			return snap.count()
+		} else if err != ErrNoSnap {
+			return 0, err
+		}
+	}
+
+	if !exists(path.Join(dir, prefixlogs+"0")) {
+		return 0, nil
+	}
+
+	logs, err := NewLogs(dir, ssz)
+	if err != nil {
+		return 0, err
+	}
+
+	defer logs.Close()
+
+	tree, err := logs.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	// the root node is not a valid index node
+	for _, tn := range tree.Children {
+		n += tn.Count()
+	}
+
+	return n, nil
+}
+
+// count returns the number of nodes in all snapshot branches
+func (s *Snap) count() (n int64, err error) {
+	// nested branches do not have nodes of their child branches
+	for _, o := range s.branches {
+		tree, err := readSnapData(s.dataFile, o)
+		if err != nil {
+			return 0, err
+		}
+
+		n += tree.Count()
+	}
+
+	return n, nil
+}
+
+// exists checks whether a file exists
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,62 @@
+package index
+
+import (
+	"os"
+	"testing"
+)
+
+var (
+	tmpdircount = "/tmp/test-count/"
+)
+
+func TestCount(t *testing.T) {
+	if err := os.RemoveAll(tmpdircount); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdircount, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := Count(tmpdircount, 0); err != nil || n != 0 {
+		t.Fatal("empty directory should have no nodes", n, err)
+	}
+
+	i, err := NewRW(tmpdircount, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fields := range [][]string{{"a", "b"}, {"a", "c"}, {"d"}} {
+		if _, err := i.Ensure(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// count using index logs
+	if n, err := Count(tmpdircount, 0); err != nil || n != 3 {
+		t.Fatal("wrong count", n, err)
+	}
+
+	// creates an index snapshot
+	i, err = NewRO(tmpdircount, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// count using the index snapshot
+	if n, err := Count(tmpdircount, 0); err != nil || n != 3 {
+		t.Fatal("wrong count", n, err)
+	}
+
+	if err := os.RemoveAll(tmpdircount); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package index
+
+import (
+	"sync/atomic"
+)
+
+var (
+	// maxTotalMemory limits the size of loaded branches of all indexes
+	maxTotalMemory int64
+
+	// totalMemory is the size of loaded branches of all indexes
+	totalMemory int64
+)
+
+// loaded has the size and the last use of a loaded first level branch
+type loaded struct {
+	size int64
+	used int64
+}
+
+// SetMaxMemory limits the size of snapshot branches loaded by the read-only
+// index. Least recently used first level branches are unloaded when loaded
+// branches are larger than the limit. The size of a branch is the size of
+// its data in the snapshot file (nodes use more memory after loading them).
+// Setting the maximum to zero will remove the limit (default behavior).
+func (i *Index) SetMaxMemory(max int64) {
+	atomic.StoreInt64(&i.maxMemory, max)
+}
+
+// SetMaxTotalMemory limits the size of snapshot branches loaded by all
+// read-only indexes (see SetMaxMemory). When the limit is reached, indexes
+// unload their least recently used branches after finding nodes.
+func SetMaxTotalMemory(max int64) {
+	atomic.StoreInt64(&maxTotalMemory, max)
+}
+
+// use prevents unloading branches until the returned function is called.
+// Branches are unloaded after that if loaded branches are over limits.
+func (i *Index) use() (done func()) {
+	if i.snap == nil {
+		return func() {}
+	}
+
+	i.evictmtx.RLock()
+
+	return func() {
+		i.evictmtx.RUnlock()
+		i.evict()
+	}
+}
+
+// touch marks the first level branch as used
+func (i *Index) touch(name string) {
+	i.brmtx.Lock()
+	if br, ok := i.loaded[name]; ok {
+		i.nextUse++
+		br.used = i.nextUse
+	}
+	i.brmtx.Unlock()
+}
+
+// addLoaded adds the size of a loaded branch to its first level branch
+func (i *Index) addLoaded(name string, size int64) {
+	i.brmtx.Lock()
+	br, ok := i.loaded[name]
+	if !ok {
+		br = &loaded{}
+		i.loaded[name] = br
+	}
+
+	i.nextUse++
+	br.used = i.nextUse
+	br.size += size
+	i.brmtx.Unlock()
+
+	atomic.AddInt64(&i.memory, size)
+	atomic.AddInt64(&totalMemory, size)
+}
+
+// overLimit checks whether loaded branches are larger than limits
+func (i *Index) overLimit() bool {
+	if max := atomic.LoadInt64(&i.maxMemory); max > 0 && atomic.LoadInt64(&i.memory) > max {
+		return true
+	}
+
+	if max := atomic.LoadInt64(&maxTotalMemory); max > 0 && atomic.LoadInt64(&totalMemory) > max {
+		return true
+	}
+
+	return false
+}
+
+// evict unloads least recently used first level branches until loaded
+// branches are within limits. The most recently used branch is never
+// unloaded therefore a single branch can be larger than the limit.
+func (i *Index) evict() {
+	if !i.overLimit() {
+		return
+	}
+
+	i.evictmtx.Lock()
+	defer i.evictmtx.Unlock()
+
+	i.root.Mutex.Lock()
+	defer i.root.Mutex.Unlock()
+
+	i.brmtx.Lock()
+	defer i.brmtx.Unlock()
+
+	for i.overLimit() && len(i.loaded) > 1 {
+		var name string
+		var used int64
+
+		for n, br := range i.loaded {
+			if name == "" || br.used < used {
+				name, used = n, br.used
+			}
+		}
+
+		size := i.loaded[name].size
+		delete(i.loaded, name)
+
+		// not loaded branches have nil values
+		i.root.Children[name] = nil
+
+		atomic.AddInt64(&i.memory, -size)
+		atomic.AddInt64(&totalMemory, -size)
+	}
+}
+
+// unloadAll removes sizes of loaded branches from the total size
+func (i *Index) unloadAll() {
+	if i.snap == nil {
+		return
+	}
+
+	i.brmtx.Lock()
+	i.loaded = map[string]*loaded{}
+	i.brmtx.Unlock()
+
+	size := atomic.SwapInt64(&i.memory, 0)
+	atomic.AddInt64(&totalMemory, -size)
+}
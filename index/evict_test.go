@@ -0,0 +1,95 @@
+package index
+
+import (
+	"testing"
+)
+
+func setupEvict(t *testing.T) (i *Index) {
+	i, err := NewRW(tmpdirsnap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fields := range [][]string{{"a"}, {"a", "x"}, {"b"}, {"b", "x"}, {"c"}} {
+		if _, err := i.Ensure(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// creates the snapshot
+	if i, err = NewRO(tmpdirsnap, 0); err != nil {
+		t.Fatal(err)
+	} else if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if i, err = NewRO(tmpdirsnap, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func TestEvict(t *testing.T) {
+	defer setupsn(t)()
+
+	i := setupEvict(t)
+
+	// allows loading a single branch
+	i.SetMaxMemory(1)
+
+	for _, name := range []string{"a", "b"} {
+		if n, err := i.FindOne([]string{name, "x"}); err != nil || n == nil {
+			t.Fatal("missing node", name, err)
+		}
+	}
+
+	if i.root.Children["a"] != nil {
+		t.Fatal("least recently used branch should be unloaded")
+	} else if i.root.Children["b"] == nil {
+		t.Fatal("most recently used branch should be loaded")
+	}
+
+	if len(i.loaded) != 1 || i.memory != i.loaded["b"].size {
+		t.Fatal("wrong loaded branches", len(i.loaded), i.memory)
+	}
+
+	// unloaded branches are loaded again when needed
+	if ns, err := i.All(); err != nil || len(ns) != 5 {
+		t.Fatal("wrong nodes", len(ns), err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if totalMemory != 0 {
+		t.Fatal("total size should be updated when closing", totalMemory)
+	}
+}
+
+func TestEvictTotal(t *testing.T) {
+	defer setupsn(t)()
+	defer SetMaxTotalMemory(0)
+
+	i := setupEvict(t)
+	SetMaxTotalMemory(1)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := i.FindOne([]string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(i.loaded) != 1 || i.root.Children["c"] == nil {
+		t.Fatal("branches should be unloaded using the total limit")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,12 +2,19 @@ package index
 
 import (
 	"errors"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
 	// ErrInvFields is given when requested fields are invalid
 	ErrInvFields = errors.New("requested fields are not valid")
+
+	// ErrMaxSeries is given when the index has reached the series limit
+	ErrMaxSeries = errors.New("maximum number of series exceeded")
 )
 
 // Index stores record IDs for each unique field combination as a tree.
@@ -17,18 +24,50 @@ type Index struct {
 	root *TNode
 	logs *Logs
 	snap *Snap
+
+	// labels is an inverted index of label fields
+	// it's only created when it's used for the first time
+	labels *Labels
+	lblmtx *sync.Mutex
+
+	// maximum number of nodes allowed in a read-write index
+	// no new nodes can be added when this limit is reached
+	maxSeries int64
+
+	// index directory and segment size used to write checkpoints
+	dir     string
+	ssz     int64
+	ckptmtx *sync.Mutex
+
+	// loaded first level snapshot branches and their total size (see evict)
+	// branches are not unloaded while evictmtx is locked for reading
+	loaded    map[string]*loaded
+	nextUse   int64
+	brmtx     *sync.Mutex
+	memory    int64
+	maxMemory int64
+	evictmtx  *sync.RWMutex
 }
 
 // NewRO loads an existing index in read-only mode. It will attempt to load
 // it from a snapshot file first and if it fails, it'll fallback to using the
 // append log. A new snapshot will be created before returning this function.
+// If the index has a checkpoint (see Checkpoint), only log entries stored
+// after the checkpoint are read from the log to create the snapshot.
 // Branches of the read only index are loaded only when it's required.
-func NewRO(dir string) (i *Index, err error) {
-	snap, err := LoadSnap(dir)
+// Index files use given segment size (or the default size if it's zero).
+func NewRO(dir string, ssz int64) (i *Index, err error) {
+	snap, err := LoadSnap(dir, ssz)
 	if err == nil && len(snap.RootNode.Children) > 0 {
 		i = &Index{
-			root: snap.RootNode,
-			snap: snap,
+			root:     snap.RootNode,
+			snap:     snap,
+			lblmtx:   &sync.Mutex{},
+			dir:      dir,
+			ssz:      ssz,
+			loaded:   map[string]*loaded{},
+			brmtx:    &sync.Mutex{},
+			evictmtx: &sync.RWMutex{},
 		}
 
 		return i, nil
@@ -38,27 +77,44 @@ func NewRO(dir string) (i *Index, err error) {
 	// Try to load data from log files if available and immediately create a
 	// new snapshot which can be used when this index is loaded next time.
 
-	logs, err := NewLogs(dir)
+	logs, err := NewLogs(dir, ssz)
 	if err != nil {
 		return nil, err
 	}
 
-	root, err := logs.Load()
-	if err != nil {
-		return nil, err
+	root, off := loadCheckpoint(dir, ssz)
+	if off == 0 || logs.replay(root, off, -1) != nil {
+		if root, err = logs.Load(); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := logs.Close(); err != nil {
 		return nil, err
 	}
 
-	if snap, err = writeSnapshot(dir, root); err != nil {
+	if snap, err = writeSnapshot(dir, root, ssz); err != nil {
 		// TODO handle snapshot store error
+	} else if err := removeCheckpoint(dir); err != nil {
+		return nil, err
 	}
 
 	i = &Index{
-		root: root,
-		snap: snap,
+		root:     root,
+		snap:     snap,
+		lblmtx:   &sync.Mutex{},
+		dir:      dir,
+		ssz:      ssz,
+		loaded:   map[string]*loaded{},
+		brmtx:    &sync.Mutex{},
+		evictmtx: &sync.RWMutex{},
+	}
+
+	// all branches are loaded when the snapshot is created
+	if snap != nil {
+		for key, o := range snap.branches {
+			i.addLoaded(strings.SplitN(key, branchsep, 2)[0], o.To-o.From)
+		}
 	}
 
 	return i, nil
@@ -66,8 +122,22 @@ func NewRO(dir string) (i *Index, err error) {
 
 // NewRW loads an existing index in read-write mode. This will always use the
 // append log to write data. This index will always have all index nodes ready.
-func NewRW(dir string) (i *Index, err error) {
-	logs, err := NewLogs(dir)
+// Nodes without valid record IDs (ex: after a crash) are repaired or removed.
+// The snapshot (if any) is removed as it will not have new index nodes.
+func NewRW(dir string, ssz int64) (i *Index, err error) {
+	return NewRWStored(dir, ssz, nil)
+}
+
+// NewRWStored is the same as NewRW but parent nodes are only repaired if
+// the stored function returns true for their depth (number of fields).
+// This is used when only some levels of the tree are written (leaf-only).
+// All parent nodes are repaired if the function is nil.
+func NewRWStored(dir string, ssz int64, stored func(depth int) bool) (i *Index, err error) {
+	if err := removeSnapshot(dir); err != nil {
+		return nil, err
+	}
+
+	logs, err := NewLogs(dir, ssz)
 	if err != nil {
 		return nil, err
 	}
@@ -78,48 +148,269 @@ func NewRW(dir string) (i *Index, err error) {
 	}
 
 	i = &Index{
-		root: root,
-		logs: logs,
+		root:    root,
+		logs:    logs,
+		lblmtx:  &sync.Mutex{},
+		dir:     dir,
+		ssz:     ssz,
+		ckptmtx: &sync.Mutex{},
+	}
+
+	if _, err := i.repairPlaceholders(stored); err != nil {
+		return nil, err
 	}
 
 	return i, nil
 }
 
+// SetMaxSeries sets the maximum number of nodes allowed in the index.
+// The Ensure method fails with ErrMaxSeries when the limit is reached.
+// Setting the maximum to zero will remove the limit (default behavior).
+func (i *Index) SetMaxSeries(max int64) {
+	atomic.StoreInt64(&i.maxSeries, max)
+}
+
+// SetGrowHook sets a function which is called with the start time after
+// allocating a new index log segment file. Read-only indexes never grow.
+func (i *Index) SetGrowHook(fn func(start time.Time)) {
+	if i.logs != nil {
+		i.logs.SetGrowHook(fn)
+	}
+}
+
 // Ensure inserts a new node to the index if it's not available.
 func (i *Index) Ensure(fields []string) (node *Node, err error) {
 	tn := i.root.Ensure(fields)
 
 	tn.Mutex.Lock()
+	if tn.Node == nil {
+		// parent nodes which are not stored (leaf-only) do not have nodes
+		tn.Node = &Node{Fields: fields, RecordID: Placeholder}
+	}
+
 	if tn.Node.RecordID == Placeholder {
-		tn.Node.RecordID = atomic.AddInt64(&i.logs.nextID, 1) - 1
+		id, err := i.nextID()
+		if err != nil {
+			// The node stays in the tree with the placeholder ID therefore
+			// it will be ignored by find operations until an ID is set.
+			tn.Mutex.Unlock()
+			return nil, err
+		}
+
+		tn.Node.RecordID = id
 		if err := i.logs.Store(tn); err != nil {
 			tn.Mutex.Unlock()
 			return nil, err
 		}
+
+		i.lblmtx.Lock()
+		if i.labels != nil {
+			i.labels.add(tn.Node)
+		}
+		i.lblmtx.Unlock()
 	}
 	tn.Mutex.Unlock()
 
 	return tn.Node, nil
 }
 
+// nextID reserves a record ID for a new index node. It will fail with
+// ErrMaxSeries if the index already has the maximum number of nodes.
+func (i *Index) nextID() (id int64, err error) {
+	max := atomic.LoadInt64(&i.maxSeries)
+
+	for {
+		id = atomic.LoadInt64(&i.logs.nextID)
+		if max > 0 && id >= max {
+			return 0, ErrMaxSeries
+		}
+
+		if atomic.CompareAndSwapInt64(&i.logs.nextID, id, id+1) {
+			return id, nil
+		}
+	}
+}
+
 // Find finds all existing index nodes with given field pattern.
 // The '*' can be used to match any value for the index field.
+// Fields ending with '*' match values starting with given prefix.
+// Fields ending with `\*` match values which end with a '*' (ex: `a\*`).
+// Fields starting with "re:" are matched as regular expressions.
+// Fields starting with '!' match values which do not match the rest.
+// Fields like "{a,b}" match any of the values separated by commas.
+// Fields starting with `\` match the rest exactly (ex: `\!a` matches "!a").
+// Nodes are sorted by their fields therefore the order is deterministic.
 func (i *Index) Find(fields []string) (ns []*Node, err error) {
+	defer i.use()()
+
+	if i.snap != nil && !i.snap.MayHave(fields) {
+		return nil, nil
+	}
+
 	if err := i.ensureBranch(fields); err != nil {
 		return nil, err
 	}
 
-	return i.root.Find(fields)
+	if ns, err = i.root.find(fields, i.locks()); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byFields(ns))
+	return ns, nil
+}
+
+// FindTree finds all index nodes which have given field pattern as a prefix
+// including nodes which match the pattern exactly (see TNode.FindTree).
+// Nodes are sorted by their fields.
+func (i *Index) FindTree(fields []string) (ns []*Node, err error) {
+	defer i.use()()
+
+	if err := i.ensureTree(fields); err != nil {
+		return nil, err
+	}
+
+	if ns, err = i.root.findTree(fields, i.locks()); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byFields(ns))
+	return ns, nil
 }
 
 // FindOne finds the index nodes with exact given field combination.
 // `n` is nil if the no nodes exist in the index with given fields.
+// Snapshot branches are not loaded if their bloom filters do not have fields.
 func (i *Index) FindOne(fields []string) (n *Node, err error) {
-	if err := i.ensureBranch(fields); err != nil {
+	defer i.use()()
+
+	// snapshot branches are looked up with query fields
+	query := Quote(fields)
+
+	if i.snap != nil && !i.snap.MayHave(query) {
+		return nil, nil
+	}
+
+	if err := i.ensureBranch(query); err != nil {
+		return nil, err
+	}
+
+	return i.root.findOne(fields, i.locks())
+}
+
+// FindLabels finds all index nodes which have all given labels. Labels are
+// index node fields formatted as "key=value" and can be in any position.
+// Label values in the query can use patterns (ex: "host=web-*").
+// Nodes under other matching nodes are not included as parent nodes
+// already have their points (ex: ["host=a"] but not ["host=a", "x"]).
+// The label index is built when this is called for the first time.
+// Nodes are sorted by their fields.
+func (i *Index) FindLabels(labels []string) (ns []*Node, err error) {
+	defer i.use()()
+
+	l, err := i.ensureLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	if ns, err = l.find(labels); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byFields(ns))
+	return ns, nil
+}
+
+// All returns all index nodes with valid record IDs regardless of the number
+// of fields they have. All snapshot branches are loaded to get all nodes.
+// Nodes are sorted by their fields.
+func (i *Index) All() (ns []*Node, err error) {
+	defer i.use()()
+
+	if err := i.ensureTree([]string{Wildcard}); err != nil {
+		return nil, err
+	}
+
+	i.root.Mutex.RLock()
+	defer i.root.Mutex.RUnlock()
+
+	// the root node is not a valid index node
+	for _, tn := range i.root.Children {
+		ns = append(ns, tn.All()...)
+	}
+
+	sort.Sort(byFields(ns))
+	return ns, nil
+}
+
+// List returns distinct field value combinations under given prefix up to
+// given depth. For example, with prefix ["app1"] and depth 1, this returns
+// all values used as the second field when the first field is "app1".
+// The prefix must only have exact field values. Results are sorted.
+func (i *Index) List(prefix []string, depth int) (values [][]string, err error) {
+	if depth < 1 {
+		return nil, ErrInvFields
+	}
+
+	exacts := make([]string, len(prefix))
+	for k, f := range prefix {
+		v, ok := exact(f)
+		if f == "" || !ok {
+			return nil, ErrInvFields
+		}
+
+		exacts[k] = v
+	}
+
+	query := prefix
+	if len(query) == 0 {
+		query = []string{Wildcard}
+	}
+
+	defer i.use()()
+
+	if err := i.ensureTree(query); err != nil {
+		return nil, err
+	}
+
+	tn := i.root
+	for _, v := range exacts {
+		tn.Mutex.RLock()
+		next, ok := tn.Children[v]
+		tn.Mutex.RUnlock()
+		if !ok {
+			return nil, nil
+		}
+
+		tn = next
+	}
+
+	values = tn.List(depth)
+	sort.Sort(fieldsList(values))
+
+	return values, nil
+}
+
+// Cardinality returns the number of series (index nodes) under each value of
+// the first index field. This can be used to find which value is responsible
+// for creating too many series. The count includes the first level node too.
+func (i *Index) Cardinality() (c map[string]int64, err error) {
+	defer i.use()()
+
+	// make sure all snapshot branches are loaded
+	if err := i.ensureTree([]string{Wildcard}); err != nil {
 		return nil, err
 	}
 
-	return i.root.FindOne(fields)
+	c = map[string]int64{}
+
+	i.root.Mutex.RLock()
+	defer i.root.Mutex.RUnlock()
+
+	for name, tn := range i.root.Children {
+		c[name] = tn.Count()
+	}
+
+	return c, nil
 }
 
 // Sync syncs the index
@@ -133,6 +424,19 @@ func (i *Index) Sync() (err error) {
 	return nil
 }
 
+// LogSize returns the number of bytes used in the index log file.
+// It's always zero for read-only indexes as they do not use logs.
+func (i *Index) LogSize() (size int64) {
+	if i.logs == nil {
+		return 0
+	}
+
+	i.logs.iomutex.Lock()
+	defer i.logs.iomutex.Unlock()
+
+	return i.logs.nextOff
+}
+
 // Close releases resources
 func (i *Index) Close() (err error) {
 	if i.logs != nil {
@@ -142,6 +446,8 @@ func (i *Index) Close() (err error) {
 	}
 
 	if i.snap != nil {
+		i.unloadAll()
+
 		if err := i.snap.Close(); err != nil {
 			return err
 		}
@@ -150,11 +456,24 @@ func (i *Index) Close() (err error) {
 	return nil
 }
 
-// ensureBranch makes sure that the branch starting from the first level
-// of the index tree is loaded from the snapshot data file. The root file
-// contains all nodes from the first level of the tree and their offsets
-// These nodes will have "nil" value in roots Children map which will be
-// used to identify branches not yet loaded from the snapshot data file.
+// locks returns the number of index tree levels locked when finding nodes.
+// Read-only indexes only modify tree nodes above snapshot branches at the
+// last level (when loading or unloading branches) and nodes in these branches
+// never change after loading them therefore they can be read without locks.
+func (i *Index) locks() int {
+	if i.snap == nil {
+		return lockall
+	}
+
+	return i.snap.depth
+}
+
+// ensureBranch makes sure that snapshot branches required to find nodes with
+// given fields are loaded from the snapshot data file. The root file contains
+// names and offsets of all branches. Branches not yet loaded have "nil" values
+// in Children maps of their parents. Branches are loaded one level at a time
+// and only branches matching the field at that level are loaded. If fields
+// are patterns, all matching branches will be loaded.
 func (i *Index) ensureBranch(fields []string) (err error) {
 	if i.snap == nil {
 		return nil
@@ -164,42 +483,191 @@ func (i *Index) ensureBranch(fields []string) (err error) {
 		return ErrInvFields
 	}
 
-	// snapshot only supports a single level for now
-	// perhaps this can be made configurable later.
-	name := fields[0]
+	return i.ensureLevel(i.root, nil, fields)
+}
+
+// ensureTree is the same as ensureBranch but all branches under matching
+// branches are also loaded. This is required to get all nodes under them.
+func (i *Index) ensureTree(fields []string) (err error) {
+	if i.snap != nil {
+		for len(fields) < i.snap.depth {
+			fields = append(fields[:len(fields):len(fields)], Wildcard)
+		}
+	}
+
+	return i.ensureBranch(fields)
+}
+
+// ensureLevel loads branches under the tree node (which has given fields)
+// matching the first query field and continues with the rest of the query
+// under each matching branch until the last level of the snapshot.
+func (i *Index) ensureLevel(tn *TNode, fields, query []string) (err error) {
+	names, err := matchChildren(tn, query[0])
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := i.loadBranch(tn, append(fields[:len(fields):len(fields)], name)); err != nil {
+			return err
+		}
+	}
+
+	if len(fields) == 0 {
+		for _, name := range names {
+			i.touch(name)
+		}
+	}
+
+	// branches at the last level have all nodes under them
+	if len(query) == 1 || len(fields)+1 >= i.snap.depth {
+		return nil
+	}
+
+	for _, name := range names {
+		tn.Mutex.RLock()
+		c, ok := tn.Children[name]
+		tn.Mutex.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if err := i.ensureLevel(c, append(fields[:len(fields):len(fields)], name), query[1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchChildren returns names of children of the tree node which may match
+// the field. Exact values and values of sets are returned without checking.
+func matchChildren(tn *TNode, field string) (names []string, err error) {
+	if v, ok := exact(field); ok {
+		return []string{v}, nil
+	}
+
+	if vs, ok := setValues(field); ok {
+		return vs, nil
+	}
+
+	tn.Mutex.RLock()
+	defer tn.Mutex.RUnlock()
+
+	for n := range tn.Children {
+		if ok, err := match(field, n); err != nil {
+			return nil, err
+		} else if ok {
+			names = append(names, n)
+		}
+	}
+
+	return names, nil
+}
+
+// ensureLabels creates the label index and adds all existing index nodes.
+// The label index is set before adding existing nodes to make sure that
+// nodes created by the Ensure method while building are also added.
+func (i *Index) ensureLabels() (l *Labels, err error) {
+	i.lblmtx.Lock()
+	if i.labels == nil {
+		i.labels = newLabels()
+	}
+	l = i.labels
+	i.lblmtx.Unlock()
+
+	l.once.Do(func() {
+		// make sure all snapshot branches are loaded
+		if l.err = i.ensureTree([]string{Wildcard}); l.err != nil {
+			return
+		}
+
+		addLabels(l, i.root)
+	})
+
+	return l, l.err
+}
+
+// addLabels adds all valid nodes under the tree node to the label index
+func addLabels(l *Labels, tn *TNode) {
+	tn.Mutex.RLock()
+	defer tn.Mutex.RUnlock()
+
+	if tn.Node != nil && tn.Node.RecordID != Placeholder {
+		l.add(tn.Node)
+	}
+
+	for _, c := range tn.Children {
+		addLabels(l, c)
+	}
+}
+
+// loadBranch loads the branch with given fields under the tree node (which is
+// its parent) if it's not already loaded.
+func (i *Index) loadBranch(tn *TNode, fields []string) (err error) {
+	name := fields[len(fields)-1]
 
 	// faster path!
 	// missing/ready
-	i.root.Mutex.RLock()
-	if br, ok := i.root.Children[name]; !ok {
+	tn.Mutex.RLock()
+	if br, ok := tn.Children[name]; !ok {
 		// item not in index
-		i.root.Mutex.RUnlock()
+		tn.Mutex.RUnlock()
 		return nil
 	} else if br != nil {
 		// item already loaded
-		i.root.Mutex.RUnlock()
+		tn.Mutex.RUnlock()
 		return nil
 	}
-	i.root.Mutex.RUnlock()
+	tn.Mutex.RUnlock()
 
 	// slower path!
 	// should load
-	i.root.Mutex.Lock()
-	defer i.root.Mutex.Unlock()
+	tn.Mutex.Lock()
+	defer tn.Mutex.Unlock()
 
 	// test it again to avoid multiple loads
-	if br, ok := i.root.Children[name]; !ok {
+	if br, ok := tn.Children[name]; !ok {
 		return nil
 	} else if br != nil {
 		return nil
 	}
 
-	br, err := i.snap.LoadBranch(name)
+	key := branchKey(fields)
+	br, err := i.snap.LoadBranch(key)
 	if err != nil {
 		return err
 	}
 
-	i.root.Children[name] = br
+	tn.Children[name] = br
+
+	o := i.snap.branches[key]
+	i.addLoaded(fields[0], o.To-o.From)
 
 	return nil
 }
+
+// fieldsList sorts field value combinations in lexicographic order
+type fieldsList [][]string
+
+func (a fieldsList) Len() int           { return len(a) }
+func (a fieldsList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fieldsList) Less(i, j int) bool { return lessFields(a[i], a[j]) }
+
+// byFields sorts index nodes by their fields in lexicographic order
+type byFields []*Node
+
+func (a byFields) Len() int           { return len(a) }
+func (a byFields) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byFields) Less(i, j int) bool { return lessFields(a[i].Fields, a[j].Fields) }
+
+// lessFields compares field value combinations in lexicographic order
+func lessFields(a, b []string) bool {
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+
+	return len(a) < len(b)
+}
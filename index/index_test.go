@@ -21,7 +21,7 @@ func TestNewIndexRW(t *testing.T) {
 	}
 
 	for j := 0; j < 3; j++ {
-		i, err := NewRW(dir)
+		i, err := NewRW(dir, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -45,7 +45,7 @@ func TestNewIndexRO(t *testing.T) {
 	}
 
 	for j := 0; j < 3; j++ {
-		i, err := NewRO(dir)
+		i, err := NewRO(dir, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -68,7 +68,7 @@ func TestEnsureNode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,7 +109,7 @@ func TestFindOne(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -154,7 +154,7 @@ func TestFindFast(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -207,7 +207,7 @@ func TestFindSlow(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -278,6 +278,706 @@ func TestFindSlow(t *testing.T) {
 	}
 }
 
+func TestFindPattern(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a", "web-1"},
+		{"a", "web-2"},
+		{"a", "db-1"},
+		{"b", "web-1"},
+		{"c", "web-*"},
+		{"c", "web-1"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// escaped wildcards match values ending with a wildcard
+	ns, err := i.Find([]string{"c", `web-\*`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 1 || ns[0].RecordID != 4 {
+		t.Fatal("wrong result", ns)
+	}
+
+	// values which look like patterns can be found with an escape
+	for k, f := range [][]string{{"d", "!a"}, {"d", "re:a"}, {"d", "{a,b}"}} {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err := i.Find([]string{f[0], Escape + f[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != 1 || ns[0].RecordID != int64(len(sets)+k) {
+			t.Fatal("wrong result", f, ns)
+		}
+	}
+
+	ns, err = i.Find([]string{"a", "re:web-.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 ||
+		(ns[0].RecordID != 0 && ns[1].RecordID != 0) ||
+		(ns[0].RecordID != 1 && ns[1].RecordID != 1) {
+		t.Fatal("wrong result")
+	}
+
+	ns, err = i.Find([]string{"a", "web-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 ||
+		(ns[0].RecordID != 0 && ns[1].RecordID != 0) ||
+		(ns[0].RecordID != 1 && ns[1].RecordID != 1) {
+		t.Fatal("wrong result")
+	}
+
+	ns, err = i.Find([]string{"a", "!web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 ||
+		(ns[0].RecordID != 1 && ns[1].RecordID != 1) ||
+		(ns[0].RecordID != 2 && ns[1].RecordID != 2) {
+		t.Fatal("wrong result")
+	}
+
+	ns, err = i.Find([]string{"a", "{web-1,db-1,db-2}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 ||
+		(ns[0].RecordID != 0 && ns[1].RecordID != 0) ||
+		(ns[0].RecordID != 2 && ns[1].RecordID != 2) {
+		t.Fatal("wrong result")
+	}
+
+	if _, err := i.Find([]string{"a", "re:("}); err == nil {
+		t.Fatal("should return error")
+	}
+
+	// an empty negated pattern is not treated as "match all"
+	if _, err := i.Find([]string{"a", "!"}); err != ErrInvFields {
+		t.Fatal("expected ErrInvFields", err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the index from logs and create a snapshot
+	// then load the index using the created snapshot
+	for j := 0; j < 2; j++ {
+		i, err := NewRO(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err := i.Find([]string{"re:a|b", "web-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != 2 ||
+			(ns[0].RecordID != 0 && ns[1].RecordID != 0) ||
+			(ns[0].RecordID != 3 && ns[1].RecordID != 3) {
+			t.Fatal("wrong result")
+		}
+
+		ns, err = i.Find([]string{"{a,b}", "web-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != 2 ||
+			(ns[0].RecordID != 0 && ns[1].RecordID != 0) ||
+			(ns[0].RecordID != 3 && ns[1].RecordID != 3) {
+			t.Fatal("wrong result")
+		}
+
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindLabels(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := i.Ensure([]string{"app=a", "host=web1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := i.FindLabels([]string{"host=web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 1 || ns[0].RecordID != 0 {
+		t.Fatal("wrong result")
+	}
+
+	// nodes created after building the label index
+	if _, err := i.Ensure([]string{"host=web1", "app=b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err = i.FindLabels([]string{"host=web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 {
+		t.Fatal("wrong result")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the index from logs and create a snapshot
+	// then load the index using the created snapshot
+	for j := 0; j < 2; j++ {
+		i, err := NewRO(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err := i.FindLabels([]string{"app=b", "host=web1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != 1 || ns[0].RecordID != 1 {
+			t.Fatal("wrong result")
+		}
+
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i.SetMaxSeries(2)
+
+	if _, err := i.Ensure([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Ensure([]string{"a", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Ensure([]string{"a", "d"}); err != ErrMaxSeries {
+		t.Fatal("should return error")
+	}
+
+	// existing nodes can be used
+	if _, err := i.Ensure([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes without valid IDs should not be in results
+	ns, err := i.Find([]string{"a", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ns) != 2 {
+		t.Fatal("wrong result")
+	}
+
+	c, err := i.Cardinality()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c, map[string]int64{"a": 2}) {
+		t.Fatal("wrong cardinality")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a", "b", "c"},
+		{"a", "b", "d"},
+		{"a", "e"},
+		{"f", "g", "h"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		prefix []string
+		depth  int
+		values [][]string
+	}
+
+	tests := []test{
+		{[]string{}, 1, [][]string{{"a"}, {"f"}}},
+		{[]string{"a"}, 1, [][]string{{"b"}, {"e"}}},
+		{[]string{"a"}, 2, [][]string{{"b", "c"}, {"b", "d"}, {"e"}}},
+		{[]string{"a", "b"}, 1, [][]string{{"c"}, {"d"}}},
+		{[]string{"z"}, 1, nil},
+	}
+
+	// test with read-write index, then with the read-only index
+	// created using logs and then using the snapshot created
+	for j := 0; j < 3; j++ {
+		var i *Index
+		var err error
+
+		if j == 0 {
+			i, err = NewRW(dir, 0)
+		} else {
+			i, err = NewRO(dir, 0)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tst := range tests {
+			values, err := i.List(tst.prefix, tst.depth)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(values, tst.values) {
+				t.Fatal("wrong values", tst.prefix, values)
+			}
+		}
+
+		if _, err := i.List([]string{"*"}, 1); err != ErrInvFields {
+			t.Fatal("should return error")
+		}
+
+		if _, err := i.List([]string{"a"}, 0); err != ErrInvFields {
+			t.Fatal("should return error")
+		}
+
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a"},
+		{"a", "b"},
+		{"c", "d", "e"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = NewRO(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := i.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// intermediate nodes ("c") do not have record IDs
+	if len(ns) != len(sets) {
+		t.Fatal("wrong number of nodes", len(ns))
+	}
+
+	for _, n := range ns {
+		if err := n.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindTree(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a"},
+		{"a", "b"},
+		{"a", "c", "d"},
+		{"b", "c", "d"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		query []string
+		count int
+	}{
+		"exact":    {[]string{"a"}, 3},
+		"pattern":  {[]string{"*", "c"}, 2},
+		"leaf":     {[]string{"a", "b"}, 1},
+		"missing":  {[]string{"x"}, 0},
+		"too long": {[]string{"a", "b", "c"}, 0},
+	}
+
+	for name, test := range tests {
+		ns, err := i.FindTree(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != test.count {
+			t.Fatal("wrong number of nodes", name, len(ns))
+		}
+	}
+
+	// intermediate nodes do not have index nodes
+	if n, err := i.FindOne([]string{"b", "c"}); err != nil || n != nil {
+		t.Fatal("intermediate nodes should not be found", n, err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindSorted(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a"},
+		{"b", "a"},
+		{"a", "c"},
+		{"c", "a"},
+		{"a", "b"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := [][]string{{"a"}, {"a", "b"}, {"a", "c"}, {"b", "a"}, {"c", "a"}}
+
+	for j := 0; j < 10; j++ {
+		ns, err := i.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := make([][]string, len(ns))
+		for k, n := range ns {
+			fields[k] = n.Fields
+		}
+
+		if !reflect.DeepEqual(fields, exp) {
+			t.Fatal("wrong order", fields)
+		}
+
+		ns, err = i.Find([]string{"*", "*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields = make([][]string, len(ns))
+		for k, n := range ns {
+			fields[k] = n.Fields
+		}
+
+		if !reflect.DeepEqual(fields, exp[1:]) {
+			t.Fatal("wrong order", fields)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListConcurrent(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for j := 0; j < 10; j++ {
+		if _, err := i.Ensure([]string{"a" + strconv.Itoa(j)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// child nodes are added while listing (run with -race)
+	done := make(chan error, 1)
+	go func() {
+		for j := 0; j < 1000; j++ {
+			f := []string{"a" + strconv.Itoa(j%10), "b" + strconv.Itoa(j)}
+			if _, err := i.Ensure(f); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	for listing := true; listing; {
+		if _, err := i.List([]string{}, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listing = false
+		default:
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindROConcurrent(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for j := 0; j < 10; j++ {
+		for k := 0; k < 10; k++ {
+			f := []string{"a" + strconv.Itoa(j), "b" + strconv.Itoa(k), "c"}
+			if _, err := i.Ensure(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetSnapDepth(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// create the snapshot and load it again to load branches when finding
+	for j := 0; j < 2; j++ {
+		if i, err = NewRO(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if j == 0 {
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// branches are loaded and unloaded while finding nodes
+	i.SetMaxMemory(1)
+
+	if i.locks() != 2 {
+		t.Fatal("wrong number of locked levels", i.locks())
+	}
+
+	done := make(chan error)
+	for j := 0; j < 10; j++ {
+		go func(j int) {
+			for k := 0; k < 20; k++ {
+				ns, err := i.Find([]string{"a" + strconv.Itoa((j+k)%10), "*", "*"})
+				if err == nil && len(ns) != 10 {
+					err = ErrBadNode
+				}
+
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+
+			done <- nil
+		}(j)
+	}
+
+	for j := 0; j < 10; j++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkEnsure(b *testing.B) {
 	if err := os.RemoveAll(dir); err != nil {
 		b.Fatal(err)
@@ -286,7 +986,7 @@ func BenchmarkEnsure(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -328,7 +1028,7 @@ func BenchmarkFindOne(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -372,7 +1072,7 @@ func BenchmarkFindFast(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -416,7 +1116,7 @@ func BenchmarkFindSlow(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	i, err := NewRW(dir)
+	i, err := NewRW(dir, 0)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -0,0 +1,47 @@
+package index
+
+// interner is used to share memory between equal field strings of index
+// nodes. Fields of nodes under the same branch usually have the same values
+// (ex: all nodes under a branch have the branch name as their first field)
+// but decoded nodes have separate copies of them.
+type interner map[string]string
+
+// intern returns the shared string equal to given string
+func (in interner) intern(s string) string {
+	if v, ok := in[s]; ok {
+		return v
+	}
+
+	in[s] = s
+	return s
+}
+
+// internFields replaces strings in the fields slice with shared strings
+func (in interner) internFields(fields []string) {
+	for j, f := range fields {
+		fields[j] = in.intern(f)
+	}
+}
+
+// internTree replaces fields of all nodes in the tree and names of children
+// with shared strings. It must be used before the tree is used by others.
+func (in interner) internTree(tn *TNode) {
+	if tn.Node != nil {
+		in.internFields(tn.Node.Fields)
+	}
+
+	if len(tn.Children) == 0 {
+		return
+	}
+
+	children := make(map[string]*TNode, len(tn.Children))
+	for name, c := range tn.Children {
+		if c != nil {
+			in.internTree(c)
+		}
+
+		children[in.intern(name)] = c
+	}
+
+	tn.Children = children
+}
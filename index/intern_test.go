@@ -0,0 +1,54 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// sameString checks whether both strings use the same memory
+func sameString(a, b string) bool {
+	ha := (*reflect.StringHeader)(unsafe.Pointer(&a))
+	hb := (*reflect.StringHeader)(unsafe.Pointer(&b))
+	return ha.Data == hb.Data && ha.Len == hb.Len
+}
+
+func TestInternTree(t *testing.T) {
+	tree := WrapNode(nil)
+	for _, fields := range [][]string{{"a", "b"}, {"a", "c"}} {
+		// copy strings to get separate strings for each node
+		copied := make([]string, len(fields))
+		for j, f := range fields {
+			copied[j] = string([]byte(f))
+		}
+
+		tn := tree.Ensure(copied)
+		tn.Node.RecordID = 0
+	}
+
+	tree.Children["x"] = nil
+
+	interner{}.internTree(tree)
+
+	a := tree.Children["a"]
+	b := a.Children["b"].Node.Fields
+	c := a.Children["c"].Node.Fields
+
+	if !reflect.DeepEqual(b, []string{"a", "b"}) || !reflect.DeepEqual(c, []string{"a", "c"}) {
+		t.Fatal("wrong fields", b, c)
+	}
+
+	if !sameString(b[0], c[0]) {
+		t.Fatal("equal fields should share memory")
+	}
+
+	for name := range tree.Children {
+		if name == "a" && !sameString(name, b[0]) {
+			t.Fatal("children names should share memory")
+		}
+	}
+
+	if c, ok := tree.Children["x"]; !ok || c != nil {
+		t.Fatal("nil children should not change")
+	}
+}
@@ -0,0 +1,147 @@
+package index
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// LabelSep separates the key and the value of a label field.
+	// Index node fields like "host=web1" are used as labels.
+	LabelSep = "="
+
+	// labelKeySep is used to join node fields when comparing nodes
+	labelKeySep = "\x00"
+)
+
+// Labels is an inverted index which maps label keys and values to index nodes.
+// Index node fields formatted as "key=value" are used as labels regardless of
+// their position in the node. This makes it possible to find nodes by labels
+// without knowing the order of fields used when tracking the measurements.
+type Labels struct {
+	index map[string]map[string][]*Node
+	nodes map[*Node]bool
+	mutex *sync.RWMutex
+	once  *sync.Once
+	err   error
+}
+
+// newLabels creates an empty label index
+func newLabels() (l *Labels) {
+	return &Labels{
+		index: map[string]map[string][]*Node{},
+		nodes: map[*Node]bool{},
+		mutex: &sync.RWMutex{},
+		once:  &sync.Once{},
+	}
+}
+
+// add adds the node to the label index if it has fields formatted as labels.
+// Nodes are only added once even if this is called multiple times.
+func (l *Labels) add(n *Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.nodes[n] {
+		return
+	}
+
+	l.nodes[n] = true
+
+	for _, f := range n.Fields {
+		key, val, ok := splitLabel(f)
+		if !ok {
+			continue
+		}
+
+		values, ok := l.index[key]
+		if !ok {
+			values = map[string][]*Node{}
+			l.index[key] = values
+		}
+
+		values[val] = append(values[val], n)
+	}
+}
+
+// find finds all nodes which have all labels in the query. Label values
+// in the query can use any pattern supported by the Find method. Nodes
+// under other matching nodes are not included (see topNodes).
+func (l *Labels) find(query []string) (ns []*Node, err error) {
+	if len(query) == 0 {
+		return nil, ErrInvFields
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	var res map[*Node]bool
+
+	for _, q := range query {
+		key, val, ok := splitLabel(q)
+		if !ok {
+			return nil, ErrInvFields
+		}
+
+		set := map[*Node]bool{}
+		add := func(nodes []*Node) {
+			for _, n := range nodes {
+				if res == nil || res[n] {
+					set[n] = true
+				}
+			}
+		}
+
+		if v, ok := exact(val); ok {
+			add(l.index[key][v])
+		} else {
+			for v, nodes := range l.index[key] {
+				if ok, err := match(val, v); err != nil {
+					return nil, err
+				} else if ok {
+					add(nodes)
+				}
+			}
+		}
+
+		res = set
+	}
+
+	return topNodes(res), nil
+}
+
+// topNodes returns nodes which do not have a parent node in the set. Points
+// of parent nodes already include points of all nodes under them therefore
+// including both would count the same measurements more than once.
+func topNodes(set map[*Node]bool) (ns []*Node) {
+	keys := make(map[string]bool, len(set))
+	for n := range set {
+		keys[strings.Join(n.Fields, labelKeySep)] = true
+	}
+
+	ns = make([]*Node, 0, len(set))
+
+outer:
+	for n := range set {
+		for i := 1; i < len(n.Fields); i++ {
+			if keys[strings.Join(n.Fields[:i], labelKeySep)] {
+				continue outer
+			}
+		}
+
+		ns = append(ns, n)
+	}
+
+	return ns
+}
+
+// splitLabel splits a label field into the key and the value.
+// `ok` will be false if the field is not formatted as a label.
+func splitLabel(f string) (key, val string, ok bool) {
+	i := strings.Index(f, LabelSep)
+	if i <= 0 {
+		return "", "", false
+	}
+
+	return f[:i], f[i+len(LabelSep):], true
+}
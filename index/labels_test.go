@@ -0,0 +1,72 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	l := newLabels()
+
+	n1 := &Node{RecordID: 0, Fields: []string{"app=a", "host=web1"}}
+	n2 := &Node{RecordID: 1, Fields: []string{"host=web2", "app=a"}}
+	n3 := &Node{RecordID: 2, Fields: []string{"app=b", "host=web1", "x"}}
+
+	for _, n := range []*Node{n1, n2, n3, n1} {
+		l.add(n)
+	}
+
+	type test struct {
+		query []string
+		nodes []*Node
+	}
+
+	tests := []test{
+		{[]string{"app=a"}, []*Node{n1, n2}},
+		{[]string{"host=web1"}, []*Node{n1, n3}},
+		{[]string{"host=web1", "app=a"}, []*Node{n1}},
+		{[]string{"host=web*"}, []*Node{n1, n2, n3}},
+		{[]string{"host=web*", "app=!a"}, []*Node{n3}},
+		{[]string{"host=web3"}, []*Node{}},
+		{[]string{"x=y"}, []*Node{}},
+	}
+
+	for _, tst := range tests {
+		ns, err := l.find(tst.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sorted := map[int64]*Node{}
+		for _, n := range ns {
+			sorted[n.RecordID] = n
+		}
+
+		expected := map[int64]*Node{}
+		for _, n := range tst.nodes {
+			expected[n.RecordID] = n
+		}
+
+		if !reflect.DeepEqual(sorted, expected) {
+			t.Fatal("wrong result", tst.query)
+		}
+	}
+
+	// nodes under matching parent nodes are not included
+	n4 := &Node{RecordID: 3, Fields: []string{"app=a"}}
+	l.add(n4)
+
+	if ns, err := l.find([]string{"app=a"}); err != nil {
+		t.Fatal(err)
+	} else if len(ns) != 2 || (ns[0] != n4 && ns[1] != n4) {
+		t.Fatal("wrong result", ns)
+	}
+
+	if _, err := l.find([]string{"x"}); err != ErrInvFields {
+		t.Fatal("should return error")
+	}
+
+	if _, err := l.find([]string{}); err != ErrInvFields {
+		t.Fatal("should return error")
+	}
+}
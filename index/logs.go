@@ -4,7 +4,9 @@ import (
 	"errors"
 	"io"
 	"path"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/kadirahq/go-tools/hybrid"
@@ -17,10 +19,15 @@ const (
 	// index files will be named "logs_0, logs_1, ..."
 	prefixlogs = "logs_"
 
-	// Size of the segment file
+	// Default size of the segment file
 	// !IMPORTANT if this value changes, the database will not be able to use
 	// older data. To avoid accidental changes, this value is hardcoded here.
+	// Logs must always be loaded with the segment size used to create them.
 	segszlogs = 1024 * 1024 * 20
+
+	// number of log entries read from the log file and decoded together
+	// when loading the index log (see Logs.Load)
+	loadbatch = 1024
 )
 
 var (
@@ -42,13 +49,27 @@ type Logs struct {
 	logFile segments.Store
 	nextID  int64
 	nextOff int64
+	entries int64
+	segSize int64
 	iomutex *sync.Mutex
+
+	// grow is called with the start time after allocating a new segment
+	grow func(start time.Time)
 }
 
-// NewLogs creates a log type index persister.
-func NewLogs(dir string) (l *Logs, err error) {
+// NewLogs creates a log type index persister. Log files are created with
+// given segment size or the default segment size if it's zero.
+func NewLogs(dir string, ssz int64) (l *Logs, err error) {
+	if ssz <= 0 {
+		ssz = segszlogs
+	}
+
+	if err := recoverLogs(dir); err != nil {
+		return nil, err
+	}
+
 	sfpath := path.Join(dir, prefixlogs)
-	f, err := segmmap.New(sfpath, segszlogs, false)
+	f, err := segmmap.New(sfpath, ssz, false)
 	if err != nil {
 		return nil, err
 	}
@@ -57,12 +78,19 @@ func NewLogs(dir string) (l *Logs, err error) {
 		logFile: f,
 		nextID:  0,
 		nextOff: 0,
+		segSize: ssz,
 		iomutex: &sync.Mutex{},
 	}
 
 	return l, nil
 }
 
+// SetGrowHook sets a function which is called with the start time after
+// allocating a new log segment file. It must be called before storing nodes.
+func (l *Logs) SetGrowHook(fn func(start time.Time)) {
+	l.grow = fn
+}
+
 // Store appends a node to the index log file and updates ID and Offset fields.
 func (l *Logs) Store(n *TNode) (err error) {
 	l.iomutex.Lock()
@@ -80,10 +108,18 @@ func (l *Logs) Store(n *TNode) (err error) {
 	sz64 := int64(size)
 	full := sz64 + hybrid.SzInt64
 
+	// a new segment file is allocated if the node ends after the last one
+	start := time.Now()
+	grow := (l.nextOff+full+l.segSize-1)/l.segSize > (l.nextOff+l.segSize-1)/l.segSize
+
 	if err := l.logFile.Ensure(l.nextOff + full); err != nil {
 		return err
 	}
 
+	if grow && l.grow != nil {
+		l.grow(start)
+	}
+
 	p, err := l.logFile.SliceAt(full, l.nextOff)
 	if err != nil {
 		return err
@@ -122,28 +158,110 @@ func (l *Logs) Store(n *TNode) (err error) {
 
 	// next item offset
 	l.nextOff += full
+	l.entries++
 
 	return nil
 }
 
 // Load loads all index nodes from the log file and builds the index tree.
 // It also sets values for its Logs.nextID and Logs.nextOff fields.
+// Log entries are decoded concurrently using a goroutine for each cpu.
 func (l *Logs) Load() (tree *TNode, err error) {
+	return l.load(runtime.NumCPU())
+}
+
+// load loads all index nodes from the log file using given number of
+// goroutines to decode log entries. Entries are read from the log file
+// in batches and decoded batches are added to the tree in log order.
+func (l *Logs) load(workers int) (tree *TNode, err error) {
 	l.iomutex.Lock()
 	defer l.iomutex.Unlock()
 
 	l.nextID = 0
 	l.nextOff = 0
+	l.entries = 0
 
 	if _, err := l.logFile.Seek(0, 0); err != nil {
 		return nil, err
 	}
 
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan *logBatch, workers)
+	order := make(chan *logBatch, workers*2)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for b := range work {
+				b.decode()
+			}
+		}()
+	}
+
+	go l.readBatches(work, order)
+
 	root := &Node{Fields: []string{}}
 	tree = WrapNode(root)
 
+	// equal field strings of loaded nodes share memory
+	in := interner{}
+
+	// all batches must be received even after an error
+	// otherwise the goroutine reading the log will block
+	for b := range order {
+		<-b.done
+
+		if err != nil {
+			continue
+		} else if b.err != nil {
+			err = b.err
+			continue
+		}
+
+		for j, node := range b.nodes {
+			in.internFields(node.Fields)
+
+			tn := tree.Ensure(node.Fields)
+			tn.Mutex.Lock()
+			tn.Node = node
+			tn.Mutex.Unlock()
+
+			l.nextOff += hybrid.SzInt64 + int64(len(b.data[j]))
+			l.nextID++
+			l.entries++
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// readBatches reads log entries from the log file and sends batches of them
+// to be decoded. Batches are also sent in log order to the `order` channel.
+// A batch with an error is sent to the `order` channel if reading fails.
+func (l *Logs) readBatches(work, order chan *logBatch) {
+	defer close(order)
+	defer close(work)
+
+	send := func(b *logBatch) {
+		work <- b
+		order <- b
+	}
+
+	failed := func(err error) {
+		b := newLogBatch()
+		b.err = err
+		close(b.done)
+		order <- b
+	}
+
 	nextSize := hybrid.NewInt64(nil)
-	dataBuff := make([]byte, 1024)
+	batch := newLogBatch()
 
 	for {
 		for toread := nextSize.Bytes[:]; len(toread) > 0; {
@@ -151,50 +269,77 @@ func (l *Logs) Load() (tree *TNode, err error) {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				return nil, err
+				failed(err)
+				return
 			}
 
 			toread = toread[n:]
 		}
 
 		size := *nextSize.Value
-		if int64(len(dataBuff)) < size {
-			dataBuff = make([]byte, size)
-		}
-
 		if size <= 0 {
 			break
 		}
 
-		data := dataBuff[:size]
+		data := make([]byte, size)
 		for toread := data[:]; len(toread) > 0; {
 			n, err := l.logFile.Read(toread)
 			if err != nil {
-				return nil, err
+				failed(err)
+				return
 			}
 
 			toread = toread[n:]
 		}
 
+		batch.data = append(batch.data, data)
+		if len(batch.data) == loadbatch {
+			send(batch)
+			batch = newLogBatch()
+		}
+	}
+
+	if len(batch.data) > 0 {
+		send(batch)
+	}
+}
+
+// logBatch is a batch of index log entries read from the log file.
+// The done channel is closed after decoding all entries in the batch.
+type logBatch struct {
+	data  [][]byte
+	nodes []*Node
+	err   error
+	done  chan struct{}
+}
+
+// newLogBatch creates an empty batch of log entries
+func newLogBatch() (b *logBatch) {
+	return &logBatch{
+		data: make([][]byte, 0, loadbatch),
+		done: make(chan struct{}),
+	}
+}
+
+// decode unmarshals and validates all log entries in the batch
+func (b *logBatch) decode() {
+	defer close(b.done)
+
+	b.nodes = make([]*Node, len(b.data))
+	for j, data := range b.data {
 		node := &Node{}
 		if err := proto.Unmarshal(data, node); err != nil {
-			return nil, err
+			b.err = err
+			return
 		}
 
 		if err := node.Validate(); err != nil {
-			return nil, err
+			b.err = err
+			return
 		}
 
-		tn := tree.Ensure(node.Fields)
-		tn.Mutex.Lock()
-		tn.Node = node
-		tn.Mutex.Unlock()
-
-		l.nextOff += hybrid.SzInt64 + size
-		l.nextID++
+		b.nodes[j] = node
 	}
-
-	return tree, nil
 }
 
 // Sync syncs all log segment files
@@ -3,6 +3,7 @@ package index
 import (
 	"os"
 	"reflect"
+	"runtime"
 	"strconv"
 	"testing"
 )
@@ -30,7 +31,7 @@ func setuplg(t testing.TB) func() {
 func TestLogstore(t *testing.T) {
 	defer setuplg(t)()
 
-	l, err := NewLogs(tmpdirlogs)
+	l, err := NewLogs(tmpdirlogs, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,7 +59,7 @@ func TestLogstore(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	l, err = NewLogs(tmpdirlogs)
+	l, err = NewLogs(tmpdirlogs, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,3 +93,83 @@ func TestLogstore(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLogsLoadOrder(t *testing.T) {
+	defer setuplg(t)()
+
+	l, err := NewLogs(tmpdirlogs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// later entries for the same fields replace earlier entries
+	count := loadbatch*3 + 1
+	for i := 0; i < count; i++ {
+		flds := []string{"a", "b" + strconv.Itoa(i%10)}
+		node := WrapNode(&Node{RecordID: int64(i), Fields: flds})
+
+		if err := l.Store(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size := l.nextOff
+
+	for _, workers := range []int{1, 4} {
+		tree, err := l.load(workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l.nextOff != size || l.nextID != int64(count) || l.entries != int64(count) {
+			t.Fatal("wrong state", l.nextOff, l.nextID, l.entries)
+		}
+
+		for i := count - 10; i < count; i++ {
+			flds := []string{"a", "b" + strconv.Itoa(i%10)}
+			if res, err := tree.FindOne(flds); err != nil || res == nil || res.RecordID != int64(i) {
+				t.Fatal("wrong node", res, err)
+			}
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkLoadLogs(b *testing.B)  { benchLoadLogs(b, 1) }
+func BenchmarkLoadLogsP(b *testing.B) { benchLoadLogs(b, runtime.NumCPU()) }
+
+func benchLoadLogs(b *testing.B, workers int) {
+	defer setuplg(b)()
+
+	l, err := NewLogs(tmpdirlogs, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < 100000; i++ {
+		istr := strconv.Itoa(i)
+		flds := []string{"r" + strconv.Itoa(i%100), "b" + istr, "c" + istr}
+		node := WrapNode(&Node{RecordID: int64(i), Fields: flds})
+
+		if err := l.Store(node); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := l.load(workers); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	if err := l.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,210 @@
+package index
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// Wildcard can be used as a query field to match any field value.
+	// Query fields ending with a wildcard will match all index field values
+	// starting with the rest of the query field (ex: "api-*" matches "api-1").
+	// This is much faster than using a regular expression to do the same.
+	Wildcard = "*"
+
+	// Escape can be used at the start of a query field to match the rest of
+	// the query field exactly. It can be used to find index field values
+	// which look like patterns (ex: `\!a` matches "!a", `\{a,b}` matches
+	// "{a,b}" and `\re:a` matches "re:a"). Index field values starting with
+	// the escape must also be escaped (ex: `\\a` matches `\a`). Escaped query
+	// fields are never patterns therefore a trailing '*' is matched exactly
+	// (ex: `\re:a*` matches "re:a*" only). Use a regular expression to find
+	// values starting with "re:" or '!' (ex: "re:re:a.*" or "re:!a.*").
+	Escape = "\\"
+
+	// EscapedWildcard can be used at the end of a query field to match index
+	// field values which really end with a '*' (ex: `a\*` matches "a*").
+	EscapedWildcard = Escape + Wildcard
+
+	// RegexPrefix is used to identify query fields with regular expressions.
+	// The expression must match the complete index field value (ex: "re:a.*").
+	RegexPrefix = "re:"
+
+	// NegatePrefix is used to exclude index field values matching the rest of
+	// the query field. It can be used with other patterns (ex: "!re:a.*").
+	// The rest of the query field must not be empty (ErrInvFields).
+	NegatePrefix = "!"
+
+	// Query fields can have a set of accepted values separated by commas and
+	// wrapped with curly braces (ex: "{a,b,c}"). Nodes for each value are
+	// looked up directly instead of matching against all index field values.
+	setStart = "{"
+	setEnd   = "}"
+	setSep   = ","
+
+	// maxPatterns is the maximum number of compiled regular expressions kept
+	// in the cache. The cache is cleared when it has more patterns than this.
+	maxPatterns = 1000
+)
+
+var (
+	// patterns caches compiled regular expressions used in queries.
+	// Queries usually have a small set of unique patterns which are
+	// repeatedly used therefore compiling them every time is wasteful.
+	patterns    = map[string]*regexp.Regexp{}
+	patternsMtx = &sync.RWMutex{}
+)
+
+// isPattern checks whether the query field should be matched against index
+// field values instead of using it to directly get a child node by name.
+func isPattern(f string) bool {
+	_, ok := exact(f)
+	return !ok
+}
+
+// exact returns the index field value matched by the query field if it's an
+// exact value or an escaped value. `ok` will be false for patterns.
+func exact(f string) (v string, ok bool) {
+	if strings.HasPrefix(f, Escape) {
+		return f[len(Escape):], true
+	}
+
+	if _, ok := setValues(f); ok ||
+		strings.HasPrefix(f, RegexPrefix) ||
+		strings.HasPrefix(f, NegatePrefix) {
+		return "", false
+	}
+
+	if strings.HasSuffix(f, EscapedWildcard) {
+		return f[:len(f)-len(EscapedWildcard)] + Wildcard, true
+	}
+
+	if strings.HasSuffix(f, Wildcard) {
+		return "", false
+	}
+
+	return f, true
+}
+
+// Quote returns query fields which only match given index field values.
+// Stored field values which look like patterns (ex: "a*" or "re:a") can be
+// used with Find and fetch functions after quoting them.
+func Quote(fields []string) (query []string) {
+	query = make([]string, len(fields))
+	for k, f := range fields {
+		query[k] = Escape + f
+	}
+
+	return query
+}
+
+// setValues returns unique values if the query field is a set of values.
+// `ok` will be false if the query field is not formatted as a set.
+func setValues(f string) (vs []string, ok bool) {
+	if len(f) < len(setStart)+len(setEnd) ||
+		!strings.HasPrefix(f, setStart) ||
+		!strings.HasSuffix(f, setEnd) {
+		return nil, false
+	}
+
+	inner := f[len(setStart) : len(f)-len(setEnd)]
+	seen := map[string]bool{}
+
+	for _, v := range strings.Split(inner, setSep) {
+		if v == "" || seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		vs = append(vs, v)
+	}
+
+	return vs, true
+}
+
+// Match checks whether index fields match all query fields. Fields match only
+// if both have the same number of fields (same as finding index nodes).
+func Match(query, fields []string) (ok bool, err error) {
+	if len(query) != len(fields) {
+		return false, nil
+	}
+
+	for i, f := range query {
+		if ok, err := match(f, fields[i]); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// match checks whether an index field value matches the query field.
+func match(f, v string) (ok bool, err error) {
+	if f == Wildcard {
+		return true, nil
+	}
+
+	if e, ok := exact(f); ok {
+		return e == v, nil
+	}
+
+	if strings.HasPrefix(f, NegatePrefix) {
+		// an empty pattern would match all values when negated
+		rest := f[len(NegatePrefix):]
+		if rest == "" {
+			return false, ErrInvFields
+		}
+
+		ok, err := match(rest, v)
+		return !ok && err == nil, err
+	}
+
+	if vs, ok := setValues(f); ok {
+		for _, s := range vs {
+			if s == v {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	if strings.HasPrefix(f, RegexPrefix) {
+		re, err := compile(f[len(RegexPrefix):])
+		if err != nil {
+			return false, err
+		}
+
+		return re.MatchString(v), nil
+	}
+
+	// only prefix patterns are left at this point
+	prefix := f[:len(f)-len(Wildcard)]
+	return strings.HasPrefix(v, prefix), nil
+}
+
+// compile compiles the regular expression or gets it from the cache.
+// Expressions are anchored to make sure they match the whole value.
+func compile(expr string) (re *regexp.Regexp, err error) {
+	patternsMtx.RLock()
+	re, ok := patterns[expr]
+	patternsMtx.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err = regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	patternsMtx.Lock()
+	if len(patterns) >= maxPatterns {
+		patterns = map[string]*regexp.Regexp{}
+	}
+	patterns[expr] = re
+	patternsMtx.Unlock()
+
+	return re, nil
+}
@@ -0,0 +1,157 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	type test struct {
+		query string
+		value string
+		match bool
+	}
+
+	tests := []test{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"*", "a", true},
+		{"api-*", "api-1", true},
+		{"api-*", "api-", true},
+		{"api-*", "web-1", false},
+		{"re:web-.*", "web-1", true},
+		{"re:web-.*", "db-1", false},
+		{"re:web", "web-1", false},
+		{"re:a|b", "b", true},
+		{"!a", "a", false},
+		{"!a", "b", true},
+		{"!api-*", "api-1", false},
+		{"!re:a|b", "c", true},
+		{"{a,b}", "b", true},
+		{"{a,b}", "c", false},
+		{"!{a,b}", "c", true},
+		{"{}", "", false},
+		{`api-\*`, "api-*", true},
+		{`api-\*`, "api-1", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`\!a`, "!a", true},
+		{`\!a`, "b", false},
+		{`\re:a`, "re:a", true},
+		{`\{a,b}`, "{a,b}", true},
+		{`\{a,b}`, "a", false},
+		{`\a*`, "a*", true},
+		{`\a*`, "ab", false},
+		{`\re:a*`, "re:ab", false},
+		{"re:a*", "re:ab", false},
+		{"re:re:a.*", "re:ab", true},
+		{"re:!a.*", "!ab", true},
+		{`\\a`, `\a`, true},
+		{`!\!a`, "!a", false},
+		{`!\!a`, "a", true},
+	}
+
+	for _, tst := range tests {
+		ok, err := match(tst.query, tst.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != tst.match {
+			t.Fatal("wrong result", tst.query, tst.value)
+		}
+	}
+
+	if _, err := match("re:(", "a"); err == nil {
+		t.Fatal("should return error")
+	}
+
+	if ok, err := match("!re:(", "a"); err == nil || ok {
+		t.Fatal("should return error")
+	}
+
+	for _, f := range []string{"!", "!!"} {
+		if ok, err := match(f, "a"); err != ErrInvFields || ok {
+			t.Fatal("should return error", f)
+		}
+	}
+}
+
+func TestMatchFields(t *testing.T) {
+	if ok, err := Match([]string{"cpu", "*"}, []string{"cpu", "all"}); err != nil || !ok {
+		t.Fatal("fields should match", err)
+	}
+
+	if ok, err := Match([]string{"cpu", "*"}, []string{"cpu_all"}); err != nil || ok {
+		t.Fatal("fields should not match", err)
+	}
+
+	if ok, err := Match([]string{"cpu"}, []string{"cpu", "all"}); err != nil || ok {
+		t.Fatal("fields should not match", err)
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	re1, err := compile("a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re2, err := compile("a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if re1 != re2 {
+		t.Fatal("should use cache")
+	}
+}
+
+func TestSetValues(t *testing.T) {
+	if vs, ok := setValues("{a,b,a,,c}"); !ok || !reflect.DeepEqual(vs, []string{"a", "b", "c"}) {
+		t.Fatal("wrong values")
+	}
+
+	if _, ok := setValues("{a,b"); ok {
+		t.Fatal("should not be a set")
+	}
+}
+
+func TestExact(t *testing.T) {
+	tests := []struct {
+		query string
+		value string
+		exact bool
+	}{
+		{"a", "a", true},
+		{`\!a`, "!a", true},
+		{`\re:a`, "re:a", true},
+		{`\{a,b}`, "{a,b}", true},
+		{`a\*`, "a*", true},
+		{"a*", "", false},
+		{"!a", "", false},
+		{`!a\*`, "", false},
+		{"re:a", "", false},
+		{"{a,b}", "", false},
+	}
+
+	for _, tst := range tests {
+		v, ok := exact(tst.query)
+		if ok != tst.exact || v != tst.value {
+			t.Fatal("wrong result", tst.query, v, ok)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	values := []string{"a", "a*", "!a", "re:a", "{a,b}", `\a`}
+	query := Quote(values)
+
+	if ok, err := Match(query, values); err != nil || !ok {
+		t.Fatal("quoted fields should match", query, err)
+	}
+
+	if ok, err := Match(query[1:2], []string{"ab"}); err != nil || ok {
+		t.Fatal("quoted fields should not be patterns", err)
+	}
+}
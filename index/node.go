@@ -6,6 +6,10 @@ const (
 	// Placeholder is used as a placeholder ID until a proper value can be set.
 	// This ID can be seen right after adding new nodes to the index tree.
 	Placeholder = -1
+
+	// lockall is used as the number of locked tree levels when reading
+	// nodes which can be modified at any level (ex: read-write indexes).
+	lockall = -1
 )
 
 var (
@@ -93,6 +97,11 @@ func (n *TNode) Ensure(fields []string) (tn *TNode) {
 // FindOne finds the index nodes with exact given field combination.
 // `n` is nil if the no nodes exist in the index with given fields.
 func (n *TNode) FindOne(fields []string) (res *Node, err error) {
+	return n.findOne(fields, lockall)
+}
+
+// findOne is FindOne which only locks given number of tree levels
+func (n *TNode) findOne(fields []string, locks int) (res *Node, err error) {
 	c := n
 
 	if !isValidFields(fields) {
@@ -100,31 +109,47 @@ func (n *TNode) FindOne(fields []string) (res *Node, err error) {
 	}
 
 	for _, f := range fields {
-		c.Mutex.RLock()
+		c.rlock(locks)
 		next, ok := c.Children[f]
-		c.Mutex.RUnlock()
+		c.runlock(locks)
 		if !ok {
 			return nil, nil
 		}
 
 		c = next
+		locks = nextLocks(locks)
 	}
 
-	c.Mutex.RLock()
+	// intermediate nodes and nodes without a valid ID are ignored
+	c.rlock(locks)
 	res = c.Node
-	if res.RecordID == Placeholder {
-		c.Mutex.RUnlock()
+	c.runlock(locks)
+	if res == nil || res.RecordID == Placeholder {
 		return nil, nil
 	}
-	c.Mutex.RUnlock()
 
 	return res, nil
 }
 
 // Find finds all nodes matching the field pattern under this node.
 // Find runs recursively for each field until all nodes are collected.
+// Query fields can be exact values, sets of values, wildcards, prefixes or
+// regular expressions. Any of these can be negated to get nodes which do
+// not match the pattern. Escaped fields are exact values (see Escape).
 func (n *TNode) Find(fields []string) (ns []*Node, err error) {
+	return n.find(fields, lockall)
+}
+
+// find is Find which only locks given number of tree levels
+func (n *TNode) find(fields []string, locks int) (ns []*Node, err error) {
 	if len(fields) == 0 {
+		// intermediate nodes and nodes without a valid ID are ignored
+		n.rlock(locks)
+		defer n.runlock(locks)
+		if n.Node == nil || n.Node.RecordID == Placeholder {
+			return nil, nil
+		}
+
 		ns = []*Node{n.Node}
 		return ns, nil
 	}
@@ -135,21 +160,25 @@ func (n *TNode) Find(fields []string) (ns []*Node, err error) {
 	//       Avoid the recursion to solve this and improve find performance.
 	//       This is an optimization task therefore the priority is low.
 	findone := true
-	for _, f := range fields {
+	values := make([]string, len(fields))
+	for i, f := range fields {
 		if f == "" {
 			return nil, ErrBadNode
 		}
 
-		if f == "*" {
+		v, ok := exact(f)
+		if !ok {
 			findone = false
 			break
 		}
+
+		values[i] = v
 	}
 
 	// The query does not have any wildcards therefore the FindOne
 	// method can be used instead of the much slower Find method.
 	if findone {
-		c, err := n.FindOne(fields)
+		c, err := n.findOne(values, locks)
 		if err != nil {
 			return nil, err
 		}
@@ -166,35 +195,204 @@ func (n *TNode) Find(fields []string) (ns []*Node, err error) {
 	// The rest of the query will be resolved recursively one field at a time.
 	car := fields[0]
 	cdr := fields[1:]
+	next := nextLocks(locks)
+
+	// If the field is a set of values, get nodes for each value directly
+	// and run the query on them. This is faster than matching all values.
+	if vs, ok := setValues(car); ok {
+		for _, v := range vs {
+			n.rlock(locks)
+			c, ok := n.Children[v]
+			n.runlock(locks)
+			if !ok {
+				continue
+			}
 
-	// If the field is a wildcard, run the query for each value under this node
-	// and merge results taken from each value. Use `cdr` as the query from now.
-	if car == "*" {
-		n.Mutex.RLock()
-		for _, c := range n.Children {
-			res, err := c.Find(cdr)
+			res, err := c.find(cdr, next)
 			if err != nil {
-				n.Mutex.RUnlock()
 				return nil, err
 			}
 
 			ns = append(ns, res...)
 		}
-		n.Mutex.RUnlock()
+
+		return ns, nil
+	}
+
+	// If the field is a pattern, run the query for each matching value under
+	// this node and merge results taken from each value. Use `cdr` from now.
+	if isPattern(car) {
+		n.rlock(locks)
+		for name, c := range n.Children {
+			if ok, err := match(car, name); err != nil {
+				n.runlock(locks)
+				return nil, err
+			} else if !ok {
+				continue
+			}
+
+			res, err := c.find(cdr, next)
+			if err != nil {
+				n.runlock(locks)
+				return nil, err
+			}
+
+			ns = append(ns, res...)
+		}
+		n.runlock(locks)
 
 		return ns, nil
 	}
 
 	// The field is a specific value, look for it in this node.
 	// Returns a nil slice if the matching item is not found.
-	n.Mutex.RLock()
-	c, ok := n.Children[car]
-	n.Mutex.RUnlock()
+	v, _ := exact(car)
+	n.rlock(locks)
+	c, ok := n.Children[v]
+	n.runlock(locks)
 	if !ok {
 		return nil, nil
 	}
 
-	return c.Find(cdr)
+	return c.find(cdr, next)
+}
+
+// FindTree finds all nodes in tree branches matching the field pattern under
+// this node. Nodes matching the pattern and all nodes under them are included
+// if they have valid record IDs. Query fields are the same as with Find.
+func (n *TNode) FindTree(fields []string) (ns []*Node, err error) {
+	return n.findTree(fields, lockall)
+}
+
+// findTree is FindTree which only locks given number of tree levels
+func (n *TNode) findTree(fields []string, locks int) (ns []*Node, err error) {
+	if len(fields) == 0 {
+		return n.All(), nil
+	}
+
+	car := fields[0]
+	cdr := fields[1:]
+
+	if car == "" {
+		return nil, ErrBadNode
+	}
+
+	n.rlock(locks)
+	defer n.runlock(locks)
+
+	next := nextLocks(locks)
+
+	if v, ok := exact(car); ok {
+		c, ok := n.Children[v]
+		if !ok {
+			return nil, nil
+		}
+
+		return c.findTree(cdr, next)
+	}
+
+	for name, c := range n.Children {
+		if ok, err := match(car, name); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		res, err := c.findTree(cdr, next)
+		if err != nil {
+			return nil, err
+		}
+
+		ns = append(ns, res...)
+	}
+
+	return ns, nil
+}
+
+// List returns distinct field value combinations under this node up to given
+// depth. Paths shorter than the depth are included when they have no children.
+func (n *TNode) List(depth int) (values [][]string) {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+
+	for name, c := range n.Children {
+		if depth == 1 || c == nil || !c.hasChildren() {
+			values = append(values, []string{name})
+			continue
+		}
+
+		for _, rest := range c.List(depth - 1) {
+			values = append(values, append([]string{name}, rest...))
+		}
+	}
+
+	return values
+}
+
+// hasChildren checks whether the tree node has any child nodes
+func (n *TNode) hasChildren() bool {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+
+	return len(n.Children) != 0
+}
+
+// Count returns the number of nodes with valid record IDs under this node.
+// The tree node itself is also counted if it has a valid record ID.
+func (n *TNode) Count() (count int64) {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+
+	if n.Node != nil && n.Node.RecordID != Placeholder {
+		count++
+	}
+
+	for _, c := range n.Children {
+		count += c.Count()
+	}
+
+	return count
+}
+
+// All returns all nodes with valid record IDs under this node.
+// The tree node itself is also included if it has a valid record ID.
+func (n *TNode) All() (ns []*Node) {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+
+	if n.Node != nil && n.Node.RecordID != Placeholder {
+		ns = append(ns, n.Node)
+	}
+
+	for _, c := range n.Children {
+		ns = append(ns, c.All()...)
+	}
+
+	return ns
+}
+
+// rlock locks the node for reading if it's in one of the locked levels
+func (n *TNode) rlock(locks int) {
+	if locks != 0 {
+		n.Mutex.RLock()
+	}
+}
+
+// runlock unlocks the node locked with rlock
+func (n *TNode) runlock(locks int) {
+	if locks != 0 {
+		n.Mutex.RUnlock()
+	}
+}
+
+// nextLocks returns the number of locked levels under a node
+// which has given number of locked levels (including itself).
+func nextLocks(locks int) int {
+	if locks > 0 {
+		return locks - 1
+	}
+
+	return locks
 }
 
 // isValidFields checks whether given set of fields are valid.
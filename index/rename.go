@@ -0,0 +1,167 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/kadirahq/go-tools/hybrid"
+)
+
+var (
+	// ErrRenameConflict is returned when renaming index nodes would create
+	// more than one index node with the same fields.
+	ErrRenameConflict = errors.New("renamed fields are used by another node")
+)
+
+// Rename rewrites fields of index nodes in given directory which have the
+// `from` pattern as a prefix (see FindTree). Each field in `to` replaces the
+// field at the same position unless it's a wildcard ("*") which keeps the old
+// value. For example, renaming ["svc1", "*"] to ["svc2", "*"] moves all nodes
+// under "svc1" to "svc2". Other values in `to` must be exact or escaped
+// values. Record IDs do not change so existing data is kept.
+// The index log is replaced the same way CompactLogs does and the snapshot is
+// rebuilt if the index has one. Nothing is changed if renamed nodes conflict
+// with other nodes. The index must not be loaded while renaming it.
+// It returns the number of renamed nodes and the size of the new index log.
+func Rename(dir string, from, to []string, ssz int64) (n int, size int64, err error) {
+	if len(from) == 0 || len(from) != len(to) {
+		return 0, 0, ErrInvFields
+	}
+
+	for k := range from {
+		if from[k] == "" || to[k] == "" || (to[k] != Wildcard && isPattern(to[k])) {
+			return 0, 0, ErrInvFields
+		}
+	}
+
+	if !exists(path.Join(dir, prefixlogs+"0")) {
+		return 0, 0, nil
+	}
+
+	logs, err := NewLogs(dir, ssz)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tree, err := logs.Load()
+	if err != nil {
+		logs.Close()
+		return 0, 0, err
+	}
+
+	size = logs.nextOff
+
+	if err := logs.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	var nodes []*Node
+	for _, tn := range tree.Children {
+		nodes = append(nodes, tn.All()...)
+	}
+
+	seen := make(map[string]bool, len(nodes))
+	renamed := make([]*Node, len(nodes))
+
+	for j, node := range nodes {
+		fields, err := renameFields(node.Fields, from, to)
+		if err != nil {
+			return 0, 0, err
+		} else if fields != nil {
+			node = &Node{RecordID: node.RecordID, Fields: fields}
+			n++
+		}
+
+		key := branchKey(node.Fields)
+		if seen[key] {
+			return 0, 0, ErrRenameConflict
+		}
+
+		seen[key] = true
+		renamed[j] = node
+	}
+
+	if n == 0 {
+		return 0, size, nil
+	}
+
+	sort.Sort(byRecordID(renamed))
+
+	tmp := path.Join(dir, compactdir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return 0, 0, err
+	}
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return 0, 0, err
+	}
+
+	if err := writeLogs(tmp, ssz, renamed); err != nil {
+		os.RemoveAll(tmp)
+		return 0, 0, err
+	}
+
+	if err := recoverLogs(dir); err != nil {
+		return 0, 0, err
+	}
+
+	if err := removeCheckpoint(dir); err != nil {
+		return 0, 0, err
+	}
+
+	size = 0
+	for _, node := range renamed {
+		size += hybrid.SzInt64 + int64(node.Size())
+	}
+
+	if !exists(path.Join(dir, prefixsnaproot+"0")) {
+		return n, size, nil
+	}
+
+	tree = newTree()
+	for _, node := range renamed {
+		tree.Ensure(node.Fields).Node = node
+	}
+
+	if err := removeSnapshot(dir); err != nil {
+		return 0, 0, err
+	}
+
+	snap, err := writeSnapshot(dir, tree, ssz)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := snap.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	return n, size, nil
+}
+
+// renameFields returns renamed fields if fields have the `from` pattern as
+// a prefix. It returns nil if fields do not match the pattern.
+func renameFields(fields, from, to []string) (renamed []string, err error) {
+	if len(fields) < len(from) {
+		return nil, nil
+	}
+
+	for k, f := range from {
+		if ok, err := match(f, fields[k]); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, nil
+		}
+	}
+
+	renamed = append([]string(nil), fields...)
+	for k, f := range to {
+		if f != Wildcard {
+			renamed[k], _ = exact(f)
+		}
+	}
+
+	return renamed, nil
+}
@@ -0,0 +1,122 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+var (
+	tmpdirrename = "/tmp/test-rename/"
+)
+
+func TestRename(t *testing.T) {
+	if err := os.RemoveAll(tmpdirrename); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tmpdirrename, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(tmpdirrename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a", "b", "c"},
+		{"a", "d", "c"},
+		{"x", "b", "c"},
+		{"y", "b"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// create a snapshot which must be rebuilt
+	if i, err = NewRO(tmpdirrename, 0); err != nil {
+		t.Fatal(err)
+	} else if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Rename(tmpdirrename, []string{"a"}, []string{"x", "y"}, 0); err != ErrInvFields {
+		t.Fatal("should fail with invalid fields", err)
+	}
+
+	if _, _, err := Rename(tmpdirrename, []string{"a", "b"}, []string{"x", "*"}, 0); err != ErrRenameConflict {
+		t.Fatal("should fail with a conflict", err)
+	}
+
+	n, size, err := Rename(tmpdirrename, []string{"a", "*"}, []string{"z", "*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal("wrong number of renamed nodes", n)
+	}
+
+	logs, err := NewLogs(tmpdirrename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := logs.Load(); err != nil {
+		t.Fatal(err)
+	} else if logs.nextOff != size || logs.entries != 4 {
+		t.Fatal("wrong log size", logs.nextOff, size, logs.entries)
+	}
+
+	if err := logs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ro := range []bool{true, false} {
+		var i *Index
+		if ro {
+			i, err = NewRO(tmpdirrename, 0)
+		} else {
+			i, err = NewRW(tmpdirrename, 0)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ns, err := i.Find([]string{"a", "*", "*"}); err != nil || len(ns) != 0 {
+			t.Fatal("old fields should not exist", ns, err)
+		}
+
+		ns, err := i.Find([]string{"z", "*", "*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := []*Node{
+			{RecordID: 0, Fields: []string{"z", "b", "c"}},
+			{RecordID: 1, Fields: []string{"z", "d", "c"}},
+		}
+
+		if !reflect.DeepEqual(ns, exp) {
+			t.Fatal("wrong nodes", ns)
+		}
+
+		if n, err := i.FindOne([]string{"y", "b"}); err != nil || n == nil || n.RecordID != 3 {
+			t.Fatal("other nodes should not change", n, err)
+		}
+
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(tmpdirrename); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+package index
+
+import (
+	"io"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/kadirahq/go-tools/hybrid"
+)
+
+const (
+	// size of the buffer used when clearing the end of the log file
+	repairbuf = 1024 * 1024
+)
+
+// Repair checks the index log in given directory after an unclean shutdown.
+// The first truncated or corrupt log entry and everything after it is cleared
+// so new nodes can be appended safely. Entries which end after `size` bytes
+// are also cleared unless `size` is negative. If the log has any nodes, the
+// index snapshot is rebuilt using them. It returns the next unused record ID
+// and whether the log file had to be modified. Index files must use given
+// segment size (or the default size if it's zero). Parent nodes are repaired
+// the same way NewRWStored does with given stored function (can be nil).
+func Repair(dir string, size, ssz int64, stored func(depth int) bool) (next int64, trimmed bool, err error) {
+	root, next, trimmed, err := trimLogs(dir, size, ssz, stored)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(root.Children) == 0 {
+		return next, trimmed, nil
+	}
+
+	// remove old snapshot files which may be incomplete or outdated
+	if err := removeSnapshot(dir); err != nil {
+		return 0, false, err
+	}
+
+	snap, err := writeSnapshot(dir, root, ssz)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if err := snap.Close(); err != nil {
+		return 0, false, err
+	}
+
+	return next, trimmed, nil
+}
+
+// TrimLogs is the same as Repair but the index snapshot is not rebuilt.
+// This can be used before loading the index in read-write mode.
+func TrimLogs(dir string, size, ssz int64, stored func(depth int) bool) (next int64, trimmed bool, err error) {
+	_, next, trimmed, err = trimLogs(dir, size, ssz, stored)
+	return next, trimmed, err
+}
+
+// trimLogs trims the index log in given directory and returns the index tree
+func trimLogs(dir string, size, ssz int64, stored func(depth int) bool) (tree *TNode, next int64, trimmed bool, err error) {
+	logs, err := NewLogs(dir, ssz)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	tree, next, trimmed, err = logs.repair(size)
+	if err != nil {
+		logs.Close()
+		return nil, 0, false, err
+	}
+
+	i := &Index{root: tree, logs: logs}
+	if n, err := i.repairPlaceholders(stored); err != nil {
+		logs.Close()
+		return nil, 0, false, err
+	} else if n > 0 {
+		trimmed = true
+	}
+
+	if err := logs.Sync(); err != nil {
+		logs.Close()
+		return nil, 0, false, err
+	}
+
+	if err := logs.Close(); err != nil {
+		return nil, 0, false, err
+	}
+
+	// the checkpoint may have nodes which were cleared from the log
+	if trimmed {
+		if err := removeCheckpoint(dir); err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	return tree, next, trimmed, nil
+}
+
+// repair reads valid log entries and clears the log file after the last one.
+// Only entries which end within `size` bytes are read if it's not negative.
+// It returns the index tree and the next unused record ID like Load does.
+func (l *Logs) repair(size int64) (tree *TNode, next int64, trimmed bool, err error) {
+	l.iomutex.Lock()
+	defer l.iomutex.Unlock()
+
+	total, err := l.logFile.Seek(0, 2)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	limit := total
+	if size >= 0 && size < total {
+		limit = size
+	}
+
+	root := &Node{Fields: []string{}}
+	tree = WrapNode(root)
+
+	var off int64
+	sizeBuff := make([]byte, hybrid.SzInt64)
+
+	for off+hybrid.SzInt64 <= limit {
+		if err := l.readAt(sizeBuff, off); err != nil {
+			return nil, 0, false, err
+		}
+
+		var nsize int64
+		hybrid.DecodeInt64(sizeBuff, &nsize)
+		if nsize <= 0 || off+hybrid.SzInt64+nsize > limit {
+			break
+		}
+
+		data := make([]byte, nsize)
+		if err := l.readAt(data, off+hybrid.SzInt64); err != nil {
+			return nil, 0, false, err
+		}
+
+		node := &Node{}
+		if err := proto.Unmarshal(data, node); err != nil {
+			break
+		}
+
+		if err := node.Validate(); err != nil {
+			break
+		}
+
+		tn := tree.Ensure(node.Fields)
+		tn.Mutex.Lock()
+		tn.Node = node
+		tn.Mutex.Unlock()
+
+		if node.RecordID >= next {
+			next = node.RecordID + 1
+		}
+
+		off += hybrid.SzInt64 + nsize
+	}
+
+	if trimmed, err = l.clear(off, total); err != nil {
+		return nil, 0, false, err
+	}
+
+	l.nextID = next
+	l.nextOff = off
+
+	return tree, next, trimmed, nil
+}
+
+// clear writes zeroes to the log file from `off` to `end` offsets.
+// Only parts which have non-zero bytes are written to the file.
+func (l *Logs) clear(off, end int64) (cleared bool, err error) {
+	buff := make([]byte, repairbuf)
+	zero := make([]byte, repairbuf)
+
+	for off < end {
+		part := buff
+		if end-off < int64(len(part)) {
+			part = part[:end-off]
+		}
+
+		if err := l.readAt(part, off); err != nil {
+			return false, err
+		}
+
+		for _, b := range part {
+			if b != 0 {
+				if _, err := l.logFile.WriteAt(zero[:len(part)], off); err != nil {
+					return false, err
+				}
+
+				cleared = true
+				break
+			}
+		}
+
+		off += int64(len(part))
+	}
+
+	return cleared, nil
+}
+
+// repairPlaceholders fixes index nodes without valid record IDs after loading
+// the index tree from logs. These are parents of loaded nodes which do not have
+// log entries (ex: entries lost in a crash). They get new record IDs and are
+// stored in the log. Nodes without valid IDs or children are removed.
+// Parents without nodes are skipped if stored returns false for their depth.
+// It returns the number of nodes which were fixed or removed.
+func (i *Index) repairPlaceholders(stored func(depth int) bool) (n int, err error) {
+	// record IDs used by lost log entries must not be reused
+	var next int64
+	for _, c := range i.root.Children {
+		for _, node := range c.All() {
+			if node.RecordID >= next {
+				next = node.RecordID + 1
+			}
+		}
+	}
+
+	if i.logs.nextID < next {
+		i.logs.nextID = next
+	}
+
+	return i.repairBranch(i.root, nil, stored)
+}
+
+// repairBranch repairs all nodes under given tree node which has given fields
+func (i *Index) repairBranch(tn *TNode, fields []string, stored func(depth int) bool) (n int, err error) {
+	for f, c := range tn.Children {
+		cfields := append(fields[:len(fields):len(fields)], f)
+
+		cn, err := i.repairBranch(c, cfields, stored)
+		n += cn
+		if err != nil {
+			return n, err
+		}
+
+		if c.Node != nil && c.Node.RecordID != Placeholder {
+			continue
+		}
+
+		if c.Node == nil && len(c.Children) != 0 && stored != nil && !stored(len(cfields)) {
+			continue
+		}
+
+		n++
+
+		if len(c.Children) == 0 {
+			delete(tn.Children, f)
+			continue
+		}
+
+		id, err := i.nextID()
+		if err != nil {
+			return n, err
+		}
+
+		c.Node = &Node{Fields: cfields, RecordID: id}
+		if err := i.logs.Store(c); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// readAt reads len(p) bytes from the log file starting from given offset.
+// The io.EOF error is ignored if all bytes were read before reaching it.
+func (l *Logs) readAt(p []byte, off int64) (err error) {
+	n, err := l.logFile.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,182 @@
+package index
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/kadirahq/go-tools/hybrid"
+)
+
+var (
+	tmpdirrepair = "/tmp/test-repair/"
+)
+
+func setuprp(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirrepair); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(tmpdirrepair, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirrepair); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	defer setuprp(t)()
+
+	l, err := NewLogs(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		istr := strconv.Itoa(i)
+		node := WrapNode(&Node{RecordID: int64(i), Fields: []string{"a" + istr}})
+		if err := l.Store(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a partially written entry at the end of the log
+	size := int64(100)
+	buff := make([]byte, hybrid.SzInt64+10)
+	hybrid.EncodeInt64(buff[:hybrid.SzInt64], &size)
+	for i := hybrid.SzInt64; i < len(buff); i++ {
+		buff[i] = 0xff
+	}
+
+	if _, err := l.logFile.WriteAt(buff, l.nextOff); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRW(tmpdirrepair, 0); err == nil {
+		t.Fatal("should fail to load damaged logs")
+	}
+
+	next, trimmed, err := Repair(tmpdirrepair, -1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if next != 3 || !trimmed {
+		t.Fatal("wrong result", next, trimmed)
+	}
+
+	next, trimmed, err = Repair(tmpdirrepair, -1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if next != 3 || trimmed {
+		t.Fatal("wrong result", next, trimmed)
+	}
+
+	snap, err := LoadSnap(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snap.RootNode.Children) != 3 {
+		t.Fatal("snapshot should be rebuilt")
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := i.Ensure([]string{"a3"}); err != nil {
+		t.Fatal(err)
+	} else if n.RecordID != 3 {
+		t.Fatal("wrong record id")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot does not have new nodes added in read-write mode
+	if exists(tmpdirrepair + prefixsnaproot + "0") {
+		t.Fatal("snapshot should be removed")
+	}
+}
+
+func TestRepairPlaceholders(t *testing.T) {
+	defer setuprp(t)()
+
+	l, err := NewLogs(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log entries for ["a"] (id 0) and ["a", "b"] (id 1) are lost
+	nodes := []*Node{
+		{RecordID: 2, Fields: []string{"a", "b", "c"}},
+		{RecordID: 3, Fields: []string{"x"}},
+	}
+
+	for _, node := range nodes {
+		if err := l.Store(WrapNode(node)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := i.Find([]string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ns) != 1 || ns[0].RecordID < 4 {
+		t.Fatal("parent node should get a new record id")
+	}
+
+	if n, err := i.Ensure([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if n.RecordID < 4 {
+		t.Fatal("parent node should get a new record id")
+	}
+
+	if n, err := i.Ensure([]string{"y"}); err != nil {
+		t.Fatal(err)
+	} else if n.RecordID != 6 {
+		t.Fatal("wrong record id")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err = NewRW(tmpdirrepair, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err = i.Find([]string{"*", "*"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ns) != 1 || ns[0].RecordID < 4 {
+		t.Fatal("repaired nodes should be stored")
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
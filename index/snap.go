@@ -4,7 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/kadirahq/go-tools/hybrid"
 	"github.com/kadirahq/go-tools/segments"
@@ -17,10 +22,19 @@ const (
 	prefixsnaproot = "snapr_"
 	prefixsnapdata = "snapd_"
 
-	// Size of the segment file
+	// Default size of the segment file
 	// !IMPORTANT if this value changes, the database will not be able to use
 	// older data. To avoid accidental changes, this value is hardcoded here.
+	// Snapshots must always be loaded with the segment size used to create them.
 	segszsnap = 1024 * 1024 * 20
+
+	// snapdepthfile has the number of index tree levels used to split the
+	// index snapshot into branches (see SetSnapDepth). Snapshots are split
+	// at the first level of the tree if the index does not have this file.
+	snapdepthfile = "snapdepth"
+
+	// branchsep separates fields in names of nested snapshot branches
+	branchsep = "\x00"
 )
 
 var (
@@ -30,20 +44,33 @@ var (
 
 // Snap helps create and load index pre-built index trees from snapshot files.
 // Index snapshots are read-only, any changes require a rebuild of the snapshot.
+//
+// Snapshots are split into branches which can be loaded separately. Branches
+// at the last level (snapshot depth) have all nodes under them. Branches at
+// other levels only have the tree node and their child branches are loaded
+// separately. Names of nested branches have all fields (see branchKey).
 type Snap struct {
 	RootNode *TNode
 	branches map[string]*Offset
+	children map[string][]string
+	depth    int
+	blooms   map[string]*bloom
 	dataFile segments.Store
 }
 
 // LoadSnap opens an index persister which stores pre-built index trees.
 // When loading a index snapshot, only the top level of the tree is loaded.
 // All other tree branches are loaded only when it's necessary (on request).
-func LoadSnap(dir string) (s *Snap, err error) {
+// The default segment size is used if given segment size is zero.
+func LoadSnap(dir string, ssz int64) (s *Snap, err error) {
+	if ssz <= 0 {
+		ssz = segszsnap
+	}
+
 	segpathr := path.Join(dir, prefixsnaproot)
 	segpathd := path.Join(dir, prefixsnapdata)
 
-	rf, err := segfile.New(segpathr, segszsnap)
+	rf, err := segfile.New(segpathr, ssz)
 	if err != nil {
 		return nil, err
 	}
@@ -57,23 +84,140 @@ func LoadSnap(dir string) (s *Snap, err error) {
 		return nil, err
 	}
 
-	df, err := segfile.New(segpathd, segszsnap)
+	df, err := segfile.New(segpathd, ssz)
 	if err != nil {
 		return nil, err
 	}
 
+	children, depth := branchChildren(branches)
+
+	// bloom filters are optional (older snapshots do not have them)
+	blooms, err := readBlooms(dir)
+	if err != nil {
+		blooms = nil
+	}
+
 	s = &Snap{
 		RootNode: root,
 		branches: branches,
+		children: children,
+		depth:    depth,
+		blooms:   blooms,
 		dataFile: df,
 	}
 
 	return s, nil
 }
 
-// LoadBranch function loads a branch from the data memory map
+// LoadBranch function loads a branch from the data memory map. Child branches
+// of nested branches are added as nil values (not loaded) to the tree node.
+// Equal field strings of nodes in the branch share memory after loading.
 func (s *Snap) LoadBranch(key string) (tree *TNode, err error) {
-	return readSnapData(s.dataFile, s.branches[key])
+	tree, err = readSnapData(s.dataFile, s.branches[key])
+	if err != nil {
+		return nil, err
+	}
+
+	interner{}.internTree(tree)
+
+	if names, ok := s.children[key]; ok {
+		if tree.Children == nil {
+			tree.Children = map[string]*TNode{}
+		}
+
+		for _, name := range names {
+			tree.Children[name] = nil
+		}
+	}
+
+	return tree, nil
+}
+
+// MayHave checks whether the snapshot may have an index node with given fields
+// using the bloom filter of its first level branch without loading the branch.
+// It returns true if fields are not exact values or if there's no filter.
+func (s *Snap) MayHave(fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+
+	// invalid fields are checked when finding nodes
+	values := make([]string, len(fields))
+	for k, f := range fields {
+		v, ok := exact(f)
+		if f == "" || !ok {
+			return true
+		}
+
+		values[k] = v
+	}
+
+	b, ok := s.blooms[values[0]]
+	if !ok {
+		return true
+	}
+
+	return b.has(branchKey(values))
+}
+
+// SetSnapDepth sets the number of index tree levels used to split snapshots
+// of the index in given directory into branches. With a higher depth, fewer
+// nodes are loaded when the index is queried with more fields but all nodes
+// have to be loaded in more steps. It's only used when creating snapshots.
+func SetSnapDepth(dir string, depth int) (err error) {
+	data := []byte(strconv.Itoa(depth) + "\n")
+	return ioutil.WriteFile(path.Join(dir, snapdepthfile), data, 0644)
+}
+
+// SnapDepth returns the snapshot depth of the index in given directory
+func SnapDepth(dir string) (depth int) {
+	data, err := ioutil.ReadFile(path.Join(dir, snapdepthfile))
+	if err != nil {
+		return 1
+	}
+
+	depth, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || depth < 1 {
+		return 1
+	}
+
+	return depth
+}
+
+// IsSnapshotFile tells whether the named file in an index directory is
+// a part of the snapshot. Snapshot files can be rebuilt from index logs.
+func IsSnapshotFile(name string) bool {
+	return name == bloomfile ||
+		strings.HasPrefix(name, prefixsnaproot) ||
+		strings.HasPrefix(name, prefixsnapdata)
+}
+
+// branchKey returns the name of the snapshot branch with given fields
+func branchKey(fields []string) string {
+	return strings.Join(fields, branchsep)
+}
+
+// branchChildren returns names of child branches of each nested branch and
+// the depth of snapshot branches. First level branches have no parents.
+func branchChildren(branches map[string]*Offset) (children map[string][]string, depth int) {
+	children = map[string][]string{}
+	depth = 1
+
+	for key := range branches {
+		fields := strings.Split(key, branchsep)
+		if len(fields) == 1 {
+			continue
+		}
+
+		if len(fields) > depth {
+			depth = len(fields)
+		}
+
+		parent := branchKey(fields[:len(fields)-1])
+		children[parent] = append(children[parent], fields[len(fields)-1])
+	}
+
+	return children, depth
 }
 
 // Close releases resources
@@ -87,11 +231,15 @@ func (s *Snap) Close() (err error) {
 
 // writeSnapshot creates a snapshot on given path and returns created snapshot.
 // This snapshot will have the complete index tree already loaded into ram.
-func writeSnapshot(dir string, tree *TNode) (s *Snap, err error) {
+func writeSnapshot(dir string, tree *TNode, ssz int64) (s *Snap, err error) {
+	if ssz <= 0 {
+		ssz = segszsnap
+	}
+
 	segpathr := path.Join(dir, prefixsnaproot)
 	segpathd := path.Join(dir, prefixsnapdata)
 
-	rf, err := segfile.New(segpathr, segszsnap)
+	rf, err := segfile.New(segpathr, ssz)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +247,7 @@ func writeSnapshot(dir string, tree *TNode) (s *Snap, err error) {
 	// can close this
 	defer rf.Close()
 
-	df, err := segfile.New(segpathd, segszsnap)
+	df, err := segfile.New(segpathd, ssz)
 	if err != nil {
 		return nil, err
 	}
@@ -107,11 +255,12 @@ func writeSnapshot(dir string, tree *TNode) (s *Snap, err error) {
 	brf := bufio.NewWriterSize(rf, 1e7)
 	bdf := bufio.NewWriterSize(df, 1e7)
 	branches := map[string]*Offset{}
+	depth := SnapDepth(dir)
 
 	var offset int64
 	var buffer []byte
 
-	for name, tn := range tree.Children {
+	err = walkBranches(tree, nil, depth, func(key string, tn *TNode) error {
 		size := tn.Size()
 		sz64 := int64(size)
 
@@ -124,20 +273,26 @@ func writeSnapshot(dir string, tree *TNode) (s *Snap, err error) {
 
 		_, err := tn.MarshalTo(towrite)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for len(towrite) > 0 {
 			n, err := bdf.Write(towrite)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			towrite = towrite[n:]
 		}
 
-		branches[name] = &Offset{offset, offset + sz64}
+		branches[key] = &Offset{offset, offset + sz64}
 		offset += sz64
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	info := &SnapInfo{
@@ -180,15 +335,76 @@ func writeSnapshot(dir string, tree *TNode) (s *Snap, err error) {
 		return nil, err
 	}
 
+	blooms := branchBlooms(tree)
+	if err := writeBlooms(dir, blooms); err != nil {
+		return nil, err
+	}
+
+	children, _ := branchChildren(branches)
+
 	s = &Snap{
 		RootNode: tree,
 		branches: branches,
+		children: children,
+		depth:    depth,
+		blooms:   blooms,
 		dataFile: df,
 	}
 
 	return s, nil
 }
 
+// walkBranches calls fn for each snapshot branch under the tree node which has
+// given fields. Tree nodes above given depth are written without children if
+// they have children as their child branches are written separately.
+func walkBranches(tn *TNode, fields []string, depth int, fn func(key string, tn *TNode) error) (err error) {
+	for name, c := range tn.Children {
+		cfields := append(fields[:len(fields):len(fields)], name)
+		key := branchKey(cfields)
+
+		if len(cfields) >= depth || len(c.Children) == 0 {
+			if err := fn(key, c); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		stub := &TNode{Node: c.Node, Children: map[string]*TNode{}}
+		if err := fn(key, stub); err != nil {
+			return err
+		}
+
+		if err := walkBranches(c, cfields, depth, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeSnapshot removes snapshot files in given index directory
+func removeSnapshot(dir string) (err error) {
+	if err := os.Remove(path.Join(dir, bloomfile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, prefix := range []string{prefixsnaproot, prefixsnapdata} {
+		files, err := filepath.Glob(filepath.Join(dir, prefix+"*"))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // readSnapRoot decodes an index tree branch from a byte slice
 // This can be used to read the index root level information.
 func readSnapRoot(r io.Reader) (tree *TNode, branches map[string]*Offset, err error) {
@@ -231,8 +447,11 @@ func readSnapRoot(r io.Reader) (tree *TNode, branches map[string]*Offset, err er
 	tree = WrapNode(nil)
 	branches = info.Branches
 
+	// nested branches are added when their parents are loaded
 	for name := range branches {
-		tree.Children[name] = nil
+		if !strings.Contains(name, branchsep) {
+			tree.Children[name] = nil
+		}
 	}
 
 	return tree, branches, nil
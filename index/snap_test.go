@@ -37,7 +37,7 @@ func TestSnapshot(t *testing.T) {
 		tree.Ensure(flds).Node.RecordID = int64(i)
 	}
 
-	s, err := writeSnapshot(tmpdirsnap, tree)
+	s, err := writeSnapshot(tmpdirsnap, tree, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +63,7 @@ func TestSnapshot(t *testing.T) {
 	}
 
 	for i := 0; i < 3; i++ {
-		if s, err = LoadSnap(tmpdirsnap); err != nil {
+		if s, err = LoadSnap(tmpdirsnap, 0); err != nil {
 			t.Fatal(err)
 		}
 
@@ -103,3 +103,87 @@ func TestSnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestSnapDepth(t *testing.T) {
+	defer setupsn(t)()
+
+	if SnapDepth(tmpdirsnap) != 1 {
+		t.Fatal("default depth should be 1")
+	}
+
+	if err := SetSnapDepth(tmpdirsnap, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if SnapDepth(tmpdirsnap) != 2 {
+		t.Fatal("wrong depth")
+	}
+
+	i, err := NewRW(tmpdirsnap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a"},
+		{"a", "b"},
+		{"a", "b", "c"},
+		{"a", "d"},
+		{"x"},
+		{"x", "y"},
+		{"x", "y", "z"},
+	}
+
+	for _, fields := range sets {
+		if _, err := i.Ensure(fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// creates the snapshot
+	if i, err = NewRO(tmpdirsnap, 0); err != nil {
+		t.Fatal(err)
+	} else if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := Count(tmpdirsnap, 0); err != nil || n != int64(len(sets)) {
+		t.Fatal("wrong count", n, err)
+	}
+
+	i, err = NewRO(tmpdirsnap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.snap.depth != 2 {
+		t.Fatal("wrong snapshot depth", i.snap.depth)
+	}
+
+	if n, err := i.FindOne([]string{"a", "b", "c"}); err != nil || n == nil {
+		t.Fatal("missing node", err)
+	}
+
+	// only branches used by the query should be loaded
+	if i.root.Children["x"] != nil {
+		t.Fatal("unused first level branch should not be loaded")
+	} else if a := i.root.Children["a"]; a == nil || a.Children["d"] != nil {
+		t.Fatal("only the queried nested branch should be loaded")
+	}
+
+	if ns, err := i.Find([]string{"*", "*"}); err != nil || len(ns) != 3 {
+		t.Fatal("wrong nodes", len(ns), err)
+	}
+
+	if ns, err := i.All(); err != nil || len(ns) != len(sets) {
+		t.Fatal("wrong nodes", len(ns), err)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
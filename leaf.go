@@ -0,0 +1,126 @@
+package kadiyadb
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/epoch"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+// fetchQuery returns the query used to fetch series matching given fields.
+// Parent series which are not stored (see Params.LeafOnly and AggregateLevels)
+// are calculated by merging stored series under matching series.
+func (d *DB) fetchQuery(fields []string) query {
+	depth, ok := d.treeDepth(len(fields))
+	if !ok {
+		return func(ctx context.Context, e *epoch.Epoch, start, end int64) ([][]protocol.Point, []*index.Node, error) {
+			return e.FetchContext(ctx, start, end, fields)
+		}
+	}
+
+	return func(ctx context.Context, e *epoch.Epoch, start, end int64) ([][]protocol.Point, []*index.Node, error) {
+		points, nodes, err := e.FetchTree(ctx, start, end, fields)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if depth > 0 {
+			points, nodes = truncate(points, nodes, depth)
+		}
+
+		points, nodes = d.aggregate(points, nodes, len(fields))
+		return points, nodes, nil
+	}
+}
+
+// treeDepth checks whether series with n fields are calculated by merging
+// stored series and returns the largest number of fields of stored series
+// which should be merged (0 if all). Series of the next aggregate level
+// already include all series with more fields therefore those are skipped.
+func (d *DB) treeDepth(n int) (depth int, ok bool) {
+	if d.params.LeafOnly {
+		return 0, true
+	}
+
+	levels := d.params.AggregateLevels
+	if levels == nil {
+		return 0, false
+	}
+
+	for _, l := range levels {
+		if l == n {
+			return 0, false
+		} else if l > n {
+			return l, true
+		}
+	}
+
+	return 0, true
+}
+
+// storedLevels returns a function which tells whether parent series with
+// given number of fields are written by Track (nil if all are written).
+func storedLevels(p *Params) func(depth int) bool {
+	if p.LeafOnly {
+		return func(depth int) bool { return false }
+	}
+
+	levels := p.AggregateLevels
+	if levels == nil {
+		return nil
+	}
+
+	return func(depth int) bool {
+		for _, l := range levels {
+			if l == depth {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// truncate removes series which have more than given number of fields
+func truncate(points [][]protocol.Point, nodes []*index.Node, depth int) ([][]protocol.Point, []*index.Node) {
+	var res [][]protocol.Point
+	var kept []*index.Node
+
+	for i, node := range nodes {
+		if len(node.Fields) <= depth {
+			res = append(res, points[i])
+			kept = append(kept, node)
+		}
+	}
+
+	return res, kept
+}
+
+// aggregate merges points of series which have the same first n fields.
+// Results have new index nodes with those fields and new point slices.
+// Series are ordered by the position of their first series in nodes.
+func (d *DB) aggregate(points [][]protocol.Point, nodes []*index.Node, n int) (res [][]protocol.Point, groups []*index.Node) {
+	seen := map[string]int{}
+
+	for i, node := range nodes {
+		key := strings.Join(node.Fields[:n], "\x00")
+
+		j, ok := seen[key]
+		if !ok {
+			j = len(groups)
+			seen[key] = j
+
+			fields := append([]string(nil), node.Fields[:n]...)
+			groups = append(groups, &index.Node{Fields: fields})
+			res = append(res, make([]protocol.Point, len(points[i])))
+		}
+
+		for k, p := range points[i] {
+			res[j][k] = d.params.PointType.Merge(res[j][k], p)
+		}
+	}
+
+	return res, groups
+}
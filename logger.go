@@ -0,0 +1,144 @@
+package kadiyadb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log messages with a level lower than the logger level are discarded.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+var (
+	// ErrLevel is returned when the log level name is not valid
+	ErrLevel = errors.New("invalid log level")
+
+	// levelNames has names of log levels used in log messages
+	levelNames = map[Level]string{
+		LevelDebug: "debug",
+		LevelInfo:  "info",
+		LevelError: "error",
+	}
+)
+
+// logger is used by all databases (see SetLogger)
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+// Fields are key value pairs added to a log message. Databases use "db" for
+// the database directory, "epoch" for the epoch start time, "error" for error
+// messages and "latency" for time taken by the operation.
+type Fields map[string]interface{}
+
+// Logger writes log messages with fields
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// SetLogger sets the logger used by all databases.
+// It must be called before opening databases.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// ParseLevel returns the log level with given name ("debug", "info", "error")
+func ParseLevel(name string) (l Level, err error) {
+	for l, n := range levelNames {
+		if n == name {
+			return l, nil
+		}
+	}
+
+	return 0, ErrLevel
+}
+
+// String returns the name of the log level
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// stdLogger writes log messages with given level or higher to a writer
+type stdLogger struct {
+	w     io.Writer
+	level Level
+	json  bool
+	mutex *sync.Mutex
+}
+
+// NewLogger creates a logger which writes messages with given level or higher
+// to w. Each message is written on a new line as a JSON object if json is set.
+// Otherwise the message is written as text followed by fields (key=value).
+//
+//	{"db":"/data/db","error":"...","level":"error","msg":"offload","time":"2016-01-01T00:00:00Z"}
+//	2016-01-01T00:00:00Z error offload db=/data/db error=...
+func NewLogger(w io.Writer, level Level, json bool) Logger {
+	return &stdLogger{
+		w:     w,
+		level: level,
+		json:  json,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Log writes the message if its level is not lower than the logger level
+func (l *stdLogger) Log(level Level, msg string, fields Fields) {
+	if level < l.level {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var line string
+	if l.json {
+		data := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			data[k] = v
+		}
+
+		data["time"] = now
+		data["level"] = level.String()
+		data["msg"] = msg
+
+		out, err := json.Marshal(data)
+		if err != nil {
+			out, _ = json.Marshal(map[string]string{"time": now, "level": level.String(), "msg": msg})
+		}
+
+		line = string(out) + "\n"
+	} else {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		parts := []string{now, level.String(), msg}
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+		}
+
+		line = strings.Join(parts, " ") + "\n"
+	}
+
+	l.mutex.Lock()
+	io.WriteString(l.w, line)
+	l.mutex.Unlock()
+}
+
+// logError logs an error of a database operation
+func logError(msg, dir string, err error) {
+	logger.Log(LevelError, msg, Fields{"db": dir, "error": err.Error()})
+}
@@ -0,0 +1,50 @@
+package kadiyadb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buff := &bytes.Buffer{}
+	l := NewLogger(buff, LevelInfo, true)
+
+	l.Log(LevelDebug, "ignored", nil)
+	if buff.Len() != 0 {
+		t.Fatal("debug messages should be discarded")
+	}
+
+	l.Log(LevelError, "offload", Fields{"db": "/data/db", "epoch": 3600})
+
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(buff.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res["level"] != "error" || res["msg"] != "offload" ||
+		res["db"] != "/data/db" || res["epoch"] != float64(3600) || res["time"] == nil {
+		t.Fatal("wrong message", res)
+	}
+
+	buff.Reset()
+	l = NewLogger(buff, LevelDebug, false)
+	l.Log(LevelDebug, "epoch closed", Fields{"epoch": 3600, "db": "/data/db"})
+
+	if !strings.HasSuffix(buff.String(), " debug epoch closed db=/data/db epoch=3600\n") {
+		t.Fatal("wrong message", buff.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelError} {
+		if res, err := ParseLevel(l.String()); err != nil || res != l {
+			t.Fatal("wrong level", l, res, err)
+		}
+	}
+
+	if _, err := ParseLevel("warn"); err != ErrLevel {
+		t.Fatal("expected ErrLevel")
+	}
+}
@@ -0,0 +1,247 @@
+package kadiyadb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// closedfile stores the start time of the last closed epoch processed by
+	// background jobs. Epochs are processed only once as rollups add points.
+	closedfile = "closed"
+)
+
+var (
+	// maintainInterval is the time between background maintenance runs
+	// unless the MaintainInterval param is set.
+	maintainInterval = time.Minute
+)
+
+// maintainLoop periodically runs background maintenance jobs until the
+// database is closed. Errors are logged and retried on the next run.
+func (d *DB) maintainLoop() {
+	defer d.jobs.Done()
+
+	interval := maintainInterval
+	if d.params.MaintainInterval > 0 {
+		interval = time.Duration(d.params.MaintainInterval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+			d.maintain(time.Now().UnixNano())
+		}
+	}
+}
+
+// maintain processes closed epochs, moves them to the slowest storage tier
+// (if any), offloads old epochs to the object store (if configured), removes
+// epochs older than the retention period, writes index checkpoints and
+// updates disk usage. Oldest epochs are also removed if files are over
+// RetentionBytes and free disk space is checked if there's a low disk
+// watermark. TrackSeq sources which stopped writing are forgotten.
+func (d *DB) maintain(now int64) {
+	if err := d.processClosed(now); err != nil {
+		logError("closed epochs", d.dir, err)
+	}
+
+	if last := atomic.LoadInt64(&d.lastClosed); last >= 0 && len(d.params.Tiers) > 0 {
+		if err := d.Migrate(uint64(last + d.params.Duration)); err != nil {
+			logError("migrate", d.dir, err)
+		}
+	}
+
+	if d.offloads() {
+		if err := d.Offload(uint64(now - d.params.ColdAfter)); err != nil {
+			logError("offload", d.dir, err)
+		}
+	}
+
+	if err := d.expire(now); err != nil {
+		logError("expire", d.dir, err)
+	}
+
+	d.dedup.expire(now - int64(dedupSourceTTL))
+
+	if iv := d.params.CheckpointInterval; iv > 0 && now-d.lastCheckpoint >= iv {
+		d.lastCheckpoint = now
+		if err := d.cache.Checkpoint(); err != nil {
+			logError("checkpoint", d.dir, err)
+		}
+	}
+
+	if _, err := d.updateDiskUsage(); err != nil {
+		logError("disk usage", d.dir, err)
+	}
+
+	if max := d.params.RetentionBytes; max > 0 {
+		if size, err := d.retainedSize(); err != nil {
+			logError("disk retention", d.dir, err)
+		} else if size > max {
+			if err := d.expireSize(now); err != nil {
+				logError("disk retention", d.dir, err)
+			}
+		}
+	}
+
+	if d.params.MinFreeDiskBytes > 0 {
+		if _, err := d.updateFreeDisk(); err != nil {
+			logError("free disk", d.dir, err)
+		}
+	}
+}
+
+// expire removes epochs which end before the retention period starts.
+// Epochs are closed and evicted from the cache before they are removed.
+func (d *DB) expire(now int64) (err error) {
+	// the epoch which has the retention start time is not removed
+	ets := now - d.params.Retention - d.params.Duration + 1
+	if ets <= 0 {
+		return nil
+	}
+
+	return d.cache.Expire(ets)
+}
+
+// expireSize removes the oldest epochs one at a time until database files
+// are within RetentionBytes. Epochs which can be written (at least the
+// current epoch) and epochs which are not processed as closed epochs yet
+// (see processClosed) are not removed. Epochs of min/max databases are
+// removed with epochs of this database.
+func (d *DB) expireSize(now int64) (err error) {
+	rw := d.params.MaxRWEpochs
+	if rw < 1 {
+		rw = 1
+	}
+
+	dur := d.params.Duration
+	end := dur*(now/dur) - (rw-1)*dur
+
+	// rollups are created when processing closed epochs
+	if last := atomic.LoadInt64(&d.lastClosed); last < 0 {
+		return nil
+	} else if last+dur < end {
+		end = last + dur
+	}
+
+	epochs, err := d.epochs()
+	if err != nil {
+		return err
+	}
+
+	for _, ets := range epochs {
+		if ets >= end {
+			return nil
+		}
+
+		if err := d.cache.Expire(ets + 1); err != nil {
+			return err
+		}
+
+		// min/max databases have the same epochs and their files
+		// are included in the size of this database
+		if d.minDB != nil {
+			if err := d.minDB.cache.Expire(ets + 1); err != nil {
+				return err
+			}
+
+			if err := d.maxDB.cache.Expire(ets + 1); err != nil {
+				return err
+			}
+		}
+
+		if _, err := d.updateDiskUsage(); err != nil {
+			return err
+		}
+
+		size, err := d.retainedSize()
+		if err != nil {
+			return err
+		} else if size <= d.params.RetentionBytes {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// processClosed rolls up and compacts (if enabled) all epochs which are older
+// than the read-write window and the late window and not processed yet.
+// Index snapshots of these epochs are created if they are not compacted.
+// Epochs are considered closed at this point as they are no longer expected
+// to get new points. Epochs older than the retention period are ignored.
+func (d *DB) processClosed(now int64) (err error) {
+	file := path.Join(d.dir, closedfile)
+
+	dur := d.params.Duration
+	end := dur*((now-d.params.LateWindow)/dur) - d.params.MaxRWEpochs*dur
+	ets := dur * ((now - d.params.Retention) / dur)
+	if ets < 0 {
+		ets = 0
+	}
+
+	if last := atomic.LoadInt64(&d.lastClosed); last >= 0 && last+dur > ets {
+		ets = last + dur
+	}
+
+	for ; ets < end; ets += dur {
+		start := time.Now()
+
+		if err := d.Rollup(uint64(ets)); err != nil {
+			return err
+		}
+
+		if d.params.Compact {
+			if err := d.Compact(uint64(ets)); err != nil {
+				return err
+			}
+		} else if err := d.cache.Snapshot(ets); err != nil {
+			return err
+		}
+
+		data := []byte(strconv.FormatInt(ets, 10))
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+
+		atomic.StoreInt64(&d.lastClosed, ets)
+
+		logger.Log(LevelInfo, "epoch closed", Fields{
+			"db":      d.dir,
+			"epoch":   ets,
+			"latency": time.Since(start).String(),
+		})
+	}
+
+	return nil
+}
+
+// readClosed reads the start time of the last closed epoch processed by
+// background jobs from the database directory. It returns -1 if none.
+func readClosed(dir string) (last int64, err error) {
+	return readEpochFile(path.Join(dir, closedfile))
+}
+
+// readEpochFile reads an epoch start time written to given file.
+// It returns -1 if the file does not exist.
+func readEpochFile(file string) (ets int64, err error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
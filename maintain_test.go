@@ -0,0 +1,742 @@
+package kadiyadb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestProcessClosed(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Compact:     true,
+		Rollups: []*Params{
+			{
+				Duration:   3600000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// make the first epoch closed by writing to the next epoch
+	if err := db.Track(uint64(p.Duration), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.processClosed(2 * p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, closedfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "0" {
+		t.Fatal("wrong last closed epoch", string(data))
+	}
+
+	if n, err := db.rollups[0].Count(0, uint64(p.Duration), []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal("epoch should be rolled up")
+	}
+
+	// already processed epochs should not be processed again
+	if err := db.processClosed(2 * p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(0, uint64(p.Duration), []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal("compacted epoch should have data")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessClosedRetry(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Compact:     true,
+		Rollups: []*Params{
+			{
+				Duration:   3600000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// make the first epoch closed by writing to the next epoch
+	if err := db.Track(uint64(p.Duration), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the epoch and make compaction fail when reading segment sizes
+	if _, err := db.Count(0, uint64(p.Duration), []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	segs := path.Join(dir, "0", "segments")
+	if err := os.Mkdir(segs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.processClosed(2 * p.Duration); err == nil {
+		t.Fatal("compaction should fail")
+	}
+
+	if err := os.Remove(segs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.processClosed(2 * p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	// the epoch should be rolled up only once
+	db.rollups[0].Fetch(0, uint64(p.Duration), []string{"a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 1 || p.Count != 1 {
+			t.Fatal("wrong rollup point", p)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLateWindow(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		LateWindow:  3600000000000,
+		Rollups: []*Params{
+			{
+				Duration:   3600000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first epoch is still in the late window
+	if err := db.processClosed(2 * p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, closedfile)); !os.IsNotExist(err) {
+		t.Fatal("epoch should not be closed")
+	}
+
+	if err := db.processClosed(3 * p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	// late points should be added to rollups
+	if err := db.Track(0, []string{"a"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last closed epoch should be loaded when opening the database
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 4, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.rollups[0]
+	r.Fetch(0, uint64(r.params.Resolution), []string{"a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []protocol.Point{{7, 3}}
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			!reflect.DeepEqual(res[0].Series[0].Points, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   7200000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs loaded in read-write mode should also be removed
+	for i := int64(0); i < 4; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// retention starts in the middle of the second epoch
+	db.expire(3*p.Duration + p.Duration/2)
+
+	for i := int64(0); i < 4; i++ {
+		name := strconv.FormatInt(i*p.Duration, 10)
+		_, err := os.Stat(path.Join(dir, name))
+		if i == 0 && !os.IsNotExist(err) {
+			t.Fatal("epoch should be removed", name)
+		} else if i > 0 && err != nil {
+			t.Fatal("epoch should not be removed", name)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireNow(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   7200000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		MinMax:      true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 4; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Expire(uint64(3*p.Duration + p.Duration/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{dir, path.Join(dir, extremadir, "min")} {
+		if _, err := os.Stat(path.Join(d, "0")); !os.IsNotExist(err) {
+			t.Fatal("epoch should be removed", d)
+		}
+
+		name := strconv.FormatInt(p.Duration, 10)
+		if _, err := os.Stat(path.Join(d, name)); err != nil {
+			t.Fatal("epoch should not be removed", d)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireUnarchived(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := path.Join(dir, "archive")
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   7200000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		ArchivePath: archive,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 4; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := uint64(3*p.Duration + p.Duration/2)
+	if err := db.Expire(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Unarchive(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// unarchived epochs should survive maintenance
+	db.maintain(int64(now))
+	if err := db.Expire(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "0")); err != nil {
+		t.Fatal("unarchived epoch should not be removed")
+	}
+
+	if err := db.Archive(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "0")); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if _, err := os.Stat(path.Join(archive, "0")); err != nil {
+		t.Fatal("epoch should be archived")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaintainMigrate(t *testing.T) {
+	tier := "/tmp/test-database-tier"
+	for _, d := range []string{dir, tier} {
+		if err := os.RemoveAll(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Tiers:       []string{tier},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// make the first epoch closed by writing to the next epoch
+	if err := db.Track(uint64(p.Duration), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.maintain(2 * p.Duration)
+
+	if _, err := os.Stat(path.Join(dir, "0")); !os.IsNotExist(err) {
+		t.Fatal("closed epoch should be moved")
+	}
+
+	if _, err := os.Stat(path.Join(tier, "0")); err != nil {
+		t.Fatal("closed epoch should be in the tier")
+	}
+
+	name := strconv.FormatInt(p.Duration, 10)
+	if _, err := os.Stat(path.Join(dir, name)); err != nil {
+		t.Fatal("open epoch should not be moved")
+	}
+
+	if n, err := db.Count(0, uint64(p.Duration), []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal("moved epoch should have data")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{dir, tier} {
+		if err := os.RemoveAll(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMaintainCheckpoint(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:           3600000000000,
+		Retention:          36000000000000,
+		Resolution:         60000000000,
+		MaxROEpochs:        2,
+		MaxRWEpochs:        1,
+		CheckpointInterval: 600000000000,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a", "b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.maintain(p.Duration)
+
+	ckpt := path.Join(dir, "0", "checkpoint")
+	if _, err := os.Stat(ckpt); err != nil {
+		t.Fatal("index checkpoint should be written", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetentionBytes(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:       3600000000000,
+		Retention:      36000000000000,
+		Resolution:     60000000000,
+		MaxROEpochs:    2,
+		MaxRWEpochs:    2,
+		RetentionBytes: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 4; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := 3*p.Duration + p.Duration/2
+	tests := []struct {
+		last    int64
+		maxRW   int64
+		removed int64
+	}{
+		// epochs which are not closed yet are not removed
+		{-1, 2, 0},
+		{0, 2, 1},
+		// epochs which can be written are not removed
+		{2 * p.Duration, 2, 2},
+		// the current epoch can be written without a read-write limit
+		{3 * p.Duration, 0, 3},
+	}
+
+	for _, tst := range tests {
+		atomic.StoreInt64(&db.lastClosed, tst.last)
+		db.params.MaxRWEpochs = tst.maxRW
+
+		if err := db.expireSize(now); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := int64(0); i < 4; i++ {
+			name := strconv.FormatInt(i*p.Duration, 10)
+			_, err := os.Stat(path.Join(dir, name))
+			if i < tst.removed && !os.IsNotExist(err) {
+				t.Fatal("epoch should be removed", tst.last, name)
+			} else if i >= tst.removed && err != nil {
+				t.Fatal("epoch should not be removed", tst.last, name)
+			}
+		}
+	}
+
+	u, err := db.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total := DiskUsage(); total < u.DiskBytes {
+		t.Fatal("total disk usage should include the database", total, u.DiskBytes)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetentionBytesRollups(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 2; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := db.retainedSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files of rollup levels are not counted
+	db.params.RetentionBytes = size
+	if total, err := db.updateDiskUsage(); err != nil {
+		t.Fatal(err)
+	} else if total <= size {
+		t.Fatal("disk usage should include rollup levels", total, size)
+	}
+
+	if err := db.Expire(uint64(p.Duration)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "0")); err != nil {
+		t.Fatal("epoch should not be removed")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetentionBytesMinMax(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:       3600000000000,
+		Retention:      36000000000000,
+		Resolution:     60000000000,
+		MaxROEpochs:    2,
+		MaxRWEpochs:    1,
+		MinMax:         true,
+		RetentionBytes: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 2; i++ {
+		if err := db.Track(uint64(i*p.Duration), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt64(&db.lastClosed, 0)
+	if err := db.expireSize(p.Duration); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{dir, path.Join(dir, extremadir, "min"), path.Join(dir, extremadir, "max")} {
+		if _, err := os.Stat(path.Join(d, "0")); !os.IsNotExist(err) {
+			t.Fatal("epoch should be removed", d)
+		}
+
+		name := strconv.FormatInt(p.Duration, 10)
+		if _, err := os.Stat(path.Join(d, name)); err != nil {
+			t.Fatal("epoch should not be removed", d)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/block"
+)
+
+const (
+	// extremadir is the directory inside the database directory which has
+	// databases used to store minimum and maximum values of points.
+	extremadir = "extrema"
+)
+
+var (
+	// ErrNoMinMax is returned when min/max values are not tracked
+	ErrNoMinMax = errors.New("database does not track min/max values")
+)
+
+// MinMaxPoint has the smallest and largest value tracked to a point. Values
+// are averages (total / count) of each Track call. Both are zero if the
+// point has no measurements.
+type MinMaxPoint struct {
+	Min float64
+	Max float64
+}
+
+// MinMaxSeries has min/max values of a series for each point of the chunk
+type MinMaxSeries struct {
+	Fields []string
+	Points []MinMaxPoint
+}
+
+// MinMaxChunk has min/max values of series for the time range of a chunk
+type MinMaxChunk struct {
+	From   uint64
+	To     uint64
+	Series []*MinMaxSeries
+}
+
+// MinMaxHandler is a function which is called with FetchMinMax result
+type MinMaxHandler func(result []*MinMaxChunk, err error)
+
+// openExtrema opens databases used to store min and max values of points.
+// These databases use the same time, storage and aggregation params as the
+// database with Min and Max point types. They do not have rollups or queries.
+// Tiers and the archive path are shared using sub directories of them.
+func openExtrema(dir string, p *Params) (min, max *DB, err error) {
+	types := map[string]block.PointType{"min": block.Min, "max": block.Max}
+
+	for name, pt := range types {
+		ep := &Params{
+			Duration:         p.Duration,
+			Resolution:       p.Resolution,
+			Retention:        p.Retention,
+			MaxROEpochs:      p.MaxROEpochs,
+			MaxRWEpochs:      p.MaxRWEpochs,
+			MaxMemory:        p.MaxMemory,
+			MaxSeries:        p.MaxSeries,
+			Durable:          p.Durable,
+			Storage:          p.Storage,
+			PointType:        pt,
+			LeafOnly:         p.LeafOnly,
+			AggregateLevels:  p.AggregateLevels,
+			BlockSegmentSize: p.BlockSegmentSize,
+			IndexSegmentSize: p.IndexSegmentSize,
+			SnapshotDepth:    p.SnapshotDepth,
+			MaintainInterval: p.MaintainInterval,
+		}
+
+		for _, tier := range p.Tiers {
+			ep.Tiers = append(ep.Tiers, path.Join(tier, extremadir, name))
+		}
+
+		if p.ArchivePath != "" {
+			ep.ArchivePath = path.Join(p.ArchivePath, extremadir, name)
+		}
+
+		edir := path.Join(dir, extremadir, name)
+		if err := os.MkdirAll(edir, 0755); err != nil {
+			closeDBs(nil, min, max)
+			return nil, nil, err
+		}
+
+		db, err := Open(edir, ep)
+		if err != nil {
+			closeDBs(nil, min, max)
+			return nil, nil, err
+		}
+
+		// files are counted in the parent database
+		setOpened(db, false)
+
+		if pt == block.Min {
+			min = db
+		} else {
+			max = db
+		}
+	}
+
+	return min, max, nil
+}
+
+// trackMinMax tracks the average value of the measurement to min and max
+// databases if the database tracks min/max values.
+func (d *DB) trackMinMax(ctx context.Context, ts uint64, fields []string, total, count float64) (err error) {
+	if d.minDB == nil || count == 0 {
+		return nil
+	}
+
+	value := total / count
+
+	if err := d.minDB.TrackContext(ctx, ts, fields, value, 1); err != nil {
+		return err
+	}
+
+	return d.maxDB.TrackContext(ctx, ts, fields, value, 1)
+}
+
+// FetchMinMax fetches min and max values of points of series matching
+// given fields (see Params.MinMax). Series are in the same order as the
+// series in the same chunk of the database which has max values.
+func (d *DB) FetchMinMax(ctx context.Context, from, to uint64, fields []string, fn MinMaxHandler) {
+	if d.minDB == nil {
+		fn(nil, ErrNoMinMax)
+		return
+	}
+
+	d.minDB.FetchContext(ctx, from, to, fields, func(mins []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		d.maxDB.FetchContext(ctx, from, to, fields, func(maxs []*protocol.Chunk, err error) {
+			if err != nil {
+				fn(nil, err)
+				return
+			}
+
+			fn(mergeMinMax(mins, maxs), nil)
+		})
+	})
+}
+
+// mergeMinMax combines chunks of min and max databases. Both databases have
+// the same time params therefore chunks have the same time ranges. Series are
+// matched using their fields as series can have different record IDs.
+func mergeMinMax(mins, maxs []*protocol.Chunk) (res []*MinMaxChunk) {
+	res = make([]*MinMaxChunk, len(maxs))
+
+	for i, c := range maxs {
+		minSeries := map[string][]protocol.Point{}
+		if i < len(mins) {
+			for _, s := range mins[i].Series {
+				minSeries[strings.Join(s.Fields, "\x00")] = s.Points
+			}
+		}
+
+		mc := &MinMaxChunk{
+			From:   c.From,
+			To:     c.To,
+			Series: make([]*MinMaxSeries, len(c.Series)),
+		}
+
+		for j, s := range c.Series {
+			minPoints := minSeries[strings.Join(s.Fields, "\x00")]
+			ms := &MinMaxSeries{
+				Fields: append([]string(nil), s.Fields...),
+				Points: make([]MinMaxPoint, len(s.Points)),
+			}
+
+			for k, p := range s.Points {
+				ms.Points[k].Max = p.Total
+				if k < len(minPoints) {
+					ms.Points[k].Min = minPoints[k].Total
+				}
+			}
+
+			mc.Series[j] = ms
+		}
+
+		res[i] = mc
+	}
+
+	return res
+}
@@ -0,0 +1,171 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestFetchMinMax(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		MinMax:      true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// average values: 5, 1, 9 (a, b) and 4 (a, c)
+	tracks := []struct {
+		fields       []string
+		total, count float64
+	}{
+		{[]string{"a", "b"}, 10, 2},
+		{[]string{"a", "b"}, 1, 1},
+		{[]string{"a", "b"}, 9, 1},
+		{[]string{"a", "c"}, 4, 1},
+	}
+
+	for _, tr := range tracks {
+		if err := db.Track(0, tr.fields, tr.total, tr.count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	expected := map[string]MinMaxPoint{
+		"b": {Min: 1, Max: 9},
+		"c": {Min: 4, Max: 4},
+	}
+
+	db.FetchMinMax(ctx, 0, 120000000000, []string{"a", "*"}, func(res []*MinMaxChunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 2 {
+			t.Fatal("wrong result")
+		}
+
+		for _, s := range res[0].Series {
+			if len(s.Points) != 2 || s.Points[0] != expected[s.Fields[1]] ||
+				s.Points[1] != (MinMaxPoint{}) {
+				t.Fatal("wrong points", s.Fields, s.Points)
+			}
+		}
+	})
+
+	// parent series have min/max values of all child series
+	db.FetchMinMax(ctx, 0, 60000000000, []string{"a"}, func(res []*MinMaxChunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			res[0].Series[0].Points[0] != (MinMaxPoint{Min: 1, Max: 9}) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.MinMax = false
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.FetchMinMax(ctx, 0, 60000000000, []string{"a"}, func(res []*MinMaxChunk, err error) {
+		if err != ErrNoMinMax {
+			t.Fatal("expected ErrNoMinMax")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchMinMaxLeafOnly(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// min/max databases store only leaf series as well
+	// therefore they do not exceed the series limit
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+		MaxSeries:   4,
+		LeafOnly:    true,
+		MinMax:      true,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := []struct {
+		fields       []string
+		total, count float64
+	}{
+		{[]string{"a", "b"}, 10, 2},
+		{[]string{"a", "c", "d"}, 1, 1},
+		{[]string{"a", "c", "e"}, 9, 1},
+	}
+
+	for _, tr := range tracks {
+		if err := db.Track(0, tr.fields, tr.total, tr.count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := db.minDB.Count(0, 60000000000, []string{"a"}); err != nil || n != 0 {
+		t.Fatal("parent series should not be stored", n, err)
+	}
+
+	db.FetchMinMax(context.Background(), 0, 60000000000, []string{"a", "c"}, func(res []*MinMaxChunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 ||
+			res[0].Series[0].Points[0] != (MinMaxPoint{Min: 1, Max: 9}) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
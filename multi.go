@@ -0,0 +1,64 @@
+package kadiyadb
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// MultiHandler is a function which is called with results of FetchMulti.
+// Results are keyed by database name and, like Handler results, they are
+// only valid inside this function unless the CopyResults param is set.
+type MultiHandler func(result map[string][]*protocol.Chunk, err error)
+
+// FetchMulti fetches data from all databases with names matching any of the
+// given names or glob patterns (see path.Match) with the same fields and time
+// range. Databases are usually loaded with LoadAll. Databases are queried one
+// after another and all their epochs stay loaded until the handler returns.
+// The handler is called once with all results or the first error.
+func FetchMulti(ctx context.Context, dbs map[string]*DB, patterns []string, from, to uint64, fields []string, fn MultiHandler) {
+	names := []string{}
+
+	for name := range dbs {
+		for _, p := range patterns {
+			ok, err := path.Match(p, name)
+			if err != nil {
+				fn(nil, err)
+				return
+			}
+
+			if ok {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	res := make(map[string][]*protocol.Chunk, len(names))
+	fetchMulti(ctx, dbs, names, res, from, to, fields, fn)
+}
+
+// fetchMulti fetches data from the first database and continues with other
+// databases inside its handler so results of all databases stay valid when
+// the handler is called with all results.
+func fetchMulti(ctx context.Context, dbs map[string]*DB, names []string, res map[string][]*protocol.Chunk, from, to uint64, fields []string, fn MultiHandler) {
+	if len(names) == 0 {
+		fn(res, nil)
+		return
+	}
+
+	name := names[0]
+	dbs[name].FetchContext(ctx, from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		res[name] = chunks
+		fetchMulti(ctx, dbs, names[1:], res, from, to, fields, fn)
+	})
+}
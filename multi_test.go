@@ -0,0 +1,77 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFetchMulti(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := map[string]*DB{}
+	for i, name := range []string{"tenant-a", "tenant-b", "other"} {
+		if err := os.MkdirAll(path.Join(dir, name), 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Params{
+			Duration:    3600000000000,
+			Retention:   36000000000000,
+			Resolution:  60000000000,
+			MaxROEpochs: 2,
+			MaxRWEpochs: 1,
+		}
+
+		db, err := Open(path.Join(dir, name), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Track(0, []string{"a"}, float64(i+1), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		dbs[name] = db
+	}
+
+	ctx := context.Background()
+	FetchMulti(ctx, dbs, []string{"tenant-*"}, 0, 60000000000, []string{"a"}, func(res map[string][]*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 2 {
+			t.Fatal("wrong number of databases", len(res))
+		}
+
+		for name, total := range map[string]float64{"tenant-a": 1, "tenant-b": 2} {
+			chunks := res[name]
+			if len(chunks) != 1 || len(chunks[0].Series) != 1 ||
+				chunks[0].Series[0].Points[0].Total != total {
+				t.Fatal("wrong result", name)
+			}
+		}
+	})
+
+	FetchMulti(ctx, dbs, []string{"["}, 0, 60000000000, []string{"a"}, func(res map[string][]*protocol.Chunk, err error) {
+		if err != path.ErrBadPattern {
+			t.Fatal("expected ErrBadPattern")
+		}
+	})
+
+	for _, db := range dbs {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
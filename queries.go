@@ -0,0 +1,217 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	// FuncSum adds totals and counts of all matching series for each point.
+	// Average values of the derived series are the averages of all series.
+	FuncSum = "sum"
+
+	// FuncMin uses the minimum average value of matching series for each point.
+	FuncMin = "min"
+
+	// FuncMax uses the maximum average value of matching series for each point.
+	FuncMax = "max"
+)
+
+const (
+	// queriedfile stores the end of points evaluated by continuous queries
+	queriedfile = "queried"
+)
+
+var (
+	// ErrInvQuery is returned when continuous query params are invalid
+	ErrInvQuery = errors.New("invalid continuous query")
+)
+
+// Query is a continuous query which aggregates all series matching the field
+// pattern and writes the result to a derived series with target fields.
+// Queries are evaluated for each point once the point is complete therefore
+// reading the derived series is much cheaper than a wildcard fetch.
+// The target fields must not match the query fields pattern. Results are only
+// written to the target series and not to series with its parent fields.
+type Query struct {
+	Fields []string `json:"fields"`
+	Target []string `json:"target"`
+	Func   string   `json:"func"`
+}
+
+// validate checks whether the query can be evaluated
+func (q *Query) validate() (err error) {
+	if q == nil || len(q.Fields) == 0 || len(q.Target) == 0 {
+		return ErrInvQuery
+	}
+
+	// results would be included when evaluating the query again
+	if ok, err := index.Match(q.Fields, q.Target); err != nil || ok {
+		return ErrInvQuery
+	}
+
+	switch q.Func {
+	case "", FuncSum, FuncMin, FuncMax:
+	default:
+		return ErrInvQuery
+	}
+
+	return nil
+}
+
+// RunQueries evaluates all continuous queries for points within the given
+// time range and adds results to derived series. Results are added to the
+// existing values therefore each time range must only be evaluated once.
+// Queries are evaluated automatically for points which are complete.
+func (d *DB) RunQueries(from, to uint64) (err error) {
+	for _, q := range d.params.Queries {
+		if err := d.runQuery(q, from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runQuery evaluates a single continuous query for given time range
+func (d *DB) runQuery(q *Query, from, to uint64) (err error) {
+	type result struct {
+		ts    uint64
+		point protocol.Point
+	}
+
+	var results []result
+
+	d.FetchContext(context.Background(), from, to, q.Fields, func(chunks []*protocol.Chunk, ferr error) {
+		if ferr != nil {
+			err = ferr
+			return
+		}
+
+		for _, c := range chunks {
+			if len(c.Series) == 0 {
+				continue
+			}
+
+			count := len(c.Series[0].Points)
+			for i := 0; i < count; i++ {
+				ps := make([]protocol.Point, len(c.Series))
+				for j, s := range c.Series {
+					ps[j] = s.Points[i]
+				}
+
+				p, ok := aggregate(q.Func, ps)
+				if !ok {
+					continue
+				}
+
+				ts := c.From + uint64(i)*uint64(d.params.Resolution)
+				results = append(results, result{ts, p})
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if err := d.trackExact(r.ts, q.Target, r.point.Total, r.point.Count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aggregate aggregates points of different series at the same position.
+// `ok` will be false if none of the points have any measurements.
+func aggregate(fn string, ps []protocol.Point) (res protocol.Point, ok bool) {
+	var total, count float64
+	min := math.Inf(1)
+	max := math.Inf(-1)
+
+	for _, p := range ps {
+		if p.Count == 0 {
+			continue
+		}
+
+		total += p.Total
+		count += p.Count
+
+		avg := p.Total / p.Count
+		min = math.Min(min, avg)
+		max = math.Max(max, avg)
+	}
+
+	if count == 0 {
+		return res, false
+	}
+
+	switch fn {
+	case FuncMin:
+		return protocol.Point{Total: min, Count: 1}, true
+	case FuncMax:
+		return protocol.Point{Total: max, Count: 1}, true
+	default:
+		return protocol.Point{Total: total, Count: count}, true
+	}
+}
+
+// queryLoop evaluates continuous queries for each point once it's complete.
+// Points are evaluated one resolution after they end to include late writes.
+func (d *DB) queryLoop() {
+	defer d.jobs.Done()
+
+	ticker := time.NewTicker(time.Duration(d.params.Resolution))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+			if err := d.queryPending(time.Now().UnixNano()); err != nil {
+				logError("queries", d.dir, err)
+			}
+		}
+	}
+}
+
+// queryPending evaluates continuous queries for points which are complete at
+// given time and were not evaluated yet. The end of evaluated points is stored
+// in the database directory so points are neither skipped nor evaluated twice
+// when the database is opened again. Points before the retention period and
+// points which failed (results may be partially written) are not evaluated.
+func (d *DB) queryPending(now int64) (err error) {
+	res := d.params.Resolution
+	end := res*(now/res) - res
+
+	last := atomic.LoadInt64(&d.lastQueried)
+	if min := res * ((now - d.params.Retention) / res); last < min {
+		last = min
+	}
+
+	if end <= last {
+		return nil
+	}
+
+	err = d.RunQueries(uint64(last), uint64(end))
+	atomic.StoreInt64(&d.lastQueried, end)
+
+	data := []byte(strconv.FormatInt(end, 10))
+	if werr := ioutil.WriteFile(path.Join(d.dir, queriedfile), data, 0644); err == nil {
+		err = werr
+	}
+
+	return err
+}
@@ -0,0 +1,278 @@
+package kadiyadb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	// seriesTTL is how long the series count returned by Usage is reused.
+	// Counting series reads index files of the epoch on disk.
+	seriesTTL = 10 * time.Second
+)
+
+var (
+	// ErrRateLimit is returned when the MaxPointsPerSec quota is exceeded
+	ErrRateLimit = errors.New("points per second quota exceeded")
+
+	// ErrDiskQuota is returned when the MaxDiskBytes quota is exceeded
+	ErrDiskQuota = errors.New("disk usage quota exceeded")
+
+	// ErrLowDisk is returned when free disk space is below MinFreeDiskBytes
+	ErrLowDisk = errors.New("free disk space is below the minimum")
+
+	// ErrMaxSeries is returned when the MaxSeries quota is exceeded
+	ErrMaxSeries = index.ErrMaxSeries
+)
+
+var (
+	// opened has open databases which are not inside other databases
+	// (rollup levels and min/max databases) and it's used by DiskUsage
+	opened    = map[*DB]bool{}
+	openedmtx = &sync.Mutex{}
+)
+
+// quota has usage counters of a database
+type quota struct {
+	// total number of points tracked since the database was opened
+	tracked int64
+
+	// size of database files in bytes when it was last checked
+	diskBytes int64
+
+	// free space of the file system in bytes when it was last checked
+	// it's -1 if it was not checked or can not be checked (see freeDiskBytes)
+	freeDiskBytes int64
+
+	// number of points tracked in the current second (used for rate limits)
+	sec   int64
+	n     int64
+	mutex *sync.Mutex
+
+	// series count of an epoch and when it was counted (used by Usage)
+	seriesEpoch int64
+	seriesTime  int64
+	series      int64
+}
+
+// Usage has current resource usage of a database
+type Usage struct {
+	// Series is the number of series in the epoch with the current time.
+	Series int64
+
+	// Tracked is the number of points tracked since the database was opened.
+	// Writes which fail and duplicates rejected by TrackSeq are not counted.
+	// Point rates can be calculated using values read at different times.
+	Tracked int64
+
+	// DiskBytes is the total size of database files.
+	DiskBytes int64
+
+	// FreeDiskBytes is the free space of the file system of the database.
+	// It's -1 if free space can not be checked on this platform.
+	FreeDiskBytes int64
+
+	// LowDisk is true when writes are rejected with ErrLowDisk because free
+	// space is below the MinFreeDiskBytes param.
+	LowDisk bool
+}
+
+// checkQuota checks whether a point can be tracked and reserves it in the
+// rate limit of the current second. `done` must be called after writing the
+// point. The point is counted as tracked only if `ok` is set. Otherwise, its
+// reservation is released so failed and duplicate writes are not counted.
+func (d *DB) checkQuota() (done func(ok bool), err error) {
+	if max := d.params.MaxDiskBytes; max > 0 && atomic.LoadInt64(&d.quota.diskBytes) >= max {
+		return nil, ErrDiskQuota
+	}
+
+	if d.lowDisk() {
+		return nil, ErrLowDisk
+	}
+
+	max := d.params.MaxPointsPerSec
+	sec := time.Now().Unix()
+
+	if max > 0 {
+		d.quota.mutex.Lock()
+		if sec != d.quota.sec {
+			d.quota.sec = sec
+			d.quota.n = 0
+		}
+
+		if d.quota.n >= max {
+			d.quota.mutex.Unlock()
+			return nil, ErrRateLimit
+		}
+
+		d.quota.n++
+		d.quota.mutex.Unlock()
+	}
+
+	done = func(ok bool) {
+		if ok {
+			atomic.AddInt64(&d.quota.tracked, 1)
+			return
+		}
+
+		if max > 0 {
+			d.quota.mutex.Lock()
+			if sec == d.quota.sec {
+				d.quota.n--
+			}
+			d.quota.mutex.Unlock()
+		}
+	}
+
+	return done, nil
+}
+
+// Usage returns current resource usage of the database. Disk usage is
+// calculated again which can take some time with a large number of files.
+// The series count is reused for a few seconds (see seriesTTL).
+func (d *DB) Usage() (u *Usage, err error) {
+	u = &Usage{Tracked: atomic.LoadInt64(&d.quota.tracked)}
+
+	if u.DiskBytes, err = d.updateDiskUsage(); err != nil {
+		return nil, err
+	}
+
+	if u.FreeDiskBytes, err = d.updateFreeDisk(); err != nil {
+		return nil, err
+	}
+
+	u.LowDisk = d.lowDisk()
+
+	if u.Series, err = d.series(time.Now().UnixNano()); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// series returns the number of series in the epoch with given time. The
+// count is reused until it's older than seriesTTL or the epoch changes.
+func (d *DB) series(now int64) (n int64, err error) {
+	ets, _ := d.split(uint64(now))
+
+	d.quota.mutex.Lock()
+	if d.quota.seriesEpoch == ets && now-d.quota.seriesTime < int64(seriesTTL) {
+		n = d.quota.series
+		d.quota.mutex.Unlock()
+		return n, nil
+	}
+	d.quota.mutex.Unlock()
+
+	info, err := d.cache.Inspect(ets)
+	if err == nil {
+		n = info.Nodes
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	d.quota.mutex.Lock()
+	d.quota.seriesEpoch = ets
+	d.quota.seriesTime = now
+	d.quota.series = n
+	d.quota.mutex.Unlock()
+
+	return n, nil
+}
+
+// updateDiskUsage calculates and stores the size of database files
+func (d *DB) updateDiskUsage() (size int64, err error) {
+	err = filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	atomic.StoreInt64(&d.quota.diskBytes, size)
+	return size, nil
+}
+
+// retainedSize calculates the size of database files which are counted for
+// RetentionBytes. Rollup levels are not included as only epochs of this level
+// are removed to stay under it (rollup levels have their own RetentionBytes).
+func (d *DB) retainedSize() (size int64, err error) {
+	rollups := filepath.Join(d.dir, rollupdir)
+	err = filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && p == rollups {
+			return filepath.SkipDir
+		} else if !fi.IsDir() {
+			size += fi.Size()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// updateFreeDisk checks and stores the free space of the file system
+func (d *DB) updateFreeDisk() (free int64, err error) {
+	if free, err = freeDiskBytes(d.dir); err != nil {
+		return 0, err
+	}
+
+	atomic.StoreInt64(&d.quota.freeDiskBytes, free)
+	return free, nil
+}
+
+// lowDisk checks whether free disk space is below the low disk watermark
+func (d *DB) lowDisk() bool {
+	min := d.params.MinFreeDiskBytes
+	if min <= 0 {
+		return false
+	}
+
+	free := atomic.LoadInt64(&d.quota.freeDiskBytes)
+	return free >= 0 && free < min
+}
+
+// DiskUsage returns the total size of files of all open databases when they
+// were last measured. Sizes are measured when databases are opened and when
+// background jobs run. Rollup levels and min/max databases are included in
+// the size of their parent databases.
+func DiskUsage() (size int64) {
+	openedmtx.Lock()
+	defer openedmtx.Unlock()
+
+	for d := range opened {
+		size += atomic.LoadInt64(&d.quota.diskBytes)
+	}
+
+	return size
+}
+
+// setOpened adds the database to or removes it from open databases
+func setOpened(d *DB, open bool) {
+	openedmtx.Lock()
+	defer openedmtx.Unlock()
+
+	if open {
+		opened[d] = true
+	} else {
+		delete(opened, d)
+	}
+}
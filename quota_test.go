@@ -0,0 +1,225 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:        3600000000000,
+		Retention:       36000000000000,
+		Resolution:      60000000000,
+		MaxROEpochs:     2,
+		MaxRWEpochs:     1,
+		MaxPointsPerSec: 2,
+		MaxDiskBytes:    1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := uint64(time.Now().UnixNano())
+
+	// at most 4 points can be tracked even if it's a new second
+	var limited bool
+	for i := 0; i < 5 && !limited; i++ {
+		err := db.Track(now, []string{"a"}, 1, 1)
+		if err == ErrRateLimit {
+			limited = true
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !limited {
+		t.Fatal("expected ErrRateLimit")
+	}
+
+	u, err := db.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Series != 1 || u.Tracked < 2 || u.Tracked > 4 || u.DiskBytes == 0 {
+		t.Fatal("wrong usage", u)
+	}
+
+	if err := db.Track(now, []string{"a"}, 1, 1); err != ErrDiskQuota {
+		t.Fatal("expected ErrDiskQuota", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaDuplicates(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:        3600000000000,
+		Retention:       36000000000000,
+		Resolution:      60000000000,
+		MaxROEpochs:     2,
+		MaxRWEpochs:     1,
+		MaxPointsPerSec: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	now := uint64(time.Now().UnixNano())
+
+	// retried writes are not counted in rate limits or usage
+	for i := 0; i < 5; i++ {
+		dup, err := db.TrackSeq(ctx, "s", 1, now, []string{"a"}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if dup != (i > 0) {
+			t.Fatal("wrong dup", i, dup)
+		}
+	}
+
+	u, err := db.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Tracked != 1 {
+		t.Fatal("wrong usage", u)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsageSeries(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano()
+	now -= now % p.Duration
+
+	if err := db.Track(uint64(now), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.series(now); err != nil || n != 1 {
+		t.Fatal("wrong count", n, err)
+	}
+
+	if err := db.Track(uint64(now), []string{"b"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the count is reused until it's older than seriesTTL
+	if n, err := db.series(now + 1); err != nil || n != 1 {
+		t.Fatal("wrong count", n, err)
+	}
+
+	if n, err := db.series(now + int64(seriesTTL)); err != nil || n != 2 {
+		t.Fatal("wrong count", n, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLowDisk(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:         3600000000000,
+		Retention:        36000000000000,
+		Resolution:       60000000000,
+		MaxROEpochs:      2,
+		MaxRWEpochs:      1,
+		MinFreeDiskBytes: 1 << 62,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := db.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := uint64(time.Now().UnixNano())
+	err = db.Track(now, []string{"a"}, 1, 1)
+
+	// free disk space is not checked on some platforms
+	if u.FreeDiskBytes < 0 {
+		if err != nil || u.LowDisk {
+			t.Fatal("writes should not be rejected", err)
+		}
+	} else if err != ErrLowDisk || !u.LowDisk {
+		t.Fatal("expected ErrLowDisk", err, u)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	// rollupdir is the directory inside the database directory which has
+	// companion databases used to store rolled up (lower resolution) data.
+	// Each rollup level is stored in a directory named by its resolution.
+	rollupdir = "rollups"
+
+	// rolledfile stores the start time of the last epoch rolled up into a
+	// rollup level. It's written in the rollup level directory after the
+	// level is synced so an epoch is not added to a level more than once.
+	rolledfile = "rolled"
+
+	// rollingfile stores the start time of the epoch being rolled up into a
+	// rollup level. It's written before adding points to the level and it's
+	// removed after writing rolledfile. If it exists when rolling up, points
+	// of that epoch were partially added (ex: after a crash).
+	rollingfile = "rolling"
+)
+
+var (
+	// ErrInvRollup is returned when rollup level params are invalid
+	ErrInvRollup = errors.New("invalid rollup parameters")
+)
+
+// invRollup returns a ParamError with ErrInvRollup for given param. The
+// constraint is formatted with given format and arguments.
+func invRollup(param, format string, a ...interface{}) (err error) {
+	return &ParamError{Err: ErrInvRollup, Param: param, Constraint: fmt.Sprintf(format, a...)}
+}
+
+// validRollup checks rollup level params against the parent database params
+// and the resolution of the previous level. The error names the constraint.
+func validRollup(p, rp *Params, prev int64) (err error) {
+	if rp == nil {
+		return ErrInvRollup
+	}
+
+	res := time.Duration(rp.Resolution)
+	dur := time.Duration(rp.Duration)
+
+	switch {
+	case len(rp.Rollups) != 0:
+		return invRollup("rollups", "must be empty in rollup %s", res)
+	case rp.Resolution <= prev:
+		return invRollup("resolution", "%s not larger than %s", res, time.Duration(prev))
+	case rp.Resolution%p.Resolution != 0:
+		return invRollup("resolution", "%s not a multiple of %s", res, time.Duration(p.Resolution))
+	case p.Duration%rp.Resolution != 0:
+		return invRollup("resolution", "%s does not divide duration %s", res, time.Duration(p.Duration))
+	case rp.Duration%p.Duration != 0:
+		return invRollup("duration", "%s not a multiple of %s", dur, time.Duration(p.Duration))
+	}
+
+	return nil
+}
+
+// openRollups opens companion databases for each rollup level. Rollup levels
+// must have increasing resolutions which are multiples of the db resolution.
+// Rollup resolutions must also fit in db epochs to roll up one epoch at a time.
+// Epoch cache sizes, memory limits and the maintain interval are taken from
+// the parent if not set.
+// Rollup levels are always durable if the parent database is durable.
+// Rollup levels use the point type of the parent to aggregate points.
+// Opened levels are closed if any of the levels cannot be opened.
+func openRollups(dir string, p *Params) (rs []*DB, err error) {
+	prev := p.Resolution
+
+	for _, rp := range p.Rollups {
+		if err := validRollup(p, rp, prev); err != nil {
+			closeDBs(nil, rs...)
+			return nil, err
+		}
+
+		prev = rp.Resolution
+
+		rpc := *rp
+		if rpc.MaxROEpochs == 0 {
+			rpc.MaxROEpochs = p.MaxROEpochs
+		}
+		if rpc.MaxRWEpochs == 0 {
+			rpc.MaxRWEpochs = p.MaxRWEpochs
+		}
+		if rpc.MaxMemory == 0 {
+			rpc.MaxMemory = p.MaxMemory
+		}
+		if rpc.MaintainInterval == 0 {
+			rpc.MaintainInterval = p.MaintainInterval
+		}
+		if p.Durable {
+			rpc.Durable = true
+		}
+
+		rpc.PointType = p.PointType
+		rpc.LeafOnly = p.LeafOnly
+		rpc.AggregateLevels = p.AggregateLevels
+
+		name := time.Duration(rp.Resolution).String()
+		rdir := path.Join(dir, rollupdir, name)
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			closeDBs(nil, rs...)
+			return nil, err
+		}
+
+		r, err := Open(rdir, &rpc)
+		if err != nil {
+			closeDBs(nil, rs...)
+			return nil, err
+		}
+
+		// rollup files are counted in the parent database
+		setOpened(r, false)
+
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+// Rollup aggregates points of the epoch which contains given timestamp and
+// adds them to all rollup levels. Points are added to existing values in
+// rollups therefore epochs must be rolled up in order. Levels which already
+// have the epoch or a later one are skipped so rolling up again is safe.
+// If rolling up an epoch stopped before a level was updated completely, its
+// points are cleared from the level first (see recoverRollup).
+// Epochs are rolled up automatically once they are closed (see maintainLoop).
+func (d *DB) Rollup(ts uint64) (err error) {
+	if len(d.rollups) == 0 {
+		return nil
+	}
+
+	ets, _ := d.split(ts)
+
+	e, err := d.cache.LoadRO(ets)
+	if err != nil {
+		return err
+	}
+
+	defer e.Release()
+
+	points, nodes, err := e.FetchAll(context.Background(), 0, d.rsize)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range d.rollups {
+		file := path.Join(r.dir, rolledfile)
+		last, err := readEpochFile(file)
+		if err != nil {
+			return err
+		}
+
+		if err := r.recoverRollup(last, d.params.Duration); err != nil {
+			return err
+		}
+
+		if last >= ets {
+			continue
+		}
+
+		data := []byte(strconv.FormatInt(ets, 10))
+		rolling := path.Join(r.dir, rollingfile)
+		if err := ioutil.WriteFile(rolling, data, 0644); err != nil {
+			return err
+		}
+
+		step := int(r.params.Resolution / d.params.Resolution)
+
+		for i, node := range nodes {
+			ps := points[i]
+
+			for j := 0; j < len(ps); j += step {
+				var point protocol.Point
+				for k := j; k < j+step && k < len(ps); k++ {
+					point = d.params.PointType.Merge(point, ps[k])
+				}
+
+				if point.Count == 0 {
+					continue
+				}
+
+				pts := uint64(ets + int64(j)*d.params.Resolution)
+				if err := r.trackExact(pts, node.Fields, point.Total, point.Count); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := r.Sync(); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+
+		if err := os.Remove(rolling); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverRollup clears points added to this rollup level by an epoch which
+// was not rolled up completely. Each epoch of the parent database (with given
+// duration) has its own point positions in the level epoch therefore points
+// added by other epochs are not changed. `last` is the start time of the last
+// epoch rolled up completely. The marker is only removed if it's not newer.
+func (r *DB) recoverRollup(last, dur int64) (err error) {
+	file := path.Join(r.dir, rollingfile)
+	ets, err := readEpochFile(file)
+	if err != nil || ets < 0 {
+		return err
+	}
+
+	if ets > last {
+		rets, pos := r.split(uint64(ets))
+
+		e, err := r.cache.LoadRW(rets)
+		if err != nil {
+			return err
+		}
+
+		err = e.ClearPoints(pos, pos+dur/r.params.Resolution)
+		if err == nil {
+			err = e.Sync()
+		}
+
+		e.Release()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(file)
+}
+
+// level returns the database with the highest resolution which still
+// has data for given timestamp considering the retention period.
+func (d *DB) level(ts uint64) (db *DB) {
+	if len(d.rollups) == 0 {
+		return d
+	}
+
+	now := time.Now().UnixNano()
+	if int64(ts) >= now-d.params.Retention {
+		return d
+	}
+
+	for _, r := range d.rollups {
+		if int64(ts) >= now-r.params.Retention {
+			return r
+		}
+	}
+
+	return d.rollups[len(d.rollups)-1]
+}
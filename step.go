@@ -0,0 +1,94 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Align defines how the time range of a step query is aligned to steps
+type Align int
+
+const (
+	// AlignFloor rounds both ends of the time range down to step boundaries
+	// (default). The step which is still in progress is not included.
+	AlignFloor Align = iota
+
+	// AlignCeil rounds both ends of the time range up to step boundaries.
+	// The first partial step is not included but the step in progress is.
+	AlignCeil
+)
+
+var (
+	// ErrInvAlign is returned when the step alignment is not supported
+	ErrInvAlign = errors.New("invalid step alignment")
+)
+
+// FetchStep is the same as FetchTimed but points are aggregated into steps of
+// given duration (in nanoseconds) so the result does not depend on the stored
+// resolution. The step is rounded up to a multiple of the resolution and zero
+// means the resolution. Step boundaries are multiples of the step and points
+// are timestamped with the start of their step. Points within a step are
+// merged with the point type of the database (ex: counters add totals and
+// counts therefore Total/Count is the average of the step).
+func (d *DB) FetchStep(ctx context.Context, from, to, step uint64, align Align, fields []string, fn TimedHandler) {
+	if align != AlignFloor && align != AlignCeil {
+		fn(nil, ErrInvAlign)
+		return
+	}
+
+	// data may be fetched from a rollup level with a lower resolution
+	l := d.level(from)
+	res := uint64(l.params.Resolution)
+	if step == 0 {
+		step = res
+	} else if step%res != 0 {
+		step += res - step%res
+	}
+
+	from, to = alignStep(from, step, align), alignStep(to, step, align)
+
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		result := l.timed(chunks)
+		for _, s := range result {
+			s.Points = l.buckets(s.Points, func(ts uint64) uint64 { return ts - ts%step })
+		}
+
+		fn(result, nil)
+	}, l.fetchQuery(fields))
+}
+
+// alignStep rounds the timestamp to a step boundary
+func alignStep(ts, step uint64, align Align) uint64 {
+	if align == AlignCeil && ts%step != 0 {
+		ts += step
+	}
+
+	return ts - ts%step
+}
+
+// buckets merges time ordered points which belong to the same bucket. The
+// bucket function returns the start of the bucket (in order) of a timestamp.
+func (d *DB) buckets(points []TimedPoint, bucket func(ts uint64) uint64) (res []TimedPoint) {
+	for _, p := range points {
+		ts := bucket(p.Timestamp)
+
+		if n := len(res); n > 0 && res[n-1].Timestamp == ts {
+			a := protocol.Point{Total: res[n-1].Total, Count: res[n-1].Count}
+			b := protocol.Point{Total: p.Total, Count: p.Count}
+			m := d.params.PointType.Merge(a, b)
+			res[n-1].Total, res[n-1].Count = m.Total, m.Count
+			continue
+		}
+
+		res = append(res, TimedPoint{Timestamp: ts, Total: p.Total, Count: p.Count})
+	}
+
+	return res
+}
@@ -0,0 +1,84 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFetchStep(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	min := uint64(p.Resolution)
+
+	points := []TimedPoint{
+		{1 * min, 5, 1},
+		{2 * min, 3, 1},
+		{6 * min, 4, 2},
+		{12 * min, 1, 1},
+	}
+
+	for _, p := range points {
+		if err := db.Track(p.Timestamp, fields, p.Total, p.Count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		step  uint64
+		align Align
+		exp   []TimedPoint
+	}{
+		{5 * min, AlignFloor, []TimedPoint{{0, 8, 2}, {5 * min, 4, 2}}},
+		{5 * min, AlignCeil, []TimedPoint{{5 * min, 4, 2}, {10 * min, 1, 1}}},
+		{0, AlignFloor, points},
+		{min + min/2, AlignFloor, []TimedPoint{{0, 5, 1}, {2 * min, 3, 1}, {6 * min, 4, 2}}},
+	}
+
+	for _, test := range tests {
+		expected := []*TimedSeries{{Fields: fields, Points: test.exp}}
+		db.FetchStep(context.Background(), min, 13*min, test.step, test.align, fields, func(res []*TimedSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(res, expected) {
+				t.Fatal("wrong result", test.step, test.align, res[0].Points)
+			}
+		})
+	}
+
+	db.FetchStep(context.Background(), 0, min, 0, Align(-1), fields, func(res []*TimedSeries, err error) {
+		if err != ErrInvAlign {
+			t.Fatal("expected ErrInvAlign", err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package kadiyadb
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// TimedPoint is a point with the timestamp of the start of its time range
+type TimedPoint struct {
+	Timestamp uint64
+	Total     float64
+	Count     float64
+}
+
+// TimedSeries has points of a series with their timestamps. Points without
+// any measurements are not included therefore sparse series are smaller.
+type TimedSeries struct {
+	Fields []string
+	Points []TimedPoint
+}
+
+// TimedHandler is a function which is called with FetchTimed result.
+// Results are copies therefore they can be used after the function returns.
+type TimedHandler func(result []*TimedSeries, err error)
+
+// FetchTimed is the same as FetchContext but each point has its timestamp
+// and empty points are skipped. Points of a series from all epochs within
+// the timestamp range are merged into a single series ordered by time.
+func (d *DB) FetchTimed(ctx context.Context, from, to uint64, fields []string, fn TimedHandler) {
+	// data may be fetched from a rollup level with a lower resolution
+	l := d.level(from)
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(l.timed(chunks), nil)
+	}, l.fetchQuery(fields))
+}
+
+// timed converts chunks to timed series. Series are ordered by the chunk
+// they first appear in and their order in that chunk.
+func (d *DB) timed(chunks []*protocol.Chunk) (result []*TimedSeries) {
+	res := uint64(d.params.Resolution)
+	seen := map[string]*TimedSeries{}
+	result = []*TimedSeries{}
+
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			key := strings.Join(s.Fields, "\x00")
+			ts, ok := seen[key]
+			if !ok {
+				ts = &TimedSeries{Fields: append([]string(nil), s.Fields...)}
+				seen[key] = ts
+				result = append(result, ts)
+			}
+
+			for i, p := range s.Points {
+				if p.Total == 0 && p.Count == 0 {
+					continue
+				}
+
+				ts.Points = append(ts.Points, TimedPoint{
+					Timestamp: c.From + uint64(i)*res,
+					Total:     p.Total,
+					Count:     p.Count,
+				})
+			}
+		}
+	}
+
+	return result
+}
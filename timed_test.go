@@ -0,0 +1,131 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFetchTimed(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	ts0 := uint64(p.Resolution * 2)
+	ts1 := uint64(p.Duration + p.Resolution)
+
+	if err := db.Track(ts0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(ts1, fields, 6, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*TimedSeries{{
+		Fields: fields,
+		Points: []TimedPoint{{ts0, 5, 1}, {ts1, 6, 2}},
+	}}
+
+	db.FetchTimed(context.Background(), 0, uint64(p.Duration*2), fields, func(res []*TimedSeries, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchTimedRollup(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{
+				Duration:   7200000000000,
+				Retention:  72000000000000,
+				Resolution: 600000000000,
+			},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	min := uint64(p.Resolution)
+
+	for i, ts := range []uint64{0, min, 10 * min} {
+		if err := db.Track(ts, fields, float64(i+1), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Rollup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// data at this time is fetched from the rollup level
+	res := uint64(p.Rollups[0].Resolution)
+	expected := []*TimedSeries{{
+		Fields: fields,
+		Points: []TimedPoint{{0, 3, 2}, {res, 3, 1}},
+	}}
+
+	db.FetchTimed(context.Background(), 0, 2*res, fields, func(res []*TimedSeries, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatal("wrong result", res[0].Points)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/block"
+)
+
+const (
+	// RankSum ranks series by the sum of totals within the time range
+	RankSum = "sum"
+
+	// RankAvg ranks series by the average value (sum of totals divided by
+	// the sum of counts) within the time range. For databases which do not
+	// use counter points, it's the average of point totals.
+	RankAvg = "avg"
+
+	// RankMax ranks series by the maximum average value of their points.
+	// For databases which do not use counter points, point totals are used.
+	RankMax = "max"
+)
+
+var (
+	// ErrInvRank is returned when the rank func or the number of series is invalid
+	ErrInvRank = errors.New("invalid top series query")
+)
+
+// FetchTopK is the same as FetchTimed but only the k series with the highest
+// rank are included in the result in descending order. Series are ranked by
+// given rank func using their points within the time range. Series without
+// measurements are not ranked. Series with the same rank are ordered by
+// their fields so results are the same for each call with the same data.
+func (d *DB) FetchTopK(ctx context.Context, from, to uint64, fields []string, rank string, k int, fn TimedHandler) {
+	if k <= 0 || (rank != RankSum && rank != RankAvg && rank != RankMax) {
+		fn(nil, ErrInvRank)
+		return
+	}
+
+	l := d.level(from)
+	l.fetch(ctx, from, to, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(topK(l.timed(chunks), rank, k, l.params.PointType), nil)
+	}, l.fetchQuery(fields))
+}
+
+// ranked is a series with its rank used to sort series
+type ranked struct {
+	series *TimedSeries
+	rank   float64
+	key    string
+}
+
+// byRank sorts ranked series by rank (descending) and fields
+type byRank []ranked
+
+func (a byRank) Len() int      { return len(a) }
+func (a byRank) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRank) Less(i, j int) bool {
+	if a[i].rank != a[j].rank {
+		return a[i].rank > a[j].rank
+	}
+
+	return a[i].key < a[j].key
+}
+
+// topK ranks series and returns the top k series in descending order.
+// Point values are averages (total / count) only for counter points.
+// Other point types already have the value (ex: max) as the point total.
+func topK(series []*TimedSeries, rank string, k int, t block.PointType) (result []*TimedSeries) {
+	rs := make([]ranked, 0, len(series))
+
+	for _, s := range series {
+		if len(s.Points) == 0 {
+			continue
+		}
+
+		var total, count, values, n float64
+		max := math.Inf(-1)
+
+		for _, p := range s.Points {
+			total += p.Total
+			count += p.Count
+
+			if p.Count == 0 {
+				continue
+			}
+
+			value := p.Total
+			if t == block.Counter {
+				value /= p.Count
+			}
+
+			if value > max {
+				max = value
+			}
+
+			values += value
+			n++
+		}
+
+		r := ranked{series: s, key: strings.Join(s.Fields, "\x00")}
+		switch rank {
+		case RankSum:
+			r.rank = total
+		case RankAvg:
+			if count == 0 || n == 0 {
+				continue
+			}
+
+			r.rank = total / count
+			if t != block.Counter {
+				r.rank = values / n
+			}
+		case RankMax:
+			if math.IsInf(max, -1) {
+				continue
+			}
+
+			r.rank = max
+		}
+
+		rs = append(rs, r)
+	}
+
+	sort.Sort(byRank(rs))
+
+	if len(rs) > k {
+		rs = rs[:k]
+	}
+
+	result = make([]*TimedSeries, len(rs))
+	for i, r := range rs {
+		result[i] = r.series
+	}
+
+	return result
+}
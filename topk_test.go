@@ -0,0 +1,156 @@
+package kadiyadb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb/block"
+)
+
+func TestFetchTopK(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	min := uint64(p.Resolution)
+	points := []struct {
+		host  string
+		ts    uint64
+		total float64
+		count float64
+	}{
+		{"h1", 1 * min, 10, 1},
+		{"h1", 2 * min, 10, 1},
+		{"h2", 1 * min, 30, 10},
+		{"h3", 1 * min, 5, 1},
+		{"h3", 3 * min, 1, 1},
+		{"h4", 2 * min, 30, 10},
+	}
+
+	for _, p := range points {
+		if err := db.Track(p.ts, []string{"cpu", p.host}, p.total, p.count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string][]string{
+		RankSum: {"h2", "h4"},
+		RankAvg: {"h1", "h2"},
+		RankMax: {"h1", "h3"},
+	}
+
+	for rank, exp := range tests {
+		db.FetchTopK(context.Background(), 0, 5*min, []string{"cpu", "*"}, rank, 2, func(res []*TimedSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != len(exp) {
+				t.Fatal("wrong result", rank, res)
+			}
+
+			for i, s := range res {
+				if s.Fields[1] != exp[i] || len(s.Points) == 0 {
+					t.Fatal("wrong series", rank, i, s)
+				}
+			}
+		})
+	}
+
+	for _, k := range []int{0, 1} {
+		db.FetchTopK(context.Background(), 0, 5*min, []string{"cpu", "*"}, "median", k, func(res []*TimedSeries, err error) {
+			if err != ErrInvRank {
+				t.Fatal("expected ErrInvRank", err)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchTopKMax(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		PointType:   block.Max,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point totals are the largest values and counts are sample counts
+	min := uint64(p.Resolution)
+	points := []struct {
+		host  string
+		ts    uint64
+		total float64
+	}{
+		{"h1", 1 * min, 10},
+		{"h1", 1 * min, 10},
+		{"h1", 1 * min, 10},
+		{"h1", 2 * min, 2},
+		{"h2", 1 * min, 6},
+		{"h2", 2 * min, 5},
+	}
+
+	for _, p := range points {
+		if err := db.Track(p.ts, []string{"cpu", p.host}, p.total, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, rank := range []string{RankAvg, RankMax} {
+		db.FetchTopK(context.Background(), 0, 5*min, []string{"cpu", "*"}, rank, 1, func(res []*TimedSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || res[0].Fields[1] != "h1" {
+				t.Fatal("wrong result", rank, res)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package kadiyadb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ctxKey is the type of context keys set by this package
+type ctxKey int
+
+const (
+	// requestIDKey is the context key of the request ID
+	requestIDKey ctxKey = iota
+)
+
+// NewRequestID generates a random request ID (16 hex characters)
+func NewRequestID() (id string) {
+	buff := make([]byte, 8)
+	rand.Read(buff)
+	return hex.EncodeToString(buff)
+}
+
+// WithRequestID returns a copy of the context with given request ID. Database
+// operations called with this context log the request ID with their latency
+// (debug level) or errors (error level) so requests can be correlated.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID of the context or an empty string
+func RequestID(ctx context.Context) (id string) {
+	id, _ = ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logRequest logs a database operation started at given time if the context
+// has a request ID. Failed operations are logged with the error.
+func logRequest(ctx context.Context, msg, dir string, start time.Time, err error) {
+	id := RequestID(ctx)
+	if id == "" {
+		return
+	}
+
+	fields := Fields{
+		"db":      dir,
+		"request": id,
+		"latency": time.Since(start).String(),
+	}
+
+	if err != nil {
+		fields["error"] = err.Error()
+		logger.Log(LevelError, msg, fields)
+		return
+	}
+
+	logger.Log(LevelDebug, msg, fields)
+}
+
+// Tracer starts spans around database operations. It can be implemented
+// with a tracing library (ex: OpenTelemetry) to include database operations
+// in distributed traces. Spans are not created unless a tracer is set.
+type Tracer interface {
+	// Start starts a span with given name and fields as a child of the span
+	// in the context (if any) and returns a context with the new span.
+	Start(ctx context.Context, name string, fields Fields) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// End ends the span. The error is nil if the operation succeeded.
+	End(err error)
+}
+
+// tracer is used by all databases (see SetTracer)
+var tracer Tracer
+
+// SetTracer sets the tracer used by all databases. Tracing is disabled if
+// it's nil (default). It must be called before opening databases.
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+// nopSpan is used when tracing is disabled
+type nopSpan struct{}
+
+func (nopSpan) End(err error) {}
+
+// startSpan starts a span for an operation of the database if tracing is
+// enabled. The epoch start time is added to span fields unless it's negative.
+func (d *DB) startSpan(ctx context.Context, name string, ets int64) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, nopSpan{}
+	}
+
+	fields := Fields{"db": d.dir}
+	if ets >= 0 {
+		fields["epoch"] = ets
+	}
+
+	if id := RequestID(ctx); id != "" {
+		fields["request"] = id
+	}
+
+	return tracer.Start(ctx, name, fields)
+}
@@ -0,0 +1,148 @@
+package kadiyadb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestRequestID(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	buff := &bytes.Buffer{}
+	defaultLogger := logger
+	SetLogger(NewLogger(buff, LevelDebug, false))
+	defer SetLogger(defaultLogger)
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := NewRequestID()
+	if len(id) != 16 || id == NewRequestID() {
+		t.Fatal("invalid request id", id)
+	}
+
+	ctx := WithRequestID(context.Background(), id)
+	if RequestID(ctx) != id || RequestID(context.Background()) != "" {
+		t.Fatal("wrong request id")
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if buff.Len() != 0 {
+		t.Fatal("requests without ids should not be logged")
+	}
+
+	if err := db.TrackContext(ctx, 0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buff.String(), " debug track ") ||
+		!strings.Contains(buff.String(), " request="+id) {
+		t.Fatal("wrong log", buff.String())
+	}
+
+	buff.Reset()
+	db.FetchContext(ctx, 0, 1, []string{"a"}, func(res []*protocol.Chunk, err error) {})
+	if !strings.Contains(buff.String(), " fetch ") ||
+		!strings.Contains(buff.String(), " request="+id) {
+		t.Fatal("wrong log", buff.String())
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testTracer records names of started and ended spans
+type testTracer struct {
+	started []string
+	ended   []string
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, fields Fields) (context.Context, Span) {
+	t.started = append(t.started, name)
+	return ctx, &testSpan{tracer: t, name: name}
+}
+
+func (s *testSpan) End(err error) {
+	s.tracer.ended = append(s.tracer.ended, s.name)
+}
+
+func TestTracer(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &testTracer{}
+	SetTracer(tr)
+	defer SetTracer(nil)
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(0, []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(0, 60000000000, []string{"a"}, func(res []*protocol.Chunk, err error) {})
+
+	expected := []string{"kadiyadb.track", "kadiyadb.fetch", "kadiyadb.fetch_epoch"}
+	if !reflect.DeepEqual(tr.started, expected) {
+		t.Fatal("wrong spans", tr.started)
+	}
+
+	if len(tr.ended) != len(expected) {
+		t.Fatal("all spans should be ended", tr.ended)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package kadiyadb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	// TransformRate divides totals and counts by the step in seconds
+	TransformRate = "rate"
+
+	// TransformDelta subtracts the previous point from each point
+	TransformDelta = "delta"
+
+	// TransformMovingAvg averages each point with previous points. The window
+	// is smaller for the first points of the series.
+	TransformMovingAvg = "movingAvg"
+)
+
+var (
+	// ErrInvTransform is returned when a transform is not supported
+	ErrInvTransform = errors.New("invalid transform")
+)
+
+// Transform is a function applied to points of each series after fetching
+// them. Points is the window size (in points) of moving averages.
+type Transform struct {
+	Func   string
+	Points int
+}
+
+// validate checks whether the transform is supported
+func (t Transform) validate() (err error) {
+	switch t.Func {
+	case TransformRate, TransformDelta:
+	case TransformMovingAvg:
+		if t.Points <= 0 {
+			return ErrInvTransform
+		}
+	default:
+		return ErrInvTransform
+	}
+
+	return nil
+}
+
+// FetchTransform is the same as FetchFill but given transforms are applied
+// in order to points of each series after filling empty points. Transforms
+// use all points of the series therefore they continue across epochs.
+// Points which cannot be calculated (ex: delta of the first point) are NaN.
+func (d *DB) FetchTransform(ctx context.Context, from, to uint64, fields []string, fill Fill, ts []Transform, fn FillHandler) {
+	for _, t := range ts {
+		if err := t.validate(); err != nil {
+			fn(nil, err)
+			return
+		}
+	}
+
+	d.FetchFill(ctx, from, to, fields, fill, func(result []*FilledSeries, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		for _, s := range result {
+			for _, t := range ts {
+				s.transform(t)
+			}
+		}
+
+		fn(result, nil)
+	})
+}
+
+// transform applies the transform to all points of the series
+func (s *FilledSeries) transform(t Transform) {
+	switch t.Func {
+	case TransformRate:
+		secs := time.Duration(s.Step).Seconds()
+		for i, p := range s.Points {
+			s.Points[i] = protocol.Point{Total: p.Total / secs, Count: p.Count / secs}
+		}
+
+	case TransformDelta:
+		prev := protocol.Point{Total: math.NaN(), Count: math.NaN()}
+		for i, p := range s.Points {
+			s.Points[i] = protocol.Point{Total: p.Total - prev.Total, Count: p.Count - prev.Count}
+			prev = p
+		}
+
+	case TransformMovingAvg:
+		points := append([]protocol.Point(nil), s.Points...)
+		for i := range points {
+			start := i - t.Points + 1
+			if start < 0 {
+				start = 0
+			}
+
+			var sum protocol.Point
+			for _, p := range points[start : i+1] {
+				sum.Total += p.Total
+				sum.Count += p.Count
+			}
+
+			n := float64(i + 1 - start)
+			s.Points[i] = protocol.Point{Total: sum.Total / n, Count: sum.Count / n}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package kadiyadb
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFetchTransform(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b"}
+	min := uint64(p.Resolution)
+
+	for i, total := range []float64{60, 120, 180, 60} {
+		if err := db.Track(uint64(i+1)*min, fields, total, 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nan := math.NaN()
+	tests := []struct {
+		ts  []Transform
+		exp []protocol.Point
+	}{
+		{[]Transform{{Func: TransformRate}}, []protocol.Point{{1, 0.1}, {2, 0.1}, {3, 0.1}, {1, 0.1}}},
+		{[]Transform{{Func: TransformDelta}}, []protocol.Point{{nan, nan}, {60, 0}, {60, 0}, {-120, 0}}},
+		{[]Transform{{Func: TransformMovingAvg, Points: 2}}, []protocol.Point{{60, 6}, {90, 6}, {150, 6}, {120, 6}}},
+		{[]Transform{{Func: TransformRate}, {Func: TransformDelta}}, []protocol.Point{{nan, nan}, {1, 0}, {1, 0}, {-2, 0}}},
+	}
+
+	for _, test := range tests {
+		db.FetchTransform(context.Background(), min, 5*min, fields, FillZero, test.ts, func(res []*FilledSeries, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res) != 1 || !samePoints(res[0].Points, test.exp) {
+				t.Fatal("wrong result", test.ts, res)
+			}
+		})
+	}
+
+	for _, ts := range [][]Transform{{{Func: "log"}}, {{Func: TransformMovingAvg}}} {
+		db.FetchTransform(context.Background(), min, 5*min, fields, FillZero, ts, func(res []*FilledSeries, err error) {
+			if err != ErrInvTransform {
+				t.Fatal("expected ErrInvTransform", err)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
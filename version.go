@@ -0,0 +1,99 @@
+package kadiyadb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// versionfile has the layout version of files in the database directory.
+	// Databases without this file use the first layout version.
+	versionfile = "version"
+)
+
+var (
+	// ErrVersion is returned when the database was written by a newer version
+	ErrVersion = errors.New("database layout version is not supported")
+)
+
+// VersionError is returned when the layout version of the database is not
+// supported. errors.Is(err, ErrVersion) returns true for these errors.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return ErrVersion.Error() + ": " + strconv.Itoa(e.Version)
+}
+
+// Is returns true if target is ErrVersion
+func (e *VersionError) Is(target error) bool {
+	return target == ErrVersion
+}
+
+// migrations upgrade files in the database directory to the next layout
+// version. The migration at index i upgrades version i+1 to version i+2.
+// Migrations are run in order when opening databases with older versions.
+var migrations []func(dir string) (err error)
+
+// Version returns the layout version used by databases written by this
+// package. It's increased by one for each registered migration.
+func Version() (v int) {
+	return len(migrations) + 1
+}
+
+// readVersion reads the layout version of the database in given directory
+func readVersion(dir string) (v int, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, versionfile))
+	if os.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// writeVersion writes the layout version of the database in given directory
+func writeVersion(dir string, v int) (err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data := []byte(strconv.Itoa(v) + "\n")
+	return ioutil.WriteFile(path.Join(dir, versionfile), data, 0644)
+}
+
+// migrate upgrades the database in given directory to the current layout
+// version. The version file is updated after each migration so interrupted
+// upgrades continue from the last successful migration. Migrations are also
+// run on new databases therefore they must work with empty directories.
+func migrate(dir string) (err error) {
+	v, err := readVersion(dir)
+	if err != nil {
+		return err
+	}
+
+	if v < 1 || v > Version() {
+		return &VersionError{Version: v}
+	}
+
+	for ; v < Version(); v++ {
+		if err := migrations[v-1](dir); err != nil {
+			return fmt.Errorf("migrate %d %s", v, err)
+		}
+
+		if err := writeVersion(dir, v+1); err != nil {
+			return err
+		}
+
+		logger.Log(LevelInfo, "migrated", Fields{"db": dir, "version": v + 1})
+	}
+
+	return nil
+}
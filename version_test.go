@@ -0,0 +1,78 @@
+package kadiyadb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 1,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := readVersion(dir); err != nil || v != Version() {
+		t.Fatal("wrong version", v, err)
+	}
+
+	// register a migration for the next version
+	var migrated int
+	defer func(m []func(string) error) { migrations = m }(migrations)
+	migrations = append(migrations, func(string) error {
+		migrated++
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		db, err := Open(dir, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if migrated != 1 {
+		t.Fatal("migration should run once", migrated)
+	}
+
+	if v, err := readVersion(dir); err != nil || v != Version() {
+		t.Fatal("wrong version", v, err)
+	}
+
+	if err := writeVersion(dir, Version()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir, p); !errors.Is(err, ErrVersion) {
+		t.Fatal("expected ErrVersion", err)
+	} else if verr, ok := err.(*VersionError); !ok || verr.Version != Version()+1 {
+		t.Fatal("wrong version error", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}